@@ -2,44 +2,89 @@ package client
 
 import (
 	"bufio"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"minidb-go/serialization/tm"
+	"minidb-go/parser/ast"
 	"minidb-go/transporter"
 	"net"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	NETWORK = "tcp"
-	ADDRESS = "127.0.0.1:8080"
-)
-
 type Client struct {
+	// 服务器的 TCP 地址和 unix socket 路径，socket 不为空时优先使用
+	address string
+	socket  string
+	// 握手时发送的用户和密码，服务端没有用户时忽略
+	user     string
+	password string
+}
+
+func NewClient(address string, socket string) *Client {
+	return &Client{
+		address: address,
+		socket:  socket,
+	}
+}
+
+// 设置连接时认证的用户和密码
+func (client *Client) SetUser(user string, password string) {
+	client.user = user
+	client.password = password
+}
+
+// 连接服务器并完成握手
+func (client *Client) dial() (net.Conn, *transporter.Conn, error) {
+	var conn net.Conn
+	var err error
+	if client.socket != "" {
+		conn, err = net.Dial("unix", client.socket)
+	} else {
+		conn, err = net.Dial("tcp", client.address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := transporter.NewConn(conn)
+	var params map[string]string
+	if client.user != "" {
+		params = map[string]string{"user": client.user, "password": client.password}
+	}
+	if _, err := tc.Handshake(params); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, tc, nil
 }
 
-func NewClient() *Client {
-	return &Client{}
+// 连接服务器执行一条语句，用于命令行中的子命令，语句出错时返回 *transporter.Error
+func (client *Client) Exec(stmt string) (*transporter.Result, error) {
+	conn, tc, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer tc.Terminate()
+	return tc.Exec(stmt)
 }
 
 func (client *Client) Start() {
-	conn, err := net.Dial(NETWORK, ADDRESS)
+	conn, tc, err := client.dial()
 	if err != nil {
-		panic(err)
+		log.Error(err)
+		return
 	}
 	defer conn.Close()
+	defer tc.Terminate()
 
 	input := bufio.NewReader(os.Stdin)
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
 
 	fmt.Println("Welcome to minidb-go")
 	fmt.Print("minidb> ")
 
-	xid := tm.XID(0)
 	stmt := ""
 	for {
 		line, err := input.ReadString('\n')
@@ -65,32 +110,80 @@ func (client *Client) Start() {
 			continue
 		}
 
-		// 发送数据
-		request := &transporter.Request{
-			Xid:  xid,
-			Stmt: stmt,
+		err = printResult(tc, stmt)
+		var serverErr *transporter.Error
+		if errors.As(err, &serverErr) {
+			fmt.Println(serverErr.Message)
+			fmt.Print("minidb> ")
+			continue
 		}
-		err = enc.Encode(request)
 		if err != nil {
 			log.Error(err)
 			return
 		}
+		fmt.Print("minidb> ")
+	}
+}
 
-		// 接收数据
-		response := &transporter.Response{}
-		err = dec.Decode(response)
-		if err != nil {
-			log.Error(err)
+// 边接收边打印结果，不在客户端保存全部的行
+func printResult(tc *transporter.Conn, stmt string) error {
+	stream, err := tc.Query(stmt)
+	if err != nil {
+		return err
+	}
+	if len(stream.Columns) > 0 {
+		fmt.Print(formatColumns(stream.Columns))
+	}
+	for {
+		rows, err := stream.Next()
+		if err == io.EOF {
+			break
 		}
-		if response.Err != "" {
-			fmt.Println(response.Err)
-			fmt.Print("minidb> ")
-			continue
+		if err != nil {
+			return err
 		}
-		xid = response.Xid
-		if response.ResultList != nil {
-			fmt.Print(response.ResultList)
+		fmt.Print(formatRows(rows))
+	}
+	if complete := stream.Complete(); complete.Message != "" {
+		fmt.Println(complete.Message)
+	} else {
+		fmt.Println()
+	}
+	return nil
+}
+
+// 将结果格式化为表格，不返回数据行的语句只显示执行信息
+func Format(result *transporter.Result) string {
+	if result.Message != "" {
+		return result.Message + "\n"
+	}
+	if len(result.Columns) == 0 {
+		return "\n"
+	}
+	return formatColumns(result.Columns) + formatRows(result.Rows) + "\n"
+}
+
+func formatColumns(columns []transporter.Column) string {
+	var b strings.Builder
+	for _, column := range columns {
+		b.WriteString(column.Name + "\t")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatRows(rows [][]transporter.Value) string {
+	var b strings.Builder
+	for _, row := range rows {
+		for _, value := range row {
+			switch value := value.(type) {
+			case float64:
+				b.WriteString(ast.FormatFloat(value) + "\t")
+			default:
+				fmt.Fprintf(&b, "%v\t", value)
+			}
 		}
-		fmt.Print("minidb> ")
+		b.WriteString("\n")
 	}
+	return b.String()
 }
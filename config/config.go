@@ -0,0 +1,152 @@
+/*
+服务端和客户端的运行时配置，可以从 JSON 格式的配置文件读取，例如：
+
+	{
+		"listen": "127.0.0.1:8081",
+		"socket": "/tmp/minidb.sock",
+		"path": "/var/lib/minidb",
+		"frames": 4096,
+		"log_level": "warn",
+		"idle_timeout": "10m"
+	}
+
+时间使用 time.ParseDuration 的格式，也可以是纳秒数。命令行参数优先于配置文件。
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 可以从字符串解析的时间间隔
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		nanos, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = Duration(nanos)
+		return nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+type Config struct {
+	// TCP 监听地址，为空时不监听 TCP
+	Listen string `json:"listen"`
+	// unix socket 的路径，为空时不监听，客户端优先使用
+	Socket string `json:"socket"`
+	// PostgreSQL 协议的 TCP 监听地址，为空时不监听
+	PostgresListen string `json:"postgres_listen"`
+	// 数据目录
+	Path string `json:"path"`
+	// 客户端连接时使用的用户和密码，服务端没有用户时忽略
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	// 缓冲池的页框数量、分片数和页面置换策略
+	Frames   int    `json:"frames"`
+	Shards   int    `json:"shards"`
+	Replacer string `json:"replacer"`
+	// double write 缓冲的页数
+	DoubleWritePages int `json:"double_write_pages"`
+	// 通过索引查找时并发读取数据页的 goroutine 数
+	SearchWorkers int `json:"search_workers"`
+
+	// 日志级别：trace、debug、info、warn、error
+	LogLevel string `json:"log_level"`
+	// 连接空闲超过该时间后断开，为 0 时不超时
+	IdleTimeout Duration `json:"idle_timeout"`
+	// 发送一个响应的超时时间，为 0 时不超时
+	WriteTimeout Duration `json:"write_timeout"`
+	// 退出时等待正在执行的语句结束的时间，超时后强制断开连接
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	CheckPoint  Duration `json:"checkpoint"`
+	AutoVacuum  Duration `json:"autovacuum"`
+	Archive     string   `json:"archive"`
+	CommitDelay Duration `json:"commit_delay"`
+}
+
+func Default() Config {
+	return Config{
+		Listen:           "127.0.0.1:8080",
+		Frames:           1024,
+		Shards:           8,
+		Replacer:         "lru",
+		DoubleWritePages: 128,
+		SearchWorkers:    2,
+		LogLevel:         "info",
+		ShutdownTimeout:  Duration(10 * time.Second),
+		CheckPoint:       Duration(time.Minute),
+	}
+}
+
+// 读取配置文件，文件中没有的配置保持不变，不认识的配置项返回错误
+func (config *Config) LoadFile(name string) error {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return fmt.Errorf("load config %s failed: %w", name, err)
+	}
+	return config.Validate()
+}
+
+func (config *Config) Validate() error {
+	switch {
+	case config.Frames <= 0:
+		return fmt.Errorf("frames must be positive, got %d", config.Frames)
+	case config.Shards <= 0:
+		return fmt.Errorf("shards must be positive, got %d", config.Shards)
+	case config.DoubleWritePages <= 0:
+		return fmt.Errorf("double_write_pages must be positive, got %d", config.DoubleWritePages)
+	case config.SearchWorkers <= 0:
+		return fmt.Errorf("search_workers must be positive, got %d", config.SearchWorkers)
+	}
+	return nil
+}
+
+// 将配置项绑定到命令行参数，参数的默认值为当前的配置
+func (config *Config) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&config.Listen, "listen", config.Listen, "TCP address to listen on or connect to, empty to disable")
+	flags.StringVar(&config.Socket, "socket", config.Socket, "unix socket path to listen on or connect to, empty to disable")
+	flags.StringVar(&config.PostgresListen, "postgres-listen", config.PostgresListen, "TCP address to accept PostgreSQL protocol connections on, empty to disable")
+	flags.StringVar(&config.Path, "path", config.Path, "database path")
+	flags.StringVar(&config.User, "user", config.User, "user to connect as")
+	flags.StringVar(&config.Password, "password", config.Password, "password of the user")
+	flags.IntVar(&config.Frames, "frames", config.Frames, "buffer pool frames")
+	flags.IntVar(&config.Shards, "shards", config.Shards, "buffer pool shards")
+	flags.StringVar(&config.Replacer, "replacer", config.Replacer, "page replacement policy: lru, wtinylfu or clock")
+	flags.IntVar(&config.DoubleWritePages, "double-write-pages", config.DoubleWritePages, "pages buffered by the double write buffer")
+	flags.IntVar(&config.SearchWorkers, "search-workers", config.SearchWorkers, "goroutines reading data pages in an index search")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "log level: trace, debug, info, warn or error")
+	flags.DurationVar((*time.Duration)(&config.IdleTimeout), "idle-timeout", time.Duration(config.IdleTimeout), "close connections idle for longer than this, 0 to disable")
+	flags.DurationVar((*time.Duration)(&config.WriteTimeout), "write-timeout", time.Duration(config.WriteTimeout), "timeout for sending a response, 0 to disable")
+	flags.DurationVar((*time.Duration)(&config.ShutdownTimeout), "shutdown-timeout", time.Duration(config.ShutdownTimeout), "time to wait for running statements on shutdown before closing connections")
+	flags.DurationVar((*time.Duration)(&config.CheckPoint), "checkpoint", time.Duration(config.CheckPoint), "checkpoint interval, 0 to disable")
+	flags.DurationVar((*time.Duration)(&config.AutoVacuum), "autovacuum", time.Duration(config.AutoVacuum), "autovacuum interval, 0 to disable")
+	flags.StringVar(&config.Archive, "archive", config.Archive, "directory to archive recycled redo log segments into, empty to disable")
+	flags.DurationVar((*time.Duration)(&config.CommitDelay), "commit-delay", time.Duration(config.CommitDelay), "time to wait for concurrent commits before flushing the redo log, 0 to disable")
+}
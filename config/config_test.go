@@ -0,0 +1,49 @@
+package config_test
+
+import (
+	"flag"
+	"minidb-go/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	name := filepath.Join(t.TempDir(), "minidb.json")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// 配置文件覆盖默认值，命令行参数覆盖配置文件
+func TestLoadFile(t *testing.T) {
+	name := writeConfig(t, `{"listen": "127.0.0.1:9000", "frames": 64, "idle_timeout": "30s", "commit_delay": 1000}`)
+	cfg := config.Default()
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(flags)
+	args := []string{"-frames", "128"}
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.LoadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:9000" || cfg.Frames != 128 || cfg.Shards != config.Default().Shards {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if time.Duration(cfg.IdleTimeout) != 30*time.Second || time.Duration(cfg.CommitDelay) != time.Microsecond {
+		t.Fatalf("unexpected durations %v %v", cfg.IdleTimeout, cfg.CommitDelay)
+	}
+
+	for _, content := range []string{`{"frame": 64}`, `{"frames": 0}`, `{"idle_timeout": "soon"}`} {
+		cfg := config.Default()
+		if err := cfg.LoadFile(writeConfig(t, content)); err == nil {
+			t.Fatalf("%s should be rejected", content)
+		}
+	}
+}
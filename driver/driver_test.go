@@ -0,0 +1,138 @@
+package driver_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	_ "minidb-go/driver"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"testing"
+)
+
+type student struct {
+	id    int64
+	name  string
+	score float64
+}
+
+func queryStudents(t *testing.T, db *sql.DB, query string, args ...interface{}) []student {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var students []student
+	for rows.Next() {
+		var s student
+		if err := rows.Scan(&s.id, &s.name, &s.score); err != nil {
+			t.Fatal(err)
+		}
+		students = append(students, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return students
+}
+
+func testDriver(t *testing.T, db *sql.DB) {
+	if _, err := db.Exec("create table student(id int, name text, score float)"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("insert into student values($1, $2, $3)", 1, "tom", 90.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		t.Fatalf("expected 1 affected row, got %d, %v", n, err)
+	}
+
+	// 回滚的事务不可见，提交的事务可见
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into student values($1, $2, $3)", 2, "jerry", 80.0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into student values(3, 'alice', 70.25);"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	students := queryStudents(t, db, "select * from student")
+	if len(students) != 2 || students[0] != (student{1, "tom", 90.5}) || students[1] != (student{3, "alice", 70.25}) {
+		t.Fatalf("unexpected students %v", students)
+	}
+	if students := queryStudents(t, db, "select * from student where id = $1", 3); len(students) != 1 || students[0].name != "alice" {
+		t.Fatalf("unexpected students %v", students)
+	}
+
+	rows, err := db.Query("select * from student where id = $1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columnTypes, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"INT", "TEXT", "FLOAT"} {
+		if name := columnTypes[i].DatabaseTypeName(); name != expected {
+			t.Fatalf("expected column type %s, got %s", expected, name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ExecContext(ctx, "insert into student values(4, 'bob', 60.0)"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := db.Exec("select * from student; select * from student;"); err == nil {
+		t.Fatal("multiple statements should be rejected")
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("minidb", "file:"+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDriver(t, db)
+	db.Close()
+
+	// 关闭后重新打开已有的数据库
+	db, err = sql.Open("minidb", "file:"+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if students := queryStudents(t, db, "select * from student"); len(students) != 2 {
+		t.Fatalf("expected 2 students after reopen, got %v", students)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	srv := server.NewServer(false, true, t.TempDir(), pager.DefaultOptions())
+	defer srv.Shutdown()
+	if err := srv.Listen("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("minidb", "minidb://"+srv.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testDriver(t, db)
+}
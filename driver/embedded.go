@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"minidb-go/tbm"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 进程内打开的数据库，同一个目录的连接共享一个 TableManager，最后一个连接关闭时关闭数据库
+type database struct {
+	tbm  *tbm.TableManager
+	refs int
+}
+
+var (
+	databasesLock sync.Mutex
+	databases     = make(map[string]*database)
+)
+
+// 进程内的连接，语句由连接自己的会话执行
+type embedded struct {
+	path    string
+	db      *database
+	session *server.Session
+}
+
+func openEmbedded(path string) (*embedded, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+	db, ok := databases[path]
+	if !ok {
+		var tableManager *tbm.TableManager
+		_, err := os.Stat(filepath.Join(path, pager.PAGE_FILE_NAME))
+		switch {
+		case err == nil:
+			tableManager, err = tbm.OpenWithOptions(path, pager.DefaultOptions())
+		case os.IsNotExist(err):
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return nil, err
+			}
+			tableManager, err = tbm.CreateWithOptions(path, pager.DefaultOptions())
+		}
+		if err != nil {
+			return nil, err
+		}
+		db = &database{tbm: tableManager}
+		databases[path] = db
+	}
+	db.refs++
+	// 进程内打开的数据库不检查用户的权限
+	session := server.NewSession(db.tbm)
+	session.SetTrusted()
+	return &embedded{
+		path:    path,
+		db:      db,
+		session: session,
+	}, nil
+}
+
+func (e *embedded) exec(ctx context.Context, query string, args []ast.SQLExprValue) (*resultSet, error) {
+	query, err := normalizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		if stmt, err = ast.BindParams(stmt, args); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resultList *tbm.ResultList
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resultList, err := e.session.ExecuteStmt(stmt)
+		done <- result{resultList, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return resultSetFromList(r.resultList), nil
+	case <-ctx.Done():
+		// 语句继续执行，关闭连接时等待语句结束后回滚会话中的事务
+		return nil, ctx.Err()
+	}
+}
+
+func (e *embedded) close() error {
+	e.session.Close()
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+	e.db.refs--
+	if e.db.refs == 0 {
+		delete(databases, e.path)
+		return e.db.tbm.Close()
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"minidb-go/parser/ast"
+	"minidb-go/transporter"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 连接断开或者收发出错，服务端可能已经执行了语句
+var errConnBroken = errors.New("connection broken")
+
+// 通过 TCP 连接服务端，参数在客户端替换为字面量
+type remote struct {
+	conn net.Conn
+	tc   *transporter.Conn
+}
+
+// params 为握手时发送的参数，例如 user 和 password
+func dialRemote(address string, params map[string]string) (*remote, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tc := transporter.NewConn(conn)
+	if _, err := tc.Handshake(params); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &remote{
+		conn: conn,
+		tc:   tc,
+	}, nil
+}
+
+func (r *remote) exec(ctx context.Context, query string, args []ast.SQLExprValue) (*resultSet, error) {
+	query, err := normalizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if query, err = interpolate(query, args); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// context 取消时让读写立即返回
+	deadline, _ := ctx.Deadline()
+	r.conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	result, err := r.tc.Exec(query)
+	var serverErr *transporter.Error
+	if errors.As(err, &serverErr) {
+		return nil, serverErr
+	}
+	if err != nil {
+		return nil, r.broken(ctx, err)
+	}
+	return resultSetFromWire(result), nil
+}
+
+func (r *remote) broken(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: %v", errConnBroken, err)
+}
+
+func (r *remote) close() error {
+	r.tc.Terminate()
+	return r.conn.Close()
+}
+
+// 将字符串外的 $n 替换为 args[n-1] 的字面量
+func interpolate(query string, args []ast.SQLExprValue) (string, error) {
+	if len(args) == 0 {
+		return query, nil
+	}
+	var builder strings.Builder
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inString = !inString
+		}
+		if c != '$' || inString {
+			builder.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(query[i+1 : j])
+		if err != nil || n == 0 || n > len(args) {
+			return "", fmt.Errorf("%w: %s", ast.ErrUnboundParam, query[i:j])
+		}
+		lit, err := literal(args[n-1])
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString(lit)
+		i = j - 1
+	}
+	return builder.String(), nil
+}
+
+// 值的字面量，浮点数总是带有小数点，字符串中不能有单引号
+func literal(value ast.SQLExprValue) (string, error) {
+	switch value := value.(type) {
+	case *ast.SQLInt:
+		return strconv.FormatInt(int64(*value), 10), nil
+	case *ast.SQLFloat:
+		f := float64(*value)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", fmt.Errorf("%w: %v", ErrUnsupportedValue, f)
+		}
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s, nil
+	case *ast.SQLText:
+		if strings.Contains(string(*value), "'") {
+			return "", fmt.Errorf("%w: string containing a single quote", ErrUnsupportedValue)
+		}
+		return "'" + string(*value) + "'", nil
+	}
+	return "", fmt.Errorf("%w: %v", ErrUnsupportedValue, value)
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"database/sql/driver"
+	"io"
+	"minidb-go/parser/ast"
+	"minidb-go/tbm"
+	"minidb-go/transporter"
+	"reflect"
+)
+
+// 语句的结果，进程内和远程的后端都转换为该格式，值为 int64、float64 或 string
+type resultSet struct {
+	columns []string
+	// 列的类型名 INT、FLOAT 或 TEXT
+	types    []string
+	nullable []bool
+	rows     [][]driver.Value
+	// 返回或者影响的行数
+	rowCount int64
+}
+
+// 行末尾隐藏的 xmin 和 xmax 不返回
+func resultSetFromList(resultList *tbm.ResultList) *resultSet {
+	if resultList == nil {
+		return &resultSet{}
+	}
+	rs := &resultSet{
+		columns:  make([]string, len(resultList.Columns)),
+		types:    make([]string, len(resultList.Columns)),
+		nullable: make([]bool, len(resultList.Columns)),
+		rows:     make([][]driver.Value, len(resultList.Rows)),
+		rowCount: int64(len(resultList.Rows) + resultList.RowsAffected),
+	}
+	for i, column := range resultList.Columns {
+		rs.columns[i] = column.Name
+		rs.types[i] = column.Type.String()
+		rs.nullable[i] = column.Nullable
+	}
+	for i, row := range resultList.Rows {
+		values := make([]driver.Value, len(resultList.Columns))
+		for j := range values {
+			switch value := row.Data[j].(type) {
+			case *ast.SQLInt:
+				values[j] = int64(*value)
+			case *ast.SQLFloat:
+				values[j] = float64(*value)
+			case *ast.SQLText:
+				values[j] = string(*value)
+			}
+		}
+		rs.rows[i] = values
+	}
+	return rs
+}
+
+func resultSetFromWire(result *transporter.Result) *resultSet {
+	rs := &resultSet{
+		columns:  make([]string, len(result.Columns)),
+		types:    make([]string, len(result.Columns)),
+		nullable: make([]bool, len(result.Columns)),
+		rows:     make([][]driver.Value, len(result.Rows)),
+		rowCount: int64(result.RowCount),
+	}
+	for i, column := range result.Columns {
+		rs.columns[i] = column.Name
+		rs.nullable[i] = column.Nullable
+		switch column.Type {
+		case transporter.TypeInt:
+			rs.types[i] = "INT"
+		case transporter.TypeFloat:
+			rs.types[i] = "FLOAT"
+		default:
+			rs.types[i] = "TEXT"
+		}
+	}
+	for i, row := range result.Rows {
+		values := make([]driver.Value, len(row))
+		for j, value := range row {
+			values[j] = value
+		}
+		rs.rows[i] = values
+	}
+	return rs
+}
+
+type result struct {
+	rowsAffected int64
+}
+
+func newResult(rs *resultSet) driver.Result {
+	return &result{rowsAffected: rs.rowCount}
+}
+
+func (r *result) LastInsertId() (int64, error) {
+	return 0, ErrLastInsertId
+}
+
+func (r *result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// 结果已经全部返回
+type rows struct {
+	rs  *resultSet
+	pos int
+}
+
+func newRows(rs *resultSet) *rows {
+	return &rows{rs: rs}
+}
+
+func (r *rows) Columns() []string {
+	return r.rs.columns
+}
+
+func (r *rows) Close() error {
+	r.pos = len(r.rs.rows)
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rs.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rs.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if index >= len(r.rs.types) {
+		return ""
+	}
+	return r.rs.types[index]
+}
+
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	switch r.ColumnTypeDatabaseTypeName(index) {
+	case "INT":
+		return reflect.TypeOf(int64(0))
+	case "FLOAT":
+		return reflect.TypeOf(float64(0))
+	case "TEXT":
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if index >= len(r.rs.nullable) {
+		return false, false
+	}
+	return r.rs.nullable[index], true
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
-	"encoding/gob"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"minidb-go/client"
-	"minidb-go/parser/ast"
+	"minidb-go/config"
 	"minidb-go/server"
-	"minidb-go/storage/bplustree"
+	"minidb-go/storage"
+	"minidb-go/storage/inspect"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/recovery"
+	"minidb-go/tbm"
 	"minidb-go/util"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,26 +29,63 @@ func init() {
 	log.SetLevel(log.InfoLevel)
 	log.SetReportCaller(true)
 	log.SetFormatter(&util.MyFormatter{})
-
-	// 注册 gob 接口类型
-	gob.Register(bplustree.BPlusTree{})
-	sqlInt := ast.SQLInt(0)
-	sqlFloat := ast.SQLFloat(0)
-	sqlText := ast.SQLText("")
-	sqlColumn := ast.SQLColumn("")
-	gob.RegisterName("minidb-go/parser/ast.SQLInt", &sqlInt)
-	gob.RegisterName("minidb-go/parser/ast.SQLFloat", &sqlFloat)
-	gob.RegisterName("minidb-go/parser/ast.SQLText", &sqlText)
-	gob.RegisterName("minidb-go/parser/ast.SQLColumn", &sqlColumn)
 }
 
 func main() {
+	// 子命令有自己的参数
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		os.Exit(inspectFiles(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(backup(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(restore(os.Args[2:]))
+	}
+
 	isServer := flag.Bool("server", false, "run as server")
 	isClient := flag.Bool("client", false, "run as client")
 	isCreate := flag.Bool("create", false, "create database")
 	isOpen := flag.Bool("open", false, "open database")
-	path := flag.String("path", "", "database path")
+	verify := flag.Bool("verify", false, "verify page checksums of the database and exit")
+	configFile := flag.String("config", "", "JSON configuration file, flags override its settings")
+	cfg := config.Default()
+	cfg.RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		// 命令行参数优先于配置文件
+		flag.Parse()
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	level, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(level)
+
+	if *verify {
+		// 数据库需要处于关闭状态
+		pageCount, corrupted, err := pager.Verify(cfg.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, pageNum := range corrupted {
+			log.Errorf("page %d is corrupted", pageNum)
+		}
+		log.Infof("verified %d pages, %d corrupted", pageCount, len(corrupted))
+		if len(corrupted) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
 	if *isServer && *isClient {
 		log.Fatal("server and client can't be both true")
@@ -48,13 +93,191 @@ func main() {
 
 	if *isServer {
 		log.Info("run as server")
-		server := server.NewServer(*isOpen, *isCreate, *path)
-		server.Start()
+		options, err := serverOptions(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server := server.NewServer(*isOpen, *isCreate, cfg.Path, options)
+		server.SetTimeouts(time.Duration(cfg.IdleTimeout), time.Duration(cfg.WriteTimeout))
+		server.SetShutdownTimeout(time.Duration(cfg.ShutdownTimeout))
+		server.StartAutoVacuum(time.Duration(cfg.AutoVacuum))
+		server.StartCheckPoint(time.Duration(cfg.CheckPoint))
+		if cfg.PostgresListen != "" {
+			if err := server.ListenPostgres(cfg.PostgresListen); err != nil {
+				log.Fatal(err)
+			}
+		}
+		server.Start(cfg.Listen, cfg.Socket)
 	} else if *isClient {
 		log.Info("run as client")
-		client := client.NewClient()
+		client := client.NewClient(cfg.Listen, cfg.Socket)
+		client.SetUser(cfg.User, cfg.Password)
 		client.Start()
 	} else {
 		log.Fatal("run as server or client")
 	}
 }
+
+// 根据配置设置缓冲池和 redo log 的参数以及存储层的全局配置
+func serverOptions(cfg config.Config) (pager.Options, error) {
+	options := pager.DefaultOptions()
+	options.Frames = cfg.Frames
+	options.Shards = cfg.Shards
+	replacerType, err := pager.ParseReplacer(cfg.Replacer)
+	if err != nil {
+		return options, err
+	}
+	options.Replacer = replacerType
+	if cfg.Archive != "" {
+		if err := os.MkdirAll(cfg.Archive, 0755); err != nil {
+			return options, err
+		}
+		options.Redo.ArchiveDir = cfg.Archive
+	}
+	options.Redo.CommitDelay = time.Duration(cfg.CommitDelay)
+	options.DoubleWritePages = cfg.DoubleWritePages
+	options.SearchWorkers = cfg.SearchWorkers
+	return options, nil
+}
+
+// minidb check -path <dir> [-repair]
+// 检查关闭状态的数据库，有错误时返回非 0 的退出码，-repair 根据数据页重建索引后再检查一次
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	path := flags.String("path", "", "database path")
+	repair := flags.Bool("repair", false, "rebuild indexes from heap data, then check again")
+	flags.Parse(args)
+
+	report, err := storage.Check(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(report)
+	if *repair {
+		// 打开时会先完成恢复
+		db, err := tbm.OpenWithOptions(*path, pager.DefaultOptions())
+		if err != nil {
+			log.Fatalf("open database failed: %v", err)
+		}
+		rebuildErr := db.RebuildIndexes()
+		closeErr := db.Close()
+		if rebuildErr != nil {
+			log.Fatalf("rebuild indexes failed: %v", rebuildErr)
+		}
+		if closeErr != nil {
+			log.Fatalf("close database failed: %v", closeErr)
+		}
+		report, err = storage.Check(*path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("after repair:")
+		fmt.Println(report)
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// minidb inspect -path <dir> [-json] [-as auto|meta|record|index] catalog|page <n>|redo|doublewrite|xid
+// 解码关闭状态的数据库中的文件
+func inspectFiles(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	path := flags.String("path", "", "database path")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	as := flags.String("as", inspect.AS_AUTO, "decode the page as auto, meta, record or index")
+	flags.Parse(args)
+
+	var result fmt.Stringer
+	var err error
+	switch flags.Arg(0) {
+	case "catalog":
+		result, err = inspect.Catalog(*path)
+	case "page":
+		var pageNum uint64
+		pageNum, err = strconv.ParseUint(flags.Arg(1), 10, 32)
+		if err == nil {
+			result, err = inspect.Page(*path, util.UUID(pageNum), *as)
+		}
+	case "redo":
+		result, err = inspect.RedoLog(*path)
+	case "doublewrite":
+		result, err = inspect.DoubleWrite(*path)
+	case "xid":
+		result, err = inspect.XIDs(*path)
+	default:
+		err = fmt.Errorf("unknown target %q, expected catalog, page <n>, redo, doublewrite or xid", flags.Arg(0))
+	}
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if *asJSON {
+		raw, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		fmt.Println(string(raw))
+	} else {
+		fmt.Println(result)
+	}
+	return 0
+}
+
+// minidb backup -to <dir> [-listen <address>] [-socket <path>] [-user <name> -password <password>]
+// 让运行中的服务器执行 BACKUP TO，备份期间服务器可以继续处理其他请求
+func backup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	to := flags.String("to", "", "backup directory")
+	address := flags.String("listen", config.Default().Listen, "TCP address of the server")
+	socket := flags.String("socket", "", "unix socket path of the server, used instead of the TCP address")
+	user := flags.String("user", "", "superuser to connect as")
+	password := flags.String("password", "", "password of the user")
+	flags.Parse(args)
+
+	if *to == "" {
+		log.Error("backup directory is required")
+		return 1
+	}
+	// 服务器的工作目录可能不同
+	dir, err := filepath.Abs(*to)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	backupClient := client.NewClient(*address, *socket)
+	backupClient.SetUser(*user, *password)
+	result, err := backupClient.Exec(fmt.Sprintf("backup to '%s';", dir))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	fmt.Print(client.Format(result))
+	return 0
+}
+
+// minidb restore -from <backup> -path <dir> [-archive <dir>] [-until <LSN|xid:<xid>|time>]
+// 将备份复制到新的数据库目录并重放 redo log，指定 -until 时重放备份和归档的日志到该位置，之后可以用 check 检查
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "backup directory")
+	path := flags.String("path", "", "database path to restore into")
+	archive := flags.String("archive", "", "directory of archived redo log segments")
+	until := flags.String("until", "", "recovery target: an LSN, xid:<xid> or an RFC3339 time, empty to replay all logs")
+	flags.Parse(args)
+
+	target, err := recovery.ParseTarget(*until)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if err := tbm.RestoreUntil(*from, *archive, *path, target, pager.DefaultOptions()); err != nil {
+		log.Error(err)
+		return 1
+	}
+	log.Infof("restored %s to %s", *from, *path)
+	return 0
+}
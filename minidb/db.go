@@ -0,0 +1,448 @@
+/*
+minidb 在进程内打开数据库，不需要启动服务端：
+
+	db, err := minidb.Open("/var/lib/minidb", nil)
+	if err != nil {
+		...
+	}
+	defer db.Close()
+	db.Exec("insert into student values($1, $2, $3)", 1, "tom", 90.5)
+	rows, err := db.Query("select * from student where id = $1", 1)
+
+语句末尾的分号可以省略，一次只能执行一条语句，参数支持整数、浮点数、字符串、[]byte 和 bool。
+所有的错误都通过返回值返回，不会退出进程。存储层在运行中（包括后台 autovacuum 和 checkpoint 中）
+出错时数据库不能再使用，之后的调用返回 ErrBroken，关闭后重新打开时通过 redo log 恢复。
+*/
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"minidb-go/tbm"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrClosed            = errors.New("database is closed")
+	ErrBroken            = errors.New("database is broken by an internal error, reopen it to recover")
+	ErrAlreadyOpen       = errors.New("database is already open in this process")
+	ErrNotExist          = errors.New("database does not exist")
+	ErrTxDone            = errors.New("transaction has already been committed or rolled back")
+	ErrTooManyStatements = errors.New("only one statement can be executed at a time")
+	ErrUnsupportedValue  = errors.New("unsupported argument type")
+)
+
+type Options struct {
+	// 缓冲池和 redo log 的配置
+	BufferPool pager.Options
+	// 目录中没有数据库时是否创建
+	CreateIfMissing bool
+	// 后台 autovacuum 和 checkpoint 的间隔，为 0 时不启动
+	AutoVacuum time.Duration
+	CheckPoint time.Duration
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		BufferPool:      pager.DefaultOptions(),
+		CreateIfMissing: true,
+	}
+}
+
+// 同一个目录在进程中只能打开一次，多个 TableManager 同时写入会破坏数据文件
+var (
+	openedLock sync.Mutex
+	opened     = make(map[string]bool)
+)
+
+type DB struct {
+	path string
+	tbm  *tbm.TableManager
+
+	// 执行语句时持有读锁，Close 持有写锁等待正在执行的语句结束
+	lock   sync.RWMutex
+	closed bool
+	// 存储层出错后记录错误，数据库不能再使用，执行语句时只持有 db.lock 的读锁，需要单独加锁
+	broken     error
+	brokenLock sync.Mutex
+	// 还没有关闭的查询结果，关闭数据库时关闭
+	rows     map[*Rows]bool
+	rowsLock sync.Mutex
+}
+
+// opts 为 nil 时使用 DefaultOptions
+func Open(path string, opts *Options) (db *DB, err error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	openedLock.Lock()
+	defer openedLock.Unlock()
+	if opened[path] {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyOpen, path)
+	}
+
+	// 恢复时存储层出错不能退出进程
+	defer func() {
+		if r := recover(); r != nil {
+			db, err = nil, fmt.Errorf("open database %s failed: %v", path, r)
+		}
+	}()
+	var tableManager *tbm.TableManager
+	_, err = os.Stat(filepath.Join(path, pager.PAGE_FILE_NAME))
+	switch {
+	case err == nil:
+		tableManager, err = tbm.OpenWithOptions(path, opts.BufferPool)
+	case os.IsNotExist(err) && opts.CreateIfMissing:
+		if err = os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		tableManager, err = tbm.CreateWithOptions(path, opts.BufferPool)
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db = &DB{path: path, tbm: tableManager, rows: make(map[*Rows]bool)}
+	// 后台任务中的 panic 不能被调用者的 recover 捕获，同样将数据库标记为损坏
+	tableManager.SetPanicHandler(func(r interface{}) {
+		db.setBroken(r)
+	})
+	if opts.AutoVacuum > 0 {
+		tableManager.StartAutoVacuum(opts.AutoVacuum)
+	}
+	if opts.CheckPoint > 0 {
+		tableManager.StartCheckPoint(opts.CheckPoint)
+	}
+	opened[path] = true
+	return db, nil
+}
+
+/*
+等待正在执行的语句结束后关闭数据库，未提交的事务被回滚。
+数据库已经损坏时不再写回任何数据，返回损坏的原因，下次打开时进行恢复。
+*/
+func (db *DB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	defer func() {
+		openedLock.Lock()
+		delete(opened, db.path)
+		openedLock.Unlock()
+	}()
+	if err := db.brokenErr(); err != nil {
+		// 不再写回任何数据，只等待后台任务停止
+		db.protect(func() error {
+			db.tbm.StopAutoVacuum()
+			db.tbm.StopCheckPoint()
+			return nil
+		})
+		return err
+	}
+	return db.protect(func() error {
+		db.rowsLock.Lock()
+		for rows := range db.rows {
+			rows.result.Close()
+		}
+		db.rows = nil
+		db.rowsLock.Unlock()
+		return db.tbm.Close()
+	})
+}
+
+type Result struct {
+	// INSERT、UPDATE 和 DELETE 影响的行数
+	RowsAffected int64
+}
+
+// 在单独的事务中执行一条语句，BEGIN、COMMIT 和 ROLLBACK 需要通过 Begin 返回的 Tx 执行
+func (db *DB) Exec(query string, args ...interface{}) (Result, error) {
+	resultList, err := db.exec(query, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(resultList), nil
+}
+
+// SELECT 的结果在 Next 时按需读取，在单独的事务中执行，Rows.Close 时提交
+func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	stmt, err := parse(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isTransactionStmt(stmt) {
+		return nil, fmt.Errorf("%s: use Begin, Tx.Commit and Tx.Rollback", query)
+	}
+	return db.query(db.newSession(), stmt)
+}
+
+// 开始一个事务，事务结束前需要调用 Commit 或者 Rollback
+func (db *DB) Begin() (*Tx, error) {
+	tx := &Tx{db: db, session: db.newSession()}
+	if _, err := db.execStmt(tx.session, ast.BeginStmt{}); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// 进程内打开的数据库不检查用户的权限
+func (db *DB) newSession() *server.Session {
+	session := server.NewSession(db.tbm)
+	session.SetTrusted()
+	return session
+}
+
+// 在临时会话中执行语句，事务控制语句只能由 Tx 执行
+func (db *DB) exec(query string, args []interface{}) (*tbm.ResultList, error) {
+	stmt, err := parse(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isTransactionStmt(stmt) {
+		return nil, fmt.Errorf("%s: use Begin, Tx.Commit and Tx.Rollback", query)
+	}
+	return db.execStmt(db.newSession(), stmt)
+}
+
+func (db *DB) execStmt(session *server.Session, stmt ast.SQLStatement) (resultList *tbm.ResultList, err error) {
+	err = db.run(func() error {
+		resultList, err = session.ExecuteStmt(stmt)
+		return err
+	})
+	return resultList, err
+}
+
+// SELECT 和 FETCH 打开游标，其他语句执行后返回空的结果
+func (db *DB) query(session *server.Session, stmt ast.SQLStatement) (*Rows, error) {
+	switch stmt.(type) {
+	case ast.SelectStmt, ast.FetchStmt:
+	default:
+		resultList, err := db.execStmt(session, stmt)
+		if err != nil {
+			return nil, err
+		}
+		return newRows(db, nil, resultList), nil
+	}
+	var rows *Rows
+	err := db.run(func() error {
+		result, err := session.Query(stmt)
+		if err != nil {
+			return err
+		}
+		// 持有 db.lock 的读锁，Close 之前一定能看到这个结果
+		rows = newRows(db, result, nil)
+		db.rowsLock.Lock()
+		db.rows[rows] = true
+		db.rowsLock.Unlock()
+		return nil
+	})
+	return rows, err
+}
+
+// 在没有关闭和损坏的数据库上执行 f，执行期间 Close 等待
+func (db *DB) run(f func() error) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := db.brokenErr(); err != nil {
+		return err
+	}
+	return db.protect(f)
+}
+
+func isTransactionStmt(stmt ast.SQLStatement) bool {
+	switch stmt.(type) {
+	case ast.BeginStmt, ast.CommitStmt, ast.RollbackStmt:
+		return true
+	}
+	return false
+}
+
+func parse(query string, args []interface{}) (ast.SQLStatement, error) {
+	query, err := normalizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return stmt, nil
+	}
+	values := make([]ast.SQLExprValue, len(args))
+	for i, arg := range args {
+		if values[i], err = sqlValue(arg); err != nil {
+			return nil, err
+		}
+	}
+	return ast.BindParams(stmt, values)
+}
+
+// 存储层在运行中出错时 panic，转换为错误并将数据库标记为损坏
+func (db *DB) protect(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = db.setBroken(r)
+		}
+	}()
+	return f()
+}
+
+// 记录第一次 panic 的原因，返回对应的错误
+func (db *DB) setBroken(r interface{}) error {
+	log.Errorf("database %s is broken: %v", db.path, r)
+	err := fmt.Errorf("%w: %v", ErrBroken, r)
+	db.brokenLock.Lock()
+	defer db.brokenLock.Unlock()
+	if db.broken == nil {
+		db.broken = err
+	}
+	return err
+}
+
+func (db *DB) brokenErr() error {
+	db.brokenLock.Lock()
+	defer db.brokenLock.Unlock()
+	return db.broken
+}
+
+type Tx struct {
+	db      *DB
+	session *server.Session
+	done    bool
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (Result, error) {
+	resultList, err := tx.exec(query, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(resultList), nil
+}
+
+// 结果在事务结束时关闭
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	stmt, err := parse(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isTransactionStmt(stmt) {
+		return nil, fmt.Errorf("%s: use Tx.Commit and Tx.Rollback", query)
+	}
+	rows, err := tx.db.query(tx.session, stmt)
+	if err != nil && !tx.session.InTransaction() {
+		tx.done = true
+	}
+	return rows, err
+}
+
+func (tx *Tx) Commit() error {
+	return tx.finish(ast.CommitStmt{})
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.finish(ast.RollbackStmt{})
+}
+
+func (tx *Tx) exec(query string, args []interface{}) (*tbm.ResultList, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	stmt, err := parse(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if isTransactionStmt(stmt) {
+		return nil, fmt.Errorf("%s: use Tx.Commit and Tx.Rollback", query)
+	}
+	resultList, err := tx.db.execStmt(tx.session, stmt)
+	// 检测到死锁时事务已经被回滚
+	if err != nil && !tx.session.InTransaction() {
+		tx.done = true
+	}
+	return resultList, err
+}
+
+func (tx *Tx) finish(stmt ast.SQLStatement) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	_, err := tx.db.execStmt(tx.session, stmt)
+	return err
+}
+
+// 将参数转换为语句中的值
+func sqlValue(value interface{}) (ast.SQLExprValue, error) {
+	switch value := value.(type) {
+	case int:
+		val := ast.SQLInt(value)
+		return &val, nil
+	case int32:
+		val := ast.SQLInt(value)
+		return &val, nil
+	case int64:
+		val := ast.SQLInt(value)
+		return &val, nil
+	case float32:
+		val := ast.SQLFloat(value)
+		return &val, nil
+	case float64:
+		val := ast.SQLFloat(value)
+		return &val, nil
+	case bool:
+		val := ast.SQLInt(0)
+		if value {
+			val = 1
+		}
+		return &val, nil
+	case string:
+		val := ast.SQLText(value)
+		return &val, nil
+	case []byte:
+		val := ast.SQLText(value)
+		return &val, nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedValue, value)
+}
+
+// 语句以分号结尾，一次只能执行一条语句
+func normalizeQuery(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasSuffix(query, ";") {
+		query += ";"
+	}
+	inString := false
+	for i, c := range query {
+		if c == '\'' {
+			inString = !inString
+		} else if c == ';' && !inString && i != len(query)-1 {
+			return "", ErrTooManyStatements
+		}
+	}
+	return query, nil
+}
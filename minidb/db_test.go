@@ -0,0 +1,181 @@
+package minidb_test
+
+import (
+	"errors"
+	"minidb-go/minidb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type student struct {
+	id    int64
+	name  string
+	score float64
+}
+
+// DB 和 Tx 都可以执行查询
+type querier interface {
+	Query(query string, args ...interface{}) (*minidb.Rows, error)
+}
+
+func queryStudents(t *testing.T, q querier, query string) []student {
+	rows, err := q.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var students []student
+	for rows.Next() {
+		var s student
+		if err := rows.Scan(&s.id, &s.name, &s.score); err != nil {
+			t.Fatal(err)
+		}
+		students = append(students, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return students
+}
+
+func TestDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := minidb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := minidb.Open(dir, nil); !errors.Is(err, minidb.ErrAlreadyOpen) {
+		t.Fatalf("expected %v, got %v", minidb.ErrAlreadyOpen, err)
+	}
+	if _, err := db.Exec("create table student(id int, name text, score float)"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("insert into student values($1, $2, $3)", 1, "tom", 90.5)
+	if err != nil || result.RowsAffected != 1 {
+		t.Fatalf("expected 1 affected row, got %v, %v", result, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into student values(2, 'jerry', 80.0)"); err != nil {
+		t.Fatal(err)
+	}
+	if students := queryStudents(t, tx, "select * from student"); len(students) != 2 {
+		t.Fatalf("expected 2 students in the transaction, got %v", students)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, minidb.ErrTxDone) {
+		t.Fatalf("expected %v, got %v", minidb.ErrTxDone, err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into student values($1, $2, $3)", 3, "alice", 70.25); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次 Next 从游标中读取一行
+	minidb.FetchSize = 1
+	defer func() { minidb.FetchSize = 100 }()
+	students := queryStudents(t, db, "select * from student")
+	if len(students) != 2 || students[0] != (student{1, "tom", 90.5}) || students[1] != (student{3, "alice", 70.25}) {
+		t.Fatalf("unexpected students %v", students)
+	}
+
+	// 错误通过返回值返回
+	if _, err := db.Exec("insert into teacher values(1)"); err == nil {
+		t.Fatal("insert into a missing table should fail")
+	}
+	if _, err := db.Exec("select * from student; select * from student"); !errors.Is(err, minidb.ErrTooManyStatements) {
+		t.Fatalf("expected %v, got %v", minidb.ErrTooManyStatements, err)
+	}
+	if _, err := db.Exec("commit"); err == nil {
+		t.Fatal("commit outside a transaction should be rejected")
+	}
+	rows, err := db.Query("select * from student where id = $1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := rows.Scan(&id); err == nil {
+		t.Fatal("scan before Next should fail")
+	}
+	rows.Next()
+	if err := rows.Scan(&id); err == nil {
+		t.Fatal("scan with too few destinations should fail")
+	}
+	rows.Close()
+
+	// 没有读取完的结果在关闭时结束
+	open, err := db.Query("select * from student")
+	if err != nil || !open.Next() {
+		t.Fatalf("expected a row, got %v", err)
+	}
+
+	// 未结束的事务在关闭时回滚
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("insert into student values(4, 'bob', 60.0)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if open.Next() || !errors.Is(open.Err(), minidb.ErrClosed) || open.Close() != nil {
+		t.Fatalf("expected %v after close, got %v", minidb.ErrClosed, open.Err())
+	}
+	if _, err := tx.Exec("select * from student"); !errors.Is(err, minidb.ErrClosed) {
+		t.Fatalf("expected %v, got %v", minidb.ErrClosed, err)
+	}
+	if _, err := db.Query("select * from student"); !errors.Is(err, minidb.ErrClosed) {
+		t.Fatalf("expected %v, got %v", minidb.ErrClosed, err)
+	}
+
+	db, err = minidb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if students := queryStudents(t, db, "select * from student"); len(students) != 2 {
+		t.Fatalf("expected 2 students after reopen, got %v", students)
+	}
+}
+
+// 无法打开数据库时返回错误而不是退出进程
+func TestOpenError(t *testing.T) {
+	dir := t.TempDir()
+	opts := minidb.DefaultOptions()
+	opts.CreateIfMissing = false
+	if _, err := minidb.Open(dir, opts); !errors.Is(err, minidb.ErrNotExist) {
+		t.Fatalf("expected %v, got %v", minidb.ErrNotExist, err)
+	}
+
+	db, err := minidb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "recovery_info")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := minidb.Open(dir, nil); err == nil {
+		t.Fatal("open without the recovery info should fail")
+	}
+	// 打开失败后可以再次尝试
+	if _, err := minidb.Open(dir, nil); err == nil || errors.Is(err, minidb.ErrAlreadyOpen) {
+		t.Fatalf("expected an open error, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/server"
+	"minidb-go/tbm"
+)
+
+var (
+	ErrRowsClosed = errors.New("rows are closed")
+	ErrNoRow      = errors.New("Scan called without calling Next")
+)
+
+// Next 每次从游标中读取的行数
+var FetchSize = 100
+
+func newResult(resultList *tbm.ResultList) Result {
+	if resultList == nil {
+		return Result{}
+	}
+	return Result{RowsAffected: int64(resultList.RowsAffected)}
+}
+
+/*
+查询的结果，用法与 database/sql 相同：
+
+	for rows.Next() {
+		rows.Scan(&id, &name)
+	}
+
+Scan 支持 *int、*int64、*float64、*string 和 *interface{}，整数可以扫描到 *float64。
+结果在 Next 时每次从游标中读取 FetchSize 行，没有读取完时需要调用 Close 结束查询。
+*/
+type Rows struct {
+	db      *DB
+	columns []tbm.Column
+	// SELECT 和 FETCH 的游标，其他语句为 nil
+	result *server.Rows
+	// 最近读取的一批行，Next 返回 true 后当前行为 batch[pos-1]
+	batch  []*ast.Row
+	pos    int
+	err    error
+	closed bool
+}
+
+func newRows(db *DB, result *server.Rows, resultList *tbm.ResultList) *Rows {
+	rows := &Rows{db: db, result: result}
+	if result != nil {
+		rows.columns = result.Columns
+	} else if resultList != nil {
+		rows.columns = resultList.Columns
+	}
+	return rows
+}
+
+func (rows *Rows) Columns() []string {
+	names := make([]string, len(rows.columns))
+	for i, column := range rows.columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// 每列的名字、类型和是否可能为 NULL
+func (rows *Rows) ColumnTypes() []tbm.Column {
+	return rows.columns
+}
+
+// 当前批次读取完之后从游标中读取下一批，出错时返回 false，错误通过 Err 返回
+func (rows *Rows) Next() bool {
+	if rows.closed {
+		return false
+	}
+	if rows.pos < len(rows.batch) {
+		rows.pos++
+		return true
+	}
+	if rows.result != nil {
+		var batch []*ast.Row
+		rows.err = rows.db.run(func() (err error) {
+			batch, err = rows.result.Fetch(FetchSize)
+			return err
+		})
+		if rows.err == nil && len(batch) > 0 {
+			rows.batch, rows.pos = batch, 1
+			return true
+		}
+	}
+	rows.Close()
+	return false
+}
+
+// 读取下一批时发生的错误
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// 没有读取完时提前结束查询，Next 返回 false 时自动关闭
+func (rows *Rows) Close() error {
+	if rows.closed {
+		return nil
+	}
+	rows.closed = true
+	rows.batch = nil
+	if rows.result == nil {
+		return nil
+	}
+	rows.db.rowsLock.Lock()
+	delete(rows.db.rows, rows)
+	rows.db.rowsLock.Unlock()
+	err := rows.db.run(rows.result.Close)
+	// 数据库关闭时已经关闭了结果
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// 将当前行的值按列的顺序写入 dest
+func (rows *Rows) Scan(dest ...interface{}) error {
+	if rows.closed {
+		return ErrRowsClosed
+	}
+	if rows.pos == 0 {
+		return ErrNoRow
+	}
+	// 行末尾是隐藏的 xmin 和 xmax
+	values := rows.batch[rows.pos-1].Data
+	if len(dest) != len(rows.columns) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(rows.columns), len(dest))
+	}
+	for i := range dest {
+		if err := scanValue(dest[i], values[i]); err != nil {
+			return fmt.Errorf("scan column %s: %w", rows.columns[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func scanValue(dest interface{}, value ast.SQLExprValue) error {
+	switch value := value.(type) {
+	case *ast.SQLInt:
+		switch dest := dest.(type) {
+		case *int64:
+			*dest = int64(*value)
+		case *int:
+			*dest = int(*value)
+		case *float64:
+			*dest = float64(*value)
+		case *interface{}:
+			*dest = int64(*value)
+		default:
+			return fmt.Errorf("cannot scan INT into %T", dest)
+		}
+	case *ast.SQLFloat:
+		switch dest := dest.(type) {
+		case *float64:
+			*dest = float64(*value)
+		case *interface{}:
+			*dest = float64(*value)
+		default:
+			return fmt.Errorf("cannot scan FLOAT into %T", dest)
+		}
+	case *ast.SQLText:
+		switch dest := dest.(type) {
+		case *string:
+			*dest = string(*value)
+		case *interface{}:
+			*dest = string(*value)
+		default:
+			return fmt.Errorf("cannot scan TEXT into %T", dest)
+		}
+	default:
+		return fmt.Errorf("unexpected value %v", value)
+	}
+	return nil
+}
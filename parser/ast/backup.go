@@ -0,0 +1,10 @@
+package ast
+
+// Dir 为备份的目标目录
+type BackupStmt struct {
+	Dir string
+}
+
+func (stmt BackupStmt) StatementType() string {
+	return "Backup"
+}
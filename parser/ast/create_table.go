@@ -18,6 +18,18 @@ type ColumnDefine struct {
 	Index index.Index
 }
 
+func (columnType ColumnType) String() string {
+	switch columnType {
+	case CT_INT:
+		return "INT"
+	case CT_FLOAT:
+		return "FLOAT"
+	case CT_TEXT:
+		return "TEXT"
+	}
+	return "UNKNOWN"
+}
+
 func (columnDeine *ColumnDefine) SetColumnType(str string) {
 	var columnType ColumnType = CT_INT
 	switch str {
@@ -34,6 +46,8 @@ func (columnDeine *ColumnDefine) SetColumnType(str string) {
 type CreateTableStmt struct {
 	TableName     string
 	ColumnDefines []*ColumnDefine
+	// 数据页和索引页在写入磁盘时压缩
+	Compressed bool
 }
 
 func (statement CreateTableStmt) StatementType() string {
@@ -0,0 +1,30 @@
+package ast
+
+// DECLARE name CURSOR FOR select，只能在事务中使用，事务结束时关闭
+type DeclareCursorStmt struct {
+	Name   string
+	Select SelectStmt
+}
+
+func (stmt DeclareCursorStmt) StatementType() string {
+	return "declare cursor"
+}
+
+// FETCH [count | NEXT | ALL] [FROM | IN] name，Count 为 0 时读取剩余的全部行
+type FetchStmt struct {
+	Name  string
+	Count int
+}
+
+func (stmt FetchStmt) StatementType() string {
+	return "fetch"
+}
+
+// CLOSE name
+type CloseCursorStmt struct {
+	Name string
+}
+
+func (stmt CloseCursorStmt) StatementType() string {
+	return "close cursor"
+}
@@ -7,6 +7,7 @@ import (
 	"math"
 	"minidb-go/parser/token"
 	"minidb-go/util"
+	"strconv"
 )
 
 type SQLValueType uint8
@@ -16,6 +17,7 @@ const (
 	SQL_FLOAT
 	SQL_TEXT
 	SQL_COLUMN
+	SQL_PARAM
 )
 
 type SQLInt int64
@@ -112,7 +114,15 @@ func (sqlInt *SQLInt) String() string {
 }
 
 func (sqlFloat *SQLFloat) String() string {
-	return fmt.Sprintf("%f", *sqlFloat)
+	return FormatFloat(float64(*sqlFloat))
+}
+
+// 使用能够精确还原的最短表示，绝对值在 [1e-6, 1e21) 之外时使用科学计数法
+func FormatFloat(v float64) string {
+	if abs := math.Abs(v); abs == 0 || (abs >= 1e-6 && abs < 1e21) {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
 }
 
 func (sqlText *SQLText) String() string {
@@ -183,6 +193,10 @@ func decodeExprValue(r io.Reader) (SQLExprValue, error) {
 		var sqlColumn SQLColumn
 		sqlColumn.Decode(r)
 		return &sqlColumn, nil
+	case SQL_PARAM:
+		var sqlParam SQLParam
+		sqlParam.Decode(r)
+		return &sqlParam, nil
 	default:
 		return nil, fmt.Errorf("unknown value type: %d", valueType)
 	}
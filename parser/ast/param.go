@@ -0,0 +1,120 @@
+package ast
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrUnboundParam = errors.New("statement has unbound parameters")
+
+// 预处理语句中的参数 $n，n 从 1 开始，执行前需要通过 BindParams 替换为具体的值
+type SQLParam uint16
+
+func (sqlParam *SQLParam) ValueType() SQLValueType {
+	return SQL_PARAM
+}
+
+func (sqlParam *SQLParam) Raw() []byte {
+	raw := make([]byte, 2)
+	binary.BigEndian.PutUint16(raw, uint16(*sqlParam))
+	return raw
+}
+
+func (sqlParam *SQLParam) Encode(w io.Writer) {
+	binary.Write(w, binary.BigEndian, SQL_PARAM)
+	binary.Write(w, binary.BigEndian, sqlParam)
+}
+
+func (sqlParam *SQLParam) Decode(r io.Reader) {
+	binary.Read(r, binary.BigEndian, sqlParam)
+}
+
+func (sqlParam *SQLParam) String() string {
+	return fmt.Sprintf("$%d", *sqlParam)
+}
+
+func (sqlParam *SQLParam) DeepCopy() SQLExprValue {
+	val := SQLParam(*sqlParam)
+	return &val
+}
+
+// 语句中参数的个数，即最大的 $n
+func NumParams(stmt SQLStatement) int {
+	n := 0
+	mapValues(stmt, func(value SQLExprValue) (SQLExprValue, error) {
+		if param, ok := value.(*SQLParam); ok && int(*param) > n {
+			n = int(*param)
+		}
+		return value, nil
+	})
+	return n
+}
+
+// 返回将参数 $n 替换为 params[n-1] 的语句，原来的语句不变
+func BindParams(stmt SQLStatement, params []SQLExprValue) (SQLStatement, error) {
+	return mapValues(stmt, func(value SQLExprValue) (SQLExprValue, error) {
+		param, ok := value.(*SQLParam)
+		if !ok {
+			return value, nil
+		}
+		if int(*param) > len(params) {
+			return nil, fmt.Errorf("%w: %v", ErrUnboundParam, param)
+		}
+		return params[*param-1], nil
+	})
+}
+
+// 对语句中的每个值调用 f，返回替换后的语句副本
+func mapValues(stmt SQLStatement, f func(SQLExprValue) (SQLExprValue, error)) (SQLStatement, error) {
+	mapWhere := func(where WhereStatement) (WhereStatement, error) {
+		if !where.IsExists || where.Expr == nil {
+			return where, nil
+		}
+		expr := *where.Expr
+		var err error
+		if expr.Left, err = f(expr.Left); err != nil {
+			return where, err
+		}
+		if expr.Right, err = f(expr.Right); err != nil {
+			return where, err
+		}
+		where.Expr = &expr
+		return where, nil
+	}
+
+	var err error
+	switch stmt := stmt.(type) {
+	case InsertIntoStmt:
+		row := make([]SQLExprValue, len(stmt.Row))
+		for i, value := range stmt.Row {
+			if row[i], err = f(value); err != nil {
+				return nil, err
+			}
+		}
+		stmt.Row = row
+		return stmt, nil
+	case UpdateStmt:
+		assigns := make([]ColumnAssign, len(stmt.ColumnAssignList))
+		for i, assign := range stmt.ColumnAssignList {
+			assigns[i] = assign
+			if assigns[i].Value, err = f(assign.Value); err != nil {
+				return nil, err
+			}
+		}
+		stmt.ColumnAssignList = assigns
+		stmt.Where, err = mapWhere(stmt.Where)
+		return stmt, err
+	case DeleteStatement:
+		stmt.Where, err = mapWhere(stmt.Where)
+		return stmt, err
+	case SelectStmt:
+		stmt.Where, err = mapWhere(stmt.Where)
+		return stmt, err
+	case DeclareCursorStmt:
+		stmt.Select.Where, err = mapWhere(stmt.Select.Where)
+		return stmt, err
+	}
+	return stmt, nil
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"minidb-go/serialization/tm"
+	"strings"
 )
 
 type Row struct {
@@ -36,12 +36,13 @@ func (row *Row) DeepCopyData() []SQLExprValue {
 	return data
 }
 
+// 包含末尾的 xmin 和 xmax，用于调试
 func (row *Row) String() string {
-	line := ""
-	for i := 0; i < len(row.Data)-2; i++ {
-		line += fmt.Sprintf("%s\t", row.Data[i])
+	values := make([]string, len(row.Data))
+	for i, value := range row.Data {
+		values[i] = value.String()
 	}
-	return line
+	return "(" + strings.Join(values, ", ") + ")"
 }
 
 func (row *Row) Encode() []byte {
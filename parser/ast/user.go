@@ -0,0 +1,79 @@
+package ast
+
+import "strings"
+
+// 表的权限，可以按位组合
+type Privilege uint8
+
+const (
+	PRIV_SELECT Privilege = 1 << iota
+	PRIV_INSERT
+	PRIV_UPDATE
+	PRIV_DELETE
+	PRIV_CREATE
+
+	PRIV_ALL = PRIV_SELECT | PRIV_INSERT | PRIV_UPDATE | PRIV_DELETE | PRIV_CREATE
+)
+
+var privilegeNames = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "CREATE"}
+
+func (privilege Privilege) String() string {
+	names := make([]string, 0, len(privilegeNames))
+	for i, name := range privilegeNames {
+		if privilege&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// CREATE USER name [WITH] PASSWORD 'password'
+type CreateUserStmt struct {
+	Name     string
+	Password string
+}
+
+func (stmt CreateUserStmt) StatementType() string {
+	return "create user"
+}
+
+// ALTER USER name [WITH] PASSWORD 'password'
+type AlterUserStmt struct {
+	Name     string
+	Password string
+}
+
+func (stmt AlterUserStmt) StatementType() string {
+	return "alter user"
+}
+
+// DROP USER name
+type DropUserStmt struct {
+	Name string
+}
+
+func (stmt DropUserStmt) StatementType() string {
+	return "drop user"
+}
+
+// GRANT privileges ON table|ALL TO user，Table 为空时表示所有的表，包括之后创建的表
+type GrantStmt struct {
+	Privileges Privilege
+	Table      string
+	User       string
+}
+
+func (stmt GrantStmt) StatementType() string {
+	return "grant"
+}
+
+// REVOKE privileges ON table|ALL FROM user，只撤销以同样的方式授予的权限
+type RevokeStmt struct {
+	Privileges Privilege
+	Table      string
+	User       string
+}
+
+func (stmt RevokeStmt) StatementType() string {
+	return "revoke"
+}
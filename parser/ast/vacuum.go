@@ -0,0 +1,10 @@
+package ast
+
+// TableName 为空时表示清理所有表
+type VacuumStmt struct {
+	TableName string
+}
+
+func (stmt VacuumStmt) StatementType() string {
+	return "Vacuum"
+}
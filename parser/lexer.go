@@ -29,7 +29,7 @@ func (lexer *Lexer) reset(savePoint savePoint) {
 
 func NewLexer(_sql string) (lexer *Lexer, err error) {
 	lexer = &Lexer{
-		sql:           strings.ToLower(_sql),
+		sql:           lowerOutsideStrings(_sql),
 		tokenPos:      0,
 		tokenSequence: make([]token.Token, 0, 16),
 	}
@@ -49,6 +49,15 @@ func NewLexer(_sql string) (lexer *Lexer, err error) {
 	return lexer, nil
 }
 
+// 关键字和标识符不区分大小写，字符串中的内容保持不变，例如备份的路径
+func lowerOutsideStrings(sql string) string {
+	parts := strings.Split(sql, "'")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = strings.ToLower(parts[i])
+	}
+	return strings.Join(parts, "'")
+}
+
 func (lexer *Lexer) GetNextToken() (resToken token.Token) {
 	if lexer.tokenPos < len(lexer.tokenSequence) {
 		resToken = lexer.tokenSequence[lexer.tokenPos]
@@ -134,6 +143,18 @@ var keywordTokenType = map[string]token.TokenType{
 	"begin":    token.TT_BEGIN,
 	"commit":   token.TT_COMMIT,
 	"rollback": token.TT_ROLLBACK,
+	"vacuum":   token.TT_VACUUM,
+	"backup":   token.TT_BACKUP,
+	"to":       token.TT_TO,
+	"declare":  token.TT_DECLARE,
+	"cursor":   token.TT_CURSOR,
+	"for":      token.TT_FOR,
+	"fetch":    token.TT_FETCH,
+	"close":    token.TT_CLOSE,
+	"alter":    token.TT_ALTER,
+	"grant":    token.TT_GRANT,
+	"revoke":   token.TT_REVOKE,
+	"on":       token.TT_ON,
 }
 
 func (lexer *Lexer) scanLiteralToken(pos int) (resToken token.Token, err error) {
@@ -197,6 +218,19 @@ func (lexer *Lexer) scanStringToken(pos int) (resToken token.Token, err error) {
 	return resToken, nil
 }
 
+// 预处理语句的参数 $1、$2 ...
+func (lexer *Lexer) scanParamToken(pos int) (resToken token.Token, err error) {
+	tokenLen := 1
+	for pos+tokenLen < len(lexer.sql) && unicode.IsDigit(rune(lexer.sql[pos+tokenLen])) {
+		tokenLen++
+	}
+	word := lexer.sql[pos : pos+tokenLen]
+	if tokenLen == 1 {
+		return token.Token{Type: token.TT_ILLEGAL, Val: word}, fmt.Errorf("expected a parameter number after '$'")
+	}
+	return token.Token{Type: token.TT_PARAM, Val: word}, nil
+}
+
 func (lexer *Lexer) scanToken(pos int) (resToken token.Token, chNum int, err error) {
 	if pos >= len(lexer.sql) {
 		return token.Token{Type: token.TT_END, Val: ""}, chNum, nil
@@ -215,6 +249,8 @@ func (lexer *Lexer) scanToken(pos int) (resToken token.Token, chNum int, err err
 	case ch == '\'':
 		resToken, err = lexer.scanStringToken(pos)
 		chNum += 2
+	case ch == '$':
+		resToken, err = lexer.scanParamToken(pos)
 	default:
 		resToken, err = lexer.scanSymbolToken(pos)
 	}
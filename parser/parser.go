@@ -68,6 +68,58 @@ func (parser *Parser) ParseStatement() (ast.SQLStatement, error) {
 		return parser.ParseDeleteStatement()
 	}
 
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_VACUUM) {
+		return parser.ParseVacuumStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_BACKUP, token.TT_TO) {
+		return parser.ParseBackupStatement()
+	}
+
+	// user 和 password 不是关键字，可以作为表名和列名
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_CREATE) && parser.matchWord("user") {
+		return parser.ParseCreateUserStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_ALTER) && parser.matchWord("user") {
+		return parser.ParseAlterUserStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_DROP) && parser.matchWord("user") {
+		return parser.ParseDropUserStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_GRANT) {
+		return parser.ParseGrantStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_REVOKE) {
+		return parser.ParseRevokeStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_DECLARE) {
+		return parser.ParseDeclareCursorStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_FETCH) {
+		return parser.ParseFetchStatement()
+	}
+
+	parser.lexer.reset(savePoint)
+	if parser.chain(token.TT_CLOSE) {
+		return parser.ParseCloseCursorStatement()
+	}
+
+	parser.lexer.reset(savePoint)
 	if parser.chain(token.TT_SELECT) {
 		return parser.ParseSelectStatement()
 	}
@@ -110,8 +162,18 @@ func (parser *Parser) ParseCreateTableStatement() (ast.CreateTableStmt, error) {
 		log.Error(err.Error())
 		return statement, err
 	}
-	if !parser.chain(token.TT_RBRACKET, token.TT_SEMICOLON) {
-		err = fmt.Errorf("expected ')' or ';'")
+	if !parser.match(token.TT_RBRACKET) {
+		err = fmt.Errorf("expected ')'")
+		log.Error(err.Error())
+		return statement, err
+	}
+	// 可选的表选项：compressed
+	if t := parser.lexer.GetCurrentToken(); t.Type == token.TT_IDENTIFIER && t.Val == "compressed" {
+		parser.lexer.GetNextToken()
+		statement.Compressed = true
+	}
+	if !parser.match(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
 		log.Error(err.Error())
 	}
 	return statement, err
@@ -292,6 +354,272 @@ func (parser *Parser) ParseDeleteStatement() (ast.DeleteStatement, error) {
 	return stmt, err
 }
 
+// VACUUM [table];
+func (parser *Parser) ParseVacuumStatement() (ast.VacuumStmt, error) {
+	stmt := ast.VacuumStmt{}
+	if t := parser.lexer.GetCurrentToken(); parser.match(token.TT_IDENTIFIER) {
+		stmt.TableName = t.Val
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err := fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// BACKUP TO 'dir';
+func (parser *Parser) ParseBackupStatement() (ast.BackupStmt, error) {
+	stmt := ast.BackupStmt{}
+	if t := parser.lexer.GetCurrentToken(); parser.match(token.TT_STRING) {
+		stmt.Dir = t.Val
+	} else {
+		err := fmt.Errorf("expected backup directory, found '%v'", t.Val)
+		log.Error(err.Error())
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err := fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// DECLARE name CURSOR FOR SELECT ...;
+func (parser *Parser) ParseDeclareCursorStatement() (ast.DeclareCursorStmt, error) {
+	stmt := ast.DeclareCursorStmt{}
+	var err error
+	stmt.Name, err = parser.parseCursorName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_CURSOR, token.TT_FOR, token.TT_SELECT) {
+		err = fmt.Errorf("expected 'cursor for select'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	stmt.Select, err = parser.ParseSelectStatement()
+	return stmt, err
+}
+
+// FETCH [count | NEXT | ALL] [FROM | IN] name;
+func (parser *Parser) ParseFetchStatement() (ast.FetchStmt, error) {
+	stmt := ast.FetchStmt{Count: 1}
+	var err error
+	t := parser.lexer.GetCurrentToken()
+	switch {
+	case parser.match(token.TT_INTEGER):
+		count, err := strconv.Atoi(t.Val)
+		if err != nil || count <= 0 {
+			err = fmt.Errorf("invalid fetch count %v", t.Val)
+			log.Error(err.Error())
+			return stmt, err
+		}
+		stmt.Count = count
+	case parser.match(token.TT_ALL):
+		stmt.Count = 0
+	case t.Type == token.TT_IDENTIFIER && t.Val == "next":
+		parser.lexer.GetNextToken()
+	}
+	parser.tree(token.TT_FROM, token.TT_IN)
+	stmt.Name, err = parser.parseCursorName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// CLOSE name;
+func (parser *Parser) ParseCloseCursorStatement() (ast.CloseCursorStmt, error) {
+	stmt := ast.CloseCursorStmt{}
+	var err error
+	stmt.Name, err = parser.parseCursorName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// CREATE USER name [WITH] PASSWORD 'password';
+func (parser *Parser) ParseCreateUserStatement() (ast.CreateUserStmt, error) {
+	stmt := ast.CreateUserStmt{}
+	var err error
+	stmt.Name, stmt.Password, err = parser.parseUserPassword()
+	return stmt, err
+}
+
+// ALTER USER name [WITH] PASSWORD 'password';
+func (parser *Parser) ParseAlterUserStatement() (ast.AlterUserStmt, error) {
+	stmt := ast.AlterUserStmt{}
+	var err error
+	stmt.Name, stmt.Password, err = parser.parseUserPassword()
+	return stmt, err
+}
+
+func (parser *Parser) parseUserPassword() (name string, password string, err error) {
+	name, err = parser.parseUserName()
+	if err != nil {
+		return
+	}
+	parser.matchWord("with")
+	if !parser.matchWord("password") {
+		err = fmt.Errorf("expected 'password', found '%v'", parser.lexer.GetCurrentToken().Val)
+		log.Error(err.Error())
+		return
+	}
+	if t := parser.lexer.GetCurrentToken(); parser.match(token.TT_STRING) {
+		password = t.Val
+	} else {
+		err = fmt.Errorf("expected a password string, found '%v'", t.Val)
+		log.Error(err.Error())
+		return
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+	}
+	return
+}
+
+// DROP USER name;
+func (parser *Parser) ParseDropUserStatement() (ast.DropUserStmt, error) {
+	stmt := ast.DropUserStmt{}
+	var err error
+	stmt.Name, err = parser.parseUserName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// GRANT privileges ON table|ALL TO user;
+func (parser *Parser) ParseGrantStatement() (ast.GrantStmt, error) {
+	stmt := ast.GrantStmt{}
+	var err error
+	stmt.Privileges, stmt.Table, err = parser.parsePrivileges()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.match(token.TT_TO) {
+		err = fmt.Errorf("expected 'to', found '%v'", parser.lexer.GetCurrentToken().Val)
+		log.Error(err.Error())
+		return stmt, err
+	}
+	stmt.User, err = parser.parseUserName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// REVOKE privileges ON table|ALL FROM|TO user;
+func (parser *Parser) ParseRevokeStatement() (ast.RevokeStmt, error) {
+	stmt := ast.RevokeStmt{}
+	var err error
+	stmt.Privileges, stmt.Table, err = parser.parsePrivileges()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.tree(token.TT_FROM, token.TT_TO) {
+		err = fmt.Errorf("expected 'from', found '%v'", parser.lexer.GetCurrentToken().Val)
+		log.Error(err.Error())
+		return stmt, err
+	}
+	stmt.User, err = parser.parseUserName()
+	if err != nil {
+		return stmt, err
+	}
+	if !parser.chain(token.TT_SEMICOLON) {
+		err = fmt.Errorf("expected ';'")
+		log.Error(err.Error())
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// SELECT, INSERT ... | ALL [PRIVILEGES]，之后是 ON [TABLE] table|ALL
+func (parser *Parser) parsePrivileges() (privileges ast.Privilege, table string, err error) {
+	if parser.match(token.TT_ALL) {
+		parser.matchWord("privileges")
+		privileges = ast.PRIV_ALL
+	} else {
+		for {
+			t := parser.lexer.GetNextToken()
+			switch t.Type {
+			case token.TT_SELECT:
+				privileges |= ast.PRIV_SELECT
+			case token.TT_INSERT:
+				privileges |= ast.PRIV_INSERT
+			case token.TT_UPDATE:
+				privileges |= ast.PRIV_UPDATE
+			case token.TT_DELETE:
+				privileges |= ast.PRIV_DELETE
+			case token.TT_CREATE:
+				privileges |= ast.PRIV_CREATE
+			default:
+				err = fmt.Errorf("expected a privilege, found '%v'", t.Val)
+				log.Error(err.Error())
+				return
+			}
+			if !parser.match(token.TT_COMMA) {
+				break
+			}
+		}
+	}
+	if !parser.match(token.TT_ON) {
+		err = fmt.Errorf("expected 'on', found '%v'", parser.lexer.GetCurrentToken().Val)
+		log.Error(err.Error())
+		return
+	}
+	if parser.match(token.TT_ALL) {
+		return
+	}
+	parser.match(token.TT_TABLE)
+	table, err = parser.parseTableName()
+	return
+}
+
+func (parser *Parser) parseUserName() (string, error) {
+	if t := parser.lexer.GetCurrentToken(); parser.match(token.TT_IDENTIFIER) {
+		return t.Val, nil
+	} else {
+		err := fmt.Errorf("expected a user name, found '%v'", t.Val)
+		log.Error(err.Error())
+		return "", err
+	}
+}
+
+func (parser *Parser) parseCursorName() (string, error) {
+	if t := parser.lexer.GetCurrentToken(); parser.match(token.TT_IDENTIFIER) {
+		return t.Val, nil
+	} else {
+		err := fmt.Errorf("expected a cursor name, found '%v'", t.Val)
+		log.Error(err.Error())
+		return "", err
+	}
+}
+
 func (parser *Parser) parseColumnAssign() (ast.ColumnAssign, error) {
 	columnAssign := ast.ColumnAssign{}
 	var err error
@@ -392,6 +720,16 @@ func (parser *Parser) parseLiteralValue() (
 	case token.TT_STRING:
 		val := ast.SQLText(t.Val)
 		value = &val
+	case token.TT_PARAM:
+		var n uint64
+		n, err = strconv.ParseUint(t.Val[1:], 10, 16)
+		if err != nil || n == 0 {
+			err = fmt.Errorf("invalid parameter %v", t.Val)
+			log.Error(err.Error())
+			return
+		}
+		val := ast.SQLParam(n)
+		value = &val
 	case token.TT_PLUS:
 		t = parser.lexer.GetNextToken()
 		value, err = parser.parseNumericValue(1, t)
@@ -447,6 +785,15 @@ func (parser *Parser) match(tokenType token.TokenType) bool {
 	}
 }
 
+// 匹配一个不是关键字的单词，例如 user、password
+func (parser *Parser) matchWord(word string) bool {
+	if t := parser.lexer.GetCurrentToken(); t.Type == token.TT_IDENTIFIER && t.Val == word {
+		parser.lexer.GetNextToken()
+		return true
+	}
+	return false
+}
+
 func (parser *Parser) chain(tokenTypeList ...token.TokenType) bool {
 	savePoint := parser.lexer.mark()
 	for _, tokenType := range tokenTypeList {
@@ -57,6 +57,23 @@ const (
 	TT_BEGIN
 	TT_COMMIT
 	TT_ROLLBACK
+
+	TT_VACUUM
+	TT_BACKUP
+	TT_TO
+
+	TT_PARAM // $1
+
+	TT_DECLARE
+	TT_CURSOR
+	TT_FOR
+	TT_FETCH
+	TT_CLOSE
+
+	TT_ALTER
+	TT_GRANT
+	TT_REVOKE
+	TT_ON
 )
 
 type Token struct {
@@ -172,6 +189,36 @@ func (tokenType TokenType) String() string {
 		return "COMMIT"
 	case TT_ROLLBACK:
 		return "ROLLBACK"
+
+	case TT_VACUUM:
+		return "VACUUM"
+	case TT_BACKUP:
+		return "BACKUP"
+	case TT_TO:
+		return "TO"
+
+	case TT_PARAM:
+		return "PARAM"
+
+	case TT_DECLARE:
+		return "DECLARE"
+	case TT_CURSOR:
+		return "CURSOR"
+	case TT_FOR:
+		return "FOR"
+	case TT_FETCH:
+		return "FETCH"
+	case TT_CLOSE:
+		return "CLOSE"
+
+	case TT_ALTER:
+		return "ALTER"
+	case TT_GRANT:
+		return "GRANT"
+	case TT_REVOKE:
+		return "REVOKE"
+	case TT_ON:
+		return "ON"
 	}
 	return "UNKNOWN"
 }
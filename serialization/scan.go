@@ -0,0 +1,61 @@
+package serialization
+
+import (
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage"
+)
+
+// 按需读取查询结果，只返回对事务可见的行，不会把全部结果放在内存中
+type RowIterator struct {
+	scan               *storage.RowScan
+	transaction        *Transaction
+	transactionManager *tm.TransactionManager
+	done               bool
+}
+
+// 开始读取 xid 可见的行，读取结束或者不再读取时需要调用 Close
+func (s *Serializer) Scan(xid tm.XID, selectStmt ast.SelectStmt) (*RowIterator, error) {
+	s.lock.RLock()
+	transaction, ok := s.activeTransaction[xid]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, ErrXidNotExists
+	}
+
+	scan, err := s.dataManager.SelectData(selectStmt)
+	if err != nil {
+		scan.Close()
+		return nil, err
+	}
+	return &RowIterator{
+		scan:               scan,
+		transaction:        transaction,
+		transactionManager: s.transactionManager,
+	}, nil
+}
+
+// 返回下一个可见的行，没有更多的行时返回 nil。数据页损坏时返回 pager.ErrPageCorrupted
+func (it *RowIterator) Next() (*ast.Row, error) {
+	if it.done {
+		return nil, nil
+	}
+	for row := range it.scan.Rows() {
+		visible, err := isVisible(row, it.transaction, it.transactionManager)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		if visible {
+			return row, nil
+		}
+	}
+	it.done = true
+	return nil, it.scan.Err()
+}
+
+// 提前结束读取，之后 Next 不再返回数据
+func (it *RowIterator) Close() {
+	it.done = true
+	it.scan.Close()
+}
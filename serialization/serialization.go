@@ -2,16 +2,21 @@ package serialization
 
 import (
 	"errors"
+	"fmt"
 	"minidb-go/parser/ast"
 	"minidb-go/serialization/tablelock"
 	"minidb-go/serialization/tm"
 	"minidb-go/storage"
 	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrXidNotExists = errors.New("transaction not exists")
 	ErrDeadLock     = errors.New("deadlock detected, abort transaction")
+	// 要删除的行已经被之后提交的事务删除，继续执行会覆盖其他事务的修改
+	ErrSerialization = errors.New("could not serialize access due to concurrent update, abort transaction")
 )
 
 // 使所有事务之间满足可重复读，使用 MVCC 实现
@@ -25,26 +30,82 @@ type Serializer struct {
 	lock      sync.RWMutex
 }
 
-func Open(path string, dataManager *storage.DataManager) *Serializer {
-	transactionManager := tm.Open(path)
+// 回滚异常退出时未提交的事务
+func Open(path string, dataManager *storage.DataManager) (*Serializer, error) {
+	transactionManager, err := tm.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	serializer := &Serializer{
 		transactionManager: transactionManager,
 		dataManager:        dataManager,
 		activeTransaction:  make(map[tm.XID]*Transaction),
 		tableLock:          tablelock.New(),
 	}
-	return serializer
+	dataManager.SetSyncXIDFile(transactionManager.Sync)
+	// checkpoint 之前分配过的 XID 不能再次分配，XID 文件中的计数器落后时补齐
+	if next := dataManager.CheckPointNextXID(); next > transactionManager.NextXID() {
+		log.Warnf("xid file is behind the last checkpoint, advance to %d", next-1)
+		transactionManager.Advance(next - 1)
+	}
+	// 开始和提交事务时 XID 文件不落盘，异常退出后日志中可能有 XID 文件中没有的事务，
+	// 提交日志已经落盘的事务在 XID 文件中可能仍处于活跃状态
+	for _, xid := range dataManager.CommittedTransactions() {
+		transactionManager.Advance(xid)
+		transactionManager.Commit(xid)
+	}
+	// 按 XID 从大到小排列
+	pending := dataManager.PendingTransactions()
+	if len(pending) > 0 {
+		transactionManager.Advance(pending[0])
+	}
+	for _, xid := range pending {
+		if !transactionManager.IsActive(xid) {
+			dataManager.DiscardUndo(xid)
+			continue
+		}
+		log.Infof("rollback transaction %d", xid)
+		if err := serializer.rollback(xid); err != nil {
+			return nil, err
+		}
+	}
+	// 没有需要撤销的日志的未结束事务也标记为已撤销，它们留下的行可以被 vacuum 清理
+	for _, xid := range transactionManager.ActiveXIDs() {
+		transactionManager.Abort(xid)
+	}
+	if err := dataManager.CheckPoint(transactionManager.NextXID()); err != nil {
+		return nil, err
+	}
+	return serializer, nil
+}
+
+// 复制 XID 文件到 path 中，复制期间不能开始新的事务
+func (s *Serializer) BackupXIDFile(path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.transactionManager.CopyTo(path)
 }
 
-func Create(path string, dataManager *storage.DataManager) *Serializer {
-	transactionManager := tm.Create(path)
+func Create(path string, dataManager *storage.DataManager) (*Serializer, error) {
+	transactionManager, err := tm.Create(path)
+	if err != nil {
+		return nil, err
+	}
 	serializer := &Serializer{
 		transactionManager: transactionManager,
 		dataManager:        dataManager,
 		activeTransaction:  make(map[tm.XID]*Transaction),
 		tableLock:          tablelock.New(),
 	}
-	return serializer
+	dataManager.SetSyncXIDFile(transactionManager.Sync)
+	return serializer, nil
+}
+
+// 下一个将要分配的 XID
+func (s *Serializer) NextXID() tm.XID {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.transactionManager.NextXID()
 }
 
 func (s *Serializer) Begin() tm.XID {
@@ -57,59 +118,77 @@ func (s *Serializer) Begin() tm.XID {
 }
 
 func (s *Serializer) Commit(xid tm.XID) error {
-	s.lock.Lock()
-	if _, ok := s.activeTransaction[xid]; !ok {
-		s.lock.Unlock()
+	s.lock.RLock()
+	_, ok := s.activeTransaction[xid]
+	s.lock.RUnlock()
+	if !ok {
 		return ErrXidNotExists
 	}
+
+	// 提交之前事务的修改和提交日志需要先写入 redo log，
+	// 落盘失败时事务仍未结束，不能让其他事务看到它的修改
+	if err := s.dataManager.LogCommit(xid); err != nil {
+		return fmt.Errorf("commit transaction %d failed: %w", xid, err)
+	}
+	s.transactionManager.Commit(xid)
+	// 在 XID 文件中标记为已提交之后，才能让之后开始的事务看到它的修改，
+	// 等待数据行的锁的事务也要在此之后才能继续，否则会看到仍未提交的 xmax
+	s.lock.Lock()
 	delete(s.activeTransaction, xid)
 	s.lock.Unlock()
-
 	// 释放 xid 依赖的数据项
 	s.tableLock.Remove(xid)
-	s.transactionManager.Commit(xid)
+	s.dataManager.DiscardUndo(xid)
 	return nil
 }
 
 func (s *Serializer) Abort(xid tm.XID) error {
 	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	if _, ok := s.activeTransaction[xid]; !ok {
+		s.lock.Unlock()
 		return ErrXidNotExists
 	}
 	// 从 activeTransaction 中删除
 	delete(s.activeTransaction, xid)
+	s.lock.Unlock()
 
+	// 回滚需要读写页和落盘，不持有 s.lock，其他事务的开始和提交不需要等待。
+	// 回滚期间 XID 文件中事务仍未结束，其他事务看不到它的修改，数据项的锁阻止其他事务修改这些行。
+	// 回滚完成之后才能释放数据项，否则其他事务可能修改被回滚的行
+	err := s.rollback(xid)
 	// 释放 xid 对应的数据项
 	s.tableLock.Remove(xid)
+	return err
+}
+
+// 撤销事务对数据的修改，补偿日志写入磁盘后再将事务标记为已撤销，
+// 落盘失败时事务在 XID 文件中仍未结束，下次打开时按未结束的事务回滚
+func (s *Serializer) rollback(xid tm.XID) error {
+	s.dataManager.Rollback(xid)
+	if err := s.dataManager.FlushLog(); err != nil {
+		return fmt.Errorf("rollback transaction %d failed: %w", xid, err)
+	}
 	s.transactionManager.Abort(xid)
 	return nil
 }
 
 func (s *Serializer) Read(xid tm.XID, selectStmt ast.SelectStmt) ([]*ast.Row, error) {
-	s.lock.RLock()
-	transaction, ok := s.activeTransaction[xid]
-	s.lock.RUnlock()
-	if !ok {
-		return nil, ErrXidNotExists
-	}
-
-	rows_chan, err := s.dataManager.SelectData(selectStmt)
+	it, err := s.Scan(xid, selectStmt)
 	if err != nil {
 		return nil, err
 	}
+	defer it.Close()
 	rows := make([]*ast.Row, 0)
-	for row := range rows_chan {
-		visible, err := isVisible(row, transaction, s.transactionManager)
+	for {
+		row, err := it.Next()
 		if err != nil {
 			return nil, err
 		}
-		if visible {
-			rows = append(rows, row)
+		if row == nil {
+			return rows, nil
 		}
+		rows = append(rows, row)
 	}
-	return rows, nil
 }
 
 func (s *Serializer) Insert(xid tm.XID, insertStmt ast.InsertIntoStmt) ([]ast.SQLExprValue, error) {
@@ -120,7 +199,9 @@ func (s *Serializer) Insert(xid tm.XID, insertStmt ast.InsertIntoStmt) ([]ast.SQ
 		return nil, ErrXidNotExists
 	}
 	insertStmt.Row = wrapData(insertStmt.Row, xid)
-	s.dataManager.InsertData(insertStmt)
+	if err := s.dataManager.InsertData(insertStmt); err != nil {
+		return nil, err
+	}
 	return insertStmt.Row, nil
 }
 
@@ -134,7 +215,7 @@ func wrapData(row []ast.SQLExprValue, xid tm.XID) []ast.SQLExprValue {
 
 func (s *Serializer) Delete(xid tm.XID, deleteStmt ast.DeleteStatement) ([]*ast.Row, error) {
 	s.lock.RLock()
-	_, ok := s.activeTransaction[xid]
+	transaction, ok := s.activeTransaction[xid]
 	s.lock.RUnlock()
 	if !ok {
 		return nil, ErrXidNotExists
@@ -144,25 +225,55 @@ func (s *Serializer) Delete(xid tm.XID, deleteStmt ast.DeleteStatement) ([]*ast.
 		Where:        deleteStmt.Where,
 		ResultColumn: []string{"*"},
 	}
-	row_chan, err := s.dataManager.SelectData(selectStmt)
+	scan, err := s.dataManager.SelectData(selectStmt)
 	if err != nil {
 		return nil, err
 	}
+	// 提前返回时结束扫描，否则扫描的 goroutine 会一直阻塞
+	defer scan.Close()
 	rows := make([]*ast.Row, 0)
-	for row := range row_chan {
+	for row := range scan.Rows() {
+		// 只删除当前事务可见的行，已经失效的旧版本不能被重新标记
+		visible, err := isVisible(row, transaction, s.transactionManager)
+		if err != nil {
+			return nil, err
+		}
+		if !visible {
+			continue
+		}
 		ok, ch := s.tableLock.Add(xid, int64(row.Offset))
 		if !ok {
-			s.Abort(xid)
+			// 回滚可能需要修改扫描正在读取的索引，先结束扫描
+			scan.Close()
+			if err := s.Abort(xid); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrDeadLock, err)
+			}
 			return nil, ErrDeadLock
 		}
 		// 等待数据行的锁释放
 		if ch != nil {
 			<-ch
 		}
-		row.SetXmax(xid)
-		s.dataManager.PageFile().WriteAt(row.Encode(), int64(row.Offset))
+		// 行可能在扫描之后被其他事务删除并提交，持有锁之后重新读取 xmax
+		xmax, err := s.dataManager.Xmax(row)
+		if err != nil {
+			return nil, err
+		}
+		if xmax != tm.NIL_XID && xmax != xid && s.transactionManager.IsCommitted(xmax) {
+			scan.Close()
+			if err := s.Abort(xid); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrSerialization, err)
+			}
+			return nil, ErrSerialization
+		}
+		if err := s.dataManager.SetXmax(row, xid); err != nil {
+			return nil, err
+		}
 		rows = append(rows, row)
 	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
 	return rows, nil
 }
 
@@ -242,6 +353,66 @@ func isVisible(row *ast.Row, transaction *Transaction,
 	return false, nil
 }
 
+// 清理对所有事务都已不可见的行版本
+func (s *Serializer) Vacuum(tableName string) (*storage.VacuumStat, error) {
+	horizon := s.oldestXmin()
+	return s.dataManager.Vacuum(tableName, func(row *ast.Row) bool {
+		return isDead(row, horizon, s.transactionManager)
+	})
+}
+
+// 返回所有活跃事务及其 snapshot 中最小的 XID，
+// 小于该值的已提交事务对所有活跃事务和之后开始的事务都是可见的
+func (s *Serializer) oldestXmin() tm.XID {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	oldest := s.transactionManager.NextXID()
+	for xid, transaction := range s.activeTransaction {
+		if xid < oldest {
+			oldest = xid
+		}
+		for snapshotXid := range transaction.Snapshot() {
+			if snapshotXid < oldest {
+				oldest = snapshotXid
+			}
+		}
+	}
+	return oldest
+}
+
+// 满足以下任一条件的行版本对所有事务都不可见：
+// XMIN 已撤销，或者 XMAX 已提交且 XMAX < horizon
+func isDead(row *ast.Row, horizon tm.XID, transactionManager *tm.TransactionManager) bool {
+	xmin, err := row.Xmin()
+	if err != nil {
+		return false
+	}
+	if transactionManager.IsAborted(xmin) {
+		return true
+	}
+	xmax, err := row.Xmax()
+	if err != nil || xmax == tm.NIL_XID {
+		return false
+	}
+	return xmax < horizon && transactionManager.IsCommitted(xmax)
+}
+
+// 关闭时回滚所有未结束的事务
 func (s *Serializer) Close() {
+	s.lock.Lock()
+	for xid := range s.activeTransaction {
+		delete(s.activeTransaction, xid)
+		if err := s.rollback(xid); err != nil {
+			log.Error(err)
+		}
+		s.tableLock.Remove(xid)
+	}
+	s.lock.Unlock()
+	// 回滚未结束的事务之后记录最新的 XID，XID 文件关闭之后不能再进行 checkpoint
+	if err := s.dataManager.CheckPoint(s.NextXID()); err != nil {
+		log.Errorf("checkpoint on close failed: %v", err)
+	}
+	s.dataManager.SetSyncXIDFile(nil)
 	s.transactionManager.Close()
 }
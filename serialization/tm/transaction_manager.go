@@ -4,11 +4,16 @@ TRANS_ACTIVE		正在生效
 TRANS_COMMITED		已提交
 TRANS_ABORTED		已撤销
 事务的状态用 1 个字节存储
+开始和结束事务时不 fsync，已提交的事务以 redo log 中的提交日志为准，
+XID 文件在 checkpoint 和关闭时落盘，异常退出后由恢复过程根据日志补全。
 */
 package tm
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
+	"minidb-go/util/vfs"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -34,33 +39,34 @@ const NIL_XID XID = 1<<32 - 1
 // 事务管理器
 type TransactionManager struct {
 	// XID文件
-	file *os.File
+	file vfs.File
 	// 当前 XID 的最大值
 	xidCounter XID
 }
 
-func Create(path string) *TransactionManager {
+func Create(path string) (*TransactionManager, error) {
 	path = path + "/" + XID_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-	file.WriteAt(xidToBytes(0), 0)
-	file.Sync()
+	file, err := vfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
+	}
+	if _, err := file.WriteAt(xidToBytes(0), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write xid file %s failed: %w", path, err)
 	}
+	file.Sync()
 	tm := &TransactionManager{
 		file:       file,
 		xidCounter: 0,
 	}
-	return tm
+	return tm, nil
 }
 
-func Open(path string) *TransactionManager {
+func Open(path string) (*TransactionManager, error) {
 	path = path + "/" + XID_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	file, err := vfs.OpenFile(path, os.O_RDWR, 0600)
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
 	}
 	tm := &TransactionManager{
 		file: file,
@@ -68,19 +74,25 @@ func Open(path string) *TransactionManager {
 	counterBytes := make([]byte, 4)
 	n, err := file.ReadAt(counterBytes, 0)
 	if n != 4 {
-		log.Fatal("invalid xid file")
-	}
-	if err != nil {
-		log.Fatal(err)
+		file.Close()
+		return nil, fmt.Errorf("invalid xid file %s: %v", path, err)
 	}
 	tm.xidCounter = XID(binary.BigEndian.Uint32(counterBytes))
-	return tm
+	return tm, nil
 }
 
 func (tm *TransactionManager) Close() {
+	if err := tm.Sync(); err != nil {
+		log.Error(err)
+	}
 	tm.file.Close()
 }
 
+// 将 XID 计数器和事务的状态落盘
+func (tm *TransactionManager) Sync() error {
+	return tm.file.Sync()
+}
+
 func xidPosition(xid XID) (position uint32) {
 	position = uint32(xid) - 1 + XID_FILE_HEADER_SIZE
 	return
@@ -91,14 +103,10 @@ func (tm *TransactionManager) updateXID(xid XID, status byte) {
 	statusBytes := []byte{status}
 	n, err := tm.file.WriteAt(statusBytes, int64(offset))
 	if n != 1 {
-		log.Fatal("unknown xid file write error")
+		log.Panic("unknown xid file write error")
 	}
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = tm.file.Sync()
-	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 }
 
@@ -112,11 +120,7 @@ func (tm *TransactionManager) incXidCounter() {
 	tm.xidCounter++
 	_, err := tm.file.WriteAt(xidToBytes(tm.xidCounter), 0)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = tm.file.Sync()
-	if err != nil {
-		log.Fatal(err)
+		log.Panic(err)
 	}
 }
 
@@ -128,6 +132,11 @@ func (tm *TransactionManager) Begin() (xid XID) {
 	return
 }
 
+// 返回下一个将要分配的 XID
+func (tm *TransactionManager) NextXID() XID {
+	return tm.xidCounter + 1
+}
+
 // 提交一个事务
 func (tm *TransactionManager) Commit(xid XID) {
 	tm.updateXID(xid, TRANS_COMMITED)
@@ -162,3 +171,58 @@ func (tm *TransactionManager) IsAborted(xid XID) (res bool) {
 	res = tm.checkStatus(xid, TRANS_ABORTED)
 	return
 }
+
+// 返回所有仍处于活跃状态的事务，异常退出后这些事务都不会再提交
+func (tm *TransactionManager) ActiveXIDs() []XID {
+	statusBytes := make([]byte, tm.xidCounter)
+	_, err := tm.file.ReadAt(statusBytes, XID_FILE_HEADER_SIZE)
+	if err != nil && err != io.EOF {
+		log.Error(err)
+	}
+	xids := make([]XID, 0)
+	for i, status := range statusBytes {
+		if status == TRANS_ACTIVE {
+			xids = append(xids, XID(i)+1)
+		}
+	}
+	return xids
+}
+
+// 返回 XID 为 1 到当前最大值的事务的状态，第 i 项为 XID i+1 的状态
+func (tm *TransactionManager) Statuses() ([]byte, error) {
+	statusBytes := make([]byte, tm.xidCounter)
+	n, err := tm.file.ReadAt(statusBytes, XID_FILE_HEADER_SIZE)
+	if n < len(statusBytes) {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("xid file is truncated: %d of %d statuses", n, len(statusBytes))
+		}
+		return nil, err
+	}
+	return statusBytes, nil
+}
+
+// 将 XID 文件复制到 path 中，调用者需要保证复制期间不会开始新的事务
+func (tm *TransactionManager) CopyTo(path string) error {
+	raw := make([]byte, XID_FILE_HEADER_SIZE+int(tm.xidCounter))
+	if _, err := tm.file.ReadAt(raw, 0); err != nil {
+		return err
+	}
+	path = path + "/" + XID_FILE_NAME
+	file, err := vfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(raw, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// 保证 xid 已经被分配过，新分配的 XID 处于活跃状态。
+// 从备份恢复或者异常退出后，redo log 中可能有 XID 文件中还没有记录的事务
+func (tm *TransactionManager) Advance(xid XID) {
+	for tm.xidCounter < xid {
+		tm.Begin()
+	}
+}
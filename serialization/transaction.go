@@ -12,8 +12,8 @@ func newTransaction(xid tm.XID, activeTransaction map[tm.XID]*Transaction) *Tran
 		xid:      xid,
 		snapshot: make(map[tm.XID]struct{}),
 	}
-	for xid, transaction := range activeTransaction {
-		transaction.snapshot[xid] = struct{}{}
+	for activeXid := range activeTransaction {
+		transaction.snapshot[activeXid] = struct{}{}
 	}
 	return transaction
 }
@@ -2,78 +2,366 @@ package server
 
 import (
 	"errors"
-	"minidb-go/parser"
+	"fmt"
 	"minidb-go/parser/ast"
+	"minidb-go/serialization"
+	"minidb-go/serialization/tm"
 	"minidb-go/tbm"
-	"minidb-go/transporter"
 )
 
-func ExecuteStmt(tbm *tbm.TableManager, request *transporter.Request) *transporter.Response {
-	xid := request.Xid
-	response := &transporter.Response{
-		Xid: xid,
+// 在会话中执行一条语句，没有正在进行的事务时在单独的事务中执行
+func (session *Session) ExecuteStmt(stmt ast.SQLStatement) (*tbm.ResultList, error) {
+	// 预处理语句的参数需要先绑定
+	if ast.NumParams(stmt) > 0 {
+		return nil, ast.ErrUnboundParam
 	}
-	stmt, err := parser.Parse(request.Stmt)
-	if err != nil {
-		response.Err = err.Error()
-		return response
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.authorize(stmt); err != nil {
+		return nil, err
 	}
+
 	switch stmt := stmt.(type) {
 	case ast.CreateTableStmt:
-		err = tbm.CreateTable(xid, stmt)
+		return session.tbm.CreateTable(session.xid, stmt)
 	case ast.InsertIntoStmt:
-		if xid == 0 {
-			// 开启一个临时事务
-			xid = tbm.Begin()
+		return session.autocommit(func(xid tm.XID) (*tbm.ResultList, error) {
+			return session.tbm.Insert(xid, stmt)
+		})
+	case ast.DeleteStatement:
+		return session.autocommit(func(xid tm.XID) (*tbm.ResultList, error) {
+			return session.tbm.Delete(xid, stmt)
+		})
+	case ast.UpdateStmt:
+		return session.autocommit(func(xid tm.XID) (*tbm.ResultList, error) {
+			return session.tbm.Update(xid, stmt)
+		})
+	case ast.SelectStmt:
+		return session.autocommit(func(xid tm.XID) (*tbm.ResultList, error) {
+			return session.tbm.Select(xid, stmt)
+		})
+	case ast.DeclareCursorStmt:
+		if session.xid == 0 {
+			return nil, fmt.Errorf("%w: cursors can only be declared in a transaction", ErrNoTransaction)
 		}
-		response.ResultList, err = tbm.Insert(xid, stmt)
-		if xid != request.Xid {
-			// 结束临时事务
-			tbm.Commit(xid)
+		if _, ok := session.cursors[stmt.Name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrCursorExists, stmt.Name)
 		}
-	case ast.DeleteStatement:
-		if xid == 0 {
-			// 开启一个临时事务
-			xid = tbm.Begin()
+		cursor, err := session.tbm.OpenCursor(session.xid, stmt.Select)
+		if err != nil {
+			return nil, err
+		}
+		session.cursors[stmt.Name] = cursor
+		return nil, nil
+	case ast.FetchStmt:
+		cursor, ok := session.cursors[stmt.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrCursorNotExist, stmt.Name)
 		}
-		response.ResultList, err = tbm.Delete(xid, stmt)
-		if xid != request.Xid {
-			// 结束临时事务
-			tbm.Commit(xid)
+		return cursor.FetchResult(stmt.Count)
+	case ast.CloseCursorStmt:
+		cursor, ok := session.cursors[stmt.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrCursorNotExist, stmt.Name)
+		}
+		cursor.Close()
+		delete(session.cursors, stmt.Name)
+		return nil, nil
+	case ast.VacuumStmt:
+		return session.tbm.Vacuum(stmt)
+	case ast.BackupStmt:
+		return session.tbm.Backup(stmt.Dir)
+	case ast.CreateUserStmt:
+		return session.tbm.CreateUser(stmt)
+	case ast.AlterUserStmt:
+		return session.tbm.AlterUser(stmt)
+	case ast.DropUserStmt:
+		return session.tbm.DropUser(stmt)
+	case ast.GrantStmt:
+		return session.tbm.Grant(stmt)
+	case ast.RevokeStmt:
+		return session.tbm.Revoke(stmt)
+	case ast.BeginStmt:
+		if session.xid != 0 {
+			return nil, ErrInTransaction
 		}
+		session.xid = session.tbm.Begin()
+		return nil, nil
+	case ast.CommitStmt:
+		if session.xid == 0 {
+			return nil, ErrNoTransaction
+		}
+		session.endTransaction()
+		xid := session.xid
+		session.xid = 0
+		return nil, session.tbm.Commit(xid)
+	case ast.RollbackStmt:
+		if session.xid == 0 {
+			return nil, ErrNoTransaction
+		}
+		session.endTransaction()
+		xid := session.xid
+		session.xid = 0
+		return nil, session.tbm.Abort(xid)
+	}
+	return nil, errors.New("unsupported statement")
+}
+
+// 检查会话的用户能否执行语句。数据库中还没有用户时不检查，之后没有认证的会话不能执行任何语句，
+// 包括创建第一个用户之前建立的连接。读写表需要表的权限，VACUUM、BACKUP 和管理用户需要超级用户，
+// 普通用户只能修改自己的密码
+func (session *Session) authorize(stmt ast.SQLStatement) error {
+	if session.trusted || !session.tbm.HasUsers() {
+		return nil
+	}
+	if session.user == "" {
+		// 之前开启的事务仍然可以结束
+		switch stmt.(type) {
+		case ast.CommitStmt, ast.RollbackStmt, ast.CloseCursorStmt:
+			return nil
+		}
+		return fmt.Errorf("%w: authentication required", ErrPermissionDenied)
+	}
+	if session.tbm.IsSuperuser(session.user) {
+		return nil
+	}
+	var table string
+	var privilege ast.Privilege
+	switch stmt := stmt.(type) {
+	case ast.SelectStmt:
+		table, privilege = stmt.TableName, ast.PRIV_SELECT
+	case ast.DeclareCursorStmt:
+		table, privilege = stmt.Select.TableName, ast.PRIV_SELECT
+	case ast.InsertIntoStmt:
+		table, privilege = stmt.TableName, ast.PRIV_INSERT
 	case ast.UpdateStmt:
-		if xid == 0 {
-			// 开启一个临时事务
-			xid = tbm.Begin()
+		table, privilege = stmt.TableName, ast.PRIV_UPDATE
+	case ast.DeleteStatement:
+		table, privilege = stmt.TableName, ast.PRIV_DELETE
+	case ast.CreateTableStmt:
+		table, privilege = stmt.TableName, ast.PRIV_CREATE
+	case ast.AlterUserStmt:
+		if stmt.Name == session.user {
+			return nil
 		}
-		response.ResultList, err = tbm.Update(xid, stmt)
-		if xid != request.Xid {
-			// 结束临时事务
-			tbm.Commit(xid)
+		return fmt.Errorf("%w: only superusers can alter other users", ErrPermissionDenied)
+	// 游标在 DECLARE 时已经检查过权限
+	case ast.BeginStmt, ast.CommitStmt, ast.RollbackStmt, ast.FetchStmt, ast.CloseCursorStmt:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s requires superuser", ErrPermissionDenied, stmt.StatementType())
+	}
+	if !session.tbm.HasPrivilege(session.user, table, privilege) {
+		return fmt.Errorf("%w: %s on table %s", ErrPermissionDenied, privilege, table)
+	}
+	return nil
+}
+
+// 在会话的事务中执行 f，没有事务时开启一个临时事务，f 返回错误时回滚临时事务
+func (session *Session) autocommit(f func(xid tm.XID) (*tbm.ResultList, error)) (*tbm.ResultList, error) {
+	if session.xid != 0 {
+		resultList, err := f(session.xid)
+		// 检测到死锁或者无法串行化时事务已经被回滚
+		if errors.Is(err, serialization.ErrDeadLock) || errors.Is(err, serialization.ErrSerialization) {
+			session.endTransaction()
+			session.xid = 0
 		}
+		return resultList, err
+	}
+	xid := session.tbm.Begin()
+	resultList, err := f(xid)
+	if err != nil {
+		session.tbm.Abort(xid)
+		return nil, err
+	}
+	if err := session.tbm.Commit(xid); err != nil {
+		return nil, err
+	}
+	return resultList, nil
+}
+
+// 流式执行 SELECT 或者 FETCH，打开游标之后调用 columns，之后每读取最多 batchSize 行调用一次 rows，
+// 不在内存中保存全部结果。回调返回错误时停止读取并返回该错误，同时返回已经读取的行数
+func (session *Session) Stream(stmt ast.SQLStatement, batchSize int,
+	columns func(*tbm.Cursor) error, rows func([]*ast.Row) error) (int, error) {
+	if ast.NumParams(stmt) > 0 {
+		return 0, ast.ErrUnboundParam
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.authorize(stmt); err != nil {
+		return 0, err
+	}
+
+	switch stmt := stmt.(type) {
 	case ast.SelectStmt:
+		n := 0
+		_, err := session.autocommit(func(xid tm.XID) (*tbm.ResultList, error) {
+			cursor, err := session.tbm.OpenCursor(xid, stmt)
+			if err != nil {
+				return nil, err
+			}
+			defer cursor.Close()
+			if err := columns(cursor); err != nil {
+				return nil, err
+			}
+			n, err = fetchBatches(cursor, 0, batchSize, rows)
+			return nil, err
+		})
+		return n, err
+	case ast.FetchStmt:
+		cursor, ok := session.cursors[stmt.Name]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", ErrCursorNotExist, stmt.Name)
+		}
+		if err := columns(cursor); err != nil {
+			return 0, err
+		}
+		return fetchBatches(cursor, stmt.Count, batchSize, rows)
+	}
+	return 0, fmt.Errorf("%s does not return rows", stmt.StatementType())
+}
+
+/*
+Query 打开的 SELECT 或者 FETCH 的结果，Fetch 时才从游标中读取，不在内存中保存全部结果。
+在会话的事务中打开的结果在事务结束时关闭，没有事务时查询在单独的事务中执行，Close 时提交。
+*/
+type Rows struct {
+	Columns []tbm.Column
+
+	session *Session
+	cursor  *tbm.Cursor
+	// FETCH 从 DECLARE 的游标中读取，关闭时不关闭游标，最多读取 remaining 行
+	name      string
+	limited   bool
+	remaining int
+	// 为查询开启的事务，在会话的事务中执行时为 0
+	xid    tm.XID
+	closed bool
+}
+
+// 打开 SELECT 或者 FETCH 的结果，不再读取时需要调用 Close
+func (session *Session) Query(stmt ast.SQLStatement) (*Rows, error) {
+	if ast.NumParams(stmt) > 0 {
+		return nil, ast.ErrUnboundParam
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if err := session.authorize(stmt); err != nil {
+		return nil, err
+	}
+
+	rows := &Rows{session: session}
+	switch stmt := stmt.(type) {
+	case ast.SelectStmt:
+		xid := session.xid
 		if xid == 0 {
-			// 开启一个临时事务
-			xid = tbm.Begin()
+			xid = session.tbm.Begin()
+			rows.xid = xid
 		}
-		response.ResultList, err = tbm.Select(xid, stmt)
-		if xid != request.Xid {
-			// 结束临时事务
-			tbm.Commit(xid)
+		cursor, err := session.tbm.OpenCursor(xid, stmt)
+		if err != nil {
+			if rows.xid != 0 {
+				session.tbm.Abort(rows.xid)
+			}
+			return nil, err
 		}
-	case ast.BeginStmt:
-		response.Xid = tbm.Begin()
-	case ast.CommitStmt:
-		err = tbm.Commit(xid)
-		response.Xid = 0
-	case ast.RollbackStmt:
-		err = tbm.Abort(xid)
-		response.Xid = 0
+		rows.cursor = cursor
+	case ast.FetchStmt:
+		cursor, ok := session.cursors[stmt.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrCursorNotExist, stmt.Name)
+		}
+		rows.cursor = cursor
+		rows.name = stmt.Name
+		rows.limited = stmt.Count > 0
+		rows.remaining = stmt.Count
 	default:
-		err = errors.New("unsupported statement")
+		return nil, fmt.Errorf("%s does not return rows", stmt.StatementType())
+	}
+	rows.Columns = rows.cursor.Columns
+	session.rows[rows] = true
+	return rows, nil
+}
+
+// 读取最多 n 行，n 为 0 时读取剩余的全部行，读取完之后返回空的结果。出错时结果被关闭
+func (rows *Rows) Fetch(n int) ([]*ast.Row, error) {
+	session := rows.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if rows.closed {
+		return nil, ErrRowsClosed
 	}
+	// FETCH 的游标可能已经被 CLOSE
+	if rows.name != "" && session.cursors[rows.name] != rows.cursor {
+		session.closeRows(rows, false)
+		return nil, fmt.Errorf("%w: %s", ErrCursorNotExist, rows.name)
+	}
+	if rows.limited {
+		if rows.remaining == 0 {
+			return []*ast.Row{}, nil
+		}
+		if n == 0 || n > rows.remaining {
+			n = rows.remaining
+		}
+	}
+	batch, err := rows.cursor.Fetch(n)
 	if err != nil {
-		response.Err = err.Error()
+		session.closeRows(rows, false)
+		return nil, err
+	}
+	rows.remaining -= len(batch)
+	return batch, nil
+}
+
+// 关闭结果，提交为查询开启的事务
+func (rows *Rows) Close() error {
+	rows.session.lock.Lock()
+	defer rows.session.lock.Unlock()
+	return rows.session.closeRows(rows, true)
+}
+
+// 需要持有 session.lock，commit 为 false 时回滚为查询开启的事务
+func (session *Session) closeRows(rows *Rows, commit bool) error {
+	if rows.closed {
+		return nil
+	}
+	rows.closed = true
+	delete(session.rows, rows)
+	if rows.name == "" {
+		rows.cursor.Close()
+	}
+	if rows.xid == 0 {
+		return nil
+	}
+	if commit {
+		return session.tbm.Commit(rows.xid)
+	}
+	return session.tbm.Abort(rows.xid)
+}
+
+// 从游标中按批读取最多 count 行，count 为 0 时读取剩余的全部行
+func fetchBatches(cursor *tbm.Cursor, count int, batchSize int, rows func([]*ast.Row) error) (int, error) {
+	n := 0
+	for count == 0 || n < count {
+		size := batchSize
+		if count > 0 && count-n < size {
+			size = count - n
+		}
+		batch, err := cursor.Fetch(size)
+		if err != nil {
+			return n, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		n += len(batch)
+		if err := rows(batch); err != nil {
+			return n, err
+		}
+		if len(batch) < size {
+			break
+		}
 	}
-	return response
+	return n, nil
 }
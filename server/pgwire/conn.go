@@ -0,0 +1,207 @@
+/*
+PostgreSQL v3 前后端协议的服务端消息编解码，支持简单查询和扩展查询协议，
+消息格式参见 https://www.postgresql.org/docs/current/protocol-message-formats.html
+
+启动时客户端发送 StartupMessage，服务端回复 AuthenticationOk、ParameterStatus
+和 ReadyForQuery，不支持取消请求。之后每条消息由 1 字节的类型和 4 字节的长度开头，
+长度包含自身但不包含类型。
+*/
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// 协议版本 3.0
+	ProtocolVersion = 3 << 16
+
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	cancelRequestCode = 80877102
+
+	// 单个消息的最大长度
+	maxMessageSize = 1 << 26
+	// 输出缓冲超过该大小时写入连接
+	flushSize = 1 << 16
+)
+
+var (
+	ErrCancelRequest = errors.New("cancel request is not supported")
+	ErrMessageSize   = errors.New("message too large")
+)
+
+// 连接的事务状态，在 ReadyForQuery 中发送
+const (
+	TxIdle   byte = 'I'
+	TxActive byte = 'T'
+	TxFailed byte = 'E'
+)
+
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// 待发送的消息，start 为正在构造的消息的开头
+	buf   []byte
+	start int
+	err   error
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// 读取 StartupMessage 中的参数，拒绝 SSL 和 GSSAPI 加密请求
+func (conn *Conn) ReadStartup() (map[string]string, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size < 8 || size > maxMessageSize {
+			return nil, ErrMessageSize
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(conn.reader, body); err != nil {
+			return nil, err
+		}
+
+		switch code := binary.BigEndian.Uint32(header[4:]); code {
+		case sslRequestCode, gssEncRequestCode:
+			if _, err := conn.conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+		case cancelRequestCode:
+			return nil, ErrCancelRequest
+		case ProtocolVersion:
+			params := make(map[string]string)
+			r := &reader{data: body}
+			for {
+				name := r.string()
+				if name == "" || r.err != nil {
+					break
+				}
+				params[name] = r.string()
+			}
+			return params, r.err
+		default:
+			return nil, fmt.Errorf("unsupported protocol version %d.%d", code>>16, code&0xffff)
+		}
+	}
+}
+
+// 读取一个前端消息，不认识的消息类型返回 *Unknown
+func (conn *Conn) ReadMessage() (Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size < 4 || size > maxMessageSize {
+		return nil, ErrMessageSize
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(conn.reader, body); err != nil {
+		return nil, err
+	}
+	return decodeMessage(header[0], body)
+}
+
+// 将缓冲的消息写入连接
+func (conn *Conn) Flush() error {
+	if conn.err == nil && len(conn.buf) > 0 {
+		_, conn.err = conn.conn.Write(conn.buf)
+	}
+	conn.buf = conn.buf[:0]
+	return conn.err
+}
+
+func (conn *Conn) begin(typ byte) {
+	conn.start = len(conn.buf)
+	conn.buf = append(conn.buf, typ, 0, 0, 0, 0)
+}
+
+func (conn *Conn) end() {
+	binary.BigEndian.PutUint32(conn.buf[conn.start+1:], uint32(len(conn.buf)-conn.start-1))
+	if len(conn.buf) > flushSize {
+		conn.Flush()
+	}
+}
+
+func (conn *Conn) int16(v int16) {
+	conn.buf = append(conn.buf, byte(v>>8), byte(v))
+}
+
+func (conn *Conn) int32(v int32) {
+	conn.buf = append(conn.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (conn *Conn) string(s string) {
+	conn.buf = append(conn.buf, s...)
+	conn.buf = append(conn.buf, 0)
+}
+
+// 消息体的读取，数据不足时记录错误
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *reader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, b := range r.data {
+		if b == 0 {
+			s := string(r.data[:i])
+			r.data = r.data[i+1:]
+			return s
+		}
+	}
+	r.err = io.ErrUnexpectedEOF
+	return ""
+}
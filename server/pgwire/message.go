@@ -0,0 +1,288 @@
+package pgwire
+
+import (
+	"fmt"
+)
+
+// 前端消息
+type Message interface {
+	messageType() byte
+}
+
+// 简单查询，可以包含多条以分号分隔的语句
+type Query struct {
+	SQL string
+}
+
+// 创建预处理语句，ParamOIDs 中为 0 的参数由服务端推断类型
+type Parse struct {
+	Name      string
+	SQL       string
+	ParamOIDs []uint32
+}
+
+// 将参数绑定到预处理语句，创建 portal，参数为 nil 表示 NULL
+type Bind struct {
+	Portal        string
+	Statement     string
+	ParamFormats  []int16
+	Params        [][]byte
+	ResultFormats []int16
+}
+
+// Kind 为 'S' 时描述预处理语句，为 'P' 时描述 portal
+type Describe struct {
+	Kind byte
+	Name string
+}
+
+// 执行 portal，MaxRows 为 0 时返回所有行
+type Execute struct {
+	Portal  string
+	MaxRows int32
+}
+
+// Kind 为 'S' 时关闭预处理语句，为 'P' 时关闭 portal
+type Close struct {
+	Kind byte
+	Name string
+}
+
+// 回复 AuthenticationCleartextPassword 的密码
+type PasswordMessage struct {
+	Password string
+}
+
+type Sync struct{}
+
+type Flush struct{}
+
+type Terminate struct{}
+
+// 不支持的消息，例如 COPY 和函数调用
+type Unknown struct {
+	Type byte
+}
+
+func (*Query) messageType() byte           { return 'Q' }
+func (*Parse) messageType() byte           { return 'P' }
+func (*Bind) messageType() byte            { return 'B' }
+func (*Describe) messageType() byte        { return 'D' }
+func (*Execute) messageType() byte         { return 'E' }
+func (*Close) messageType() byte           { return 'C' }
+func (*PasswordMessage) messageType() byte { return 'p' }
+func (*Sync) messageType() byte            { return 'S' }
+func (*Flush) messageType() byte           { return 'H' }
+func (*Terminate) messageType() byte       { return 'X' }
+func (msg *Unknown) messageType() byte {
+	return msg.Type
+}
+
+func decodeMessage(typ byte, body []byte) (Message, error) {
+	r := &reader{data: body}
+	var msg Message
+	switch typ {
+	case 'Q':
+		msg = &Query{SQL: r.string()}
+	case 'P':
+		parse := &Parse{Name: r.string(), SQL: r.string()}
+		n := r.int16()
+		for i := int16(0); i < n && r.err == nil; i++ {
+			parse.ParamOIDs = append(parse.ParamOIDs, uint32(r.int32()))
+		}
+		msg = parse
+	case 'B':
+		bind := &Bind{Portal: r.string(), Statement: r.string()}
+		bind.ParamFormats = readFormats(r)
+		n := r.int16()
+		for i := int16(0); i < n && r.err == nil; i++ {
+			size := r.int32()
+			if size < 0 {
+				bind.Params = append(bind.Params, nil)
+				continue
+			}
+			param := make([]byte, size)
+			copy(param, r.next(int(size)))
+			bind.Params = append(bind.Params, param)
+		}
+		bind.ResultFormats = readFormats(r)
+		msg = bind
+	case 'D':
+		msg = &Describe{Kind: r.byte(), Name: r.string()}
+	case 'E':
+		msg = &Execute{Portal: r.string(), MaxRows: r.int32()}
+	case 'C':
+		msg = &Close{Kind: r.byte(), Name: r.string()}
+	case 'p':
+		msg = &PasswordMessage{Password: r.string()}
+	case 'S':
+		msg = &Sync{}
+	case 'H':
+		msg = &Flush{}
+	case 'X':
+		msg = &Terminate{}
+	default:
+		return &Unknown{Type: typ}, nil
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed message '%c': %w", typ, r.err)
+	}
+	return msg, nil
+}
+
+func readFormats(r *reader) []int16 {
+	n := r.int16()
+	formats := make([]int16, 0, n)
+	for i := int16(0); i < n && r.err == nil; i++ {
+		formats = append(formats, r.int16())
+	}
+	return formats
+}
+
+// 第 i 个值的格式，没有指定时为文本，只有一个时用于所有值
+func FormatOf(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return FormatText
+	case 1:
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return FormatText
+}
+
+// RowDescription 中的一列
+type Field struct {
+	Name    string
+	TypeOID uint32
+	Format  int16
+}
+
+func (conn *Conn) WriteAuthenticationOk() {
+	conn.begin('R')
+	conn.int32(0)
+	conn.end()
+}
+
+// 要求客户端发送明文密码
+func (conn *Conn) WriteAuthenticationCleartextPassword() {
+	conn.begin('R')
+	conn.int32(3)
+	conn.end()
+}
+
+func (conn *Conn) WriteParameterStatus(name string, value string) {
+	conn.begin('S')
+	conn.string(name)
+	conn.string(value)
+	conn.end()
+}
+
+func (conn *Conn) WriteReadyForQuery(txStatus byte) {
+	conn.begin('Z')
+	conn.buf = append(conn.buf, txStatus)
+	conn.end()
+}
+
+func (conn *Conn) WriteRowDescription(fields []Field) {
+	conn.begin('T')
+	conn.int16(int16(len(fields)))
+	for _, field := range fields {
+		conn.string(field.Name)
+		// 表的 OID 和列号
+		conn.int32(0)
+		conn.int16(0)
+		conn.int32(int32(field.TypeOID))
+		conn.int16(TypeSize(field.TypeOID))
+		// 类型修饰符
+		conn.int32(-1)
+		conn.int16(field.Format)
+	}
+	conn.end()
+}
+
+// 值为 nil 时表示 NULL
+func (conn *Conn) WriteDataRow(values [][]byte) {
+	conn.begin('D')
+	conn.int16(int16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			conn.int32(-1)
+			continue
+		}
+		conn.int32(int32(len(value)))
+		conn.buf = append(conn.buf, value...)
+	}
+	conn.end()
+}
+
+// tag 为语句的类型和影响的行数，例如 INSERT 0 1
+func (conn *Conn) WriteCommandComplete(tag string) {
+	conn.begin('C')
+	conn.string(tag)
+	conn.end()
+}
+
+func (conn *Conn) WriteEmptyQueryResponse() {
+	conn.begin('I')
+	conn.end()
+}
+
+func (conn *Conn) WriteParseComplete() {
+	conn.begin('1')
+	conn.end()
+}
+
+func (conn *Conn) WriteBindComplete() {
+	conn.begin('2')
+	conn.end()
+}
+
+func (conn *Conn) WriteCloseComplete() {
+	conn.begin('3')
+	conn.end()
+}
+
+func (conn *Conn) WriteNoData() {
+	conn.begin('n')
+	conn.end()
+}
+
+// 执行到 Execute 指定的行数，portal 中还有剩余的行
+func (conn *Conn) WritePortalSuspended() {
+	conn.begin('s')
+	conn.end()
+}
+
+func (conn *Conn) WriteParameterDescription(oids []uint32) {
+	conn.begin('t')
+	conn.int16(int16(len(oids)))
+	for _, oid := range oids {
+		conn.int32(int32(oid))
+	}
+	conn.end()
+}
+
+func (conn *Conn) WriteError(err *Error) {
+	conn.writeNotice('E', "ERROR", err.Code, err.Message)
+}
+
+func (conn *Conn) WriteNotice(message string) {
+	conn.writeNotice('N', "NOTICE", CodeSuccessfulCompletion, message)
+}
+
+func (conn *Conn) writeNotice(typ byte, severity string, code string, message string) {
+	conn.begin(typ)
+	conn.buf = append(conn.buf, 'S')
+	conn.string(severity)
+	conn.buf = append(conn.buf, 'V')
+	conn.string(severity)
+	conn.buf = append(conn.buf, 'C')
+	conn.string(code)
+	conn.buf = append(conn.buf, 'M')
+	conn.string(message)
+	conn.buf = append(conn.buf, 0)
+	conn.end()
+}
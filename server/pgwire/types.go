@@ -0,0 +1,171 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"minidb-go/parser/ast"
+	"strconv"
+)
+
+// 值的格式
+const (
+	FormatText   int16 = 0
+	FormatBinary int16 = 1
+)
+
+// PostgreSQL 中 pg_type 的 OID
+const (
+	OIDInt2    uint32 = 21
+	OIDInt4    uint32 = 23
+	OIDInt8    uint32 = 20
+	OIDFloat4  uint32 = 700
+	OIDFloat8  uint32 = 701
+	OIDNumeric uint32 = 1700
+	OIDText    uint32 = 25
+	OIDVarchar uint32 = 1043
+	OIDUnknown uint32 = 705
+)
+
+// 列类型对应的 OID，int 和 float 都是 64 位
+func TypeOID(columnType ast.ColumnType) uint32 {
+	switch columnType {
+	case ast.CT_INT:
+		return OIDInt8
+	case ast.CT_FLOAT:
+		return OIDFloat8
+	default:
+		return OIDText
+	}
+}
+
+// 定长类型的字节数，变长类型为 -1
+func TypeSize(oid uint32) int16 {
+	switch oid {
+	case OIDInt2:
+		return 2
+	case OIDInt4, OIDFloat4:
+		return 4
+	case OIDInt8, OIDFloat8:
+		return 8
+	}
+	return -1
+}
+
+// 按列类型编码一个值，文本格式的浮点数使用能还原原值的最短表示
+func EncodeValue(value ast.SQLExprValue, columnType ast.ColumnType, format int16) ([]byte, error) {
+	if format == FormatText {
+		switch value := value.(type) {
+		case *ast.SQLInt:
+			return strconv.AppendInt(nil, int64(*value), 10), nil
+		case *ast.SQLFloat:
+			return strconv.AppendFloat(nil, float64(*value), 'g', -1, 64), nil
+		case *ast.SQLText:
+			return []byte(*value), nil
+		}
+		return nil, fmt.Errorf("can't encode value %v", value)
+	}
+
+	switch columnType {
+	case ast.CT_INT:
+		if value, ok := value.(*ast.SQLInt); ok {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(*value))
+			return buf, nil
+		}
+	case ast.CT_FLOAT:
+		if value, ok := value.(*ast.SQLFloat); ok {
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, math.Float64bits(float64(*value)))
+			return buf, nil
+		}
+	case ast.CT_TEXT:
+		if value, ok := value.(*ast.SQLText); ok {
+			return []byte(*value), nil
+		}
+	}
+	return nil, fmt.Errorf("can't encode value %v as %v in binary format", value, TypeOID(columnType))
+}
+
+// 按参数类型 oid 解码客户端发送的参数
+func DecodeParam(data []byte, oid uint32, format int16) (ast.SQLExprValue, error) {
+	if format == FormatText {
+		switch oid {
+		case OIDInt2, OIDInt4, OIDInt8:
+			v, err := strconv.ParseInt(string(data), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer %q", data)
+			}
+			val := ast.SQLInt(v)
+			return &val, nil
+		case OIDFloat4, OIDFloat8, OIDNumeric:
+			v, err := strconv.ParseFloat(string(data), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid float %q", data)
+			}
+			val := ast.SQLFloat(v)
+			return &val, nil
+		default:
+			val := ast.SQLText(data)
+			return &val, nil
+		}
+	}
+
+	switch {
+	case oid == OIDInt2 && len(data) == 2:
+		val := ast.SQLInt(int16(binary.BigEndian.Uint16(data)))
+		return &val, nil
+	case oid == OIDInt4 && len(data) == 4:
+		val := ast.SQLInt(int32(binary.BigEndian.Uint32(data)))
+		return &val, nil
+	case oid == OIDInt8 && len(data) == 8:
+		val := ast.SQLInt(int64(binary.BigEndian.Uint64(data)))
+		return &val, nil
+	case oid == OIDFloat4 && len(data) == 4:
+		val := ast.SQLFloat(math.Float32frombits(binary.BigEndian.Uint32(data)))
+		return &val, nil
+	case oid == OIDFloat8 && len(data) == 8:
+		val := ast.SQLFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		return &val, nil
+	case oid == OIDText || oid == OIDVarchar || oid == OIDUnknown:
+		val := ast.SQLText(data)
+		return &val, nil
+	}
+	return nil, fmt.Errorf("unsupported binary parameter of type %d with %d bytes", oid, len(data))
+}
+
+// SQLSTATE 错误码
+const (
+	CodeSuccessfulCompletion      = "00000"
+	CodeProtocolViolation         = "08P01"
+	CodeFeatureNotSupported       = "0A000"
+	CodeActiveSQLTransaction      = "25001"
+	CodeNoActiveSQLTransaction    = "25P01"
+	CodeInvalidSQLStatementName   = "26000"
+	CodeInvalidCursorName         = "34000"
+	CodeInvalidPassword           = "28P01"
+	CodeInsufficientPrivilege     = "42501"
+	CodeDuplicateObject           = "42710"
+	CodeUndefinedObject           = "42704"
+	CodeDuplicateCursor           = "42P03"
+	CodeDeadlockDetected          = "40P01"
+	CodeSerializationFailure      = "40001"
+	CodeSyntaxError               = "42601"
+	CodeUndefinedTable            = "42P01"
+	CodeInvalidTextRepresentation = "22P02"
+	CodeInternalError             = "XX000"
+)
+
+// 带有 SQLSTATE 的错误，通过 ErrorResponse 发送给客户端
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func NewError(code string, err error) *Error {
+	return &Error{Code: code, Message: err.Error()}
+}
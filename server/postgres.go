@@ -0,0 +1,669 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization"
+	"minidb-go/server/pgwire"
+	"minidb-go/storage"
+	"minidb-go/tbm"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 预处理语句，stmt 为 nil 时是空查询
+type pgStatement struct {
+	stmt      ast.SQLStatement
+	paramOIDs []uint32
+
+	// SELECT 和 FETCH 返回的列，其他语句不返回数据行
+	columns []tbm.Column
+}
+
+// 绑定了参数的预处理语句，第一次 Execute 时执行，之后按 Execute 的行数从游标中读取结果
+type pgPortal struct {
+	statement *pgStatement
+	stmt      ast.SQLStatement
+	formats   []int16
+
+	executed bool
+	result   *tbm.ResultList
+	// SELECT 和 FETCH 的结果，读取完之后关闭并置为 nil
+	rows *Rows
+}
+
+/*
+PostgreSQL 协议的连接，语句由连接的会话执行，事务属于会话，
+预处理语句和 portal 属于连接。扩展查询出错后忽略之后的消息直到 Sync。
+*/
+type postgresConn struct {
+	server  *Server
+	conn    net.Conn
+	pg      *pgwire.Conn
+	session *Session
+
+	statements map[string]*pgStatement
+	portals    map[string]*pgPortal
+	skip       bool
+}
+
+// 在 TCP 地址 address 上接受 PostgreSQL v3 协议的连接，可以使用 psql 等工具访问
+func (server *Server) ListenPostgres(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server.serve(listener, server.handlePostgres)
+	return nil
+}
+
+func (server *Server) handlePostgres(conn net.Conn) {
+	log.Infof("new postgres connection from %v", conn.RemoteAddr())
+	defer log.Infof("lose postgres connection from %v", conn.RemoteAddr())
+	// 连接断开时回滚会话中未结束的事务
+	session := NewSession(server.tbm)
+	defer session.Close()
+	pc := &postgresConn{
+		server:     server,
+		conn:       conn,
+		pg:         pgwire.NewConn(conn),
+		session:    session,
+		statements: make(map[string]*pgStatement),
+		portals:    make(map[string]*pgPortal),
+	}
+
+	if !server.waitRequest(conn) {
+		return
+	}
+	if err := pc.startup(); err != nil {
+		log.Error(err)
+		return
+	}
+	// 发送 ReadyForQuery 之后等待下一个请求，退出时不再接受新的请求
+	idle := true
+	for {
+		if idle && !server.waitRequest(conn) {
+			return
+		}
+		msg, err := pc.pg.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !server.isClosing() {
+				log.Error(err)
+			}
+			return
+		}
+		idle = false
+
+		switch msg := msg.(type) {
+		case *pgwire.Terminate:
+			return
+		case *pgwire.Sync:
+			pc.skip = false
+			pc.sync()
+			idle = true
+		case *pgwire.Query:
+			pc.query(msg.SQL)
+			idle = true
+		case *pgwire.Flush:
+			if err := pc.flush(); err != nil {
+				log.Error(err)
+				return
+			}
+		default:
+			if pc.skip {
+				continue
+			}
+			if err := pc.extended(msg); err != nil {
+				pc.pg.WriteError(postgresError(err))
+				pc.skip = true
+			}
+		}
+
+		if idle {
+			pc.pg.WriteReadyForQuery(pc.txStatus())
+			if err := pc.flush(); err != nil {
+				log.Error(err)
+				return
+			}
+		}
+	}
+}
+
+func (pc *postgresConn) startup() error {
+	params, err := pc.pg.ReadStartup()
+	if err != nil {
+		return err
+	}
+	// 数据库中有用户时要求密码，否则信任所有连接
+	if pc.server.tbm.HasUsers() {
+		if err := pc.authenticate(params["user"]); err != nil {
+			return err
+		}
+	}
+	log.Infof("postgres user %q connected to database %q", params["user"], params["database"])
+	pc.pg.WriteAuthenticationOk()
+	pc.pg.WriteParameterStatus("server_version", "14.0")
+	pc.pg.WriteParameterStatus("server_encoding", "UTF8")
+	pc.pg.WriteParameterStatus("client_encoding", "UTF8")
+	pc.pg.WriteParameterStatus("DateStyle", "ISO, MDY")
+	pc.pg.WriteParameterStatus("integer_datetimes", "on")
+	pc.pg.WriteParameterStatus("standard_conforming_strings", "on")
+	pc.pg.WriteReadyForQuery(pc.txStatus())
+	return pc.flush()
+}
+
+// 以明文密码认证，失败时发送错误，之后断开连接
+func (pc *postgresConn) authenticate(user string) error {
+	pc.pg.WriteAuthenticationCleartextPassword()
+	if err := pc.flush(); err != nil {
+		return err
+	}
+	msg, err := pc.pg.ReadMessage()
+	if err != nil {
+		return err
+	}
+	password, ok := msg.(*pgwire.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("expected password message, got %T", msg)
+	}
+	if err := pc.server.tbm.Authenticate(user, password.Password); err != nil {
+		pc.pg.WriteError(pgwire.NewError(pgwire.CodeInvalidPassword, fmt.Errorf("password authentication failed for user %q", user)))
+		pc.flush()
+		return fmt.Errorf("%w for postgres user %q", err, user)
+	}
+	pc.session.SetUser(user)
+	return nil
+}
+
+func (pc *postgresConn) flush() error {
+	if pc.server.writeTimeout > 0 {
+		pc.conn.SetWriteDeadline(time.Now().Add(pc.server.writeTimeout))
+	}
+	return pc.pg.Flush()
+}
+
+func (pc *postgresConn) txStatus() byte {
+	if pc.session.InTransaction() {
+		return pgwire.TxActive
+	}
+	return pgwire.TxIdle
+}
+
+// 简单查询，依次执行每条语句，出错时不再执行之后的语句
+func (pc *postgresConn) query(sql string) {
+	stmts := splitStatements(sql)
+	if len(stmts) == 0 {
+		pc.pg.WriteEmptyQueryResponse()
+		return
+	}
+	for _, sql := range stmts {
+		if err := pc.simpleQuery(sql); err != nil {
+			pc.pg.WriteError(postgresError(err))
+			return
+		}
+	}
+}
+
+func (pc *postgresConn) simpleQuery(sql string) error {
+	stmt, err := parser.Parse(sql)
+	if err != nil {
+		return pgwire.NewError(pgwire.CodeSyntaxError, err)
+	}
+	statement, err := pc.prepare(stmt, nil)
+	if err != nil {
+		return err
+	}
+	portal := &pgPortal{statement: statement, stmt: stmt}
+	defer portal.close()
+	if err := pc.run(portal); err != nil {
+		return err
+	}
+	if fields := portal.fields(); fields != nil {
+		pc.pg.WriteRowDescription(fields)
+	}
+	return pc.sendRows(portal, 0)
+}
+
+// 扩展查询协议的消息
+func (pc *postgresConn) extended(msg pgwire.Message) error {
+	switch msg := msg.(type) {
+	case *pgwire.Parse:
+		return pc.parse(msg)
+	case *pgwire.Bind:
+		return pc.bind(msg)
+	case *pgwire.Describe:
+		return pc.describe(msg)
+	case *pgwire.Execute:
+		portal, ok := pc.portals[msg.Portal]
+		if !ok {
+			return &pgwire.Error{Code: pgwire.CodeInvalidCursorName, Message: fmt.Sprintf("portal %q does not exist", msg.Portal)}
+		}
+		if err := pc.run(portal); err != nil {
+			return err
+		}
+		return pc.sendRows(portal, int(msg.MaxRows))
+	case *pgwire.Close:
+		if msg.Kind == 'S' {
+			delete(pc.statements, msg.Name)
+		} else if portal, ok := pc.portals[msg.Name]; ok {
+			portal.close()
+			delete(pc.portals, msg.Name)
+		}
+		pc.pg.WriteCloseComplete()
+		return nil
+	}
+	return &pgwire.Error{Code: pgwire.CodeFeatureNotSupported, Message: fmt.Sprintf("unsupported message type '%c'", msg.(*pgwire.Unknown).Type)}
+}
+
+func (pc *postgresConn) parse(msg *pgwire.Parse) error {
+	var stmt ast.SQLStatement
+	switch stmts := splitStatements(msg.SQL); len(stmts) {
+	case 0:
+	case 1:
+		var err error
+		if stmt, err = parser.Parse(stmts[0]); err != nil {
+			return pgwire.NewError(pgwire.CodeSyntaxError, err)
+		}
+	default:
+		return &pgwire.Error{Code: pgwire.CodeSyntaxError, Message: "cannot insert multiple commands into a prepared statement"}
+	}
+	statement, err := pc.prepare(stmt, msg.ParamOIDs)
+	if err != nil {
+		return err
+	}
+	pc.statements[msg.Name] = statement
+	pc.pg.WriteParseComplete()
+	return nil
+}
+
+func (pc *postgresConn) bind(msg *pgwire.Bind) error {
+	statement, ok := pc.statements[msg.Statement]
+	if !ok {
+		return &pgwire.Error{Code: pgwire.CodeInvalidSQLStatementName, Message: fmt.Sprintf("prepared statement %q does not exist", msg.Statement)}
+	}
+	if len(msg.Params) != len(statement.paramOIDs) {
+		return &pgwire.Error{
+			Code:    pgwire.CodeProtocolViolation,
+			Message: fmt.Sprintf("bind message supplies %d parameters, but prepared statement requires %d", len(msg.Params), len(statement.paramOIDs)),
+		}
+	}
+	params := make([]ast.SQLExprValue, len(msg.Params))
+	for i, data := range msg.Params {
+		if data == nil {
+			return &pgwire.Error{Code: pgwire.CodeFeatureNotSupported, Message: "null values are not supported"}
+		}
+		value, err := pgwire.DecodeParam(data, statement.paramOIDs[i], pgwire.FormatOf(msg.ParamFormats, i))
+		if err != nil {
+			return pgwire.NewError(pgwire.CodeInvalidTextRepresentation, err)
+		}
+		params[i] = value
+	}
+	stmt := statement.stmt
+	if len(params) > 0 {
+		var err error
+		if stmt, err = ast.BindParams(stmt, params); err != nil {
+			return err
+		}
+	}
+	if portal, ok := pc.portals[msg.Portal]; ok {
+		portal.close()
+	}
+	pc.portals[msg.Portal] = &pgPortal{
+		statement: statement,
+		stmt:      stmt,
+		formats:   msg.ResultFormats,
+	}
+	pc.pg.WriteBindComplete()
+	return nil
+}
+
+func (pc *postgresConn) describe(msg *pgwire.Describe) error {
+	var fields []pgwire.Field
+	if msg.Kind == 'S' {
+		statement, ok := pc.statements[msg.Name]
+		if !ok {
+			return &pgwire.Error{Code: pgwire.CodeInvalidSQLStatementName, Message: fmt.Sprintf("prepared statement %q does not exist", msg.Name)}
+		}
+		pc.pg.WriteParameterDescription(statement.paramOIDs)
+		// 还不知道结果的格式，使用文本格式
+		fields = (&pgPortal{statement: statement}).fields()
+	} else {
+		portal, ok := pc.portals[msg.Name]
+		if !ok {
+			return &pgwire.Error{Code: pgwire.CodeInvalidCursorName, Message: fmt.Sprintf("portal %q does not exist", msg.Name)}
+		}
+		fields = portal.fields()
+	}
+	if fields == nil {
+		pc.pg.WriteNoData()
+	} else {
+		pc.pg.WriteRowDescription(fields)
+	}
+	return nil
+}
+
+// 确定参数的类型和 SELECT 返回的列，客户端没有指定类型的参数根据表结构推断
+func (pc *postgresConn) prepare(stmt ast.SQLStatement, paramOIDs []uint32) (*pgStatement, error) {
+	statement := &pgStatement{stmt: stmt}
+	if stmt == nil {
+		return statement, nil
+	}
+	n := ast.NumParams(stmt)
+	if len(paramOIDs) > n {
+		n = len(paramOIDs)
+	}
+	statement.paramOIDs = make([]uint32, n)
+	copy(statement.paramOIDs, paramOIDs)
+	paramTypes := pc.paramTypes(stmt)
+	for i, oid := range statement.paramOIDs {
+		if oid != 0 {
+			continue
+		}
+		if columnType, ok := paramTypes[i+1]; ok {
+			statement.paramOIDs[i] = pgwire.TypeOID(columnType)
+		} else {
+			statement.paramOIDs[i] = pgwire.OIDText
+		}
+	}
+
+	var err error
+	switch stmt := stmt.(type) {
+	case ast.SelectStmt:
+		statement.columns, err = pc.server.tbm.Columns(stmt.TableName)
+	case ast.FetchStmt:
+		statement.columns, err = pc.session.CursorColumns(stmt.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// 参数对应的列的类型：INSERT 中相同位置的列，赋值和比较中另一边的列
+func (pc *postgresConn) paramTypes(stmt ast.SQLStatement) map[int]ast.ColumnType {
+	paramTypes := make(map[int]ast.ColumnType)
+	columnType := func(tableName string, column ast.SQLExprValue) (ast.ColumnType, bool) {
+		name, ok := column.(*ast.SQLColumn)
+		if !ok {
+			return 0, false
+		}
+		columns, err := pc.server.tbm.Columns(tableName)
+		if err != nil {
+			return 0, false
+		}
+		for _, column := range columns {
+			if column.Name == string(*name) {
+				return column.Type, true
+			}
+		}
+		return 0, false
+	}
+	addParam := func(value ast.SQLExprValue, columnType ast.ColumnType, ok bool) {
+		if param, isParam := value.(*ast.SQLParam); isParam && ok {
+			paramTypes[int(*param)] = columnType
+		}
+	}
+	addWhere := func(tableName string, where ast.WhereStatement) {
+		if !where.IsExists || where.Expr == nil {
+			return
+		}
+		leftType, leftOk := columnType(tableName, where.Expr.Left)
+		rightType, rightOk := columnType(tableName, where.Expr.Right)
+		addParam(where.Expr.Left, rightType, rightOk)
+		addParam(where.Expr.Right, leftType, leftOk)
+	}
+
+	switch stmt := stmt.(type) {
+	case ast.InsertIntoStmt:
+		if columns, err := pc.server.tbm.Columns(stmt.TableName); err == nil {
+			for i, value := range stmt.Row {
+				if i < len(columns) {
+					addParam(value, columns[i].Type, true)
+				}
+			}
+		}
+	case ast.UpdateStmt:
+		for _, assign := range stmt.ColumnAssignList {
+			column := ast.SQLColumn(assign.ColumnName)
+			columnType, ok := columnType(stmt.TableName, &column)
+			addParam(assign.Value, columnType, ok)
+		}
+		addWhere(stmt.TableName, stmt.Where)
+	case ast.DeleteStatement:
+		addWhere(stmt.TableName, stmt.Where)
+	case ast.SelectStmt:
+		addWhere(stmt.TableName, stmt.Where)
+	}
+	return paramTypes
+}
+
+// Sync 结束隐式事务，没有正在进行的事务时关闭所有 portal，提交其中的查询
+func (pc *postgresConn) sync() {
+	if pc.session.InTransaction() {
+		return
+	}
+	for name, portal := range pc.portals {
+		portal.close()
+		delete(pc.portals, name)
+	}
+}
+
+// 执行 portal 中的语句，只执行一次，SELECT 和 FETCH 只打开结果，发送时再读取
+func (pc *postgresConn) run(portal *pgPortal) error {
+	if portal.executed || portal.stmt == nil {
+		return nil
+	}
+	portal.executed = true
+	if portal.statement.columns != nil {
+		rows, err := pc.session.Query(portal.stmt)
+		if err != nil {
+			return err
+		}
+		portal.rows = rows
+		return nil
+	}
+	result, err := pc.session.ExecuteStmt(portal.stmt)
+	if err != nil {
+		return err
+	}
+	portal.result = result
+	return nil
+}
+
+// 发送最多 maxRows 行结果，为 0 时发送所有剩余的行
+func (pc *postgresConn) sendRows(portal *pgPortal, maxRows int) error {
+	if portal.stmt == nil {
+		pc.pg.WriteEmptyQueryResponse()
+		return nil
+	}
+	if portal.statement.columns == nil {
+		// 其他语句的执行信息与 CommandComplete 重复，只发送 VACUUM 和 BACKUP 的统计信息
+		switch portal.stmt.(type) {
+		case ast.VacuumStmt, ast.BackupStmt:
+			if portal.result != nil && portal.result.Message != "" {
+				pc.pg.WriteNotice(portal.result.Message)
+			}
+		}
+		pc.pg.WriteCommandComplete(commandTag(portal.stmt, portal.result))
+		return nil
+	}
+
+	// 每次最多读取 RowBatchSize 行，发送之后再读取下一批
+	columns := portal.statement.columns
+	values := make([][]byte, len(columns))
+	sent := 0
+	for portal.rows != nil && (maxRows == 0 || sent < maxRows) {
+		size := RowBatchSize
+		if maxRows > 0 && maxRows-sent < size {
+			size = maxRows - sent
+		}
+		rows, err := portal.rows.Fetch(size)
+		if err != nil {
+			portal.rows = nil
+			return err
+		}
+		for _, row := range rows {
+			for i, column := range columns {
+				value, err := pgwire.EncodeValue(row.Data[i], column.Type, pgwire.FormatOf(portal.formats, i))
+				if err != nil {
+					return err
+				}
+				values[i] = value
+			}
+			pc.pg.WriteDataRow(values)
+		}
+		sent += len(rows)
+		if len(rows) < size {
+			// 读取完毕，提交为查询开启的事务
+			err := portal.rows.Close()
+			portal.rows = nil
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if err := pc.flush(); err != nil {
+			return err
+		}
+	}
+	if portal.rows != nil {
+		pc.pg.WritePortalSuspended()
+		return nil
+	}
+	pc.pg.WriteCommandComplete(commandTag(portal.stmt, &tbm.ResultList{RowsAffected: sent}))
+	return nil
+}
+
+// 关闭没有读取完的结果
+func (portal *pgPortal) close() {
+	if portal.rows == nil {
+		return
+	}
+	if err := portal.rows.Close(); err != nil {
+		log.Errorf("close portal failed: %v", err)
+	}
+	portal.rows = nil
+}
+
+// SELECT 返回的列，其他语句返回 nil
+func (portal *pgPortal) fields() []pgwire.Field {
+	if portal.statement.columns == nil {
+		return nil
+	}
+	fields := make([]pgwire.Field, len(portal.statement.columns))
+	for i, column := range portal.statement.columns {
+		fields[i] = pgwire.Field{
+			Name:    column.Name,
+			TypeOID: pgwire.TypeOID(column.Type),
+			Format:  pgwire.FormatOf(portal.formats, i),
+		}
+	}
+	return fields
+}
+
+// CommandComplete 中的命令和影响的行数
+func commandTag(stmt ast.SQLStatement, result *tbm.ResultList) string {
+	rows := 0
+	if result != nil {
+		rows = len(result.Rows) + result.RowsAffected
+	}
+	switch stmt.(type) {
+	case ast.CreateTableStmt:
+		return "CREATE TABLE"
+	case ast.InsertIntoStmt:
+		return fmt.Sprintf("INSERT 0 %d", rows)
+	case ast.UpdateStmt:
+		return fmt.Sprintf("UPDATE %d", rows)
+	case ast.DeleteStatement:
+		return fmt.Sprintf("DELETE %d", rows)
+	case ast.SelectStmt:
+		return fmt.Sprintf("SELECT %d", rows)
+	case ast.FetchStmt:
+		return fmt.Sprintf("FETCH %d", rows)
+	case ast.BeginStmt:
+		return "BEGIN"
+	case ast.CommitStmt:
+		return "COMMIT"
+	case ast.RollbackStmt:
+		return "ROLLBACK"
+	case ast.VacuumStmt:
+		return "VACUUM"
+	case ast.BackupStmt:
+		return "BACKUP"
+	case ast.CreateUserStmt:
+		return "CREATE ROLE"
+	case ast.AlterUserStmt:
+		return "ALTER ROLE"
+	case ast.DropUserStmt:
+		return "DROP ROLE"
+	}
+	return strings.ToUpper(stmt.StatementType())
+}
+
+// 按错误的类型确定 SQLSTATE
+func postgresError(err error) *pgwire.Error {
+	var pgErr *pgwire.Error
+	if errors.As(err, &pgErr) {
+		return pgErr
+	}
+	code := pgwire.CodeInternalError
+	switch {
+	case errors.Is(err, ErrInTransaction):
+		code = pgwire.CodeActiveSQLTransaction
+	case errors.Is(err, ErrNoTransaction):
+		code = pgwire.CodeNoActiveSQLTransaction
+	case errors.Is(err, serialization.ErrDeadLock):
+		code = pgwire.CodeDeadlockDetected
+	case errors.Is(err, serialization.ErrSerialization):
+		code = pgwire.CodeSerializationFailure
+	case errors.Is(err, tbm.ErrTableNotExists), errors.Is(err, storage.ErrTableNotExist):
+		code = pgwire.CodeUndefinedTable
+	case errors.Is(err, ast.ErrUnboundParam):
+		code = pgwire.CodeProtocolViolation
+	case errors.Is(err, ErrCursorNotExist):
+		code = pgwire.CodeInvalidCursorName
+	case errors.Is(err, ErrCursorExists):
+		code = pgwire.CodeDuplicateCursor
+	case errors.Is(err, ErrPermissionDenied):
+		code = pgwire.CodeInsufficientPrivilege
+	case errors.Is(err, tbm.ErrUserExists):
+		code = pgwire.CodeDuplicateObject
+	case errors.Is(err, tbm.ErrUserNotExist):
+		code = pgwire.CodeUndefinedObject
+	}
+	return pgwire.NewError(code, err)
+}
+
+// 按分号拆分多条语句，忽略字符串中的分号和空语句，每条语句以分号结尾
+func splitStatements(sql string) []string {
+	stmts := make([]string, 0, 1)
+	inString := false
+	start := 0
+	add := func(stmt string) {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" && stmt != ";" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	for i := 0; i < len(sql); i++ {
+		switch sql[i] {
+		case '\'':
+			inString = !inString
+		case ';':
+			if !inString {
+				add(sql[start : i+1])
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(sql[start:]); rest != "" {
+		add(rest + ";")
+	}
+	return stmts
+}
@@ -0,0 +1,281 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"net"
+	"testing"
+)
+
+type pgMessage struct {
+	typ  byte
+	body []byte
+}
+
+// 只实现测试需要的消息的 PostgreSQL 客户端
+type pgClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func int16Bytes(v int16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+func int32Bytes(v int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func int64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func dialPostgres(t *testing.T, address string) *pgClient {
+	client := startPostgres(t, address, "test")
+	messages := client.receive()
+	if messages[0].typ != 'R' || binary.BigEndian.Uint32(messages[0].body) != 0 {
+		t.Fatalf("expected AuthenticationOk, got %c", messages[0].typ)
+	}
+	return client
+}
+
+// 只发送 StartupMessage
+func startPostgres(t *testing.T, address string, user string) *pgClient {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &pgClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	body := bytes.Join([][]byte{int32Bytes(3 << 16), cstring("user"), cstring(user), {0}}, nil)
+	if _, err := conn.Write(append(int32Bytes(int32(len(body)+4)), body...)); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func (client *pgClient) send(typ byte, fields ...[]byte) {
+	body := bytes.Join(fields, nil)
+	msg := append([]byte{typ}, int32Bytes(int32(len(body)+4))...)
+	if _, err := client.conn.Write(append(msg, body...)); err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+// 读取消息直到 ReadyForQuery
+func (client *pgClient) receive() []pgMessage {
+	var messages []pgMessage
+	for {
+		msg := client.next()
+		messages = append(messages, msg)
+		if msg.typ == 'Z' {
+			return messages
+		}
+	}
+}
+
+func (client *pgClient) next() pgMessage {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(client.reader, header); err != nil {
+		client.t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(client.reader, body); err != nil {
+		client.t.Fatal(err)
+	}
+	return pgMessage{typ: header[0], body: body}
+}
+
+func (client *pgClient) query(sql string) []pgMessage {
+	client.send('Q', cstring(sql))
+	return client.receive()
+}
+
+// 消息类型的序列，例如 "CTDCZ"
+func messageTypes(messages []pgMessage) string {
+	types := make([]byte, len(messages))
+	for i, msg := range messages {
+		types[i] = msg.typ
+	}
+	return string(types)
+}
+
+// DataRow 中的值
+func dataRow(msg pgMessage) [][]byte {
+	n := int(binary.BigEndian.Uint16(msg.body))
+	values := make([][]byte, n)
+	body := msg.body[2:]
+	for i := range values {
+		size := int(int32(binary.BigEndian.Uint32(body)))
+		values[i] = body[4 : 4+size]
+		body = body[4+size:]
+	}
+	return values
+}
+
+// ErrorResponse 中的 SQLSTATE
+func errorCode(msg pgMessage) string {
+	for _, field := range bytes.Split(msg.body, []byte{0}) {
+		if len(field) > 0 && field[0] == 'C' {
+			return string(field[1:])
+		}
+	}
+	return ""
+}
+
+func expectTypes(t *testing.T, messages []pgMessage, expected string) {
+	t.Helper()
+	if types := messageTypes(messages); types != expected {
+		t.Fatalf("expected messages %s, got %s", expected, types)
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	srv := server.NewServer(false, true, t.TempDir(), pager.DefaultOptions())
+	defer srv.Shutdown()
+	if err := srv.ListenPostgres("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	client := dialPostgres(t, srv.Addrs()[0].String())
+	defer client.conn.Close()
+
+	// 简单查询，一次发送多条语句
+	messages := client.query("create table t1(id int, name text, score float); insert into t1 values(1, 'a;b', 1.5); select * from t1")
+	expectTypes(t, messages, "CCTDCZ")
+	if tag := string(messages[1].body); tag != "INSERT 0 1\x00" {
+		t.Fatalf("unexpected command tag %q", tag)
+	}
+	if row := dataRow(messages[3]); string(row[0]) != "1" || string(row[1]) != "a;b" || string(row[2]) != "1.5" {
+		t.Fatalf("unexpected row %q", row)
+	}
+
+	// 扩展查询，参数的类型由表结构推断，int 和 float 使用二进制格式
+	client.send('P', cstring(""), cstring("insert into t1 values($1, $2, $3)"), int16Bytes(0))
+	client.send('D', []byte{'S'}, cstring(""))
+	client.send('B', cstring(""), cstring(""),
+		int16Bytes(3), int16Bytes(1), int16Bytes(0), int16Bytes(1),
+		int16Bytes(3),
+		int32Bytes(8), int64Bytes(2),
+		int32Bytes(1), []byte("b"),
+		int32Bytes(8), int64Bytes(math.Float64bits(2.25)),
+		int16Bytes(0))
+	client.send('E', cstring(""), int32Bytes(0))
+	client.send('S')
+	messages = client.receive()
+	expectTypes(t, messages, "1tn2CZ")
+	if oids := messages[1].body; !bytes.Equal(oids, bytes.Join([][]byte{int16Bytes(3), int32Bytes(20), int32Bytes(25), int32Bytes(701)}, nil)) {
+		t.Fatalf("unexpected parameter types %v", oids)
+	}
+
+	// 二进制格式的结果，每次 Execute 从游标中读取一行，读满一行时不知道之后是否还有行
+	client.send('P', cstring("s1"), cstring("select * from t1;"), int16Bytes(0))
+	client.send('B', cstring("p1"), cstring("s1"), int16Bytes(0), int16Bytes(0), int16Bytes(1), int16Bytes(1))
+	client.send('D', []byte{'P'}, cstring("p1"))
+	client.send('E', cstring("p1"), int32Bytes(1))
+	client.send('E', cstring("p1"), int32Bytes(1))
+	client.send('E', cstring("p1"), int32Bytes(1))
+	client.send('S')
+	messages = client.receive()
+	expectTypes(t, messages, "12TDsDsCZ")
+	row := dataRow(messages[5])
+	if id := binary.BigEndian.Uint64(row[0]); id != 2 || string(row[1]) != "b" || math.Float64frombits(binary.BigEndian.Uint64(row[2])) != 2.25 {
+		t.Fatalf("unexpected binary row %v", row)
+	}
+
+	// 条件中的参数与比较的列类型相同
+	client.send('P', cstring("s2"), cstring("select * from t1 where id = $1"), int16Bytes(0))
+	client.send('D', []byte{'S'}, cstring("s2"))
+	client.send('S')
+	messages = client.receive()
+	expectTypes(t, messages, "1tTZ")
+	if oids := messages[1].body; !bytes.Equal(oids, bytes.Join([][]byte{int16Bytes(1), int32Bytes(20)}, nil)) {
+		t.Fatalf("unexpected parameter types %v", oids)
+	}
+
+	// 出错后忽略消息直到 Sync
+	client.send('B', cstring(""), cstring("missing"), int16Bytes(0), int16Bytes(0), int16Bytes(0))
+	client.send('E', cstring(""), int32Bytes(0))
+	client.send('S')
+	messages = client.receive()
+	expectTypes(t, messages, "EZ")
+	if code := errorCode(messages[0]); code != "26000" {
+		t.Fatalf("unexpected error code %s", code)
+	}
+	messages = client.query("select * from missing;")
+	if expectTypes(t, messages, "EZ"); errorCode(messages[0]) != "42P01" {
+		t.Fatalf("unexpected error code %s", errorCode(messages[0]))
+	}
+
+	// ReadyForQuery 中的事务状态
+	messages = client.query("begin;")
+	if status := messages[len(messages)-1].body[0]; status != 'T' {
+		t.Fatalf("expected transaction status T, got %c", status)
+	}
+	messages = client.query("delete from t1 where id = 1; rollback;")
+	expectTypes(t, messages, "CCZ")
+	if tag := string(messages[0].body); tag != "DELETE 1\x00" || messages[2].body[0] != 'I' {
+		t.Fatalf("unexpected result %q, status %c", tag, messages[2].body[0])
+	}
+	client.send('X')
+}
+
+// 数据库中有用户时要求明文密码
+func TestPostgresAuthentication(t *testing.T) {
+	srv := server.NewServer(false, true, t.TempDir(), pager.DefaultOptions())
+	defer srv.Shutdown()
+	if err := srv.ListenPostgres("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	address := srv.Addrs()[0].String()
+	client := dialPostgres(t, address)
+	defer client.conn.Close()
+	expectTypes(t, client.query("create table t1(id int); create user admin password 'secret'"), "CCZ")
+	// 创建用户之前建立的连接不再有权限
+	if messages := client.query("select * from t1"); messages[0].typ != 'E' || errorCode(messages[0]) != "42501" {
+		t.Fatalf("expected insufficient privilege, got %c", messages[0].typ)
+	}
+
+	login := func(user string, password string, sql string) pgMessage {
+		client := startPostgres(t, address, user)
+		t.Cleanup(func() { client.conn.Close() })
+		if msg := client.next(); msg.typ != 'R' || binary.BigEndian.Uint32(msg.body) != 3 {
+			t.Fatalf("expected AuthenticationCleartextPassword, got %c", msg.typ)
+		}
+		client.send('p', cstring(password))
+		msg := client.next()
+		if msg.typ == 'R' {
+			// 认证通过后的 ParameterStatus 和 ReadyForQuery
+			client.receive()
+			messages := client.query(sql)
+			return messages[0]
+		}
+		return msg
+	}
+	if msg := login("admin", "secret", "create user bob password 'hunter2'"); msg.typ != 'C' {
+		t.Fatalf("expected command complete, got %c", msg.typ)
+	}
+	if msg := login("bob", "wrong", ""); msg.typ != 'E' || errorCode(msg) != "28P01" {
+		t.Fatalf("expected invalid password, got %c", msg.typ)
+	}
+	if msg := login("bob", "hunter2", "insert into t1 values(1)"); msg.typ != 'E' || errorCode(msg) != "42501" {
+		t.Fatalf("expected insufficient privilege, got %c", msg.typ)
+	}
+	if msg := login("admin", "secret", "insert into t1 values(1)"); msg.typ != 'C' {
+		t.Fatalf("expected command complete, got %c", msg.typ)
+	}
+}
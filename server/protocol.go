@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization"
+	"minidb-go/storage"
+	"minidb-go/tbm"
+	"minidb-go/transporter"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const serverName = "minidb-go"
+
+// 每个 Rows 消息最多包含的行数
+var RowBatchSize = 100
+
+// 处理 transporter 协议的连接，先握手，之后每个请求执行一条语句
+func (server *Server) handle(conn net.Conn) {
+	log.Infof("new connection from %v", conn.RemoteAddr())
+	defer log.Infof("lose connection from %v", conn.RemoteAddr())
+	tc := transporter.NewConn(conn)
+	if !server.waitRequest(conn) {
+		return
+	}
+	user, err := server.handshake(conn, tc)
+	if err != nil {
+		if !server.isClosing() && !errors.Is(err, io.EOF) {
+			log.Errorf("handshake with %v failed: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	// 连接断开时回滚会话中未结束的事务
+	session := NewSession(server.tbm)
+	defer session.Close()
+	session.SetUser(user)
+	for server.waitRequest(conn) {
+		msg, err := tc.Receive()
+		if err != nil {
+			if !server.isClosing() && !errors.Is(err, io.EOF) {
+				log.Error(err)
+			}
+			return
+		}
+
+		if server.writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(server.writeTimeout))
+		}
+		switch msg := msg.(type) {
+		case *transporter.Query:
+			err = session.Handle(tc, msg.SQL)
+		case *transporter.Terminate:
+			return
+		default:
+			// 客户端不应该发送的消息，连接的状态未知
+			tc.Send(&transporter.Error{
+				Code:    transporter.CodeProtocol,
+				Message: fmt.Sprintf("unexpected message %T", msg),
+			})
+			tc.Flush()
+			return
+		}
+		if err == nil {
+			err = tc.Flush()
+		}
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
+
+// 读取 Hello 并回复 Welcome，客户端的版本过低或者认证失败时回复错误。
+// 数据库中有用户时以 Hello 中的 user 和 password 认证，返回认证通过的用户
+func (server *Server) handshake(conn net.Conn, tc *transporter.Conn) (string, error) {
+	msg, err := tc.Receive()
+	if err != nil {
+		return "", err
+	}
+	hello, ok := msg.(*transporter.Hello)
+	if !ok || hello.Magic != transporter.Magic {
+		return "", transporter.ErrBadMagic
+	}
+	if hello.Version < transporter.MinVersion {
+		tc.Send(&transporter.Error{
+			Code:    transporter.CodeProtocol,
+			Message: fmt.Sprintf("unsupported protocol version %d, server supports %d to %d", hello.Version, transporter.MinVersion, transporter.Version),
+		})
+		tc.Flush()
+		return "", fmt.Errorf("unsupported protocol version %d", hello.Version)
+	}
+	user := ""
+	if server.tbm.HasUsers() {
+		user = hello.Params["user"]
+		if err := server.tbm.Authenticate(user, hello.Params["password"]); err != nil {
+			tc.Send(&transporter.Error{
+				Code:    transporter.CodeAuthentication,
+				Message: fmt.Sprintf("password authentication failed for user %q", user),
+			})
+			tc.Flush()
+			return "", fmt.Errorf("%w for user %q", err, user)
+		}
+	}
+	version := hello.Version
+	if version > transporter.Version {
+		version = transporter.Version
+	}
+	if err := tc.Send(&transporter.Welcome{Version: version, Server: serverName}); err != nil {
+		return "", err
+	}
+	tc.SetVersion(version)
+	return user, tc.Flush()
+}
+
+// 执行一条语句并发送结果，语句出错时发送 Error，返回的错误为连接的错误
+func (session *Session) Handle(tc *transporter.Conn, sql string) error {
+	stmt, err := parser.Parse(sql)
+	if err != nil {
+		return tc.Send(session.errorMessage(transporter.NewError(transporter.CodeSyntax, err)))
+	}
+	switch stmt.(type) {
+	case ast.SelectStmt, ast.FetchStmt:
+		return session.stream(tc, stmt)
+	}
+	resultList, err := session.ExecuteStmt(stmt)
+	if err != nil {
+		return tc.Send(session.errorMessage(err))
+	}
+
+	complete := &transporter.Complete{Status: session.status()}
+	if resultList == nil {
+		return tc.Send(complete)
+	}
+	complete.Message = resultList.Message
+	complete.Rows = uint64(len(resultList.Rows) + resultList.RowsAffected)
+	if len(resultList.Columns) > 0 {
+		if err := tc.Send(columnsMessage(resultList.Columns)); err != nil {
+			return err
+		}
+		for start := 0; start < len(resultList.Rows); start += RowBatchSize {
+			end := start + RowBatchSize
+			if end > len(resultList.Rows) {
+				end = len(resultList.Rows)
+			}
+			if err := tc.Send(rowsMessage(resultList.Rows[start:end], len(resultList.Columns))); err != nil {
+				return err
+			}
+		}
+	}
+	return tc.Send(complete)
+}
+
+// 边读取边发送 SELECT 和 FETCH 的结果，每个 Rows 消息最多 RowBatchSize 行。
+// 发送部分结果之后出错时以 Error 结束，客户端需要丢弃已经收到的行
+func (session *Session) stream(tc *transporter.Conn, stmt ast.SQLStatement) error {
+	var connErr error
+	columns := 0
+	n, err := session.Stream(stmt, RowBatchSize, func(cursor *tbm.Cursor) error {
+		columns = len(cursor.Columns)
+		connErr = tc.Send(columnsMessage(cursor.Columns))
+		return connErr
+	}, func(rows []*ast.Row) error {
+		connErr = tc.Send(rowsMessage(rows, columns))
+		if connErr == nil {
+			// 每批数据及时发送给客户端，不在缓冲区中积累
+			connErr = tc.Flush()
+		}
+		return connErr
+	})
+	if connErr != nil {
+		return connErr
+	}
+	if err != nil {
+		return tc.Send(session.errorMessage(err))
+	}
+	return tc.Send(&transporter.Complete{Rows: uint64(n), Status: session.status()})
+}
+
+func (session *Session) status() byte {
+	if session.InTransaction() {
+		return transporter.StatusInTransaction
+	}
+	return transporter.StatusIdle
+}
+
+// 将执行语句的错误转换为带错误码的 Error 消息
+func (session *Session) errorMessage(err error) *transporter.Error {
+	var msg *transporter.Error
+	if !errors.As(err, &msg) {
+		code := transporter.CodeInternal
+		switch {
+		case errors.Is(err, ErrInTransaction), errors.Is(err, ErrNoTransaction):
+			code = transporter.CodeTransactionState
+		case errors.Is(err, serialization.ErrDeadLock):
+			code = transporter.CodeDeadlock
+		case errors.Is(err, serialization.ErrSerialization):
+			code = transporter.CodeSerialization
+		case errors.Is(err, tbm.ErrTableNotExists), errors.Is(err, storage.ErrTableNotExist):
+			code = transporter.CodeUndefinedTable
+		case errors.Is(err, ast.ErrUnboundParam):
+			code = transporter.CodeSyntax
+		case errors.Is(err, ErrCursorNotExist), errors.Is(err, ErrCursorExists):
+			code = transporter.CodeCursor
+		case errors.Is(err, ErrPermissionDenied):
+			code = transporter.CodePermissionDenied
+		}
+		msg = transporter.NewError(code, err)
+	}
+	msg.Status = session.status()
+	return msg
+}
+
+func columnsMessage(resultColumns []tbm.Column) *transporter.Columns {
+	columns := make([]transporter.Column, len(resultColumns))
+	for i, column := range resultColumns {
+		columns[i] = transporter.Column{
+			Name:     column.Name,
+			Type:     columnType(column.Type),
+			Nullable: column.Nullable,
+		}
+	}
+	return &transporter.Columns{Columns: columns}
+}
+
+func columnType(columnType ast.ColumnType) uint8 {
+	switch columnType {
+	case ast.CT_INT:
+		return transporter.TypeInt
+	case ast.CT_FLOAT:
+		return transporter.TypeFloat
+	default:
+		return transporter.TypeText
+	}
+}
+
+// 行末尾隐藏的 xmin 和 xmax 不发送
+func rowsMessage(rows []*ast.Row, columns int) *transporter.Rows {
+	msg := &transporter.Rows{Rows: make([][]transporter.Value, len(rows))}
+	for i, row := range rows {
+		values := make([]transporter.Value, columns)
+		for j := range values {
+			values[j] = wireValue(row.Data[j])
+		}
+		msg.Rows[i] = values
+	}
+	return msg
+}
+
+func wireValue(value ast.SQLExprValue) transporter.Value {
+	switch value := value.(type) {
+	case *ast.SQLInt:
+		return int64(*value)
+	case *ast.SQLFloat:
+		return float64(*value)
+	case *ast.SQLText:
+		return string(*value)
+	}
+	return nil
+}
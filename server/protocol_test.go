@@ -0,0 +1,244 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"minidb-go/transporter"
+	"net"
+	"testing"
+)
+
+func TestProtocol(t *testing.T) {
+	srv := server.NewServer(false, true, t.TempDir(), pager.DefaultOptions())
+	defer srv.Shutdown()
+	if err := srv.Listen("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	address := srv.Addrs()[0].String()
+	server.RowBatchSize = 2
+	defer func() { server.RowBatchSize = 100 }()
+
+	conn, tc := dial(t, "tcp", address)
+	defer conn.Close()
+	exec(t, tc, "create table t1(id int, name text, score float);")
+	for i := 1; i <= 5; i++ {
+		exec(t, tc, fmt.Sprintf("insert into t1 values(%d, 'name%d', %d.25);", i, i, i))
+	}
+
+	// 结果按批发送，不包含隐藏的 xmin 和 xmax
+	if err := tc.Send(&transporter.Query{SQL: "select * from t1;"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	batches := 0
+	rows := 0
+	for done := false; !done; {
+		msg, err := tc.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch msg := msg.(type) {
+		case *transporter.Columns:
+			expected := []transporter.Column{
+				{Name: "id", Type: transporter.TypeInt},
+				{Name: "name", Type: transporter.TypeText},
+				{Name: "score", Type: transporter.TypeFloat},
+			}
+			if fmt.Sprint(msg.Columns) != fmt.Sprint(expected) {
+				t.Fatalf("unexpected columns %v", msg.Columns)
+			}
+		case *transporter.Rows:
+			batches++
+			for _, row := range msg.Rows {
+				rows++
+				if len(row) != 3 || row[0] != int64(rows) || row[1] != fmt.Sprintf("name%d", rows) || row[2] != float64(rows)+0.25 {
+					t.Fatalf("unexpected row %v", row)
+				}
+			}
+		case *transporter.Complete:
+			if msg.Rows != 5 || msg.Status != transporter.StatusIdle {
+				t.Fatalf("unexpected complete %+v", msg)
+			}
+			done = true
+		default:
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+	if batches != 3 || rows != 5 {
+		t.Fatalf("expected 5 rows in 3 batches, got %d rows in %d batches", rows, batches)
+	}
+
+	var serverErr *transporter.Error
+	// 游标分批读取，每次 FETCH 的结果同样按批发送
+	exec(t, tc, "begin;")
+	exec(t, tc, "declare c cursor for select * from t1;")
+	stream, err := tc.Query("fetch 3 from c;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches = 0
+	for {
+		rows, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches++
+		if len(rows) > server.RowBatchSize {
+			t.Fatalf("batch of %d rows is larger than %d", len(rows), server.RowBatchSize)
+		}
+	}
+	if len(stream.Columns) != 3 || batches != 2 || stream.Complete().Rows != 3 {
+		t.Fatalf("expected 3 rows in 2 batches, got %d rows in %d batches", stream.Complete().Rows, batches)
+	}
+	if result := exec(t, tc, "fetch all from c;"); len(result.Rows) != 2 || result.Rows[0][0] != int64(4) {
+		t.Fatalf("expected the last 2 rows, got %v", result.Rows)
+	}
+	exec(t, tc, "close c;")
+	if _, err := tc.Exec("fetch c;"); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodeCursor {
+		t.Fatalf("expected cursor error, got %v", err)
+	}
+	exec(t, tc, "commit;")
+
+	// 修改语句只返回影响的行数
+	if result := exec(t, tc, "update t1 set score = 0.5 where id = 5;"); result.RowCount != 1 || result.Message != "UPDATE 1" || len(result.Columns) != 0 {
+		t.Fatalf("unexpected update result %+v", result)
+	}
+
+	// 版本 1 的客户端收到的 Columns 没有 flags
+	v1, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+	v1Conn := transporter.NewConn(v1)
+	v1Conn.Send(&transporter.Hello{Magic: transporter.Magic, Version: 1})
+	v1Conn.Flush()
+	if msg, err := v1Conn.Receive(); err != nil || msg.(*transporter.Welcome).Version != 1 {
+		t.Fatalf("expected version 1, got %v, %v", msg, err)
+	}
+	v1Conn.SetVersion(1)
+	if result, err := v1Conn.Exec("select * from t1 where id = 5;"); err != nil || len(result.Columns) != 3 || result.Rows[0][2] != 0.5 {
+		t.Fatalf("unexpected result for version 1 client %+v, %v", result, err)
+	}
+
+	// 没有读完的结果可以直接丢弃
+	stream, err = tc.Query("select * from t1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 错误带有错误码和事务状态，连接仍然可以使用
+	if _, err := tc.Exec("select * from missing;"); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodeUndefinedTable {
+		t.Fatalf("expected undefined table error, got %v", err)
+	}
+	if _, err := tc.Exec("selec * from t1;"); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodeSyntax {
+		t.Fatalf("expected syntax error, got %v", err)
+	}
+	if result := exec(t, tc, "begin;"); result.Status != transporter.StatusInTransaction {
+		t.Fatalf("expected in transaction status, got %q", result.Status)
+	}
+	if _, err := tc.Exec("begin;"); !errors.As(err, &serverErr) ||
+		serverErr.Code != transporter.CodeTransactionState || serverErr.Status != transporter.StatusInTransaction {
+		t.Fatalf("expected transaction state error, got %+v", err)
+	}
+	if result := exec(t, tc, "rollback;"); result.Status != transporter.StatusIdle {
+		t.Fatalf("expected idle status, got %q", result.Status)
+	}
+
+	// 版本过低的客户端被拒绝
+	old, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	oldConn := transporter.NewConn(old)
+	oldConn.Send(&transporter.Hello{Magic: transporter.Magic, Version: 0})
+	oldConn.Flush()
+	if msg, err := oldConn.Receive(); err != nil || msg.(*transporter.Error).Code != transporter.CodeProtocol {
+		t.Fatalf("expected protocol error, got %v, %v", msg, err)
+	}
+
+	// 不是 Hello 的连接被直接断开
+	bad, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	frame := []byte{transporter.MsgQuery, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], 4)
+	bad.Write(append(frame, 0, 0, 0, 0))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// 数据库中有用户之后连接需要认证，没有权限的语句返回 CodePermissionDenied
+func TestAuthentication(t *testing.T) {
+	srv := server.NewServer(false, true, t.TempDir(), pager.DefaultOptions())
+	defer srv.Shutdown()
+	if err := srv.Listen("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	address := srv.Addrs()[0].String()
+
+	conn, tc := dial(t, "tcp", address)
+	defer conn.Close()
+	exec(t, tc, "create table t1(id int, name text);")
+	exec(t, tc, "create user admin password 'secret';")
+	// 创建用户之前建立的连接不再有权限
+	var serverErr *transporter.Error
+	if _, err := tc.Exec("select * from t1;"); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodePermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	login := func(params map[string]string) (*transporter.Conn, error) {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		tc := transporter.NewConn(conn)
+		_, err = tc.Handshake(params)
+		return tc, err
+	}
+	admin, err := login(map[string]string{"user": "admin", "password": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, admin, "create user bob password 'hunter2';")
+	exec(t, admin, "grant select on t1 to bob;")
+	for _, params := range []map[string]string{
+		nil,
+		{"user": "bob", "password": "wrong"},
+		{"user": "nobody", "password": "hunter2"},
+	} {
+		if _, err := login(params); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodeAuthentication {
+			t.Fatalf("expected authentication error for %v, got %v", params, err)
+		}
+	}
+
+	bob, err := login(map[string]string{"user": "bob", "password": "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, bob, "select * from t1;")
+	if _, err := bob.Exec("insert into t1 values(1, 'a');"); !errors.As(err, &serverErr) || serverErr.Code != transporter.CodePermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	exec(t, admin, "insert into t1 values(1, 'a');")
+}
@@ -1,101 +1,273 @@
 package server
 
 import (
-	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"minidb-go/storage/pager"
 	"minidb-go/tbm"
-	"minidb-go/transporter"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	NETWORK = "tcp"
-	ADDRESS = "127.0.0.1:8080"
-)
-
 type Server struct {
 	tbm *tbm.TableManager
+
+	// 连接空闲超过 idleTimeout 后断开，发送响应超过 writeTimeout 时断开，为 0 时不超时
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	// 退出时等待正在执行的语句结束的时间，为 0 时一直等待
+	shutdownTimeout time.Duration
+
+	// 保护 listeners、conns 和 closing，closing 之后不再接受新的连接和请求
+	lock      sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closing   bool
+	// 正在处理的连接
+	handlers sync.WaitGroup
 }
 
-func NewServer(isOpen, isCreate bool, path string) *Server {
-	server := &Server{}
+// options: 缓冲池的配置
+func NewServer(isOpen, isCreate bool, path string, options pager.Options) *Server {
+	server := &Server{
+		conns: make(map[net.Conn]struct{}),
+	}
 	if isOpen && isCreate {
 		logrus.Fatal("create and open can't be both true")
 		return nil
 	}
+	var err error
 	if isCreate {
 		log.Infof("create database: %v", path)
-		server.tbm = tbm.Create(path)
+		server.tbm, err = tbm.CreateWithOptions(path, options)
 	} else if isOpen {
 		log.Infof("open database: %v", path)
-		server.tbm = tbm.Open(path)
+		server.tbm, err = tbm.OpenWithOptions(path, options)
 	} else {
 		logrus.Fatal("create or open database")
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
 	return server
 }
 
-func (server *Server) Start() {
-	go func() {
-		listener, err := net.Listen(NETWORK, ADDRESS)
+// interval 为 0 时不启动 autovacuum
+func (server *Server) StartAutoVacuum(interval time.Duration) {
+	if interval > 0 {
+		log.Infof("autovacuum every %v", interval)
+		server.tbm.StartAutoVacuum(interval)
+	}
+}
+
+// interval 为 0 时不启动后台 checkpoint
+func (server *Server) StartCheckPoint(interval time.Duration) {
+	if interval > 0 {
+		log.Infof("checkpoint every %v", interval)
+		server.tbm.StartCheckPoint(interval)
+	}
+}
+
+func (server *Server) SetTimeouts(idleTimeout time.Duration, writeTimeout time.Duration) {
+	server.idleTimeout = idleTimeout
+	server.writeTimeout = writeTimeout
+}
+
+func (server *Server) SetShutdownTimeout(shutdownTimeout time.Duration) {
+	server.shutdownTimeout = shutdownTimeout
+}
+
+// 在 TCP 地址 address 和 unix socket 路径 socket 上监听，收到退出信号后关闭服务和数据库
+func (server *Server) Start(address string, socket string) {
+	if err := server.Listen(address, socket); err != nil {
+		log.Fatal(err)
+	}
+	WaitForExit()
+	server.Shutdown()
+}
+
+// 在 TCP 地址 address 和 unix socket 路径 socket 上监听，为空时不监听
+func (server *Server) Listen(address string, socket string) error {
+	if address == "" && socket == "" {
+		return errors.New("listen address and unix socket can't be both empty")
+	}
+	if address != "" {
+		listener, err := net.Listen("tcp", address)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		defer func() {
-			listener.Close()
-			if server.tbm != nil {
-				server.tbm.Close()
-			}
-		}()
-		log.Infof("server start at %v://%v", NETWORK, ADDRESS)
+		server.serve(listener, server.handle)
+	}
+	if socket != "" {
+		// 上次异常退出时留下的 socket 文件
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			return err
+		}
+		server.serve(listener, server.handle)
+	}
+	return nil
+}
+
+// 正在监听的地址
+func (server *Server) Addrs() []net.Addr {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	addrs := make([]net.Addr, len(server.listeners))
+	for i, listener := range server.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+/*
+停止接受新的连接，等待正在执行的语句结束后断开连接并回滚未结束的事务，
+超过 shutdownTimeout 时强制断开。最后关闭数据库，写回脏页并做 checkpoint，
+下次打开时不需要恢复。
+*/
+func (server *Server) Shutdown() {
+	server.lock.Lock()
+	server.closing = true
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	// 让等待请求的连接立即返回，正在执行语句的连接在发送响应后返回
+	for conn := range server.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	server.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if server.shutdownTimeout > 0 {
+		timeout = time.After(server.shutdownTimeout)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		server.lock.Lock()
+		log.Warnf("%d connections still running after %v, closing them", len(server.conns), server.shutdownTimeout)
+		for conn := range server.conns {
+			conn.Close()
+		}
+		server.lock.Unlock()
+	}
+
+	log.Infof("buffer pool stats: %v", server.tbm.BufferPoolStats())
+	// 强制断开的连接中未结束的事务在这里回滚
+	if err := server.tbm.Close(); err != nil {
+		log.Errorf("close database failed, it will be recovered on the next start: %v", err)
+		return
+	}
+	log.Info("database closed")
+}
+
+// 在 listener 上接受连接，每个连接由 handler 在单独的 goroutine 中处理
+func (server *Server) serve(listener net.Listener, handler func(net.Conn)) {
+	server.lock.Lock()
+	server.listeners = append(server.listeners, listener)
+	server.lock.Unlock()
+	log.Infof("server start at %v://%v", listener.Addr().Network(), listener.Addr())
+	go func() {
+		var delay time.Duration
 		for {
 			conn, err := listener.Accept()
+			// 退出时关闭了 listener
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 文件描述符耗尽等错误可能是暂时的，等待一段时间后重试
 			if err != nil {
-				log.Fatal(err)
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay < time.Second {
+					delay *= 2
+				}
+				log.Errorf("accept failed: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+
+			server.lock.Lock()
+			if server.closing {
+				server.lock.Unlock()
+				conn.Close()
+				return
 			}
-			go server.handle(conn)
+			server.conns[conn] = struct{}{}
+			server.handlers.Add(1)
+			server.lock.Unlock()
+			go func() {
+				defer server.release(conn)
+				handler(conn)
+			}()
 		}
 	}()
-	WaitForExit()
 }
 
-func (server *Server) handle(conn net.Conn) {
-	log.Infof("new connection from %v", conn.RemoteAddr())
-	defer func() {
-		log.Infof("lose connection from %v", conn.RemoteAddr())
-		conn.Close()
-	}()
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	for {
-		request := &transporter.Request{}
-		err := dec.Decode(request)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-
-		response := ExecuteStmt(server.tbm, request)
-		err = enc.Encode(response)
-		if err != nil {
-			log.Error(err)
-			return
-		}
+// 设置下一个请求的读取期限，退出时返回 false
+func (server *Server) waitRequest(conn net.Conn) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.closing {
+		return false
+	}
+	if server.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(server.idleTimeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
 	}
+	return true
 }
 
+// 关闭连接，退出时不再等待该连接
+func (server *Server) release(conn net.Conn) {
+	conn.Close()
+	server.lock.Lock()
+	delete(server.conns, conn)
+	server.lock.Unlock()
+	server.handlers.Done()
+}
+
+func (server *Server) isClosing() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.closing
+}
+
+// 等待 SIGINT、SIGTERM 或者标准输入的 exit，再次收到信号时直接退出
 func WaitForExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
 	// 设置退出信号
-	exit := make(chan bool)
+	exit := make(chan bool, 1)
 
-	// 等待用户输入
+	// 等待用户输入，标准输入关闭时只等待信号
 	go func() {
 		var input string
 		for {
 			_, err := fmt.Scanln(&input)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return
+			}
 			if err != nil {
 				log.Error(err)
 				continue
@@ -109,6 +281,10 @@ func WaitForExit() {
 	}()
 
 	// 等待退出信号
-	<-exit
-	log.Info("exit")
+	select {
+	case sig := <-signals:
+		log.Infof("received %v, exit", sig)
+	case <-exit:
+		log.Info("exit")
+	}
 }
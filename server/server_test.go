@@ -0,0 +1,70 @@
+package server_test
+
+import (
+	"minidb-go/client"
+	"minidb-go/server"
+	"minidb-go/storage/pager"
+	"minidb-go/tbm"
+	"minidb-go/transporter"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func exec(t *testing.T, tc *transporter.Conn, stmt string) *transporter.Result {
+	result, err := tc.Exec(stmt)
+	if err != nil {
+		t.Fatalf("%s: %v", stmt, err)
+	}
+	return result
+}
+
+func dial(t *testing.T, network string, address string) (net.Conn, *transporter.Conn) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := transporter.NewConn(conn)
+	if _, err := tc.Handshake(nil); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, tc
+}
+
+// 退出时断开连接，回滚未结束的事务并关闭数据库
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "minidb.sock")
+	srv := server.NewServer(false, true, dir, pager.DefaultOptions())
+	srv.SetShutdownTimeout(5 * time.Second)
+	if err := srv.Listen("", socket); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, tc := dial(t, "unix", socket)
+	defer conn.Close()
+	exec(t, tc, "create table t1(id int, name text, age int);")
+	exec(t, tc, "begin;")
+	exec(t, tc, "insert into t1 values(1, 'a', 1);")
+	if _, err := client.NewClient("", socket).Exec("insert into t1 values(2, 'b', 2);"); err != nil {
+		t.Fatalf("autocommit insert failed: %v", err)
+	}
+
+	srv.Shutdown()
+	if _, err := net.Dial("unix", socket); err == nil {
+		t.Fatal("server should stop accepting connections")
+	}
+	if _, err := tc.Receive(); err == nil {
+		t.Fatal("connection should be closed")
+	}
+
+	db := tbm.Open(dir)
+	defer db.Close()
+	session := server.NewSession(db)
+	defer session.Close()
+	if n := countRows(t, session); n != 1 {
+		t.Fatalf("expected only the committed row, got %d rows", n)
+	}
+}
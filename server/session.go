@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/tbm"
+	"sync"
+)
+
+var (
+	ErrInTransaction    = errors.New("there is already a transaction in progress")
+	ErrNoTransaction    = errors.New("there is no transaction in progress")
+	ErrPreparedNotExist = errors.New("prepared statement not exist")
+	ErrCursorNotExist   = errors.New("cursor not exist")
+	ErrCursorExists     = errors.New("cursor already exists")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrRowsClosed       = errors.New("rows are closed")
+)
+
+/*
+每个连接对应一个会话，会话持有连接上正在进行的事务、设置、预处理语句和游标。
+事务只能由开启它的会话提交或者回滚，连接断开时通过 Close 回滚未结束的事务。
+游标属于事务，事务结束时关闭。
+*/
+type Session struct {
+	tbm *tbm.TableManager
+
+	// 当前的事务，为 0 时每条语句在单独的事务中执行
+	xid tm.XID
+	// 会话级别的设置
+	settings map[string]string
+	// 按名字保存的预处理语句
+	prepared map[string]ast.SQLStatement
+	// DECLARE CURSOR 打开的游标
+	cursors map[string]*tbm.Cursor
+	// Query 打开的还没有关闭的结果
+	rows map[*Rows]bool
+	// 认证通过的用户，数据库中有用户之后，没有用户的会话不能执行任何语句
+	user string
+	// 进程内使用时可以直接访问数据文件，不检查权限
+	trusted bool
+
+	// 同一个会话中的语句按顺序执行，Close 可能与正在执行的语句并发
+	lock sync.Mutex
+}
+
+func NewSession(tableManager *tbm.TableManager) *Session {
+	return &Session{
+		tbm:      tableManager,
+		settings: make(map[string]string),
+		prepared: make(map[string]ast.SQLStatement),
+		cursors:  make(map[string]*tbm.Cursor),
+		rows:     make(map[*Rows]bool),
+	}
+}
+
+// 设置会话的用户，之后的语句按该用户的权限执行
+func (session *Session) SetUser(name string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.user = name
+}
+
+// 不检查会话的权限，用于进程内打开的数据库
+func (session *Session) SetTrusted() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.trusted = true
+}
+
+// 是否有正在进行的事务
+func (session *Session) InTransaction() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.xid != 0
+}
+
+func (session *Session) Set(name string, value string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.settings[name] = value
+}
+
+func (session *Session) Setting(name string) (string, bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	value, ok := session.settings[name]
+	return value, ok
+}
+
+// 解析语句并以 name 保存，同名的语句会被替换
+func (session *Session) Prepare(name string, stmt string) error {
+	parsed, err := parser.Parse(stmt)
+	if err != nil {
+		return err
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.prepared[name] = parsed
+	return nil
+}
+
+func (session *Session) Deallocate(name string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	delete(session.prepared, name)
+}
+
+// 执行一条 SQL 语句
+func (session *Session) Execute(stmt string) (*tbm.ResultList, error) {
+	parsed, err := parser.Parse(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return session.ExecuteStmt(parsed)
+}
+
+// 执行以 name 保存的预处理语句
+func (session *Session) ExecutePrepared(name string) (*tbm.ResultList, error) {
+	session.lock.Lock()
+	stmt, ok := session.prepared[name]
+	session.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPreparedNotExist, name)
+	}
+	return session.ExecuteStmt(stmt)
+}
+
+// 回滚会话中未结束的事务，连接断开时调用
+func (session *Session) Close() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.xid != 0 {
+		session.endTransaction()
+		session.tbm.Abort(session.xid)
+		session.xid = 0
+	}
+	for rows := range session.rows {
+		session.closeRows(rows, false)
+	}
+	session.prepared = make(map[string]ast.SQLStatement)
+}
+
+// 事务结束时关闭事务中打开的游标和结果，需要持有 session.lock
+func (session *Session) endTransaction() {
+	for rows := range session.rows {
+		if rows.xid == 0 {
+			session.closeRows(rows, false)
+		}
+	}
+	for name, cursor := range session.cursors {
+		cursor.Close()
+		delete(session.cursors, name)
+	}
+}
+
+// 游标返回的列，用于在 FETCH 执行之前描述结果
+func (session *Session) CursorColumns(name string) ([]tbm.Column, error) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	cursor, ok := session.cursors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCursorNotExist, name)
+	}
+	return cursor.Columns, nil
+}
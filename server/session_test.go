@@ -0,0 +1,284 @@
+package server_test
+
+import (
+	"errors"
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/server"
+	"minidb-go/tbm"
+	"testing"
+)
+
+func countRows(t *testing.T, session *server.Session) int {
+	resultList, err := session.Execute("select * from t1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(resultList.Rows)
+}
+
+// 事务属于开启它的会话，其他会话不能提交，会话关闭时回滚未结束的事务
+func TestSession(t *testing.T) {
+	db := tbm.Create(t.TempDir())
+	defer db.Close()
+
+	s1 := server.NewSession(db)
+	s2 := server.NewSession(db)
+	defer s2.Close()
+	if _, err := s1.Execute("create table t1(id int, name text, age int);"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Execute("begin;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Execute("begin;"); !errors.Is(err, server.ErrInTransaction) {
+		t.Fatalf("expected %v, got %v", server.ErrInTransaction, err)
+	}
+	if _, err := s1.Execute("insert into t1 values(1, 'a', 1);"); err != nil {
+		t.Fatal(err)
+	}
+	if !s1.InTransaction() || s2.InTransaction() {
+		t.Fatal("transaction should only belong to s1")
+	}
+	if n := countRows(t, s1); n != 1 {
+		t.Fatalf("s1 should see its own row, got %d rows", n)
+	}
+	if n := countRows(t, s2); n != 0 {
+		t.Fatalf("s2 should not see uncommitted rows, got %d rows", n)
+	}
+	if _, err := s2.Execute("commit;"); !errors.Is(err, server.ErrNoTransaction) {
+		t.Fatalf("expected %v, got %v", server.ErrNoTransaction, err)
+	}
+
+	// 连接断开
+	s1.Close()
+	if n := countRows(t, s2); n != 0 {
+		t.Fatalf("rows of closed session should be rolled back, got %d rows", n)
+	}
+
+	// 没有事务时每条语句单独提交
+	if _, err := s2.Execute("insert into t1 values(2, 'b', 2);"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Prepare("count", "select * from t1 where id = 2;"); err != nil {
+		t.Fatal(err)
+	}
+	s3 := server.NewSession(db)
+	defer s3.Close()
+	if n := countRows(t, s3); n != 1 {
+		t.Fatalf("expected 1 committed row, got %d rows", n)
+	}
+	if _, err := s3.ExecutePrepared("count"); !errors.Is(err, server.ErrPreparedNotExist) {
+		t.Fatalf("prepared statements should belong to the session, got %v", err)
+	}
+	resultList, err := s2.ExecutePrepared("count")
+	if err != nil || len(resultList.Rows) != 1 {
+		t.Fatalf("expected 1 row from prepared statement, got %v, %v", resultList, err)
+	}
+}
+
+// 游标在事务中分批读取结果，事务结束时关闭
+func TestCursor(t *testing.T) {
+	db := tbm.Create(t.TempDir())
+	defer db.Close()
+	session := server.NewSession(db)
+	defer session.Close()
+
+	if _, err := session.Execute("create table t1(id int, name text);"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if _, err := session.Execute(fmt.Sprintf("insert into t1 values(%d, 'name%d');", i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := session.Execute("declare c cursor for select * from t1;"); !errors.Is(err, server.ErrNoTransaction) {
+		t.Fatalf("expected %v, got %v", server.ErrNoTransaction, err)
+	}
+	if _, err := session.Execute("begin;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("declare c cursor for select * from t1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("declare c cursor for select * from t1;"); !errors.Is(err, server.ErrCursorExists) {
+		t.Fatalf("expected %v, got %v", server.ErrCursorExists, err)
+	}
+	next := 1
+	fetch := func(stmt string, expected int) {
+		resultList, err := session.Execute(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resultList.Rows) != expected || len(resultList.Columns) != 2 {
+			t.Fatalf("%s: expected %d rows, got %d", stmt, expected, len(resultList.Rows))
+		}
+		for _, row := range resultList.Rows {
+			if row.Data[0].String() != fmt.Sprint(next) {
+				t.Fatalf("%s: expected id %d, got %v", stmt, next, row.Data[0])
+			}
+			next++
+		}
+	}
+	fetch("fetch 30 from c;", 30)
+	fetch("fetch c;", 1)
+	fetch("fetch next in c;", 1)
+	fetch("fetch all from c;", 68)
+	fetch("fetch c;", 0)
+	if _, err := session.Execute("close c;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("fetch c;"); !errors.Is(err, server.ErrCursorNotExist) {
+		t.Fatalf("expected %v, got %v", server.ErrCursorNotExist, err)
+	}
+
+	// 提前关闭没有读完的游标，事务结束时关闭剩余的游标
+	if _, err := session.Execute("declare c1 cursor for select * from t1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("declare c2 cursor for select * from t1 where id = 5;"); err != nil {
+		t.Fatal(err)
+	}
+	next = 1
+	fetch("fetch c1;", 1)
+	if _, err := session.Execute("close c1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("commit;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute("fetch c2;"); !errors.Is(err, server.ErrCursorNotExist) {
+		t.Fatalf("cursor should be closed after commit, got %v", err)
+	}
+
+	// 不在事务中的 SELECT 按批读取
+	batches := 0
+	n, err := session.Stream(ast.SelectStmt{TableName: "t1"}, 30, func(cursor *tbm.Cursor) error {
+		return nil
+	}, func(rows []*ast.Row) error {
+		batches++
+		return nil
+	})
+	if err != nil || n != 100 || batches != 4 {
+		t.Fatalf("expected 100 rows in 4 batches, got %d rows in %d batches, %v", n, batches, err)
+	}
+	// 回调出错时停止读取
+	stop := errors.New("stop")
+	n, err = session.Stream(ast.SelectStmt{TableName: "t1"}, 30, func(cursor *tbm.Cursor) error {
+		return nil
+	}, func(rows []*ast.Row) error {
+		return stop
+	})
+	if err != stop || n != 30 || session.InTransaction() {
+		t.Fatalf("expected to stop after the first batch, got %d rows, %v", n, err)
+	}
+}
+
+// 数据库中有用户之后，没有认证的会话不能执行语句，普通用户只能执行授予的操作
+func TestPrivileges(t *testing.T) {
+	tbm.PasswordIterations = 16
+	defer func() { tbm.PasswordIterations = 4096 }()
+	db := tbm.Create(t.TempDir())
+	defer db.Close()
+	anonymous := server.NewSession(db)
+	defer anonymous.Close()
+	admin := server.NewSession(db)
+	defer admin.Close()
+	admin.SetUser("admin")
+	bob := server.NewSession(db)
+	defer bob.Close()
+	bob.SetUser("bob")
+
+	// 还没有用户时不检查权限
+	for _, stmt := range []string{
+		"create table t1(id int, name text);",
+		"create table t2(id int, name text);",
+		"insert into t1 values(1, 'a');",
+		"begin;",
+		"create user admin password 'secret';",
+	} {
+		if _, err := anonymous.Execute(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	// 创建第一个用户的会话也不能再读写表或者授予自己权限，只能结束之前的事务
+	for _, stmt := range []string{
+		"select * from t1;",
+		"grant all on all to admin;",
+		"create user eve password 'x';",
+	} {
+		if _, err := anonymous.Execute(stmt); !errors.Is(err, server.ErrPermissionDenied) {
+			t.Fatalf("%s: expected %v, got %v", stmt, server.ErrPermissionDenied, err)
+		}
+	}
+	if _, err := anonymous.Execute("commit;"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range []string{
+		"create user bob with password 'hunter2';",
+		"grant select, insert on t1 to bob;",
+		"grant select on all to bob;",
+	} {
+		if _, err := admin.Execute(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if !db.IsSuperuser("admin") || db.IsSuperuser("bob") {
+		t.Fatal("only the first user should be a superuser")
+	}
+	if db.Authenticate("bob", "hunter2") != nil || !errors.Is(db.Authenticate("bob", "wrong"), tbm.ErrAuthentication) ||
+		!errors.Is(db.Authenticate("nobody", ""), tbm.ErrAuthentication) {
+		t.Fatal("unexpected authentication result")
+	}
+
+	allowed := []string{
+		"select * from t1;",
+		"select * from t2;",
+		"insert into t1 values(2, 'b');",
+		"alter user bob password 'changed';",
+	}
+	for _, stmt := range allowed {
+		if _, err := bob.Execute(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	denied := []string{
+		"insert into t2 values(1, 'a');",
+		"update t1 set name = 'c' where id = 1;",
+		"delete from t1 where id = 1;",
+		"create table t3(id int);",
+		"vacuum;",
+		"create user eve password 'x';",
+		"alter user admin password 'x';",
+		"grant all on all to bob;",
+	}
+	for _, stmt := range denied {
+		if _, err := bob.Execute(stmt); !errors.Is(err, server.ErrPermissionDenied) {
+			t.Fatalf("%s: expected %v, got %v", stmt, server.ErrPermissionDenied, err)
+		}
+	}
+
+	// 撤销针对单个表的权限，对所有表授予的权限不受影响
+	if _, err := admin.Execute("revoke insert, select on t1 from bob;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Execute("insert into t1 values(3, 'c');"); !errors.Is(err, server.ErrPermissionDenied) {
+		t.Fatalf("expected %v, got %v", server.ErrPermissionDenied, err)
+	}
+	if _, err := bob.Execute("select * from t1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Execute("grant delete on missing to bob;"); !errors.Is(err, tbm.ErrTableNotExists) {
+		t.Fatalf("expected %v, got %v", tbm.ErrTableNotExists, err)
+	}
+	if _, err := admin.Execute("drop user admin;"); !errors.Is(err, tbm.ErrLastSuperuser) {
+		t.Fatalf("expected %v, got %v", tbm.ErrLastSuperuser, err)
+	}
+	if _, err := admin.Execute("drop user bob;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Execute("select * from t1;"); !errors.Is(err, server.ErrPermissionDenied) {
+		t.Fatalf("dropped user should have no privileges, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/pager"
+	"minidb-go/util/vfs"
+	"os"
+	"path/filepath"
+)
+
+// 一次备份的统计信息
+type BackupStat struct {
+	Dir   string
+	Pages int
+	// 备份中的 redo log 的范围，恢复时从 StartLSN 重放到 EndLSN
+	StartLSN int64
+	EndLSN   int64
+}
+
+func (stat *BackupStat) String() string {
+	return fmt.Sprintf("%s: %d pages, redo log from %d to %d",
+		stat.Dir, stat.Pages, stat.StartLSN, stat.EndLSN)
+}
+
+/*
+在线备份页文件、redo log 和控制文件到 dir 中，备份期间不阻塞其他事务的读写。
+copyXIDFile 负责复制 XID 文件，在页复制完之后、确定日志的结束位置之前调用，
+此时已提交的事务的日志都在结束位置之前，之后提交的事务在备份中是未结束的，恢复时被回滚。
+不记录日志的修改（建表、重建索引）需要由调用者在备份期间阻止。
+*/
+func (dm *DataManager) Backup(dir string, nextXID tm.XID, copyXIDFile func() error) (*BackupStat, error) {
+	if err := dm.CheckPoint(nextXID); err != nil {
+		return nil, err
+	}
+	data := dm.recovery.StartBackup()
+	defer dm.recovery.EndBackup()
+
+	name := filepath.Join(dir, pager.PAGE_FILE_NAME)
+	file, err := vfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat := &BackupStat{Dir: dir, StartLSN: data.RedoStartLSN}
+	copied, err := dm.pager.CopyPages(file, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyXIDFile(); err != nil {
+		return nil, err
+	}
+	// 复制的页写回时对应的日志已经落盘，结束位置需要在最后一次复制页之后确定，
+	// 复制期间分配的新页需要再复制一次，直到没有新页为止
+	for {
+		dm.pager.LogBarrier(func() {
+			stat.EndLSN = dm.recovery.CurrentLSN()
+		})
+		pageCount, err := dm.pager.CopyPages(file, copied)
+		if err != nil {
+			return nil, err
+		}
+		if pageCount == copied {
+			break
+		}
+		copied = pageCount
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	stat.Pages = int(copied)
+
+	if err := dm.recovery.BackupLog(dir, data, stat.EndLSN); err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
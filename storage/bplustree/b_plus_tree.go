@@ -5,6 +5,9 @@ B+ 树并行访问协议如下：
 然后在根节点中查找key应该出现的孩子节点，获取孩子节点的读锁，
 然后释放根节点的读锁，以此类推，直到找到目标叶子节点，此时该叶子节点获取了读锁。
 
+插入和删除时持有树的写锁，分裂会修改父节点和根节点，查找在从根节点向下查找期间持有树的读锁，
+找到叶子节点之后沿着叶子节点链表读取时不再持有树的锁。
+
 对于删除和插入操作，也是从根节点开始，
 先获取根节点的写锁，一旦孩子节点也获取了写锁，
 检查根节点是否安全，如果安全释放孩子节点所有祖先节点的写锁，
@@ -16,10 +19,10 @@ package bplustree
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
 	"minidb-go/storage/index"
 	p "minidb-go/storage/pager"
-	"minidb-go/storage/recovery"
 	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
 	"sync"
@@ -33,6 +36,8 @@ type BPlusTree struct {
 	Root      util.UUID
 	FirstLeaf util.UUID
 	LastLeaf  util.UUID
+	// 节点所在的页在写入磁盘时是否压缩
+	Compressed bool
 
 	order     uint16
 	keySize   uint8
@@ -42,18 +47,22 @@ type BPlusTree struct {
 	columnId uint16
 
 	pager *p.Pager
-	rec   *recovery.Recovery
 
 	lock sync.RWMutex
 }
 
+// 表的元数据通过 gob 编码，其中的索引是接口类型
+func init() {
+	gob.Register(&BPlusTree{})
+}
+
 // pager: 分页器
 // keySize: 主键的大小， 单位 byte
 // valueSize: 值的大小， 单位 byte， 不能小于 4 byte
 // return:
 // 		tree: b+树
 func NewTree(pager *p.Pager, keySize uint8, valueSize uint8,
-	tableId uint16, columnId uint16, rec *recovery.Recovery) *BPlusTree {
+	tableId uint16, columnId uint16) *BPlusTree {
 	// order: 每个节点的最大项数，需要为偶数
 	order := uint16((util.PAGE_SIZE-1024)/uint16(keySize+valueSize)) / 2 * 2
 
@@ -80,13 +89,12 @@ func NewTree(pager *p.Pager, keySize uint8, valueSize uint8,
 	tree.pager = pager
 	tree.tableId = tableId
 	tree.columnId = columnId
-	tree.rec = rec
 
 	rootNode.Keys = make([]index.KeyType, order)
 	rootNode.Values = make([]index.ValueType, order+1)
 	rootNode.tree = tree
 
-	tree.pager.Flush(rootPage)
+	pager.Unpin(rootPage, true)
 	return tree
 }
 
@@ -135,6 +143,59 @@ func (tree *BPlusTree) ValueSize() uint8 {
 	return tree.valueSize
 }
 
+// 从 meta page 中解码出来的树需要设置 pager 之后才能使用
+func (tree *BPlusTree) SetPager(pager *p.Pager) {
+	tree.pager = pager
+}
+
+// 保存在 meta page 中的树的信息，包括不导出的字段
+type treeInfo struct {
+	Root       util.UUID
+	FirstLeaf  util.UUID
+	LastLeaf   util.UUID
+	Compressed bool
+
+	Order     uint16
+	KeySize   uint8
+	ValueSize uint8
+
+	TableId  uint16
+	ColumnId uint16
+}
+
+func (tree *BPlusTree) GobEncode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(treeInfo{
+		Root:       tree.Root,
+		FirstLeaf:  tree.FirstLeaf,
+		LastLeaf:   tree.LastLeaf,
+		Compressed: tree.Compressed,
+		Order:      tree.order,
+		KeySize:    tree.keySize,
+		ValueSize:  tree.valueSize,
+		TableId:    tree.tableId,
+		ColumnId:   tree.columnId,
+	})
+	return buf.Bytes(), err
+}
+
+func (tree *BPlusTree) GobDecode(data []byte) error {
+	var info treeInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return err
+	}
+	tree.Root = info.Root
+	tree.FirstLeaf = info.FirstLeaf
+	tree.LastLeaf = info.LastLeaf
+	tree.Compressed = info.Compressed
+	tree.order = info.Order
+	tree.keySize = info.KeySize
+	tree.valueSize = info.ValueSize
+	tree.tableId = info.TableId
+	tree.columnId = info.ColumnId
+	return nil
+}
+
 func bytesToUUID(bytes []byte) util.UUID {
 	if len(bytes) != 4 {
 		return 0
@@ -151,10 +212,41 @@ func (tree *BPlusTree) getNode(pageNum util.UUID) (*BPlusTreeNode, error) {
 		tree: tree,
 	}
 	page, err := tree.pager.GetPage(pageNum, node)
+	if err != nil {
+		return nil, err
+	}
 	node = page.Data().(*BPlusTreeNode)
 	node.page = page
 	node.tree = tree
-	return node, err
+	return node, nil
+}
+
+// 为节点分配一个新页，返回的页已经被 pin
+func (tree *BPlusTree) newNodePage(node *BPlusTreeNode) *p.Page {
+	page := tree.pager.NewPage(node)
+	page.SetCompressible(tree.Compressed)
+	return page
+}
+
+// 设置之后新分配的节点页是否压缩，根节点也会被设置
+func (tree *BPlusTree) SetCompressed(compressed bool) {
+	// 树的信息保存在 meta page 中
+	metaPage := tree.pager.MetaPage()
+	metaPage.Lock()
+	tree.Compressed = compressed
+	metaPage.Unlock()
+	root, err := tree.getNode(tree.Root)
+	if err != nil {
+		log.Panic(err)
+	}
+	root.page.SetCompressible(compressed)
+	tree.pager.Unpin(root.page, true)
+}
+
+// 释放节点的锁，并 unpin 节点所在的页
+func (tree *BPlusTree) releaseNode(node *BPlusTreeNode, visit VisitType, dirty bool) {
+	unlockNode(node, visit)
+	tree.pager.Unpin(node.page, dirty)
 }
 
 type VisitType bool
@@ -185,69 +277,95 @@ func unlockNode(node *BPlusTreeNode, visit VisitType) {
 // return:
 // 		node: key 应该在的 B+树节点
 // 		index: 在节点中的下标
-func (tree *BPlusTree) searchLowerInTree(key index.KeyType, visit VisitType) (*BPlusTreeNode, uint16) {
+// 		err: 读取节点失败时返回，此时不持有任何节点
+func (tree *BPlusTree) searchLowerInTree(key index.KeyType, visit VisitType) (*BPlusTreeNode, uint16, error) {
 	node, err := tree.getNode(tree.Root)
 	// log.Info(node.Addr)
 	if err != nil {
-		log.Fatalf("tree root page load error: %v", err)
+		return nil, 0, fmt.Errorf("tree root page load error: %w", err)
 	}
 	lockNode(node, visit)
-	index := node.LowerBound(key)
 
 	for !node.isLeaf {
 		if node.Len == 0 {
 			break
 		}
-		index = node.LowerBound(key)
+		index := node.LowerBound(key)
 		childNode, err := tree.getNode(bytesToUUID(node.Values[index]))
 		if err != nil {
-			log.Fatal(err)
+			tree.releaseNode(node, visit, false)
+			return nil, 0, err
 		}
 		lockNode(childNode, visit)
-		unlockNode(node, visit)
+		tree.releaseNode(node, visit, false)
 		node = childNode
 	}
-	return node, uint16(index)
+	return node, node.LowerBound(key), nil
 }
 
 func (tree *BPlusTree) searchUpperInTree(key index.KeyType, visit VisitType) (*BPlusTreeNode, uint16) {
 	node, err := tree.getNode(tree.Root)
 	if err != nil {
-		log.Fatalf("tree root page load error: %v", err)
+		log.Panicf("tree root page load error: %v", err)
 	}
 	lockNode(node, visit)
-	index := node.UpperBound(key)
 
 	for !node.isLeaf {
-		index = node.UpperBound(key)
-		childnNode, err := tree.getNode(bytesToUUID(node.Values[index]))
+		index := node.UpperBound(key)
+		childNode, err := tree.getNode(bytesToUUID(node.Values[index]))
 		if err != nil {
-			log.Fatal(err)
+			log.Panic(err)
 		}
-		lockNode(childnNode, visit)
-		unlockNode(node, visit)
+		lockNode(childNode, visit)
+		tree.releaseNode(node, visit, false)
+		node = childNode
 	}
-	return node, uint16(index)
+	return node, node.UpperBound(key)
 }
 
-func (tree *BPlusTree) Search(key index.KeyType) <-chan index.ValueType {
-	valueChan := make(chan index.ValueType, 64)
+func (tree *BPlusTree) Search(key index.KeyType) *index.SearchResult {
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.search(key)
+}
 
-	leafNode, index := tree.searchLowerInTree(key, Visit_Read)
+// 调用者需要持有树的锁，查找在其他 goroutine 中进行，读取节点失败时不 panic，错误记录在结果中
+func (tree *BPlusTree) search(key index.KeyType) *index.SearchResult {
+	result := index.NewSearchResult(64)
+
+	leafNode, index, err := tree.searchLowerInTree(key, Visit_Read)
+	if err != nil {
+		result.Close(err)
+		return result
+	}
+	// key 等于父节点中的分隔键时，会落在下一个叶子节点的开头
+	if index == leafNode.Len && leafNode.NextLeaf != p.NIL_PAGE_NUM {
+		nextLeafNode, err := tree.getNode(leafNode.NextLeaf)
+		if err != nil {
+			tree.releaseNode(leafNode, Visit_Read, false)
+			result.Close(err)
+			return result
+		}
+		lockNode(nextLeafNode, Visit_Read)
+		tree.releaseNode(leafNode, Visit_Read, false)
+		leafNode = nextLeafNode
+		index = 0
+	}
 	if uint16(index) == leafNode.Len || !bytes.Equal(leafNode.Keys[index], key) {
-		close(valueChan)
-		unlockNode(leafNode, Visit_Read)
-		return valueChan
+		result.Close(nil)
+		tree.releaseNode(leafNode, Visit_Read, false)
+		return result
 	}
 
-	// 往 ValueChan 中放入数据
+	// 往 result 中放入数据
 	go func() {
-		defer close(valueChan)
+		var err error
+		defer func() { result.Close(err) }()
 		currentIndex := index
 		for {
 			for currentIndex < leafNode.Len && bytes.Equal(leafNode.Keys[currentIndex], key) {
 				currentValue := leafNode.Values[currentIndex]
-				valueChan <- currentValue
+				result.Send(currentValue)
 				currentIndex++
 			}
 			// 如果循环到当前 node 的最后一个 Value，则尝试获取下一个 node
@@ -256,87 +374,151 @@ func (tree *BPlusTree) Search(key index.KeyType) <-chan index.ValueType {
 				if leafNode.NextLeaf == p.NIL_PAGE_NUM {
 					break
 				}
-				nextLeafNode, err := tree.getNode(leafNode.NextLeaf)
-				lockNode(nextLeafNode, Visit_Read)
-				unlockNode(leafNode, Visit_Read)
-				leafNode = nextLeafNode
+				var nextLeafNode *BPlusTreeNode
+				nextLeafNode, err = tree.getNode(leafNode.NextLeaf)
 				if err != nil {
-					log.Fatal(err)
+					break
 				}
+				lockNode(nextLeafNode, Visit_Read)
+				tree.releaseNode(leafNode, Visit_Read, false)
+				leafNode = nextLeafNode
 				currentIndex = 0
 			} else {
 				break
 			}
 		}
-		unlockNode(leafNode, Visit_Read)
+		tree.releaseNode(leafNode, Visit_Read, false)
 	}()
-	return valueChan
+	return result
 }
 
 // 在 B+树中插入一个 key-value 对，允许有相同的 key
 // key: 主键
 // value: 值
 func (tree *BPlusTree) Insert(key index.KeyType, value index.ValueType) error {
+	tree.Lock()
+	defer tree.Unlock()
+
 	// 如果已经存在相同的 (key, value), 则直接返回
-	valueChan := tree.Search(key)
-	for treeValue := range valueChan {
+	result := tree.search(key)
+	found := false
+	for treeValue := range result.Values() {
 		if bytes.Equal(treeValue, value) {
-			return nil
+			found = true
 		}
 	}
-	node, _ := tree.searchLowerInTree(key, Visit_Write)
+	if err := result.Err(); err != nil || found {
+		return err
+	}
+	node, _, err := tree.searchLowerInTree(key, Visit_Write)
+	if err != nil {
+		return err
+	}
 
 	// TODO: 新插入的 value 需要放在最后一个位置
 	ok := node.insertEntry(key, value)
 	// logrus.Infof("insert key: %v, value: %v, ok: %v", key, value, ok)
-	tree.rec.Write(node.page)
 
 	if !ok {
+		tree.releaseNode(node, Visit_Write, false)
 		err := fmt.Errorf("insert key-value pair failed: key: %v, value: %v", key, value)
 		logrus.Error(err)
 		return err
 	}
 
 	if node.needSplit() {
-		// node 在 split 函数里面被 unlock
+		// node 在 split 函数里面被 release
 		tree.splitLeaf(node)
 	} else {
-		unlockNode(node, Visit_Write)
+		tree.releaseNode(node, Visit_Write, true)
 	}
 	return nil
 }
 
+// 在 B+树中删除一个 key-value 对，删除后不合并节点
+func (tree *BPlusTree) Delete(key index.KeyType, value index.ValueType) error {
+	tree.Lock()
+	defer tree.Unlock()
+
+	node, i, err := tree.searchLowerInTree(key, Visit_Write)
+	if err != nil {
+		return err
+	}
+	for {
+		for ; i < node.Len && bytes.Equal(node.Keys[i], key); i++ {
+			if bytes.Equal(node.Values[i], value) {
+				node.deleteEntry(i)
+				tree.releaseNode(node, Visit_Write, true)
+				return nil
+			}
+		}
+		// 相同的 key 可能延续到下一个叶子节点
+		if i < node.Len || node.NextLeaf == p.NIL_PAGE_NUM {
+			break
+		}
+		nextLeafNode, err := tree.getNode(node.NextLeaf)
+		if err != nil {
+			log.Panic(err)
+		}
+		lockNode(nextLeafNode, Visit_Write)
+		tree.releaseNode(node, Visit_Write, false)
+		node = nextLeafNode
+		i = 0
+	}
+	tree.releaseNode(node, Visit_Write, false)
+	return index.ErrKeyNotFound
+}
+
+// 根节点分裂时新建一个根节点作为分裂后节点的父节点，返回的页已经被 pin 并且加了写锁
+func (tree *BPlusTree) newRoot(node *BPlusTreeNode) *p.Page {
+	newRoot := newNode(tree)
+	rootPage := tree.newNodePage(newRoot)
+	newRoot.page = rootPage
+	rootPage.Lock()
+	newRoot.Addr = rootPage.PageNum()
+	newRoot.Parent = p.NIL_PAGE_NUM
+	newRoot.PreLeaf = p.NIL_PAGE_NUM
+	newRoot.NextLeaf = p.NIL_PAGE_NUM
+	newRoot.Len = 0
+	newRoot.isLeaf = false
+	newRoot.Values[0] = util.UUIDToBytes(tree.valueSize, node.Addr)
+
+	node.Parent = newRoot.Addr
+	tree.Root = newRoot.Addr
+	return rootPage
+}
+
 func (tree *BPlusTree) splitLeaf(node *BPlusTreeNode) {
-	// 如果当前节点是根节点，那需要新建一个根节点作为分裂后节点的父节点
 	logrus.Infof("split leaf node: %v", node.Addr)
-	defer unlockNode(node, Visit_Write)
-
+	defer tree.pager.Unpin(node.page, true)
+
+	// 被分裂修改的页，需要设置为分裂日志的 LSN，根节点和叶子节点的信息保存在 meta page 中
+	pages := []*p.Page{node.page, tree.pager.MetaPage()}
+	// 被分裂修改的页在写入日志之后解锁，更新父节点时父节点的分裂会修改这些节点
+	tree.pager.MetaPage().Lock()
+	locked := []*p.Page{node.page, tree.pager.MetaPage()}
+	rootPageNum := p.NIL_PAGE_NUM
+	// 如果当前节点是根节点，那需要新建一个根节点作为分裂后节点的父节点
 	if node.Addr == tree.Root {
-		newRoot := newNode(tree)
-		rootPage := tree.pager.NewPage(newRoot)
-		newRoot.page = rootPage
-		newRoot.Addr = rootPage.PageNum()
-		newRoot.Parent = 0
-		newRoot.Len = 0
-		newRoot.isLeaf = false
-		newRoot.Values[0] = util.UUIDToBytes(tree.valueSize, node.Addr)
-
-		node.Parent = newRoot.Addr
-
-		tree.Root = newRoot.Addr
+		rootPage := tree.newRoot(node)
+		defer tree.pager.Unpin(rootPage, true)
+		pages = append(pages, rootPage)
+		locked = append(locked, rootPage)
+		rootPageNum = rootPage.PageNum()
+
 		tree.FirstLeaf = node.Addr
 		tree.LastLeaf = node.Addr
 	}
 
 	newNode := newNode(tree)
-	newNodePage := tree.pager.NewPage(newNode)
+	newNodePage := tree.newNodePage(newNode)
 	newNode.page = newNodePage
+	newNodePage.Lock()
 	newNode.Addr = newNodePage.PageNum()
 	newNode.Parent = node.Parent
-
-	redolog := redolog.NewBNodeSplitLog(
-		tree.tableId, tree.columnId, node.Addr, newNode.Addr)
-	node.page.AppendLog(redolog)
+	defer tree.pager.Unpin(newNodePage, true)
+	pages = append(pages, newNodePage)
+	locked = append(locked, newNodePage)
 
 	// 更新树的最后一个节点
 	if tree.LastLeaf == node.Addr {
@@ -349,61 +531,81 @@ func (tree *BPlusTree) splitLeaf(node *BPlusTreeNode) {
 		newNode.Keys[i-order/2] = node.Keys[i]
 		newNode.Values[i-order/2] = node.Values[i]
 	}
+	newNode.Len = node.Len - order/2
 	node.Len = order / 2
-	newNode.Len = order - order/2
 
 	newNode.isLeaf = true
 
 	// 重新设置前后节点关系
+	nextLeaf := node.NextLeaf
 	newNode.PreLeaf = node.Addr
-	newNode.NextLeaf = node.NextLeaf
+	newNode.NextLeaf = nextLeaf
 
 	// 如果当前节点后面还有节点，还需要更改后一个节点的 preLeaf
-	if node.NextLeaf != 0 {
-		nextNextLeaf, _ := tree.getNode(node.NextLeaf)
+	if nextLeaf != p.NIL_PAGE_NUM {
+		nextNextLeaf, err := tree.getNode(nextLeaf)
+		if err != nil {
+			log.Panic(err)
+		}
+		lockNode(nextNextLeaf, Visit_Write)
 		nextNextLeaf.PreLeaf = newNode.Addr
+		defer tree.pager.Unpin(nextNextLeaf.page, true)
+		pages = append(pages, nextNextLeaf.page)
+		locked = append(locked, nextNextLeaf.page)
 	}
 	node.NextLeaf = newNode.Addr
 
-	if node.Addr == tree.LastLeaf {
-		tree.LastLeaf = newNode.Addr
+	redolog := redolog.NewBNodeSplitLog(
+		tree.tableId, tree.columnId, node.Addr, newNode.Addr, rootPageNum, nextLeaf, true,
+		bytesList(newNode.Keys[:newNode.Len]), bytesList(newNode.Values[:newNode.Len]))
+	tree.pager.AppendLog(redolog, pages...)
+	for _, page := range locked {
+		page.Unlock()
 	}
 
-	tree.rec.Write(node.page)
-	tree.rec.Write(newNode.page)
-
 	// 递归更改父节点
-	parentNode, _ := tree.getNode(node.Parent)
+	parentNode, err := tree.getNode(node.Parent)
+	if err != nil {
+		log.Panic(err)
+	}
+	lockNode(parentNode, Visit_Write)
 	parentNode.insertEntry(newNode.Keys[0], util.UUIDToBytes(tree.valueSize, newNode.Addr))
+	unlockNode(parentNode, Visit_Write)
 	if parentNode.needSplit() {
 		tree.splitParent(parentNode)
 	}
+	tree.pager.Unpin(parentNode.page, true)
 }
 
 func (tree *BPlusTree) splitParent(node *BPlusTreeNode) {
 	logrus.Infof("split parent node: %v", node.Addr)
 	lockNode(node, Visit_Write)
-	defer unlockNode(node, Visit_Write)
+
+	pages := []*p.Page{node.page, tree.pager.MetaPage()}
+	// 被分裂修改的页在写入日志之后解锁，更新父节点时父节点的分裂会修改这些节点
+	tree.pager.MetaPage().Lock()
+	locked := []*p.Page{node.page, tree.pager.MetaPage()}
+	rootPageNum := p.NIL_PAGE_NUM
 	// 如果当前节点是根节点，那需要新建一个根节点作为分裂后节点的父节点
 	if node.Addr == tree.Root {
-		newRoot := newNode(tree)
-		newRootPage := tree.pager.NewPage(newRoot)
-		newRoot.page = newRootPage
-		newRoot.Addr = newRootPage.PageNum()
-		newRoot.Parent = 0
-		newRoot.isLeaf = false
-		newRoot.Len = 0
-		newRoot.Values[0] = util.UUIDToBytes(tree.valueSize, node.Addr)
-
-		node.Parent = newRoot.Addr
-
-		tree.Root = newRoot.Addr
+		rootPage := tree.newRoot(node)
+		defer tree.pager.Unpin(rootPage, true)
+		pages = append(pages, rootPage)
+		locked = append(locked, rootPage)
+		rootPageNum = rootPage.PageNum()
 	}
 
 	newNode := newNode(tree)
-	newNodePage := tree.pager.NewPage(newNode)
+	newNodePage := tree.newNodePage(newNode)
 	newNode.page = newNodePage
+	newNodePage.Lock()
+	locked = append(locked, newNodePage)
 	newNode.Addr = newNodePage.PageNum()
+	newNode.Parent = node.Parent
+	newNode.PreLeaf = p.NIL_PAGE_NUM
+	newNode.NextLeaf = p.NIL_PAGE_NUM
+	defer tree.pager.Unpin(newNodePage, true)
+	pages = append(pages, newNodePage)
 
 	// 复制一半元素
 	order := tree.order
@@ -414,28 +616,50 @@ func (tree *BPlusTree) splitParent(node *BPlusTreeNode) {
 	// 对于非叶子节点，children 比 keys 多一
 	newNode.Values[node.Len-order/2] = node.Values[node.Len]
 	// node 需要上升一个节点到父节点
+	newNode.Len = node.Len - order/2
 	node.Len = order/2 - 1
-	newNode.Len = order - order/2
 
 	newNode.isLeaf = false
 
-	// 更新新节点的子节点的父节点
+	redolog := redolog.NewBNodeSplitLog(
+		tree.tableId, tree.columnId, node.Addr, newNode.Addr, rootPageNum, p.NIL_PAGE_NUM, false,
+		bytesList(newNode.Keys[:newNode.Len]), bytesList(newNode.Values[:newNode.Len+1]))
+	tree.pager.AppendLog(redolog, pages...)
+	for _, page := range locked {
+		page.Unlock()
+	}
+
+	// 更新新节点的子节点的父节点，子节点的修改也由分裂日志恢复
 	for i := uint16(0); i < newNode.Len+1; i++ {
-		child, _ := tree.getNode(util.BytesToUUID(newNode.Values[i]))
+		child, err := tree.getNode(util.BytesToUUID(newNode.Values[i]))
+		if err != nil {
+			log.Panic(err)
+		}
+		lockNode(child, Visit_Write)
 		child.Parent = newNode.Addr
-
-		tree.rec.Write(child.page)
+		child.page.SetLSN(node.page.LSN())
+		tree.releaseNode(child, Visit_Write, true)
 	}
 
-	// 写入 page 到 double write
-	tree.rec.Write(node.page)
-	tree.rec.Write(newNode.page)
-
 	k := node.Keys[node.Len]
 	v := util.UUIDToBytes(tree.valueSize, newNode.Addr)
-	parent, _ := tree.getNode(node.Parent)
+	parent, err := tree.getNode(node.Parent)
+	if err != nil {
+		log.Panic(err)
+	}
+	lockNode(parent, Visit_Write)
 	parent.insertEntry(k, v)
+	unlockNode(parent, Visit_Write)
 	if parent.needSplit() {
 		tree.splitParent(parent)
 	}
+	tree.pager.Unpin(parent.page, true)
+}
+
+func bytesList[T ~[]byte](list []T) [][]byte {
+	result := make([][]byte, len(list))
+	for i, b := range list {
+		result[i] = b
+	}
+	return result
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"minidb-go/storage/index"
 	"minidb-go/storage/pager"
@@ -11,7 +12,6 @@ import (
 	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
 	"sort"
-	"sync"
 )
 
 type BPlusTreeNode struct {
@@ -29,8 +29,6 @@ type BPlusTreeNode struct {
 	// 只在内存中使用，用于解码
 	tree *BPlusTree
 	page *pager.Page
-
-	lock sync.RWMutex
 }
 
 func newNode(tree *BPlusTree) *BPlusTreeNode {
@@ -67,7 +65,7 @@ func (node *BPlusTreeNode) needSplit() bool {
 func (node *BPlusTreeNode) insertEntry(key index.KeyType, value index.ValueType) bool {
 	redolog := redolog.NewBNodeInsertKVLog(
 		node.tree.tableId, node.tree.columnId, node.Addr, key, value)
-	node.page.AppendLog(redolog)
+	node.tree.pager.AppendLog(redolog, node.page)
 
 	order := node.tree.order
 	index := node.LowerBound(key)
@@ -87,6 +85,19 @@ func (node *BPlusTreeNode) insertEntry(key index.KeyType, value index.ValueType)
 	return true
 }
 
+// 删除叶子节点中下标为 index 的项，不进行节点合并
+func (node *BPlusTreeNode) deleteEntry(index uint16) {
+	redolog := redolog.NewBNodeDeleteKVLog(
+		node.tree.tableId, node.tree.columnId, node.Addr, node.Keys[index], node.Values[index])
+	node.tree.pager.AppendLog(redolog, node.page)
+
+	copy(node.Keys[index:], node.Keys[index+1:node.Len])
+	copy(node.Values[index:], node.Values[index+1:node.Len])
+	node.Len--
+	node.Keys[node.Len] = nil
+	node.Values[node.Len] = nil
+}
+
 func (node *BPlusTreeNode) Size() int {
 	var keySize, ValueSize int
 	if node.Len == 0 {
@@ -119,20 +130,21 @@ func (node *BPlusTreeNode) SetTree(tree *BPlusTree) {
 	node.tree = tree
 }
 
+// 节点的锁就是所在页的锁，写回页时持有页的读锁，得到的页与日志一致
 func (node *BPlusTreeNode) RLock() {
-	node.lock.RLock()
+	node.page.RLock()
 }
 
 func (node *BPlusTreeNode) RUnlock() {
-	node.lock.RUnlock()
+	node.page.RUnlock()
 }
 
 func (node *BPlusTreeNode) Lock() {
-	node.lock.Lock()
+	node.page.Lock()
 }
 
 func (node *BPlusTreeNode) Unlock() {
-	node.lock.Unlock()
+	node.page.Unlock()
 }
 
 func (node *BPlusTreeNode) Encode() []byte {
@@ -168,6 +180,10 @@ func (node *BPlusTreeNode) Decode(r io.Reader) error {
 	binary.Read(r, binary.BigEndian, &node.Len)
 
 	binary.Read(r, binary.BigEndian, &node.isLeaf)
+	// 页损坏时 Len 可能超过节点的容量
+	if node.Len >= node.tree.order {
+		return fmt.Errorf("node has %d keys, order is %d", node.Len, node.tree.order)
+	}
 
 	if node.isLeaf {
 		node.Keys = make([]index.KeyType, int(node.tree.order))
@@ -177,14 +193,14 @@ func (node *BPlusTreeNode) Decode(r io.Reader) error {
 		node.Values = make([]index.ValueType, int(node.tree.order)+1)
 	}
 	for i := 0; i < int(node.Len); i++ {
-		node.Keys[i] = make(index.KeyType, node.tree.KeySize())
+		node.Keys[i] = make(index.KeyType, node.tree.keySize)
 		r.Read(node.Keys[i])
-		node.Values[i] = make(index.ValueType, node.tree.ValueSize())
+		node.Values[i] = make(index.ValueType, node.tree.valueSize)
 		r.Read(node.Values[i])
 	}
 
 	if !node.isLeaf {
-		node.Values[node.Len] = make(index.ValueType, node.tree.ValueSize())
+		node.Values[node.Len] = make(index.ValueType, node.tree.valueSize)
 		r.Read(node.Values[node.Len])
 	}
 	return nil
@@ -1,11 +1,15 @@
 package bplustree
 
 import (
+	"bytes"
+	"minidb-go/storage/index"
 	"minidb-go/storage/pager"
 	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
 )
 
+// 恢复时按日志的顺序调用，页的 LSN 不小于日志的 LSN 时说明该页已经包含了日志中的修改
+
 func (tree *BPlusTree) RecoverInsertKV(log *redolog.BNodeInsertKVLog) error {
 	key := log.Key()
 	value := log.Value()
@@ -13,6 +17,10 @@ func (tree *BPlusTree) RecoverInsertKV(log *redolog.BNodeInsertKVLog) error {
 	if err != nil {
 		return err
 	}
+	if page.LSN() >= log.LSN() {
+		tree.pager.Unpin(page, false)
+		return nil
+	}
 	index := node.LowerBound(key)
 
 	order := tree.order
@@ -30,7 +38,34 @@ func (tree *BPlusTree) RecoverInsertKV(log *redolog.BNodeInsertKVLog) error {
 	}
 	node.Len++
 
-	tree.pager.Flush(page)
+	page.SetLSN(log.LSN())
+	tree.pager.Unpin(page, true)
+	return nil
+}
+
+func (tree *BPlusTree) RecoverDeleteKV(log *redolog.BNodeDeleteKVLog) error {
+	page, node, err := tree.getNodePage(log.PageNum())
+	if err != nil {
+		return err
+	}
+	if page.LSN() >= log.LSN() {
+		tree.pager.Unpin(page, false)
+		return nil
+	}
+	for i := node.LowerBound(log.Key()); i < node.Len; i++ {
+		if !bytes.Equal(node.Keys[i], log.Key()) {
+			break
+		}
+		if bytes.Equal(node.Values[i], log.Value()) {
+			copy(node.Keys[i:], node.Keys[i+1:node.Len])
+			copy(node.Values[i:], node.Values[i+1:node.Len])
+			node.Len--
+			break
+		}
+	}
+
+	page.SetLSN(log.LSN())
+	tree.pager.Unpin(page, true)
 	return nil
 }
 
@@ -39,144 +74,138 @@ func (tree *BPlusTree) getNodePage(pageNum util.UUID) (*pager.Page, *BPlusTreeNo
 		tree: tree,
 	}
 	page, err := tree.pager.GetPage(pageNum, node)
+	if err != nil {
+		return nil, nil, err
+	}
+	node = page.Data().(*BPlusTreeNode)
 	node.page = page
-	return page, node, err
+	return page, node, nil
 }
 
+// 分裂修改的每个页分别根据自己的 LSN 判断是否需要恢复，
+// 新节点的内容保存在日志中，不依赖原节点在磁盘上是否已经分裂
 func (tree *BPlusTree) RecoverSplitNode(log *redolog.BNodeSplitLog) error {
+	LSN := log.LSN()
+	order := tree.order
+	rootPageNum := log.RootPageNum()
+
+	// 原节点保留前一半的元素
 	page, node, err := tree.getNodePage(log.PageNum())
 	if err != nil {
 		return err
 	}
-	nextPage, _, err := tree.getNodePage(log.NextPageNum())
+	applied := page.LSN() >= LSN
+	if !applied {
+		if log.IsLeaf() {
+			node.Len = order / 2
+			node.NextLeaf = log.NextPageNum()
+		} else {
+			node.Len = order/2 - 1
+		}
+		if rootPageNum != pager.NIL_PAGE_NUM {
+			node.Parent = rootPageNum
+		}
+		page.SetLSN(LSN)
+	}
+	parent := node.Parent
+	tree.pager.Unpin(page, !applied)
+
+	// 根节点分裂时新建的根节点
+	if rootPageNum != pager.NIL_PAGE_NUM {
+		rootPage, root, err := tree.getNodePage(rootPageNum)
+		if err != nil {
+			return err
+		}
+		applied := rootPage.LSN() >= LSN
+		if !applied {
+			resetNode(root, rootPageNum, false)
+			rootPage.SetCompressible(tree.Compressed)
+			root.Parent = pager.NIL_PAGE_NUM
+			root.Values[0] = util.UUIDToBytes(tree.valueSize, log.PageNum())
+			rootPage.SetLSN(LSN)
+		}
+		tree.pager.Unpin(rootPage, !applied)
+
+		tree.Root = rootPageNum
+		if log.IsLeaf() {
+			tree.FirstLeaf = log.PageNum()
+			tree.LastLeaf = log.PageNum()
+		}
+	}
+
+	// 分裂出的新节点
+	nextPage, nextNode, err := tree.getNodePage(log.NextPageNum())
 	if err != nil {
 		return err
 	}
-	if node.isLeaf {
-		err = tree.recoverSplitLeafNode(page, nextPage, log)
+	applied = nextPage.LSN() >= LSN
+	if !applied {
+		resetNode(nextNode, log.NextPageNum(), log.IsLeaf())
+		nextPage.SetCompressible(tree.Compressed)
+		nextNode.Parent = parent
+		if log.IsLeaf() {
+			nextNode.PreLeaf = log.PageNum()
+			nextNode.NextLeaf = log.NextLeaf()
+		}
+		for i, key := range log.Keys() {
+			nextNode.Keys[i] = key
+		}
+		for i, value := range log.Values() {
+			nextNode.Values[i] = value
+		}
+		nextNode.Len = uint16(len(log.Keys()))
+		nextPage.SetLSN(LSN)
+	}
+	tree.pager.Unpin(nextPage, !applied)
+
+	if log.IsLeaf() {
+		if tree.LastLeaf == log.PageNum() {
+			tree.LastLeaf = log.NextPageNum()
+		}
+		// 后一个叶子节点的 preLeaf
+		if log.NextLeaf() != pager.NIL_PAGE_NUM {
+			err = tree.recoverPointer(log.NextLeaf(), LSN, func(node *BPlusTreeNode) {
+				node.PreLeaf = log.NextPageNum()
+			})
+		}
 	} else {
-		err = tree.recoverSplitNonLeafNode(page, nextPage, log)
+		// 新节点的子节点的父节点
+		for _, value := range log.Values() {
+			err = tree.recoverPointer(util.BytesToUUID(value), LSN, func(node *BPlusTreeNode) {
+				node.Parent = log.NextPageNum()
+			})
+			if err != nil {
+				break
+			}
+		}
 	}
-	tree.pager.Flush(page)
-	tree.pager.Flush(nextPage)
+	tree.pager.MarkDirty(tree.pager.MetaPage())
 	return err
 }
 
-func (tree *BPlusTree) recoverSplitLeafNode(page *pager.Page, nextPage *pager.Page,
-	log *redolog.BNodeSplitLog) error {
-	node := page.Data().(*BPlusTreeNode)
-	nextNode := nextPage.Data().(*BPlusTreeNode)
-	// 如果当前节点是根节点，那需要新建一个根节点作为分裂后节点的父节点
-	if node.Addr == tree.Root {
-		newRoot := newNode(tree)
-		rootPage := tree.pager.NewPage(newRoot)
-		newRoot.page = rootPage
-		newRoot.Addr = rootPage.PageNum()
-		newRoot.Parent = 0
-		newRoot.Len = 0
-		newRoot.isLeaf = false
-		newRoot.Values[0] = util.UUIDToBytes(tree.valueSize, node.Addr)
-
-		node.Parent = newRoot.Addr
-
-		tree.Root = newRoot.Addr
-		tree.FirstLeaf = node.Addr
-		tree.LastLeaf = node.Addr
-	}
-
-	nextNode.Addr = nextPage.PageNum()
-	nextNode.Parent = node.Parent
-
-	// 更新树的最后一个节点
-	if tree.LastLeaf == node.Addr {
-		tree.LastLeaf = nextNode.Addr
-	}
-
-	order := tree.order
-	// 复制一半元素
-	for i := order / 2; i < node.Len; i++ {
-		nextNode.Keys[i-order/2] = node.Keys[i]
-		nextNode.Values[i-order/2] = node.Values[i]
-	}
-	node.Len = order / 2
-	nextNode.Len = order - order/2
-
-	nextNode.isLeaf = true
-
-	// 重新设置前后节点关系
-	nextNode.PreLeaf = node.Addr
-	nextNode.NextLeaf = node.NextLeaf
-
-	// 如果当前节点后面还有节点，还需要更改后一个节点的 preLeaf
-	if node.NextLeaf != 0 {
-		nextNextLeaf, _ := tree.getNode(node.NextLeaf)
-		nextNextLeaf.PreLeaf = nextNode.Addr
-	}
-	node.NextLeaf = nextNode.Addr
-
-	if node.Addr == tree.LastLeaf {
-		tree.LastLeaf = nextNode.Addr
-	}
-
-	// 不需要递归更改父节点
-	// // 递归更改父节点
-	// parentNode, _ := tree.getNode(node.Parent)
-	// parentNode.insertEntry(newNode.Keys[0], util.UUIDToBytes(tree.valueSize, newNode.Addr))
-	// if parentNode.needSplit() {
-	// 	tree.splitParent(parentNode)
-	// }
-	return nil
+// 清空节点中的元素
+func resetNode(node *BPlusTreeNode, pageNum util.UUID, isLeaf bool) {
+	node.Addr = pageNum
+	node.PreLeaf = pager.NIL_PAGE_NUM
+	node.NextLeaf = pager.NIL_PAGE_NUM
+	node.Len = 0
+	node.isLeaf = isLeaf
+	node.Keys = make([]index.KeyType, node.tree.order)
+	node.Values = make([]index.ValueType, node.tree.order+1)
 }
 
-func (tree *BPlusTree) recoverSplitNonLeafNode(page *pager.Page, nextPage *pager.Page,
-	log *redolog.BNodeSplitLog) error {
-	node := page.Data().(*BPlusTreeNode)
-	// 如果当前节点是根节点，那需要新建一个根节点作为分裂后节点的父节点
-	if node.Addr == tree.Root {
-		newRoot := newNode(tree)
-		newRootPage := tree.pager.NewPage(newRoot)
-		newRoot.page = newRootPage
-		newRoot.Addr = newRootPage.PageNum()
-		newRoot.Parent = 0
-		newRoot.isLeaf = false
-		newRoot.Len = 0
-		newRoot.Values[0] = util.UUIDToBytes(tree.valueSize, node.Addr)
-
-		node.Parent = newRoot.Addr
-
-		tree.Root = newRoot.Addr
+// 修改分裂时被顺带修改的节点中的指针
+func (tree *BPlusTree) recoverPointer(pageNum util.UUID, LSN int64,
+	update func(node *BPlusTreeNode)) error {
+	page, node, err := tree.getNodePage(pageNum)
+	if err != nil {
+		return err
 	}
-
-	nextNode := nextPage.Data().(*BPlusTreeNode)
-	nextNode.Addr = nextPage.PageNum()
-
-	// 复制一半元素
-	order := tree.order
-	for i := order / 2; i < node.Len; i++ {
-		nextNode.Keys[i-order/2] = node.Keys[i]
-		nextNode.Values[i-order/2] = node.Values[i]
-	}
-	// 对于非叶子节点，children 比 keys 多一
-	nextNode.Values[node.Len-order/2] = node.Values[node.Len]
-	// node 需要上升一个节点到父节点
-	node.Len = order/2 - 1
-	nextNode.Len = order - order/2
-
-	nextNode.isLeaf = false
-
-	// 更新新节点的子节点的父节点
-	for i := uint16(0); i < nextNode.Len+1; i++ {
-		child, _ := tree.getNode(util.BytesToUUID(nextNode.Values[i]))
-		child.Parent = nextNode.Addr
-	}
-
-	// 不用递归更改父节点
-	// k := node.Keys[node.Len]
-	// v := util.UUIDToBytes(tree.valueSize, newNode.Addr)
-	// parent, _ := tree.getNode(node.Parent)
-	// parent.insertEntry(k, v)
-	// if parent.needSplit() {
-	// 	tree.splitParent(parent)
-	// }
+	applied := page.LSN() >= LSN
+	if !applied {
+		update(node)
+		page.SetLSN(LSN)
+	}
+	tree.pager.Unpin(page, !applied)
 	return nil
 }
@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/bplustree"
+	"minidb-go/storage/index"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/recinfo"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+离线检查数据库文件的一致性，需要在数据库关闭时调用：
+	页的校验和与页头，数据页链表的 next/prev，每一行的解码，
+	B+ 树的键顺序、父节点指针、叶子节点链表和节点的容量，
+	索引项与数据行是否一一对应，以及行的 xmin/xmax 在 XID 文件中的状态。
+页头中没有页的类型，页的类型由引用它的结构决定，没有被引用的页只作为警告，
+异常退出、vacuum 和重建索引都会留下这样的页。
+*/
+
+// 一个索引的统计信息
+type IndexStat struct {
+	TableName  string
+	ColumnName string
+
+	Depth   int
+	Nodes   int
+	Entries int
+	// 节点的平均填充率，删除之后不合并节点，只检查节点没有超过容量
+	Fill float64
+}
+
+func (stat *IndexStat) String() string {
+	return fmt.Sprintf("index %s.%s: depth %d, %d nodes, %d entries, %.0f%% full",
+		stat.TableName, stat.ColumnName, stat.Depth, stat.Nodes, stat.Entries, stat.Fill*100)
+}
+
+type CheckReport struct {
+	// 页文件中的页数
+	Pages      int
+	DataPages  int
+	IndexPages int
+	Rows       int
+
+	Indexes  []*IndexStat
+	Errors   []string
+	Warnings []string
+}
+
+func (report *CheckReport) errorf(format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+func (report *CheckReport) warnf(format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (report *CheckReport) OK() bool {
+	return len(report.Errors) == 0
+}
+
+func (report *CheckReport) String() string {
+	var b strings.Builder
+	for _, stat := range report.Indexes {
+		b.WriteString(stat.String() + "\n")
+	}
+	for _, warning := range report.Warnings {
+		b.WriteString("warning: " + warning + "\n")
+	}
+	for _, err := range report.Errors {
+		b.WriteString("error: " + err + "\n")
+	}
+	fmt.Fprintf(&b, "checked %d pages (%d data, %d index), %d rows: %d errors, %d warnings",
+		report.Pages, report.DataPages, report.IndexPages, report.Rows,
+		len(report.Errors), len(report.Warnings))
+	return b.String()
+}
+
+type checker struct {
+	report *CheckReport
+	file   vfs.File
+
+	control recinfo.ControlData
+	// XID i+1 的状态
+	statuses []byte
+
+	corrupted map[util.UUID]bool
+	// 每个页被哪个结构引用
+	owners map[util.UUID]string
+}
+
+// 检查 path 下的数据库，无法打开文件时返回 error，发现的问题记录在 report 中
+func Check(path string) (*CheckReport, error) {
+	if _, err := os.Stat(path + "/" + recinfo.REC_INFO_FILE_NAME); err != nil {
+		return nil, err
+	}
+	info, err := recinfo.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	control := info.Data()
+	info.Close()
+
+	file, err := vfs.OpenFile(path+"/"+pager.PAGE_FILE_NAME, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		report:    &CheckReport{},
+		file:      file,
+		control:   control,
+		corrupted: make(map[util.UUID]bool),
+		owners:    make(map[util.UUID]string),
+	}
+	// 压缩的页不会写满整个页，向上取整
+	c.report.Pages = int((stat.Size() + util.PAGE_SIZE - 1) / util.PAGE_SIZE)
+	for i := 0; i < c.report.Pages; i++ {
+		if _, err := pager.ReadImage(file, util.UUID(i)); err != nil {
+			c.report.errorf("page %d: %v", i, err)
+			c.corrupted[util.UUID(i)] = true
+		}
+	}
+	// 异常退出后页文件中缺少 redo log 中的修改，检查的结果没有意义
+	if !control.CleanShutdown {
+		c.report.errorf("database was not shut down cleanly, open it once to run recovery before checking")
+		return c.report, nil
+	}
+
+	if _, err := os.Stat(path + "/" + tm.XID_FILE_NAME); err != nil {
+		return nil, err
+	}
+	transactionManager, err := tm.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c.statuses, err = transactionManager.Statuses()
+	transactionManager.Close()
+	if err != nil {
+		c.report.errorf("%s: %v", tm.XID_FILE_NAME, err)
+	}
+	if control.NextXID > tm.XID(len(c.statuses))+1 {
+		c.report.errorf("checkpoint next xid %d is ahead of the xid file (%d transactions)",
+			control.NextXID, len(c.statuses))
+	}
+
+	metaData := c.checkMeta(control.CatalogRoot)
+	if metaData != nil {
+		tableNames := make([]string, 0, len(metaData.Tables))
+		for tableName := range metaData.Tables {
+			tableNames = append(tableNames, tableName)
+		}
+		sort.Strings(tableNames)
+		for _, tableName := range tableNames {
+			c.checkTable(metaData.Tables[tableName])
+		}
+	}
+
+	unreachable := make([]util.UUID, 0)
+	for i := 0; i < c.report.Pages; i++ {
+		pageNum := util.UUID(i)
+		if _, ok := c.owners[pageNum]; !ok && !c.corrupted[pageNum] {
+			unreachable = append(unreachable, pageNum)
+		}
+	}
+	if len(unreachable) > 0 {
+		c.report.warnf("%d pages are not referenced by any table or index: %v",
+			len(unreachable), unreachable)
+	}
+	return c.report, nil
+}
+
+// 记录页的引用者，页号越界或者已经被引用时返回 false
+func (c *checker) visit(pageNum util.UUID, owner string) bool {
+	if int(pageNum) >= c.report.Pages {
+		c.report.errorf("%s: page %d is beyond the end of the file", owner, pageNum)
+		return false
+	}
+	if other, ok := c.owners[pageNum]; ok {
+		c.report.errorf("page %d is referenced by both %s and %s", pageNum, other, owner)
+		return false
+	}
+	c.owners[pageNum] = owner
+	return true
+}
+
+// 读取并解码页，校验和错误的页已经报告过，不再重复报告
+func (c *checker) loadPage(pageNum util.UUID, pageData pagedata.PageData, owner string) *pager.Page {
+	if c.corrupted[pageNum] {
+		return nil
+	}
+	image, err := pager.ReadImage(c.file, pageNum)
+	if err != nil {
+		c.report.errorf("%s: %v", owner, err)
+		return nil
+	}
+	page, err := pager.LoadPage(bytes.NewReader(image), pageData)
+	if err != nil {
+		c.report.errorf("%s: %v", owner, err)
+		return nil
+	}
+	// 正常关闭时所有的日志都在最后一次 checkpoint 之前
+	if page.LSN() > c.control.CheckPointLSN {
+		c.report.errorf("%s: page %d LSN %d is ahead of the last checkpoint %d",
+			owner, pageNum, page.LSN(), c.control.CheckPointLSN)
+	}
+	return page
+}
+
+func (c *checker) checkMeta(rootPageNum util.UUID) *pagedata.MetaData {
+	owner := "meta page"
+	if !c.visit(rootPageNum, owner) {
+		return nil
+	}
+	page := c.loadPage(rootPageNum, pagedata.NewMetaData(), owner)
+	if page == nil {
+		return nil
+	}
+	c.checkNoLinks(page, owner)
+	metaData := page.Data().(*pagedata.MetaData)
+	if metaData.Version != util.VERSION {
+		c.report.errorf("%s: version %q does not match %q", owner, metaData.Version, util.VERSION)
+	}
+	tableIds := make(map[uint16]string)
+	for tableName, tableInfo := range metaData.Tables {
+		if tableName != tableInfo.TableName {
+			c.report.errorf("%s: table %s is stored as %s", owner, tableInfo.TableName, tableName)
+		}
+		if other, ok := tableIds[tableInfo.TableId]; ok {
+			c.report.errorf("%s: tables %s and %s have the same id %d",
+				owner, other, tableName, tableInfo.TableId)
+		}
+		tableIds[tableInfo.TableId] = tableName
+	}
+	return metaData
+}
+
+// meta page 和索引页不使用页头中的链表
+func (c *checker) checkNoLinks(page *pager.Page, owner string) {
+	if page.NextPageNum() != pager.NIL_PAGE_NUM || page.PrevPageNum() != pager.NIL_PAGE_NUM {
+		c.report.errorf("%s: page %d is linked to next %d and prev %d",
+			owner, page.PageNum(), page.NextPageNum(), page.PrevPageNum())
+	}
+}
+
+// 检查 xid 是否已经分配，并返回它的状态
+func (c *checker) checkXID(xid tm.XID, owner string) (byte, bool) {
+	if xid == 0 || int(xid) > len(c.statuses) {
+		c.report.errorf("%s: xid %d was never assigned", owner, xid)
+		return 0, false
+	}
+	status := c.statuses[xid-1]
+	if status > tm.TRANS_ABORTED {
+		c.report.errorf("%s: xid %d has unknown status %d", owner, xid, status)
+		return 0, false
+	}
+	return status, true
+}
+
+func (c *checker) checkRow(row *ast.Row, columnNum int, owner string) bool {
+	if len(row.Data) != columnNum+2 {
+		c.report.errorf("%s: row has %d values, expected %d", owner, len(row.Data), columnNum+2)
+		return false
+	}
+	xmin, err := row.Xmin()
+	if err != nil {
+		c.report.errorf("%s: %v", owner, err)
+		return false
+	}
+	xmax, err := row.Xmax()
+	if err != nil {
+		c.report.errorf("%s: %v", owner, err)
+		return false
+	}
+	// 正常关闭时未结束的事务都已经撤销，被撤销的插入和删除也已经回滚
+	if status, ok := c.checkXID(xmin, owner); ok {
+		switch status {
+		case tm.TRANS_ACTIVE:
+			c.report.errorf("%s: row inserted by transaction %d which is still active", owner, xmin)
+		case tm.TRANS_ABORTED:
+			c.report.warnf("%s: row inserted by aborted transaction %d", owner, xmin)
+		}
+	}
+	if xmax == tm.NIL_XID {
+		return true
+	}
+	if status, ok := c.checkXID(xmax, owner); ok {
+		switch status {
+		case tm.TRANS_ACTIVE:
+			c.report.errorf("%s: row deleted by transaction %d which is still active", owner, xmax)
+		case tm.TRANS_ABORTED:
+			c.report.warnf("%s: row deleted by aborted transaction %d", owner, xmax)
+		}
+	}
+	return true
+}
+
+func (c *checker) checkTable(tableInfo *pagedata.TableInfo) {
+	tableName := tableInfo.TableName
+	columnNum := len(tableInfo.ColumnDefines)
+	if columnNum == 0 {
+		c.report.errorf("table %s: no columns", tableName)
+		return
+	}
+
+	// 每个索引中由数据行得到的索引项，以及第一个得到该项的位置
+	rowEntries := make([]map[indexEntry]string, columnNum)
+	for i := range rowEntries {
+		rowEntries[i] = make(map[indexEntry]string)
+	}
+
+	prevPageNum := pager.NIL_PAGE_NUM
+	pageNum := tableInfo.FirstPageNum
+	for pageNum != pager.NIL_PAGE_NUM {
+		owner := fmt.Sprintf("table %s data page %d", tableName, pageNum)
+		if !c.visit(pageNum, owner) {
+			break
+		}
+		page := c.loadPage(pageNum, pagedata.NewRecordData(), owner)
+		if page == nil {
+			break
+		}
+		c.report.DataPages++
+		if page.PrevPageNum() != prevPageNum {
+			c.report.errorf("%s: prev page is %d, expected %d", owner, page.PrevPageNum(), prevPageNum)
+		}
+
+		recordData := page.Data().(*pagedata.RecordData)
+		if recordData.Size() > util.PAGE_SIZE-pager.PAGE_HEADER_SIZE {
+			c.report.errorf("%s: data size %d exceeds the page", owner, recordData.Size())
+		}
+		base := int64(pageNum)*util.PAGE_SIZE + pager.PAGE_HEADER_SIZE
+		// vacuum 整理数据页时不改变行的 offset，offset 只需要在页内并且互不相同
+		offsets := make(map[int64]struct{}, len(recordData.Rows()))
+		rowsSize := 2 + 1
+		for _, row := range recordData.Rows() {
+			c.report.Rows++
+			rowOwner := fmt.Sprintf("%s offset %d", owner, row.Offset)
+			if row.Offset < base+2+1 || row.Offset >= int64(pageNum+1)*util.PAGE_SIZE {
+				c.report.errorf("%s: offset is outside the page", rowOwner)
+			}
+			if _, ok := offsets[row.Offset]; ok {
+				c.report.errorf("%s: offset is used by another row", rowOwner)
+			}
+			offsets[row.Offset] = struct{}{}
+			rowsSize += int(row.Size)
+			if !c.checkRow(row, columnNum, rowOwner) {
+				continue
+			}
+			for i, columnDefine := range tableInfo.ColumnDefines {
+				if columnDefine.Index == nil {
+					continue
+				}
+				entry := getIndexEntry(tableInfo, i, row, pageNum)
+				if _, ok := rowEntries[i][entry]; !ok {
+					rowEntries[i][entry] = rowOwner
+				}
+			}
+		}
+		// 被撤销的插入留下的空间在 vacuum 之前仍然计入数据大小
+		if rowsSize > recordData.Size() {
+			c.report.errorf("%s: rows take %d bytes, more than the data size %d", owner, rowsSize, recordData.Size())
+		}
+		prevPageNum = pageNum
+		pageNum = page.NextPageNum()
+	}
+	if pageNum == pager.NIL_PAGE_NUM && prevPageNum != tableInfo.LastPageNum {
+		c.report.errorf("table %s: last data page is %d, catalog says %d",
+			tableName, prevPageNum, tableInfo.LastPageNum)
+	}
+
+	for i, columnDefine := range tableInfo.ColumnDefines {
+		if columnDefine.Index == nil {
+			continue
+		}
+		owner := fmt.Sprintf("index %s.%s", tableName, columnDefine.Name)
+		tree, ok := columnDefine.Index.(*bplustree.BPlusTree)
+		if !ok {
+			c.report.errorf("%s: unknown index type %T", owner, columnDefine.Index)
+			continue
+		}
+		if tree.TableId() != tableInfo.TableId || int(tree.ColumnId()) != i {
+			c.report.errorf("%s: index belongs to table %d column %d",
+				owner, tree.TableId(), tree.ColumnId())
+		}
+		indexEntries := c.checkTree(tableName, columnDefine.Name, tree)
+		if indexEntries == nil {
+			continue
+		}
+		// 索引项只在 vacuum 删除行之后才删除，指向已删除但未清理的行版本是正常的
+		for entry, rowOwner := range rowEntries[i] {
+			if _, ok := indexEntries[entry]; !ok {
+				c.report.errorf("%s: row at %s is not indexed (key %x)", owner, rowOwner, entry.key)
+			}
+		}
+		for entry := range indexEntries {
+			if _, ok := rowEntries[i][entry]; !ok {
+				c.report.errorf("%s: entry %x -> %x does not point at any row", owner, entry.key, entry.value)
+			}
+		}
+	}
+}
+
+type leafInfo struct {
+	addr     util.UUID
+	preLeaf  util.UUID
+	nextLeaf util.UUID
+}
+
+type treeChecker struct {
+	*checker
+	owner string
+	tree  *bplustree.BPlusTree
+
+	stat      *IndexStat
+	leafDepth int
+	leaves    []leafInfo
+	entries   map[indexEntry]int
+	keys      int
+}
+
+// 检查 B+ 树，返回所有叶子节点中的索引项，根节点无法读取时返回 nil
+func (c *checker) checkTree(tableName string, columnName string,
+	tree *bplustree.BPlusTree) map[indexEntry]int {
+	tc := &treeChecker{
+		checker: c,
+		owner:   fmt.Sprintf("index %s.%s", tableName, columnName),
+		tree:    tree,
+		stat: &IndexStat{
+			TableName:  tableName,
+			ColumnName: columnName,
+		},
+		leafDepth: -1,
+		entries:   make(map[indexEntry]int),
+	}
+	if !tc.checkNode(tree.Root, pager.NIL_PAGE_NUM, 1, nil, nil) {
+		return nil
+	}
+
+	// 叶子节点链表需要与树中叶子节点的顺序一致
+	prev := pager.NIL_PAGE_NUM
+	for i, leaf := range tc.leaves {
+		if leaf.preLeaf != prev {
+			c.report.errorf("%s: leaf %d points back to %d, expected %d", tc.owner, leaf.addr, leaf.preLeaf, prev)
+		}
+		next := pager.NIL_PAGE_NUM
+		if i+1 < len(tc.leaves) {
+			next = tc.leaves[i+1].addr
+		}
+		if leaf.nextLeaf != next {
+			c.report.errorf("%s: leaf %d points to %d, expected %d", tc.owner, leaf.addr, leaf.nextLeaf, next)
+		}
+		prev = leaf.addr
+	}
+	if len(tc.leaves) > 0 {
+		if tree.FirstLeaf != tc.leaves[0].addr || tree.LastLeaf != prev {
+			c.report.errorf("%s: first and last leaves are %d and %d, catalog says %d and %d",
+				tc.owner, tc.leaves[0].addr, prev, tree.FirstLeaf, tree.LastLeaf)
+		}
+	}
+	for entry, count := range tc.entries {
+		if count > 1 {
+			c.report.warnf("%s: entry %x -> %x appears %d times", tc.owner, entry.key, entry.value, count)
+		}
+	}
+
+	tc.stat.Depth = tc.leafDepth
+	if tc.stat.Nodes > 0 {
+		tc.stat.Fill = float64(tc.keys) / float64(tc.stat.Nodes*int(tree.Order()-2))
+	}
+	c.report.Indexes = append(c.report.Indexes, tc.stat)
+	return tc.entries
+}
+
+// 检查以 pageNum 为根的子树，子树中的键需要在 [low, high] 之间，nil 表示没有限制
+func (tc *treeChecker) checkNode(pageNum util.UUID, parent util.UUID, depth int,
+	low index.KeyType, high index.KeyType) bool {
+	owner := fmt.Sprintf("%s node %d", tc.owner, pageNum)
+	if !tc.visit(pageNum, owner) {
+		return false
+	}
+	node := &bplustree.BPlusTreeNode{}
+	node.SetTree(tc.tree)
+	page := tc.loadPage(pageNum, node, owner)
+	if page == nil {
+		return false
+	}
+	node = page.Data().(*bplustree.BPlusTreeNode)
+	tc.report.IndexPages++
+	tc.stat.Nodes++
+	tc.keys += int(node.Len)
+	tc.checkNoLinks(page, owner)
+
+	if node.Addr != pageNum {
+		tc.report.errorf("%s: node address is %d", owner, node.Addr)
+	}
+	if node.Parent != parent {
+		tc.report.errorf("%s: parent is %d, expected %d", owner, node.Parent, parent)
+	}
+	// 插入后达到 order-1 个键时立即分裂
+	if node.Len >= tc.tree.Order()-1 {
+		tc.report.errorf("%s: %d keys exceed the capacity %d", owner, node.Len, tc.tree.Order()-2)
+	}
+	for i := 0; i < int(node.Len); i++ {
+		key := node.Keys[i]
+		if i > 0 && bytes.Compare(node.Keys[i-1], key) > 0 {
+			tc.report.errorf("%s: key %d %x is smaller than the previous key", owner, i, key)
+		}
+		if (low != nil && bytes.Compare(key, low) < 0) || (high != nil && bytes.Compare(key, high) > 0) {
+			tc.report.errorf("%s: key %d %x is outside the range of the parent", owner, i, key)
+		}
+	}
+
+	if node.IsLeaf() {
+		if tc.leafDepth == -1 {
+			tc.leafDepth = depth
+		} else if tc.leafDepth != depth {
+			tc.report.errorf("%s: leaf at depth %d, other leaves are at depth %d", owner, depth, tc.leafDepth)
+		}
+		tc.leaves = append(tc.leaves, leafInfo{
+			addr:     pageNum,
+			preLeaf:  node.PreLeaf,
+			nextLeaf: node.NextLeaf,
+		})
+		tc.stat.Entries += int(node.Len)
+		for i := 0; i < int(node.Len); i++ {
+			tc.entries[indexEntry{key: string(node.Keys[i]), value: string(node.Values[i])}]++
+		}
+		return true
+	}
+
+	if node.Len == 0 {
+		tc.report.errorf("%s: internal node has no keys", owner)
+	}
+	for i := 0; i <= int(node.Len); i++ {
+		childLow, childHigh := low, high
+		if i > 0 {
+			childLow = node.Keys[i-1]
+		}
+		if i < int(node.Len) {
+			childHigh = node.Keys[i]
+		}
+		// 子节点无法读取时跳过，其余子节点仍然检查
+		tc.checkNode(util.BytesToUUID(node.Values[i]), pageNum, depth+1, childLow, childHigh)
+	}
+	return true
+}
+
+// 根据数据页重建表的所有索引，旧索引的页不再被引用，返回新索引中的索引项数。
+// 新索引不记录 redo log，调用者需要在重建之前进行 checkpoint，并保证期间没有其他事务
+func (dm *DataManager) RebuildIndexes(tableName string) (int, error) {
+	tableInfo := dm.pager.GetMetaData().GetTableInfo(tableName)
+	if tableInfo == nil {
+		return 0, ErrTableNotExist
+	}
+
+	dm.vacuumLock.Lock()
+	defer dm.vacuumLock.Unlock()
+	dm.pager.SetAppendLog(nil)
+	defer dm.pager.SetAppendLog(dm.recovery.AppendLog)
+
+	trees := make([]*bplustree.BPlusTree, len(tableInfo.ColumnDefines))
+	// 同一行的多个版本对应相同的索引项
+	inserted := make([]map[indexEntry]struct{}, len(tableInfo.ColumnDefines))
+	for i, columnDefine := range tableInfo.ColumnDefines {
+		if columnDefine.Index == nil {
+			continue
+		}
+		tree := bplustree.NewTree(dm.pager, columnDefine.Index.KeySize(),
+			columnDefine.Index.ValueSize(), tableInfo.TableId, uint16(i))
+		tree.SetCompressed(tableInfo.Compressed)
+		trees[i] = tree
+		inserted[i] = make(map[indexEntry]struct{})
+	}
+
+	entries := 0
+	pageNum := tableInfo.FirstPageNum
+	for pageNum != pager.NIL_PAGE_NUM {
+		page, err := dm.getRecordPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+		page.RLock()
+		rows := page.Data().(*pagedata.RecordData).Rows()
+		nextPageNum := page.NextPageNum()
+		page.RUnlock()
+		dm.pager.Unpin(page, false)
+
+		for _, row := range rows {
+			for i, tree := range trees {
+				if tree == nil {
+					continue
+				}
+				entry := getIndexEntry(tableInfo, i, row, pageNum)
+				if _, ok := inserted[i][entry]; ok {
+					continue
+				}
+				inserted[i][entry] = struct{}{}
+				if err := tree.Insert([]byte(entry.key), []byte(entry.value)); err != nil {
+					return 0, err
+				}
+				entries++
+			}
+		}
+		pageNum = nextPageNum
+	}
+
+	// 新索引的页全部写入磁盘之后，才让 meta page 引用新索引
+	if err := dm.pager.FlushAll(); err != nil {
+		return 0, err
+	}
+	dm.pager.MetaPage().Lock()
+	for i, tree := range trees {
+		if tree != nil {
+			tableInfo.ColumnDefines[i].Index = tree
+		}
+	}
+	dm.pager.MetaPage().Unlock()
+	dm.pager.MarkDirty(dm.pager.MetaPage())
+	if err := dm.pager.FlushAll(); err != nil {
+		return 0, err
+	}
+	return entries, nil
+}
@@ -11,20 +11,23 @@ import (
 	"fmt"
 	"minidb-go/parser/ast"
 	"minidb-go/parser/token"
+	"minidb-go/serialization/tm"
 	"minidb-go/storage/index"
 	"minidb-go/storage/pager"
 	"minidb-go/storage/pager/pagedata"
 	"minidb-go/storage/recovery"
 	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
-	"os"
+	"minidb-go/util/vfs"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrTableNotExist = errors.New("table not exist")
+	ErrRowNotFound   = errors.New("row not found")
 )
 
 type DataManager struct {
@@ -33,71 +36,250 @@ type DataManager struct {
 	// recovery 在创建时传入，不负责关闭
 	recovery *recovery.Recovery
 	//TODO: Data Cache，自适应哈希索引
+
+	// vacuum 时持有写锁，插入时持有读锁
+	vacuumLock sync.RWMutex
+	// 同一时间只有一批脏页写回
+	flushLock sync.Mutex
+	// 同一时间只有一个事务向数据页追加数据行
+	insertLock sync.Mutex
+
+	// 未结束的事务写入的可撤销日志
+	undoLogs map[tm.XID]*undoChain
+	undoLock sync.Mutex
+
+	// 同一时间只进行一次 checkpoint
+	checkPointLock sync.Mutex
+	// checkpoint 更新控制文件之前将 XID 文件落盘，由事务层设置
+	syncXIDFile func() error
+
+	// 重放日志时遇到提交日志的事务，按提交的顺序排列
+	committed []tm.XID
+
+	// 通过索引查找时并发读取数据页的 goroutine 数
+	searchWorkers int
 }
 
-func Create(path string, p *pager.Pager, recovery *recovery.Recovery) *DataManager {
+func Create(path string, p *pager.Pager, recovery *recovery.Recovery, searchWorkers int) *DataManager {
 	dm := &DataManager{
-		pager:    p,
-		recovery: recovery,
+		pager:         p,
+		recovery:      recovery,
+		undoLogs:      make(map[tm.XID]*undoChain),
+		searchWorkers: searchWorkers,
 	}
-	dm.pager.SetCacheEviction(func(key interface{}, val interface{}) {
-		page := val.(*pager.Page)
-		dm.recovery.Write(page)
-	})
+	dm.pager.SetFlush(dm.flushPages)
+	dm.recovery.SetSyncAllocated(dm.pager.SyncAllocated)
+	dm.pager.SetAppendLog(dm.recovery.AppendLog)
 	return dm
 }
 
-func Open(path string, p *pager.Pager, recovery *recovery.Recovery) *DataManager {
+// 如果上次异常退出，打开时会重放 redo log，未提交的事务需要由调用者回滚后再调用 CheckPoint
+func Open(path string, p *pager.Pager, recovery *recovery.Recovery, searchWorkers int) (*DataManager, error) {
 	dm := &DataManager{
-		pager:    p,
-		recovery: recovery,
+		pager:         p,
+		recovery:      recovery,
+		undoLogs:      make(map[tm.XID]*undoChain),
+		searchWorkers: searchWorkers,
 	}
-	dm.pager.SetCacheEviction(func(key interface{}, val interface{}) {
-		page := val.(*pager.Page)
-		dm.recovery.Write(page)
-	})
-	return dm
+	dm.pager.SetFlush(dm.flushPages)
+	dm.recovery.SetSyncAllocated(dm.pager.SyncAllocated)
+	dm.attachIndexes()
+	if dm.recovery.NeedRedo() {
+		dm.pager.SetRecreateMissing(dm.recovery.FromBackup())
+		if err := dm.recovery.Redo(dm.redo); err != nil {
+			return nil, fmt.Errorf("redo failed: %w", err)
+		}
+		if err := dm.pager.FlushAll(); err != nil {
+			return nil, fmt.Errorf("flush recovered pages failed: %w", err)
+		}
+		dm.pager.SetRecreateMissing(false)
+		dm.recovery.FinishRestore()
+	}
+	dm.pager.SetAppendLog(dm.recovery.AppendLog)
+	return dm, nil
 }
 
-func (dm *DataManager) PageFile() *os.File {
+// 最近一次 checkpoint 时下一个将要分配的 XID
+func (dm *DataManager) CheckPointNextXID() tm.XID {
+	return dm.recovery.ControlData().NextXID
+}
+
+func (dm *DataManager) SetSyncXIDFile(syncXIDFile func() error) {
+	dm.syncXIDFile = syncXIDFile
+}
+
+func (dm *DataManager) PageFile() vfs.File {
 	return dm.pager.PageFile()
 }
 
-func (dm *DataManager) getRecordData(pageNum util.UUID) *pagedata.RecordData {
+// 缓冲池写回脏页时调用，脏页经过 double write 写入磁盘
+// 多个分片可能同时写回，double write 的缓冲区同一时间只能被一批页使用
+// 获取页的二进制需要等待页上的修改完成，在 flushLock 之外进行
+func (dm *DataManager) flushPages(pages []*pager.Page) error {
+	images := make([][]byte, len(pages))
+	for i, page := range pages {
+		images[i] = page.Raw()
+	}
+
+	dm.flushLock.Lock()
+	defer dm.flushLock.Unlock()
+	for i, page := range pages {
+		if err := dm.recovery.Write(page.PageNum(), images[i]); err != nil {
+			return err
+		}
+	}
+	return dm.recovery.Flush()
+}
+
+// 事务提交时调用，保证事务的修改在异常退出后可以通过 redo log 恢复
+func (dm *DataManager) FlushLog() error {
+	return dm.recovery.FlushLog()
+}
+
+/*
+写入事务的提交日志并落盘，之后才能在 XID 文件中将事务标记为已提交。
+并发提交的事务的日志由一次 fsync 一起落盘，只读事务不写提交日志，也不需要落盘。
+*/
+func (dm *DataManager) LogCommit(xid tm.XID) error {
+	dm.undoLock.Lock()
+	_, written := dm.undoLogs[xid]
+	dm.undoLock.Unlock()
+	if !written {
+		return nil
+	}
+	dm.pager.AppendLog(redolog.NewCommitLog(xid, time.Now()))
+	return dm.recovery.FlushLog()
+}
+
+/*
+模糊 checkpoint，写回脏页期间不阻塞其他事务的修改。
+先确定 checkpoint 的 LSN，此时之前的日志修改的页都已经是脏页，
+全部写回之后恢复时只需要从该 LSN 开始重放，
+如果有未结束的事务，需要从其中最早的日志开始，以便收集撤销需要的日志。
+XID 文件在更新控制文件之前落盘，之前丢弃了撤销日志的事务的状态都已经写入 XID 文件。
+出错时 checkpoint 不推进，恢复时仍然从上一次 checkpoint 开始。
+*/
+func (dm *DataManager) CheckPoint(nextXID tm.XID) error {
+	dm.checkPointLock.Lock()
+	defer dm.checkPointLock.Unlock()
+
+	var LSN, redoStartLSN int64
+	dm.pager.LogBarrier(func() {
+		LSN = dm.recovery.CurrentLSN()
+		redoStartLSN = dm.oldestUndoLSN(LSN)
+	})
+	// 脏页没有全部写回时不能推进 checkpoint
+	if err := dm.pager.FlushAll(); err != nil {
+		return fmt.Errorf("checkpoint flush failed: %w", err)
+	}
+	if dm.syncXIDFile != nil {
+		if err := dm.syncXIDFile(); err != nil {
+			return fmt.Errorf("sync xid file failed: %w", err)
+		}
+	}
+	return dm.recovery.CheckPoint(LSN, redoStartLSN, nextXID)
+}
+
+// 返回被 pin 的数据页，使用完毕后需要 Unpin
+// 数据页损坏时返回的错误满足 errors.Is(err, pager.ErrPageCorrupted)
+func (dm *DataManager) getRecordPage(pageNum util.UUID) (*pager.Page, error) {
 	recordPage, err := dm.pager.GetPage(pageNum, pagedata.NewRecordData())
 	if err != nil {
-		log.Fatalf("get record page failed: %v", err)
+		return nil, fmt.Errorf("get record page failed: %w", err)
+	}
+	return recordPage, nil
+}
+
+// 查询的结果，Rows 被关闭之后通过 Err 得到扫描数据页时发生的错误
+type RowScan struct {
+	rows chan *ast.Row
+	// Close 之后扫描提前结束，不再向 rows 发送数据
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	err  error
+}
+
+func newRowScan() *RowScan {
+	return &RowScan{
+		rows: make(chan *ast.Row, 64),
+		done: make(chan struct{}),
 	}
-	return recordPage.Data().(*pagedata.RecordData)
 }
 
-func (dm *DataManager) SelectData(selectStatement ast.SelectStmt) (
-	<-chan *ast.Row, error) {
-	rows := make(chan *ast.Row, 64)
+// 提前结束扫描，不再读取的结果需要调用 Close，否则扫描的 goroutine 会一直阻塞。可以多次调用
+func (scan *RowScan) Close() {
+	scan.closeOnce.Do(func() {
+		close(scan.done)
+	})
+}
+
+func (scan *RowScan) closed() bool {
+	select {
+	case <-scan.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 发送一行结果，扫描已经被关闭时返回 false
+func (scan *RowScan) send(row *ast.Row) bool {
+	select {
+	case scan.rows <- row:
+		return true
+	case <-scan.done:
+		return false
+	}
+}
+
+func (scan *RowScan) Rows() <-chan *ast.Row {
+	return scan.rows
+}
+
+// 需要在 Rows 被关闭之后调用，返回扫描过程中的第一个错误
+func (scan *RowScan) Err() error {
+	scan.lock.Lock()
+	defer scan.lock.Unlock()
+	return scan.err
+}
+
+// 记录第一个错误，扫描会继续到 rows 被关闭，不会阻塞索引的查找
+func (scan *RowScan) fail(err error) {
+	scan.lock.Lock()
+	defer scan.lock.Unlock()
+	if scan.err == nil {
+		scan.err = err
+	}
+}
+
+func (dm *DataManager) SelectData(selectStatement ast.SelectStmt) (*RowScan, error) {
+	scan := newRowScan()
 	metaData := dm.pager.GetMetaData()
 	// 获取表信息
 	tableInfo := metaData.GetTableInfo(selectStatement.TableName)
 	if tableInfo == nil {
-		close(rows)
-		err := fmt.Errorf("table %s not exist", selectStatement.TableName)
-		return rows, err
+		close(scan.rows)
+		err := fmt.Errorf("%w: %s", ErrTableNotExist, selectStatement.TableName)
+		return scan, err
 	}
 
 	if selectStatement.Where.IsExists {
 		expr := selectStatement.Where.Expr
 		if expr.IsEqual() {
 			// 相等查找
-			dm.equalSearch(rows, tableInfo, expr, expr.Right)
+			dm.equalSearch(scan, tableInfo, expr, expr.Right)
 		} else {
 			// TODO: 非相等查找
 			err := fmt.Errorf("only support equal condition")
-			return rows, err
+			return scan, err
 		}
 	} else {
 		// 没有 where 条件，全表扫描
-		dm.fullScan(rows, tableInfo, selectStatement.Where.Expr)
+		go dm.fullScan(scan, tableInfo, selectStatement.Where.Expr)
 	}
-	return rows, nil
+	return scan, nil
 }
 
 // 把 where 转换成一个函数，返回值为 bool，表示是否符合条件
@@ -183,14 +365,14 @@ func whereToFunc(tableInfo *pagedata.TableInfo, expr *ast.SQLExpr) (
 	}
 }
 
-func (dm *DataManager) equalSearch(rows chan<- *ast.Row, tableInfo *pagedata.TableInfo,
+func (dm *DataManager) equalSearch(scan *RowScan, tableInfo *pagedata.TableInfo,
 	expr *ast.SQLExpr, value ast.SQLExprValue) {
 	if expr.Left.ValueType() == ast.SQL_COLUMN {
 		// 查询索引
 		columnName := string(*expr.Left.(*ast.SQLColumn))
 		columnDefine := tableInfo.GetColumnDefine(columnName)
 		if columnDefine == nil {
-			close(rows)
+			close(scan.rows)
 			log.Errorf("column %s not exist", columnName)
 			return
 		}
@@ -198,38 +380,38 @@ func (dm *DataManager) equalSearch(rows chan<- *ast.Row, tableInfo *pagedata.Tab
 		if index == nil {
 			// 没有索引，全表扫描
 			log.Warnf("index %s not exist, full scan table", *expr.Left.(*ast.SQLColumn))
-			dm.fullScan(rows, tableInfo, expr)
+			go dm.fullScan(scan, tableInfo, expr)
 			return
 		}
 		if columnName == tableInfo.PrimaryKey() {
 			// 主键索引，直接遍历数据页
-			dm.primaryKeyEqualSearch(rows, index, expr.Right)
+			dm.primaryKeyEqualSearch(scan, index, expr.Right)
 			return
 		} else {
 			// 非主键索引相等
 			primaryColumn := tableInfo.GetColumnDefine(tableInfo.PrimaryKey())
 			if primaryColumn == nil {
-				close(rows)
+				close(scan.rows)
 				log.Errorf("primary key %s not exist", tableInfo.PrimaryKey())
 				return
 			}
 			primaryIndex := primaryColumn.Index
 			if primaryIndex == nil {
-				close(rows)
+				close(scan.rows)
 				log.Errorf("fatal error: primary index %s not exist", tableInfo.PrimaryKey())
 				return
 			}
-			dm.simpleEqualSearch(rows, index, primaryIndex, expr.Right)
+			dm.simpleEqualSearch(scan, index, primaryIndex, expr.Right)
 			return
 		}
 	} else {
 		if expr.Left == expr.Right {
 			log.Warnf("full scan table")
-			dm.fullScan(rows, tableInfo, expr)
+			go dm.fullScan(scan, tableInfo, expr)
 			return
 		} else {
 			// 左值和右值不相等，结果为空
-			close(rows)
+			close(scan.rows)
 			return
 		}
 	}
@@ -244,106 +426,148 @@ func checkValueFunc(value ast.SQLExprValue) func(*ast.Row) bool {
 	}
 }
 
-func (dm *DataManager) primaryKeyEqualSearch(rows chan<- *ast.Row, primaryIndex index.Index, value ast.SQLExprValue) {
-	valueChan := primaryIndex.Search(value.Raw())
+func (dm *DataManager) primaryKeyEqualSearch(scan *RowScan, primaryIndex index.Index, value ast.SQLExprValue) {
+	result := primaryIndex.Search(value.Raw())
 	w := sync.WaitGroup{}
-	w.Add(util.MAX_SEARCH_THRESHOLD)
-	for i := 0; i < util.MAX_SEARCH_THRESHOLD; i++ {
+	w.Add(dm.searchWorkers)
+	for i := 0; i < dm.searchWorkers; i++ {
 		go func() {
 			defer w.Done()
-			for pageNumBytes := range valueChan {
+			for pageNumBytes := range result.Values() {
 				pageNum := util.BytesToUUID(pageNumBytes)
-				dm.traverseData(rows, pageNum, checkValueFunc(value))
+				dm.traverseData(scan, pageNum, checkValueFunc(value))
 			}
 		}()
 	}
 	go func() {
 		w.Wait()
-		close(rows)
+		if err := result.Err(); err != nil {
+			scan.fail(err)
+		}
+		close(scan.rows)
 	}()
 }
 
 // 非主键索引相等查找
-func (dm *DataManager) simpleEqualSearch(rows chan<- *ast.Row, simpleIndex index.Index,
+func (dm *DataManager) simpleEqualSearch(scan *RowScan, simpleIndex index.Index,
 	primaryIndex index.Index, value ast.SQLExprValue) {
 	// 先查找主键索引
-	indexChan := simpleIndex.Search(value.Raw())
+	primaryKeys := simpleIndex.Search(value.Raw())
 	w := sync.WaitGroup{}
-	w.Add(util.MAX_SEARCH_THRESHOLD)
-	for i := 0; i < util.MAX_SEARCH_THRESHOLD; i++ {
+	w.Add(dm.searchWorkers)
+	for i := 0; i < dm.searchWorkers; i++ {
 		go func() {
 			defer w.Done()
 			// 根据主键查找数据页
-			for primaryKeyBytes := range indexChan {
-				pageNumChan := primaryIndex.Search(index.KeyType(primaryKeyBytes))
-				for pageNumBytes := range pageNumChan {
+			for primaryKeyBytes := range primaryKeys.Values() {
+				pageNums := primaryIndex.Search(index.KeyType(primaryKeyBytes))
+				for pageNumBytes := range pageNums.Values() {
 					pageNum := util.BytesToUUID(pageNumBytes)
-					dm.traverseData(rows, pageNum, checkValueFunc(value))
+					dm.traverseData(scan, pageNum, checkValueFunc(value))
+				}
+				if err := pageNums.Err(); err != nil {
+					scan.fail(err)
 				}
 			}
 		}()
 	}
 	go func() {
 		w.Wait()
-		close(rows)
+		if err := primaryKeys.Err(); err != nil {
+			scan.fail(err)
+		}
+		close(scan.rows)
 	}()
 }
 
 // 扫描指定表的全部数据，自动关闭 rows
-func (dm *DataManager) fullScan(rows chan<- *ast.Row, tableInfo *pagedata.TableInfo, expr *ast.SQLExpr) {
+func (dm *DataManager) fullScan(scan *RowScan, tableInfo *pagedata.TableInfo, expr *ast.SQLExpr) {
 	// TODO: 双线程扫描
 	check, err := whereToFunc(tableInfo, expr)
 	if err != nil {
-		close(rows)
+		close(scan.rows)
 		log.Errorf("whereToFunc failed: %v", err)
 		return
 	}
 	pageNum := tableInfo.FirstPageNum
-	for pageNum != 0 {
-		dm.traverseData(rows, pageNum, check)
+	for pageNum != pager.NIL_PAGE_NUM {
+		if !dm.traverseData(scan, pageNum, check) {
+			break
+		}
 		var err error
 		pageNum, err = dm.pager.NextPageNum(pageNum)
 		if err != nil {
-			log.Errorf("fatal error: %s", err)
-			return
+			// 无法得到下一个数据页，结束扫描
+			scan.fail(err)
+			break
 		}
 	}
-	close(rows)
+	close(scan.rows)
 }
 
-// 遍历数据页，查找符合条件的数据，不负责关闭 rows
-func (dm *DataManager) traverseData(rows chan<- *ast.Row, pageNum util.UUID, check func(*ast.Row) bool) {
-	recordData := dm.getRecordData(pageNum)
-	for _, row := range recordData.Rows() {
-		if check(row) {
-			rows <- row
+// 遍历数据页，查找符合条件的数据，不负责关闭 rows，读取数据页失败时记录到 scan 中。
+// 扫描已经被关闭时返回 false
+func (dm *DataManager) traverseData(scan *RowScan, pageNum util.UUID, check func(*ast.Row) bool) bool {
+	if scan.closed() {
+		return false
+	}
+	recordPage, err := dm.getRecordPage(pageNum)
+	if err != nil {
+		scan.fail(err)
+		return true
+	}
+	// 先复制一份行列表，避免在发送时持有页锁
+	recordPage.RLock()
+	pageRows := recordPage.Data().(*pagedata.RecordData).Rows()
+	recordPage.RUnlock()
+	dm.pager.Unpin(recordPage, false)
+	for _, row := range pageRows {
+		if check(row) && !scan.send(row) {
+			return false
 		}
 	}
+	return true
 }
 
 // 插入数据
-func (dm *DataManager) InsertData(insertStatement ast.InsertIntoStmt) {
+func (dm *DataManager) InsertData(insertStatement ast.InsertIntoStmt) error {
 	metaData := dm.pager.GetMetaData()
 	tableInfo := metaData.GetTableInfo(insertStatement.TableName)
 	if tableInfo == nil {
-		log.Warnf("table %s not exist", insertStatement.TableName)
-		return
+		return ErrTableNotExist
 	}
+	// 插入过程中不允许 vacuum 整理数据页和索引
+	dm.vacuumLock.RLock()
+	defer dm.vacuumLock.RUnlock()
+
 	row := ast.NewRow(insertStatement.Row)
+	// 选择数据页到追加数据行期间持有 insertLock，避免同时写满同一页或者同时分配新页
+	dm.insertLock.Lock()
 	// TODO: 检查字段是否存在
 	dataPage, err := dm.pager.Select(row.Size, insertStatement.TableName)
-	row.SetOffset(int64(dataPage.PageNum())*util.PAGE_SIZE + int64(dataPage.Size()))
 	if err != nil {
-		log.Errorf("table %s not exist", insertStatement.TableName)
-		return
+		dm.insertLock.Unlock()
+		return err
 	}
 	// 插入数据
+	xmin, _ := row.Xmin()
+	dm.beginUndo(xmin)
+	dataPage.Lock()
 	pageData := dataPage.Data().(*pagedata.RecordData)
+	// vacuum 不会改变行的 Offset，页末尾的 Offset 可能仍被整理前插入的行使用
+	pageBegin := int64(dataPage.PageNum()) * util.PAGE_SIZE
+	row.SetOffset(pageData.AllocOffset(pageBegin+pager.PAGE_HEADER_SIZE+2+1,
+		pageBegin+util.PAGE_SIZE, pageBegin+int64(dataPage.Size())))
 	pageData.Append(row)
+	appendLog := redolog.NewRecordPageAppendLog(
+		tableInfo.TableId, dataPage.PageNum(), dataPage.PrevPageNum(), row)
+	dm.pager.AppendLog(appendLog, dataPage)
+	dataPage.Unlock()
+	dm.insertLock.Unlock()
+	dm.pushUndo(appendLog)
 
-	redolog := redolog.NewRecordPageAppendLog(dataPage.PageNum(), row)
-	dataPage.AppendLog(redolog)
-	dm.recovery.Write(dataPage)
+	pageNum := dataPage.PageNum()
+	dm.pager.Unpin(dataPage, true)
 
 	for i, columnDefine := range tableInfo.ColumnDefines {
 		index := columnDefine.Index
@@ -351,14 +575,83 @@ func (dm *DataManager) InsertData(insertStatement ast.InsertIntoStmt) {
 			continue
 		}
 		// 更新索引
+		var value []byte
 		if i == 0 {
 			// 主键索引
-			index.Insert(insertStatement.Row[i].Raw(), util.UUIDToBytes(index.ValueSize(), dataPage.PageNum()))
+			value = util.UUIDToBytes(index.ValueSize(), pageNum)
 		} else {
 			// 非主键索引
-			index.Insert(insertStatement.Row[i].Raw(), insertStatement.Row[0].Raw())
+			value = insertStatement.Row[0].Raw()
 		}
+		key := insertStatement.Row[i].Raw()
+		// 撤销日志先于索引的修改写入
+		undoLog := redolog.NewIndexInsertLog(xmin, tableInfo.TableId, uint16(i), pageNum, key, value)
+		dm.pager.AppendLog(undoLog)
+		dm.pushUndo(undoLog)
+		index.Insert(key, value)
+	}
+	return nil
+}
+
+// 返回数据页中该行当前的 xmax，扫描得到的行可能已经被其他事务修改
+func (dm *DataManager) Xmax(row *ast.Row) (tm.XID, error) {
+	dm.vacuumLock.RLock()
+	defer dm.vacuumLock.RUnlock()
+
+	pageNum := util.UUID(row.Offset / util.PAGE_SIZE)
+	recordPage, err := dm.getRecordPage(pageNum)
+	if err != nil {
+		return tm.NIL_XID, err
+	}
+	defer dm.pager.Unpin(recordPage, false)
+	recordPage.RLock()
+	defer recordPage.RUnlock()
+	rowXmin, _ := row.Xmin()
+	pageRow := findRow(recordPage.Data().(*pagedata.RecordData), row.Offset, row.Data[0].Raw(),
+		rowXmin, func(*ast.Row) bool {
+			return true
+		})
+	if pageRow == nil {
+		return tm.NIL_XID, fmt.Errorf("read xmax of row at offset %d: %w", row.Offset, ErrRowNotFound)
+	}
+	xmax, _ := pageRow.Xmax()
+	return xmax, nil
+}
+
+// 设置数据行的 xmax，row 的 Offset 决定了其所在的数据页
+func (dm *DataManager) SetXmax(row *ast.Row, xid tm.XID) error {
+	// 设置 xmax 期间不允许 vacuum 删除数据行
+	dm.vacuumLock.RLock()
+	defer dm.vacuumLock.RUnlock()
+
+	pageNum := util.UUID(row.Offset / util.PAGE_SIZE)
+	recordPage, err := dm.getRecordPage(pageNum)
+	if err != nil {
+		return err
+	}
+	dm.beginUndo(xid)
+	recordPage.Lock()
+	// 数据页可能已经被换出后重新读入，需要按主键和 xmin 找到页中的数据行
+	rowXmin, _ := row.Xmin()
+	pageRow := findRow(recordPage.Data().(*pagedata.RecordData), row.Offset, row.Data[0].Raw(),
+		rowXmin, func(*ast.Row) bool {
+			return true
+		})
+	if pageRow == nil {
+		recordPage.Unlock()
+		dm.pager.Unpin(recordPage, false)
+		return fmt.Errorf("set xmax of row at offset %d: %w", row.Offset, ErrRowNotFound)
 	}
+	oldXmax, _ := pageRow.Xmax()
+	redolog := redolog.NewRecordSetXmaxLog(
+		pageNum, pageRow.Offset, pageRow.Data[0].Raw(), rowXmin, oldXmax, xid)
+	pageRow.SetXmax(xid)
+	dm.pager.AppendLog(redolog, recordPage)
+	dm.pushUndo(redolog)
+	recordPage.Unlock()
+	row.SetXmax(xid)
+	dm.pager.Unpin(recordPage, true)
+	return nil
 }
 
 func (dm *DataManager) Close() {
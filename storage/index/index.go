@@ -1,14 +1,59 @@
 package index
 
+import (
+	"errors"
+	"sync"
+)
+
+var ErrKeyNotFound = errors.New("key-value pair not found")
+
 type KeyType []byte
 
 // Value 的数据类型， 不能小于 32 位 (4 byte)
 type ValueType []byte
 
 type Index interface {
-	Search(key KeyType) <-chan ValueType
+	// 查找 key 对应的所有值，读取节点失败时提前结束，错误通过 SearchResult.Err 返回
+	Search(key KeyType) *SearchResult
 	Insert(key KeyType, value ValueType) error
+	// 删除一个 key-value 对，不存在时返回 ErrKeyNotFound
+	Delete(key KeyType, value ValueType) error
 
 	KeySize() uint8
 	ValueSize() uint8
 }
+
+// 查找的结果，由单独的 goroutine 发送，Values 被关闭之后才能调用 Err
+type SearchResult struct {
+	values chan ValueType
+
+	lock sync.Mutex
+	err  error
+}
+
+func NewSearchResult(size int) *SearchResult {
+	return &SearchResult{values: make(chan ValueType, size)}
+}
+
+func (result *SearchResult) Values() <-chan ValueType {
+	return result.values
+}
+
+// 返回查找过程中的错误
+func (result *SearchResult) Err() error {
+	result.lock.Lock()
+	defer result.lock.Unlock()
+	return result.err
+}
+
+func (result *SearchResult) Send(value ValueType) {
+	result.values <- value
+}
+
+// 结束查找，err 不为 nil 时记录查找失败的原因
+func (result *SearchResult) Close(err error) {
+	result.lock.Lock()
+	result.err = err
+	result.lock.Unlock()
+	close(result.values)
+}
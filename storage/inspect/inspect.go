@@ -0,0 +1,715 @@
+/*
+inspect 解码数据库目录中的文件，用于排查存储层的问题，需要在数据库关闭时调用。
+可以查看 meta page 中的目录、任意一页的内容、redo log 中的日志、
+double write buffer 中的页以及每个事务的状态。
+返回的结构都可以直接编码为 JSON，String 方法返回便于阅读的文本。
+*/
+package inspect
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/bplustree"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/doublewrite"
+	"minidb-go/storage/recovery/recinfo"
+	"minidb-go/storage/recovery/redo"
+	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 页的解码方式
+const (
+	AS_AUTO   = "auto"
+	AS_META   = "meta"
+	AS_RECORD = "record"
+	AS_INDEX  = "index"
+)
+
+var columnTypeNames = map[ast.ColumnType]string{
+	ast.CT_INT:   "int",
+	ast.CT_FLOAT: "float",
+	ast.CT_TEXT:  "text",
+}
+
+var statusNames = map[byte]string{
+	tm.TRANS_ACTIVE:   "active",
+	tm.TRANS_COMMITED: "committed",
+	tm.TRANS_ABORTED:  "aborted",
+}
+
+type IndexInfo struct {
+	Root       util.UUID `json:"root"`
+	FirstLeaf  util.UUID `json:"firstLeaf"`
+	LastLeaf   util.UUID `json:"lastLeaf"`
+	Order      uint16    `json:"order"`
+	KeySize    uint8     `json:"keySize"`
+	ValueSize  uint8     `json:"valueSize"`
+	Compressed bool      `json:"compressed"`
+}
+
+type ColumnInfo struct {
+	Id    uint16     `json:"id"`
+	Name  string     `json:"name"`
+	Type  string     `json:"type"`
+	Index *IndexInfo `json:"index,omitempty"`
+}
+
+type TableInfo struct {
+	Name       string        `json:"name"`
+	Id         uint16        `json:"id"`
+	FirstPage  util.UUID     `json:"firstPage"`
+	LastPage   util.UUID     `json:"lastPage"`
+	Compressed bool          `json:"compressed"`
+	Columns    []*ColumnInfo `json:"columns"`
+}
+
+type CatalogInfo struct {
+	Version string       `json:"version"`
+	Tables  []*TableInfo `json:"tables"`
+}
+
+func (catalog *CatalogInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version %s, %d tables\n", catalog.Version, len(catalog.Tables))
+	for _, table := range catalog.Tables {
+		fmt.Fprintf(&b, "table %s (id %d): data pages %d..%d, compressed %v\n",
+			table.Name, table.Id, table.FirstPage, table.LastPage, table.Compressed)
+		for _, column := range table.Columns {
+			fmt.Fprintf(&b, "  column %d %s %s", column.Id, column.Name, column.Type)
+			if index := column.Index; index != nil {
+				fmt.Fprintf(&b, ", index root %d, leaves %d..%d, order %d, key %d bytes, value %d bytes",
+					index.Root, index.FirstLeaf, index.LastLeaf, index.Order, index.KeySize, index.ValueSize)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+type ControlInfo struct {
+	CheckPointLSN int64       `json:"checkPointLSN"`
+	RedoStartLSN  int64       `json:"redoStartLSN"`
+	CleanShutdown bool        `json:"cleanShutdown"`
+	NextXID       tm.XID      `json:"nextXID"`
+	CatalogRoot   util.UUID   `json:"catalogRoot"`
+	Catalog       CatalogInfo `json:"catalog"`
+}
+
+func (control *ControlInfo) String() string {
+	return fmt.Sprintf("checkpoint %d, redo start %d, clean shutdown %v, next xid %d, catalog root %d\n%s",
+		control.CheckPointLSN, control.RedoStartLSN, control.CleanShutdown,
+		control.NextXID, control.CatalogRoot, control.Catalog.String())
+}
+
+// 数据库目录中的页文件、控制信息和 meta page
+type database struct {
+	file     vfs.File
+	pages    int
+	control  recinfo.ControlData
+	metaData *pagedata.MetaData
+}
+
+func openDatabase(path string) (*database, error) {
+	if _, err := os.Stat(path + "/" + recinfo.REC_INFO_FILE_NAME); err != nil {
+		return nil, err
+	}
+	info, err := recinfo.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	control := info.Data()
+	info.Close()
+
+	file, err := vfs.OpenFile(path+"/"+pager.PAGE_FILE_NAME, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	db := &database{
+		file: file,
+		// 压缩的页不会写满整个页，向上取整
+		pages:   int((stat.Size() + util.PAGE_SIZE - 1) / util.PAGE_SIZE),
+		control: control,
+	}
+	image, err := pager.ReadImage(file, control.CatalogRoot)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read meta page failed: %w", err)
+	}
+	page, err := pager.LoadPage(bytes.NewReader(image), pagedata.NewMetaData())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read meta page failed: %w", err)
+	}
+	db.metaData = page.Data().(*pagedata.MetaData)
+	return db, nil
+}
+
+// 按 id 排序的表
+func (db *database) tables() []*pagedata.TableInfo {
+	tables := make([]*pagedata.TableInfo, 0, len(db.metaData.Tables))
+	for _, tableInfo := range db.metaData.Tables {
+		tables = append(tables, tableInfo)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].TableId < tables[j].TableId })
+	return tables
+}
+
+func (db *database) catalog() CatalogInfo {
+	catalog := CatalogInfo{
+		Version: db.metaData.Version,
+		Tables:  make([]*TableInfo, 0),
+	}
+	for _, tableInfo := range db.tables() {
+		table := &TableInfo{
+			Name:       tableInfo.TableName,
+			Id:         tableInfo.TableId,
+			FirstPage:  tableInfo.FirstPageNum,
+			LastPage:   tableInfo.LastPageNum,
+			Compressed: tableInfo.Compressed,
+		}
+		for _, columnDefine := range tableInfo.ColumnDefines {
+			column := &ColumnInfo{
+				Id:   columnDefine.ColumnId,
+				Name: columnDefine.Name,
+				Type: columnTypeNames[columnDefine.Type],
+			}
+			if tree, ok := columnDefine.Index.(*bplustree.BPlusTree); ok {
+				column.Index = &IndexInfo{
+					Root:       tree.Root,
+					FirstLeaf:  tree.FirstLeaf,
+					LastLeaf:   tree.LastLeaf,
+					Order:      tree.Order(),
+					KeySize:    tree.KeySize(),
+					ValueSize:  tree.ValueSize(),
+					Compressed: tree.Compressed,
+				}
+			}
+			table.Columns = append(table.Columns, column)
+		}
+		catalog.Tables = append(catalog.Tables, table)
+	}
+	return catalog
+}
+
+// 控制文件和 meta page 中的目录
+func Catalog(path string) (*ControlInfo, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.file.Close()
+	return &ControlInfo{
+		CheckPointLSN: db.control.CheckPointLSN,
+		RedoStartLSN:  db.control.RedoStartLSN,
+		CleanShutdown: db.control.CleanShutdown,
+		NextXID:       db.control.NextXID,
+		CatalogRoot:   db.control.CatalogRoot,
+		Catalog:       db.catalog(),
+	}, nil
+}
+
+type RowInfo struct {
+	Offset int64    `json:"offset"`
+	Size   uint16   `json:"size"`
+	Values []string `json:"values"`
+	Xmin   tm.XID   `json:"xmin"`
+	Xmax   tm.XID   `json:"xmax"`
+}
+
+type NodeInfo struct {
+	Addr     util.UUID `json:"addr"`
+	Parent   util.UUID `json:"parent"`
+	PreLeaf  util.UUID `json:"preLeaf"`
+	NextLeaf util.UUID `json:"nextLeaf"`
+	IsLeaf   bool      `json:"isLeaf"`
+	// 键和值的十六进制，非叶子节点的值比键多一个
+	Keys   []string `json:"keys"`
+	Values []string `json:"values"`
+}
+
+type PageInfo struct {
+	PageNum      util.UUID `json:"pageNum"`
+	Checksum     uint32    `json:"checksum"`
+	LSN          int64     `json:"lsn"`
+	NextPageNum  util.UUID `json:"nextPageNum"`
+	PrevPageNum  util.UUID `json:"prevPageNum"`
+	PayloadLen   uint16    `json:"payloadLen"`
+	Compressible bool      `json:"compressible"`
+	Compressed   bool      `json:"compressed"`
+	ChecksumOK   bool      `json:"checksumOK"`
+
+	// 解码的方式，以及引用该页的表或索引
+	Type  string `json:"type"`
+	Owner string `json:"owner,omitempty"`
+
+	Catalog *CatalogInfo `json:"catalog,omitempty"`
+	Rows    []*RowInfo   `json:"rows,omitempty"`
+	Node    *NodeInfo    `json:"node,omitempty"`
+}
+
+func (info *PageInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "page %d: checksum %08x (ok %v), LSN %d, next %d, prev %d, payload %d bytes, compressible %v, compressed %v\n",
+		info.PageNum, info.Checksum, info.ChecksumOK, info.LSN, info.NextPageNum, info.PrevPageNum,
+		info.PayloadLen, info.Compressible, info.Compressed)
+	fmt.Fprintf(&b, "decoded as %s page", info.Type)
+	if info.Owner != "" {
+		fmt.Fprintf(&b, " owned by %s", info.Owner)
+	}
+	b.WriteString("\n")
+	switch {
+	case info.Catalog != nil:
+		b.WriteString(info.Catalog.String() + "\n")
+	case info.Node != nil:
+		node := info.Node
+		fmt.Fprintf(&b, "node %d: parent %d, leaf %v, prev leaf %d, next leaf %d, %d keys\n",
+			node.Addr, node.Parent, node.IsLeaf, node.PreLeaf, node.NextLeaf, len(node.Keys))
+		for i, key := range node.Keys {
+			fmt.Fprintf(&b, "  %s -> %s\n", key, node.Values[i])
+		}
+		if !node.IsLeaf && len(node.Values) > len(node.Keys) {
+			fmt.Fprintf(&b, "  last child -> %s\n", node.Values[len(node.Keys)])
+		}
+	case info.Type == AS_RECORD:
+		fmt.Fprintf(&b, "%d rows\n", len(info.Rows))
+		for _, row := range info.Rows {
+			fmt.Fprintf(&b, "  offset %d size %d xmin %d xmax %d: %s\n",
+				row.Offset, row.Size, row.Xmin, row.Xmax, strings.Join(row.Values, ", "))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// 解码页号为 pageNum 的页，as 为 AS_AUTO 时根据引用该页的结构决定解码方式
+func Page(path string, pageNum util.UUID, as string) (*PageInfo, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.file.Close()
+	if as != AS_AUTO && as != AS_META && as != AS_RECORD && as != AS_INDEX {
+		return nil, fmt.Errorf("unknown page type %q", as)
+	}
+	if int(pageNum) >= db.pages {
+		return nil, fmt.Errorf("page %d is beyond the end of the file (%d pages)", pageNum, db.pages)
+	}
+
+	image := make([]byte, util.PAGE_SIZE)
+	n, _ := db.file.ReadAt(image, int64(pageNum)*util.PAGE_SIZE)
+	if n < pager.PAGE_HEADER_SIZE {
+		return nil, fmt.Errorf("page %d is truncated", pageNum)
+	}
+	header := pager.ReadHeader(image)
+	size := pager.ImageSize(image)
+	info := &PageInfo{
+		PageNum:      header.PageNum,
+		Checksum:     header.Checksum,
+		LSN:          header.LSN,
+		NextPageNum:  header.NextPageNum,
+		PrevPageNum:  header.PrevPageNum,
+		PayloadLen:   header.PayloadLen,
+		Compressible: header.Flags&pager.FLAG_COMPRESSIBLE != 0,
+		Compressed:   header.Flags&pager.FLAG_COMPRESSED != 0,
+		ChecksumOK:   size <= n && pager.VerifyImage(image[:size]),
+		Type:         as,
+	}
+	// 校验失败的页只显示页头
+	if !info.ChecksumOK {
+		return info, nil
+	}
+	image = image[:size]
+
+	pageType, owner, tree := db.classify(pageNum)
+	if as == AS_AUTO {
+		if pageType == "" {
+			return nil, fmt.Errorf("page %d is not referenced by the catalog, use -as to decode it", pageNum)
+		}
+		info.Type = pageType
+	}
+	if info.Type == pageType {
+		info.Owner = owner
+	}
+	if info.Type == AS_INDEX && tree == nil {
+		// 没有被任何索引引用的页，使用第一个索引的参数解码
+		tree = db.anyTree()
+		if tree == nil {
+			return nil, fmt.Errorf("page %d: no index to decode the node with", pageNum)
+		}
+	}
+
+	switch info.Type {
+	case AS_META:
+		page, err := pager.LoadPage(bytes.NewReader(image), pagedata.NewMetaData())
+		if err != nil {
+			return nil, err
+		}
+		db.metaData = page.Data().(*pagedata.MetaData)
+		catalog := db.catalog()
+		info.Catalog = &catalog
+	case AS_RECORD:
+		page, err := pager.LoadPage(bytes.NewReader(image), pagedata.NewRecordData())
+		if err != nil {
+			return nil, err
+		}
+		info.Rows = make([]*RowInfo, 0)
+		for _, row := range page.Data().(*pagedata.RecordData).Rows() {
+			info.Rows = append(info.Rows, newRowInfo(row))
+		}
+	case AS_INDEX:
+		node := &bplustree.BPlusTreeNode{}
+		node.SetTree(tree)
+		page, err := pager.LoadPage(bytes.NewReader(image), node)
+		if err != nil {
+			return nil, err
+		}
+		info.Node = newNodeInfo(page.Data().(*bplustree.BPlusTreeNode))
+	}
+	return info, nil
+}
+
+func newRowInfo(row *ast.Row) *RowInfo {
+	info := &RowInfo{
+		Offset: row.Offset,
+		Size:   row.Size,
+		Values: make([]string, 0, len(row.Data)),
+	}
+	for i, value := range row.Data {
+		// 最后两列为 xmin 和 xmax
+		if i >= len(row.Data)-2 {
+			break
+		}
+		info.Values = append(info.Values, value.String())
+	}
+	info.Xmin, _ = row.Xmin()
+	info.Xmax, _ = row.Xmax()
+	return info
+}
+
+func newNodeInfo(node *bplustree.BPlusTreeNode) *NodeInfo {
+	info := &NodeInfo{
+		Addr:     node.Addr,
+		Parent:   node.Parent,
+		PreLeaf:  node.PreLeaf,
+		NextLeaf: node.NextLeaf,
+		IsLeaf:   node.IsLeaf(),
+		Keys:     make([]string, 0, node.Len),
+		Values:   make([]string, 0, node.Len+1),
+	}
+	valueNum := int(node.Len)
+	if !node.IsLeaf() {
+		valueNum++
+	}
+	for i := 0; i < int(node.Len); i++ {
+		info.Keys = append(info.Keys, hex.EncodeToString(node.Keys[i]))
+	}
+	for i := 0; i < valueNum; i++ {
+		info.Values = append(info.Values, hex.EncodeToString(node.Values[i]))
+	}
+	return info
+}
+
+// 根据目录判断页的类型，返回类型、引用该页的表或索引，以及索引页所在的 B+ 树，
+// 没有被引用的页返回空的类型
+func (db *database) classify(pageNum util.UUID) (string, string, *bplustree.BPlusTree) {
+	if pageNum == db.control.CatalogRoot {
+		return AS_META, "", nil
+	}
+	tables := db.tables()
+	for _, tableInfo := range tables {
+		// 只读取页头中的链接，页数用于防止链表成环
+		next := tableInfo.FirstPageNum
+		for i := 0; next != pager.NIL_PAGE_NUM && i < db.pages; i++ {
+			if next == pageNum {
+				return AS_RECORD, "table " + tableInfo.TableName, nil
+			}
+			image, err := pager.ReadImage(db.file, next)
+			if err != nil {
+				break
+			}
+			next = pager.ReadHeader(image).NextPageNum
+		}
+	}
+	for _, tableInfo := range tables {
+		for _, columnDefine := range tableInfo.ColumnDefines {
+			tree, ok := columnDefine.Index.(*bplustree.BPlusTree)
+			if ok && db.inTree(tree, pageNum) {
+				return AS_INDEX, fmt.Sprintf("index %s.%s", tableInfo.TableName, columnDefine.Name), tree
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// 从根节点开始遍历 B+ 树，判断 pageNum 是否为树中的节点
+func (db *database) inTree(tree *bplustree.BPlusTree, pageNum util.UUID) bool {
+	visited := make(map[util.UUID]bool)
+	queue := []util.UUID{tree.Root}
+	for len(queue) > 0 {
+		addr := queue[0]
+		queue = queue[1:]
+		if addr == pageNum {
+			return true
+		}
+		if visited[addr] || int(addr) >= db.pages {
+			continue
+		}
+		visited[addr] = true
+		image, err := pager.ReadImage(db.file, addr)
+		if err != nil {
+			continue
+		}
+		node := &bplustree.BPlusTreeNode{}
+		node.SetTree(tree)
+		page, err := pager.LoadPage(bytes.NewReader(image), node)
+		if err != nil {
+			continue
+		}
+		node = page.Data().(*bplustree.BPlusTreeNode)
+		if node.IsLeaf() {
+			continue
+		}
+		for i := 0; i <= int(node.Len); i++ {
+			queue = append(queue, util.BytesToUUID(node.Values[i]))
+		}
+	}
+	return false
+}
+
+func (db *database) anyTree() *bplustree.BPlusTree {
+	for _, tableInfo := range db.tables() {
+		for _, columnDefine := range tableInfo.ColumnDefines {
+			if tree, ok := columnDefine.Index.(*bplustree.BPlusTree); ok {
+				return tree
+			}
+		}
+	}
+	return nil
+}
+
+type LogRecord struct {
+	// 日志在 redo log 中的起止位置，日志的 LSN 为结束的位置
+	StartLSN int64                  `json:"startLSN"`
+	LSN      int64                  `json:"lsn"`
+	Type     string                 `json:"type"`
+	Fields   map[string]interface{} `json:"fields"`
+}
+
+type RedoInfo struct {
+	FirstLSN int64 `json:"firstLSN"`
+	// 最后一条完整的日志结束的位置，小于 FileLSN 时之后的内容已经损坏
+	EndLSN  int64        `json:"endLSN"`
+	FileLSN int64        `json:"fileLSN"`
+	Records []*LogRecord `json:"records"`
+}
+
+func (info *RedoInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "redo log %d..%d, %d records\n", info.FirstLSN, info.FileLSN, len(info.Records))
+	for _, record := range info.Records {
+		fmt.Fprintf(&b, "%d..%d %s %s\n", record.StartLSN, record.LSN, record.Type, formatFields(record.Fields))
+	}
+	if info.EndLSN < info.FileLSN {
+		fmt.Fprintf(&b, "log after %d is corrupted\n", info.EndLSN)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func formatFields(fields map[string]interface{}) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := fields[name]
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = "{" + formatFields(nested) + "}"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", name, value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// 按顺序读取 redo log 中的所有日志
+func RedoLog(path string) (*RedoInfo, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	redoLog, err := redo.Open(path, nil, redo.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer redoLog.Close()
+	info := &RedoInfo{
+		FirstLSN: redoLog.FirstLSN(),
+		FileLSN:  redoLog.CurrentLSN(),
+		Records:  make([]*LogRecord, 0),
+	}
+	startLSN := info.FirstLSN
+	endLSN, err := redoLog.Scan(startLSN, func(l redolog.Log) error {
+		info.Records = append(info.Records, &LogRecord{
+			StartLSN: startLSN,
+			LSN:      l.LSN(),
+			Type:     l.Type().String(),
+			Fields:   logFields(l),
+		})
+		startLSN = l.LSN()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	info.EndLSN = endLSN
+	return info, nil
+}
+
+func logFields(l redolog.Log) map[string]interface{} {
+	hexBytes := hex.EncodeToString
+	switch l := l.(type) {
+	case *redolog.BNodeInsertKVLog:
+		return map[string]interface{}{"tableId": l.TableId(), "columnId": l.ColumnId(),
+			"pageNum": l.PageNum(), "key": hexBytes(l.Key()), "value": hexBytes(l.Value())}
+	case *redolog.BNodeDeleteKVLog:
+		return map[string]interface{}{"tableId": l.TableId(), "columnId": l.ColumnId(),
+			"pageNum": l.PageNum(), "key": hexBytes(l.Key()), "value": hexBytes(l.Value())}
+	case *redolog.BNodeSplitLog:
+		return map[string]interface{}{"tableId": l.TableId(), "columnId": l.ColumnId(),
+			"pageNum": l.PageNum(), "newPageNum": l.NextPageNum(), "rootPageNum": l.RootPageNum(),
+			"nextLeaf": l.NextLeaf(), "isLeaf": l.IsLeaf(), "movedKeys": len(l.Keys())}
+	case *redolog.RecordPageAppendLog:
+		row := newRowInfo(l.Row())
+		return map[string]interface{}{"tableId": l.TableId(), "pageNum": l.PageNum(),
+			"prevPageNum": l.PrevPageNum(), "offset": row.Offset, "xid": row.Xmin,
+			"values": strings.Join(row.Values, ", ")}
+	case *redolog.RecordPageRemoveLog:
+		return map[string]interface{}{"pageNum": l.PageNum(), "offset": l.Offset(),
+			"key": hexBytes(l.Key()), "xmin": l.Xmin()}
+	case *redolog.RecordSetXmaxLog:
+		return map[string]interface{}{"pageNum": l.PageNum(), "offset": l.Offset(),
+			"key": hexBytes(l.Key()), "xmin": l.Xmin(), "oldXmax": l.OldXmax(), "newXmax": l.NewXmax()}
+	case *redolog.IndexInsertLog:
+		return map[string]interface{}{"xid": l.Xid(), "tableId": l.TableId(), "columnId": l.ColumnId(),
+			"pageNum": l.PageNum(), "key": hexBytes(l.Key()), "value": hexBytes(l.Value())}
+	case *redolog.RecordPageCompactLog:
+		return map[string]interface{}{"pageNum": l.PageNum(), "removedOffsets": l.Offsets()}
+	case *redolog.CompensationLog:
+		fields := map[string]interface{}{"xid": l.Xid(), "undoneLSN": l.UndoneLSN()}
+		if action := l.Action(); action != nil {
+			actionFields := logFields(action)
+			actionFields["type"] = action.Type().String()
+			fields["action"] = actionFields
+		}
+		return fields
+	case *redolog.CommitLog:
+		return map[string]interface{}{"xid": l.Xid(), "time": l.Time().Format(time.RFC3339Nano)}
+	}
+	return map[string]interface{}{}
+}
+
+type BufferedPage struct {
+	Offset  int64     `json:"offset"`
+	PageNum util.UUID `json:"pageNum"`
+	LSN     int64     `json:"lsn"`
+	Size    int       `json:"size"`
+}
+
+type DoubleWriteInfo struct {
+	// 正常关闭或者写回完成后 buffer 为空
+	Pages []*BufferedPage `json:"pages"`
+}
+
+func (info *DoubleWriteInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "double write buffer: %d pages\n", len(info.Pages))
+	for _, page := range info.Pages {
+		fmt.Fprintf(&b, "offset %d: page %d, LSN %d, %d bytes\n", page.Offset, page.PageNum, page.LSN, page.Size)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// 列出 double write buffer 中校验和正确的页
+func DoubleWrite(path string) (*DoubleWriteInfo, error) {
+	file, err := vfs.OpenFile(path+"/"+doublewrite.DOUBLE_WRITE_BUFF_FILE_NAME, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := &DoubleWriteInfo{Pages: make([]*BufferedPage, 0)}
+	for _, buffered := range doublewrite.ReadBuffer(file, stat.Size()) {
+		header := pager.ReadHeader(buffered.Image)
+		info.Pages = append(info.Pages, &BufferedPage{
+			Offset:  buffered.Offset,
+			PageNum: header.PageNum,
+			LSN:     header.LSN,
+			Size:    len(buffered.Image),
+		})
+	}
+	return info, nil
+}
+
+type XIDStatus struct {
+	XID    tm.XID `json:"xid"`
+	Status string `json:"status"`
+}
+
+type XIDInfo struct {
+	NextXID      tm.XID       `json:"nextXID"`
+	Transactions []*XIDStatus `json:"transactions"`
+}
+
+func (info *XIDInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d transactions, next xid %d\n", len(info.Transactions), info.NextXID)
+	for _, status := range info.Transactions {
+		fmt.Fprintf(&b, "%d %s\n", status.XID, status.Status)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// 返回 XID 文件中每个事务的状态
+func XIDs(path string) (*XIDInfo, error) {
+	if _, err := os.Stat(path + "/" + tm.XID_FILE_NAME); err != nil {
+		return nil, err
+	}
+	transactionManager, err := tm.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer transactionManager.Close()
+	statuses, err := transactionManager.Statuses()
+	if err != nil {
+		return nil, err
+	}
+	info := &XIDInfo{
+		NextXID:      transactionManager.NextXID(),
+		Transactions: make([]*XIDStatus, 0, len(statuses)),
+	}
+	for i, status := range statuses {
+		name, ok := statusNames[status]
+		if !ok {
+			name = fmt.Sprintf("unknown(%d)", status)
+		}
+		info.Transactions = append(info.Transactions, &XIDStatus{XID: tm.XID(i) + 1, Status: name})
+	}
+	return info, nil
+}
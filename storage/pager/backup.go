@@ -0,0 +1,41 @@
+package pager
+
+import (
+	"errors"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
+	"time"
+)
+
+// 读取一页时校验失败的重试次数，正在被写回的页可能只读到一部分
+const COPY_PAGE_RETRIES = 16
+
+/*
+在线复制页文件中从 from 开始的页到 dst，页号不变，返回复制之后页文件中的页数。
+复制期间可以继续写回脏页，读到部分写入的页时会重新读取，
+复制的页都是完整的，但可能处于不同的时间点，需要重放 redo log 才能一致。
+*/
+func (pager *Pager) CopyPages(dst vfs.File, from util.UUID) (util.UUID, error) {
+	// 新页在分配时写入页文件，持有 allocLock 得到的大小包含所有已分配的页
+	pager.allocLock.Lock()
+	stat, err := pager.file.Stat()
+	pager.allocLock.Unlock()
+	if err != nil {
+		return from, err
+	}
+	pageCount := util.UUID((stat.Size() + util.PAGE_SIZE - 1) / util.PAGE_SIZE)
+	for pageNum := from; pageNum < pageCount; pageNum++ {
+		image, err := ReadImage(pager.file, pageNum)
+		for i := 0; i < COPY_PAGE_RETRIES && errors.Is(err, ErrPageCorrupted); i++ {
+			time.Sleep(time.Millisecond)
+			image, err = ReadImage(pager.file, pageNum)
+		}
+		if err != nil {
+			return pageNum, err
+		}
+		if _, err := dst.WriteAt(image, int64(pageNum)*util.PAGE_SIZE); err != nil {
+			return pageNum, err
+		}
+	}
+	return pageCount, nil
+}
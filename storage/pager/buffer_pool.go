@@ -0,0 +1,412 @@
+/*
+BufferPool 管理内存中的页框，页在使用期间需要被 pin，使用完毕后 Unpin。
+被 pin 的页不会被淘汰，replacer 选中被 pin 的页时，该页暂时离开 replacer，Unpin 后再放回。
+
+脏页的写回策略：
+STEAL 策略下脏页可以在淘汰时被写回磁盘，写回前由 flush 函数保证对应的 redo log 已经落盘
+NO_STEAL 策略下脏页不会因为淘汰而写回，只由后台刷盘或 FlushAll 写回，写回后才可以被淘汰
+
+不在 replacer 中的页不计入容量，所以驻留的页数最多为 Frames 加上被 pin 的页数。
+
+replacer 决定淘汰哪一个未被 pin 的页，可以选择 LRU、W-TinyLFU 或 CLOCK。
+W-TinyLFU 会根据访问频率拒绝只访问一次的页，全表扫描不会把热点页挤出缓冲池。
+
+缓冲池按页号分成多个分片，每个分片有自己的锁、页框和 replacer，
+并行查询访问不同的页时不会争用同一把锁，淘汰只在分片内部进行。
+*/
+package pager
+
+import (
+	"fmt"
+	"minidb-go/storage/recovery/redo"
+	"minidb-go/util"
+	"minidb-go/util/cache"
+	"minidb-go/util/cache/clock"
+	"minidb-go/util/cache/lru"
+	"minidb-go/util/cache/wtinylfu"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type StealPolicy uint8
+
+const (
+	STEAL StealPolicy = iota
+	NO_STEAL
+)
+
+// 页面置换策略
+type ReplacerType uint8
+
+const (
+	REPLACER_LRU ReplacerType = iota
+	REPLACER_W_TINY_LFU
+	REPLACER_CLOCK
+)
+
+func (replacer ReplacerType) String() string {
+	switch replacer {
+	case REPLACER_LRU:
+		return "lru"
+	case REPLACER_W_TINY_LFU:
+		return "wtinylfu"
+	case REPLACER_CLOCK:
+		return "clock"
+	default:
+		return "unknown"
+	}
+}
+
+// 将名字转换为置换策略，用于命令行参数
+func ParseReplacer(name string) (ReplacerType, error) {
+	for _, replacer := range []ReplacerType{REPLACER_LRU, REPLACER_W_TINY_LFU, REPLACER_CLOCK} {
+		if replacer.String() == name {
+			return replacer, nil
+		}
+	}
+	return REPLACER_LRU, fmt.Errorf("unknown replacer: %s", name)
+}
+
+func newReplacer(replacer ReplacerType, frames int) cache.Cache[util.UUID, *frame] {
+	switch replacer {
+	case REPLACER_W_TINY_LFU:
+		return wtinylfu.NewWTinyLFU[util.UUID, *frame](frames, nil)
+	case REPLACER_CLOCK:
+		return clock.NewClock[util.UUID, *frame](frames)
+	default:
+		return lru.NewLRU[util.UUID, *frame](frames)
+	}
+}
+
+type Options struct {
+	// 缓冲池的页框数量
+	Frames int
+	// 脏页的写回策略
+	Policy StealPolicy
+	// 页面置换策略
+	Replacer ReplacerType
+	// 缓冲池的分片数，每个分片有独立的锁和 replacer，不会超过 Frames
+	Shards int
+	// 后台刷脏页的间隔，为 0 时不启动后台刷盘
+	FlushInterval time.Duration
+	// redo log 的配置，打开数据库时传给 recovery
+	Redo redo.Options
+	// double write 在内存中缓存的页数，达到 75% 时写入磁盘
+	DoubleWritePages int
+	// 通过索引查找时并发读取数据页的 goroutine 数
+	SearchWorkers int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Frames:        1024,
+		Policy:        STEAL,
+		Replacer:      REPLACER_LRU,
+		Shards:        8,
+		FlushInterval: time.Second,
+		Redo:          redo.DefaultOptions(),
+
+		DoubleWritePages: 128,
+		SearchWorkers:    2,
+	}
+}
+
+type frame struct {
+	page     *Page
+	pinCount int
+	dirty    bool
+	// 被 replacer 选中但不能淘汰的页会离开 replacer
+	inReplacer bool
+}
+
+// 将一批脏页持久化到磁盘
+type FlushFunc func(pages []*Page) error
+
+type bufferPool struct {
+	shards []*poolShard
+	// pin 时页是否已经在内存中，以及淘汰的页数
+	stats cache.Counter
+
+	stopFlush chan struct{}
+	flushDone chan struct{}
+}
+
+type poolShard struct {
+	// 分片中所有驻留在内存中的页
+	frames map[util.UUID]*frame
+	// 记录页的访问，决定淘汰的顺序
+	replacer cache.Cache[util.UUID, *frame]
+	stats    *cache.Counter
+
+	policy StealPolicy
+	flush  FlushFunc
+
+	lock sync.Mutex
+}
+
+func newBufferPool(options Options, flush FlushFunc) *bufferPool {
+	shardNum := options.Shards
+	if shardNum > options.Frames {
+		shardNum = options.Frames
+	}
+	if shardNum < 1 {
+		shardNum = 1
+	}
+	pool := &bufferPool{
+		shards: make([]*poolShard, shardNum),
+	}
+	frames := (options.Frames + shardNum - 1) / shardNum
+	for i := range pool.shards {
+		shard := &poolShard{
+			frames:   make(map[util.UUID]*frame),
+			replacer: newReplacer(options.Replacer, frames),
+			stats:    &pool.stats,
+			policy:   options.Policy,
+			flush:    flush,
+		}
+		shard.replacer.SetEviction(shard.evict)
+		pool.shards[i] = shard
+	}
+	if options.FlushInterval > 0 {
+		pool.stopFlush = make(chan struct{})
+		pool.flushDone = make(chan struct{})
+		go pool.backgroundFlush(options.FlushInterval)
+	}
+	return pool
+}
+
+// 连续的页号落在不同的分片上
+func (pool *bufferPool) shard(pageNum util.UUID) *poolShard {
+	return pool.shards[int(pageNum)%len(pool.shards)]
+}
+
+func (pool *bufferPool) setFlush(flush FlushFunc) {
+	for _, shard := range pool.shards {
+		shard.lock.Lock()
+		shard.flush = flush
+		shard.lock.Unlock()
+	}
+}
+
+// 返回被 pin 的页，页不在内存中时调用 load 从磁盘中读取
+func (pool *bufferPool) pin(pageNum util.UUID, load func() (*Page, error)) (*Page, error) {
+	return pool.shard(pageNum).pin(pageNum, load)
+}
+
+// 放入一个新分配的页，新页一定是脏页
+func (pool *bufferPool) add(page *Page) {
+	pool.shard(page.pageNum).add(page)
+}
+
+func (pool *bufferPool) unpin(page *Page, dirty bool) {
+	pool.shard(page.pageNum).unpin(page, dirty)
+}
+
+func (pool *bufferPool) markDirty(page *Page) {
+	pool.shard(page.pageNum).markDirty(page)
+}
+
+func (shard *poolShard) pin(pageNum util.UUID, load func() (*Page, error)) (*Page, error) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if f, ok := shard.frames[pageNum]; ok {
+		shard.stats.Hit()
+		f.pinCount++
+		if f.inReplacer {
+			// 让 replacer 记录这次访问
+			shard.replacer.Get(pageNum)
+		}
+		return f.page, nil
+	}
+	shard.stats.Miss()
+	page, err := load()
+	if err != nil {
+		return nil, err
+	}
+	shard.insert(&frame{
+		page:     page,
+		pinCount: 1,
+	})
+	return page, nil
+}
+
+func (shard *poolShard) add(page *Page) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	shard.insert(&frame{
+		page:     page,
+		pinCount: 1,
+		dirty:    true,
+	})
+}
+
+// 放入新的页框，可能会淘汰其他页
+func (shard *poolShard) insert(f *frame) {
+	shard.frames[f.page.pageNum] = f
+	// replacer 可能马上选中这个页，evict 会把 inReplacer 设置为 false
+	f.inReplacer = true
+	shard.replacer.Set(f.page.pageNum, f)
+}
+
+func (shard *poolShard) unpin(page *Page, dirty bool) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	f, ok := shard.frames[page.pageNum]
+	if !ok || f.pinCount == 0 {
+		log.Errorf("unpin page %d which is not pinned", page.pageNum)
+		return
+	}
+	f.dirty = f.dirty || dirty
+	f.pinCount--
+	if f.pinCount == 0 && !f.inReplacer && (!f.dirty || shard.policy == STEAL) {
+		f.inReplacer = true
+		shard.replacer.Set(page.pageNum, f)
+	}
+}
+
+func (shard *poolShard) markDirty(page *Page) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if f, ok := shard.frames[page.pageNum]; ok {
+		f.dirty = true
+	}
+}
+
+// replacer 的淘汰回调，调用时已经持有 shard.lock
+func (shard *poolShard) evict(pageNum util.UUID, f *frame) {
+	f.inReplacer = false
+	if f.pinCount > 0 || (f.dirty && shard.policy == NO_STEAL) {
+		// 页仍然驻留在内存中，Unpin 或者写回之后再放回 replacer
+		return
+	}
+	if f.dirty {
+		// STEAL 策略下只写回被淘汰的页，其他脏页由后台刷盘写回，持有分片的锁的时间尽量短
+		if err := shard.flush([]*Page{f.page}); err != nil {
+			// 写回失败的页不能丢弃，留在内存中，由后台刷盘或 FlushAll 重试后再放回 replacer
+			log.Errorf("write back page %d failed: %v", pageNum, err)
+			return
+		}
+		f.dirty = false
+	}
+	shard.stats.Evict()
+	delete(shard.frames, f.page.pageNum)
+}
+
+// 返回分片中被 pin 或者未被 pin 的脏页
+func (shard *poolShard) dirtyFrames(pinned bool) []*frame {
+	frames := make([]*frame, 0)
+	for _, f := range shard.frames {
+		if f.dirty && pinned == (f.pinCount > 0) {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// 写回脏页，调用时已经持有 shard.lock，失败时页仍然是脏页
+func (shard *poolShard) flushFrames(frames []*frame) error {
+	if len(frames) == 0 {
+		return nil
+	}
+	pages := make([]*Page, len(frames))
+	for i, f := range frames {
+		pages[i] = f.page
+	}
+	if err := shard.flush(pages); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		f.dirty = false
+		// NO_STEAL 策略下写回后的页才能被淘汰，STEAL 策略下淘汰时写回失败的页也不在 replacer 中
+		if f.pinCount == 0 && !f.inReplacer {
+			f.inReplacer = true
+			shard.replacer.Set(f.page.pageNum, f)
+		}
+	}
+	return nil
+}
+
+/*
+写回未被 pin 的脏页，withPinned 为 true 时也写回被 pin 的脏页。
+被 pin 的页可能正在被修改，修改者持有页的锁时会标记脏页，需要分片的锁，
+因此在释放分片的锁之后再写回这些页，写回期间额外 pin 住页避免被淘汰。
+写回之后页可能已经有新的修改，这些页仍然是脏页。
+*/
+func (shard *poolShard) flushDirty(withPinned bool) error {
+	shard.lock.Lock()
+	err := shard.flushFrames(shard.dirtyFrames(false))
+	pinned := make([]*Page, 0)
+	if withPinned {
+		for _, f := range shard.dirtyFrames(true) {
+			f.pinCount++
+			pinned = append(pinned, f.page)
+		}
+	}
+	flush := shard.flush
+	shard.lock.Unlock()
+
+	if len(pinned) == 0 {
+		return err
+	}
+	pinnedErr := flush(pinned)
+	for _, page := range pinned {
+		shard.unpin(page, false)
+	}
+	if err == nil {
+		err = pinnedErr
+	}
+	return err
+}
+
+// 定期写回未被 pin 的脏页，使热点页不会在淘汰时才被写回
+func (pool *bufferPool) backgroundFlush(interval time.Duration) {
+	defer close(pool.flushDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.stopFlush:
+			return
+		case <-ticker.C:
+			for _, shard := range pool.shards {
+				// 失败的页仍然是脏页，下次再写回
+				if err := shard.flushDirty(false); err != nil {
+					log.Errorf("background flush failed: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// 写回所有脏页，包括被 pin 的页，某个分片失败时继续写回其他分片
+func (pool *bufferPool) flushAll() error {
+	var firstErr error
+	for _, shard := range pool.shards {
+		if err := shard.flushDirty(true); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (pool *bufferPool) getStats() cache.Stats {
+	return pool.stats.Stats()
+}
+
+func (pool *bufferPool) close() error {
+	pool.stopBackgroundFlush()
+	return pool.flushAll()
+}
+
+func (pool *bufferPool) stopBackgroundFlush() {
+	if pool.stopFlush != nil {
+		close(pool.stopFlush)
+		<-pool.flushDone
+	}
+}
@@ -3,11 +3,15 @@ package pager
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"minidb-go/storage/pager/pagedata"
-	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
+	"minidb-go/util/compress"
 	"sync"
+	"sync/atomic"
 )
 
 type PageType uint8
@@ -20,18 +24,110 @@ const (
 
 const (
 	NIL_PAGE_NUM util.UUID = util.UUID(1<<32 - 1)
+
+	// pageNum + checksum + LSN + nextPageNum + prevPageNum + flags + payloadLen
+	PAGE_HEADER_SIZE = 4 + 4 + 8 + 4 + 4 + 1 + 2
+
+	// 校验和在页头中的位置
+	PAGE_CHECKSUM_OFFSET = 4
+	PAGE_CHECKSUM_SIZE   = 4
 )
 
-// Page 本身不判断是否损坏（即checksum不匹配），判断部分写由 Double Write 完成。
+// 页头中的标志位
+const (
+	// 页所属的表开启了压缩
+	FLAG_COMPRESSIBLE uint8 = 1 << iota
+	// 页的数据以压缩的形式保存
+	FLAG_COMPRESSED
+)
+
+/*
+页的磁盘格式：header + payload + padding
+未压缩的页大小为 PAGE_SIZE，压缩的页只写入 SECTOR_SIZE 对齐的一部分，
+剩余的部分保留磁盘上原有的内容，读取时根据 payloadLen 忽略。
+header 中的 checksum 是除 checksum 字段以外整个页的 CRC32C，每次从磁盘读入页时都会校验。
+*/
+
+var ErrPageCorrupted = errors.New("page is corrupted")
+
+// 页的校验和不匹配，或者页头中的页号与页的位置不符，可以通过 errors.Is(err, ErrPageCorrupted) 判断
+type PageCorruptedError struct {
+	PageNum util.UUID
+}
+
+func (e *PageCorruptedError) Error() string {
+	return fmt.Sprintf("page %d is corrupted", e.PageNum)
+}
+
+func (e *PageCorruptedError) Is(target error) bool {
+	return target == ErrPageCorrupted
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 计算页的校验和，image 为页在磁盘上的二进制
+func Checksum(image []byte) uint32 {
+	crc := crc32.Update(0, castagnoliTable, image[:PAGE_CHECKSUM_OFFSET])
+	return crc32.Update(crc, castagnoliTable, image[PAGE_CHECKSUM_OFFSET+PAGE_CHECKSUM_SIZE:])
+}
+
+// 判断页的校验和是否正确，image 的长度需要为 ImageSize
+func VerifyImage(image []byte) bool {
+	if len(image) < PAGE_HEADER_SIZE {
+		return false
+	}
+	checksum := binary.BigEndian.Uint32(image[PAGE_CHECKSUM_OFFSET:])
+	return Checksum(image) == checksum
+}
+
+// 从 file 中读取页号为 pageNum 的页并校验，返回页在磁盘上的二进制
+func ReadImage(file io.ReaderAt, pageNum util.UUID) ([]byte, error) {
+	image := make([]byte, util.PAGE_SIZE)
+	n, err := file.ReadAt(image, int64(pageNum)*util.PAGE_SIZE)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// 文件末尾的压缩页不足 PAGE_SIZE
+	if n < PAGE_HEADER_SIZE {
+		return nil, &PageCorruptedError{PageNum: pageNum}
+	}
+	size := ImageSize(image)
+	if size > n || !VerifyImage(image[:size]) ||
+		util.UUID(binary.BigEndian.Uint32(image)) != pageNum {
+		return nil, &PageCorruptedError{PageNum: pageNum}
+	}
+	return image[:size], nil
+}
+
+// 页头中的字段，用于在不解码页数据的情况下查看页
+type PageHeader struct {
+	PageNum     util.UUID
+	Checksum    uint32
+	LSN         int64
+	NextPageNum util.UUID
+	PrevPageNum util.UUID
+	Flags       uint8
+	PayloadLen  uint16
+}
+
+// 解析页头，header 至少为 PAGE_HEADER_SIZE 字节，不进行校验
+func ReadHeader(header []byte) PageHeader {
+	var h PageHeader
+	binary.Read(bytes.NewReader(header[:PAGE_HEADER_SIZE]), binary.BigEndian, &h)
+	return h
+}
+
 type Page struct {
 	pageNum util.UUID
 
-	LSN int64
+	// 最后一条修改该页的 redo log 的 LSN，写回磁盘前需要保证该 LSN 之前的日志已经落盘
+	lsn int64
 
 	nextPageNum util.UUID
 	prevPageNum util.UUID
 
-	logs []redolog.Log
+	// 写入磁盘时是否尝试压缩
+	compressible bool
 
 	data pagedata.PageData
 
@@ -45,8 +141,6 @@ func newPage(pageNum util.UUID, pageData pagedata.PageData) *Page {
 		nextPageNum: NIL_PAGE_NUM,
 		prevPageNum: NIL_PAGE_NUM,
 
-		logs: make([]redolog.Log, 0),
-
 		data: pageData,
 	}
 }
@@ -54,41 +148,114 @@ func newPage(pageNum util.UUID, pageData pagedata.PageData) *Page {
 func LoadPage(r io.Reader, pageData pagedata.PageData) (*Page, error) {
 	page := &Page{}
 
+	var checksum uint32
 	binary.Read(r, binary.BigEndian, &page.pageNum)
-	binary.Read(r, binary.BigEndian, &page.LSN)
+	binary.Read(r, binary.BigEndian, &checksum)
+	binary.Read(r, binary.BigEndian, &page.lsn)
 	binary.Read(r, binary.BigEndian, &page.nextPageNum)
 	binary.Read(r, binary.BigEndian, &page.prevPageNum)
+	var flags uint8
+	var payloadLen uint16
+	binary.Read(r, binary.BigEndian, &flags)
+	err := binary.Read(r, binary.BigEndian, &payloadLen)
+	if err != nil {
+		return nil, err
+	}
+	page.compressible = flags&FLAG_COMPRESSIBLE != 0
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if flags&FLAG_COMPRESSED != 0 {
+		payload, err = compress.Decompress(payload, util.PAGE_SIZE)
+		if err != nil {
+			return nil, fmt.Errorf("decompress page %d failed: %v", page.pageNum, err)
+		}
+	}
 	page.data = pageData
-	page.data.Decode(r)
+	if err := page.data.Decode(bytes.NewReader(payload)); err != nil {
+		return nil, fmt.Errorf("decode page %d failed: %w", page.pageNum, err)
+	}
 	return page, nil
 }
 
+// 根据页头计算页在磁盘上的大小，header 至少为 PAGE_HEADER_SIZE 字节，
+// 页头损坏时返回的大小可能超过 PAGE_SIZE
+func ImageSize(header []byte) int {
+	flags := header[PAGE_HEADER_SIZE-3]
+	if flags&FLAG_COMPRESSED == 0 {
+		return util.PAGE_SIZE
+	}
+	payloadLen := int(binary.BigEndian.Uint16(header[PAGE_HEADER_SIZE-2:]))
+	return compressedImageSize(payloadLen)
+}
+
+func compressedImageSize(payloadLen int) int {
+	size := PAGE_HEADER_SIZE + payloadLen
+	return (size + util.SECTOR_SIZE - 1) / util.SECTOR_SIZE * util.SECTOR_SIZE
+}
+
 func (p *Page) PageNum() util.UUID {
 	return p.pageNum
 }
 
-// 返回 Page 数据的二进制，PageSize的大小
+// 返回 Page 在磁盘上的二进制，未压缩时为 PageSize 的大小，
+// 压缩后为 SECTOR_SIZE 的整数倍，大小可以由 ImageSize 得到
+// 持有页的读锁，页头中的 LSN 与数据一致，调用者不能持有页的锁
 func (page *Page) Raw() []byte {
+	page.RLock()
+	defer page.RUnlock()
+
 	buff := new(bytes.Buffer)
 	buff.Grow(util.PAGE_SIZE)
 	binary.Write(buff, binary.BigEndian, page.pageNum)
-	binary.Write(buff, binary.BigEndian, page.LSN)
+	binary.Write(buff, binary.BigEndian, uint32(0))
+	binary.Write(buff, binary.BigEndian, page.LSN())
 	binary.Write(buff, binary.BigEndian, page.nextPageNum)
 	binary.Write(buff, binary.BigEndian, page.prevPageNum)
-	dataByte := page.data.Encode()
-	buff.Write(dataByte)
+
+	payload := page.data.Encode()
+	flags := uint8(0)
+	size := util.PAGE_SIZE
+	if page.compressible {
+		flags |= FLAG_COMPRESSIBLE
+		// 只有压缩后能少写至少一个扇区时才保存压缩的数据
+		compressed := compress.Compress(payload)
+		if compressedImageSize(len(compressed)) < util.PAGE_SIZE {
+			flags |= FLAG_COMPRESSED
+			payload = compressed
+			size = compressedImageSize(len(compressed))
+		}
+	}
+	binary.Write(buff, binary.BigEndian, flags)
+	binary.Write(buff, binary.BigEndian, uint16(len(payload)))
+	buff.Write(payload)
 	// logrus.Info(len(buff.Bytes()))
-	zeroLen := util.PAGE_SIZE - buff.Len()
+	zeroLen := size - buff.Len()
 	buff.Write(make([]byte, zeroLen))
-	return buff.Bytes()
+	image := buff.Bytes()
+	binary.BigEndian.PutUint32(image[PAGE_CHECKSUM_OFFSET:], Checksum(image))
+	return image
 }
 
-func (page *Page) Logs() []redolog.Log {
-	return page.logs
+func (p *Page) Compressible() bool {
+	return p.compressible
 }
 
-func (page *Page) AppendLog(log redolog.Log) {
-	page.logs = append(page.logs, log)
+// 设置页在写入磁盘时是否压缩，调用者需要持有 pin，不能持有页的锁
+func (p *Page) SetCompressible(compressible bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.compressible = compressible
+}
+
+func (page *Page) LSN() int64 {
+	return atomic.LoadInt64(&page.lsn)
+}
+
+func (page *Page) SetLSN(LSN int64) {
+	atomic.StoreInt64(&page.lsn, LSN)
 }
 
 // 以共享的方式返回 Page 的数据
@@ -105,13 +272,29 @@ func (p *Page) SetNextPageNum(pageNum util.UUID) {
 }
 
 func (p *Page) PrevPageNum() util.UUID {
-	return p.nextPageNum
+	return p.prevPageNum
 }
 
 func (p *Page) SetPrevPageNum(pageNum util.UUID) {
-	p.nextPageNum = pageNum
+	p.prevPageNum = pageNum
 }
 
 func (p *Page) Size() int {
-	return 4 + 8 + 4 + 4 + p.data.Size()
+	return PAGE_HEADER_SIZE + p.data.Size()
+}
+
+func (p *Page) RLock() {
+	p.rwlock.RLock()
+}
+
+func (p *Page) RUnlock() {
+	p.rwlock.RUnlock()
+}
+
+func (p *Page) Lock() {
+	p.rwlock.Lock()
+}
+
+func (p *Page) Unlock() {
+	p.rwlock.Unlock()
 }
@@ -19,6 +19,9 @@ type TableInfo struct {
 
 	FirstPageNum util.UUID
 	LastPageNum  util.UUID
+
+	// 数据页是否压缩
+	Compressed bool
 }
 
 func (ti *TableInfo) PrimaryKey() string {
@@ -46,9 +49,23 @@ func (ti *TableInfo) SetLastPageNum(uuid util.UUID) {
 	ti.LastPageNum = uuid
 }
 
+// 数据库用户，只保存加盐的密码哈希
+type UserInfo struct {
+	Name       string
+	Salt       []byte
+	Hash       []byte
+	Iterations int
+	Superuser  bool
+
+	// 表名到权限，空字符串表示所有的表
+	Privileges map[string]ast.Privilege
+}
+
 type MetaData struct {
 	Version string
 	Tables  map[string]*TableInfo
+	// 旧版本的数据库中为 nil
+	Users map[string]*UserInfo
 }
 
 func (meta *MetaData) GetTableInfo(tableName string) *TableInfo {
@@ -72,6 +89,7 @@ func NewMetaData() *MetaData {
 	return &MetaData{
 		Version: util.VERSION,
 		Tables:  make(map[string]*TableInfo, 0),
+		Users:   make(map[string]*UserInfo),
 	}
 }
 
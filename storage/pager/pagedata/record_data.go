@@ -3,8 +3,8 @@ package pagedata
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
 	"minidb-go/parser/ast"
 )
 
@@ -36,16 +36,16 @@ func (record *RecordData) Decode(r io.Reader) error {
 	var count uint8
 	err := binary.Read(r, binary.BigEndian, &count)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	record.rows = make([]*ast.Row, count)
-	for _, row := range record.rows {
+	for i := range record.rows {
+		row := new(ast.Row)
 		err := row.Decode(r)
 		if err != nil {
-			log.Fatal(err)
-			return err
+			return fmt.Errorf("decode row %d failed: %w", i, err)
 		}
+		record.rows[i] = row
 	}
 	return nil
 }
@@ -63,6 +63,57 @@ func (record *RecordData) Append(row *ast.Row) {
 	record.size += row.Size
 }
 
+// 从页中删除一行，其他行的 Offset 保持不变，占用的空间由 vacuum 整理数据页时回收
+func (record *RecordData) Remove(row *ast.Row) bool {
+	for i, pageRow := range record.rows {
+		if pageRow == row {
+			// Rows 返回的切片可能正在被遍历，不能原地修改
+			rows := make([]*ast.Row, 0, len(record.rows)-1)
+			rows = append(rows, record.rows[:i]...)
+			record.rows = append(rows, record.rows[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 删除 dead 返回 true 的行，并将剩余的行紧凑地排列在页中，返回被删除的行
+// 行的 Offset 只用于标识页中的行，整理数据页时保持不变，正在进行的事务仍然可以按 Offset 找到行
+func (record *RecordData) Compact(dead func(*ast.Row) bool) []*ast.Row {
+	removed := make([]*ast.Row, 0)
+	rows := make([]*ast.Row, 0, len(record.rows))
+	size := uint16(2 + 1)
+	for _, row := range record.rows {
+		if dead(row) {
+			removed = append(removed, row)
+			continue
+		}
+		rows = append(rows, row)
+		size += row.Size
+	}
+	record.rows = rows
+	record.size = size
+	return removed
+}
+
+// 为新插入的行分配 Offset，优先使用 from，被页中的行占用时在 [begin, end) 中顺序查找未被使用的 Offset
+func (record *RecordData) AllocOffset(begin, end, from int64) int64 {
+	used := make(map[int64]struct{}, len(record.rows))
+	for _, row := range record.rows {
+		used[row.Offset] = struct{}{}
+	}
+	offset := from
+	for {
+		if offset < begin || offset >= end {
+			offset = begin
+		}
+		if _, ok := used[offset]; !ok {
+			return offset
+		}
+		offset++
+	}
+}
+
 func (record *RecordData) PageDataType() PageDataType {
 	return RECORE_DATA
 }
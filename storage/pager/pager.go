@@ -1,78 +1,133 @@
 package pager
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/redo/redolog"
 	"minidb-go/util"
 	"minidb-go/util/cache"
-	"minidb-go/util/cache/lru"
+	"minidb-go/util/vfs"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Pager struct {
-	cache cache.Cache
-	file  *os.File
+	pool *bufferPool
+	file vfs.File
+
+	// meta page 常驻内存，永远不会被 unpin
+	metaPage *Page
+
+	// 分配新页时需要互斥，保证页号不重复
+	allocLock sync.Mutex
+	// 有分配之后还没有落盘的页
+	allocated bool
+
+	// 为 redo log 分配 LSN，为 nil 时不记录日志
+	appendLog AppendLogFunc
+	// 记录日志时持有读锁，checkpoint 持有写锁等待正在记录的日志设置完页的 LSN
+	logLock sync.RWMutex
+
+	// 从备份恢复时，备份之后分配的页不在页文件中，重放日志时作为新分配的空页
+	recreateMissing bool
 }
 
+// 记录一条 redo log，返回日志的 LSN
+type AppendLogFunc func(log redolog.Log) int64
+
 const (
 	PAGE_FILE_NAME = "data.db"
 )
 
-func Create(path string) *Pager {
+var ErrVersionMismatch = errors.New("version of the page file does not match")
+
+func Create(path string, options Options) (*Pager, error) {
 	path = path + "/" + PAGE_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
 	}
 	pager := &Pager{
 		file: file,
 	}
-
-	pager.cache = lru.NewLRU(util.PAGE_CACHE_CAP)
+	pager.pool = newBufferPool(options, pager.flushPages)
 
 	// 初始化 meta page
 	metaData := pagedata.NewMetaData()
-	metaPage := pager.NewPage(metaData)
-
-	pager.Flush(metaPage)
-	return pager
+	pager.metaPage = pager.NewPage(metaData)
+	return pager, nil
 }
 
-func Open(path string) *Pager {
+// 打开后需要调用 LoadMetaPage 读取 meta page，在此之前可以通过 double write 修复页文件
+func Open(path string, options Options) (*Pager, error) {
 	path = path + "/" + PAGE_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
 	}
 	pager := &Pager{
 		file: file,
 	}
+	pager.pool = newBufferPool(options, pager.flushPages)
+	return pager, nil
+}
 
-	pager.cache = lru.NewLRU(util.PAGE_CACHE_CAP)
-
-	metaPage, err := pager.GetPage(0, pagedata.NewMetaData())
+// rootPageNum: meta page 的页号，保存在控制文件中
+func (pager *Pager) LoadMetaPage(rootPageNum util.UUID) error {
+	metaPage, err := pager.GetPage(rootPageNum, pagedata.NewMetaData())
 	if err != nil {
-		log.Fatalf("get meta page failed: %v", err)
+		return fmt.Errorf("get meta page failed: %w", err)
 	}
-	metaData := metaPage.data.(*pagedata.MetaData)
-	if metaData.Version != util.VERSION {
-		log.Fatalf("version not match")
+	metaData, ok := metaPage.data.(*pagedata.MetaData)
+	if !ok || metaData.Version != util.VERSION {
+		return ErrVersionMismatch
 	}
-	return pager
+	pager.metaPage = metaPage
+	return nil
 }
 
-func (pager *Pager) PageFile() *os.File {
+func (pager *Pager) PageFile() vfs.File {
 	return pager.file
 }
 
-func (pager *Pager) SetCacheEviction(eviction cache.Eviction) {
-	pager.cache.SetEviction(eviction)
+// 设置脏页写回磁盘的方式，默认直接写入页文件
+func (pager *Pager) SetFlush(flush FlushFunc) {
+	pager.pool.setFlush(flush)
+}
+
+// 设置 redo log 的记录方式
+func (pager *Pager) SetAppendLog(appendLog AppendLogFunc) {
+	pager.appendLog = appendLog
 }
 
-// 选择一个具有可用空间的 page
+// 记录一条 redo log，将被日志修改的页的 LSN 设置为日志的 LSN 并标记为脏页，
+// 调用者需要持有这些页的 pin，并在修改页的同时调用，保证日志的顺序和修改的顺序一致
+func (pager *Pager) AppendLog(log redolog.Log, pages ...*Page) {
+	if pager.appendLog == nil {
+		return
+	}
+	pager.logLock.RLock()
+	defer pager.logLock.RUnlock()
+	LSN := pager.appendLog(log)
+	for _, page := range pages {
+		page.SetLSN(LSN)
+		pager.pool.markDirty(page)
+	}
+}
+
+// 等待正在记录的日志都设置完页的 LSN 并标记脏页后调用 f，
+// f 执行期间不会有新的日志，此时之前的日志修改的页都已经是脏页
+func (pager *Pager) LogBarrier(f func()) {
+	pager.logLock.Lock()
+	defer pager.logLock.Unlock()
+	f()
+}
+
+// 选择一个具有可用空间的 page，返回的 page 已经被 pin
 func (pager *Pager) Select(spaceSize uint16, tableName string) (page *Page, err error) {
 	if spaceSize > util.PAGE_SIZE {
 		return nil, fmt.Errorf("space size %d is too large", spaceSize)
@@ -83,7 +138,7 @@ func (pager *Pager) Select(spaceSize uint16, tableName string) (page *Page, err
 	table := metaData.GetTableInfo(tableName)
 	page, err = pager.GetPage(table.LastPageNum, pagedata.NewRecordData())
 	if err != nil {
-		err = fmt.Errorf("meta page error, table '%v' last data page not found", table.TableName)
+		err = fmt.Errorf("table '%v' last data page not found: %w", table.TableName, err)
 		return
 	}
 
@@ -92,11 +147,21 @@ func (pager *Pager) Select(spaceSize uint16, tableName string) (page *Page, err
 		return page, nil
 	} else {
 		// 如果 page 可用空间小于需要的空间，则需要分配新的 page
+		// 这些页可能正在被 checkpoint 写回，修改时持有页的锁
 		newDataPage := pager.NewPage(pagedata.NewRecordData())
+		newDataPage.Lock()
+		newDataPage.compressible = table.Compressed
 		newDataPage.nextPageNum = NIL_PAGE_NUM
 		newDataPage.prevPageNum = page.pageNum
+		newDataPage.Unlock()
+		page.Lock()
 		page.nextPageNum = newDataPage.pageNum
+		page.Unlock()
+		pager.Unpin(page, true)
+		pager.metaPage.Lock()
 		table.SetLastPageNum(newDataPage.pageNum)
+		pager.metaPage.Unlock()
+		pager.MarkDirty(pager.metaPage)
 		return newDataPage, nil
 	}
 }
@@ -107,52 +172,142 @@ func (pager *Pager) NextPageNum(pageNum util.UUID) (util.UUID, error) {
 		err = fmt.Errorf("get page failed: %v", err)
 		return NIL_PAGE_NUM, err
 	}
+	defer pager.Unpin(page, false)
 	return page.nextPageNum, nil
 }
 
+// 分配一个新页，返回的 page 已经被 pin，并且是脏页
 func (pager *Pager) NewPage(pageData pagedata.PageData) *Page {
+	page := pager.allocate(pageData)
+	// 放入缓冲池时可能淘汰脏页，写回脏页需要 SyncAllocated，不能持有 allocLock
+	pager.pool.add(page)
+	return page
+}
+
+func (pager *Pager) allocate(pageData pagedata.PageData) *Page {
+	pager.allocLock.Lock()
+	defer pager.allocLock.Unlock()
+
 	stat, _ := pager.file.Stat()
 	fileSize := stat.Size()
 
-	pageNum := util.UUID(fileSize / util.PAGE_SIZE)
+	// 压缩的页不会写满整个页，向上取整
+	pageNum := util.UUID((fileSize + util.PAGE_SIZE - 1) / util.PAGE_SIZE)
 	page := newPage(pageNum, pageData)
-	pager.cache.Set(pageNum, page)
-	pager.Flush(page)
+	// 先写入页文件以占用页号，不单独落盘，由 SyncAllocated 在引用新页的日志或者页写入之前落盘
+	raw := page.Raw()
+	if _, err := pager.file.WriteAt(raw, int64(pageNum)*util.PAGE_SIZE); err != nil {
+		log.Panicf("allocate page %d failed: %v", pageNum, err)
+	}
+	pager.allocated = true
 	return page
 }
 
+// 将新分配的页落盘，没有新分配的页时不做任何事
+func (pager *Pager) SyncAllocated() error {
+	pager.allocLock.Lock()
+	defer pager.allocLock.Unlock()
+	if !pager.allocated {
+		return nil
+	}
+	if err := pager.file.Sync(); err != nil {
+		return fmt.Errorf("sync allocated pages failed: %w", err)
+	}
+	pager.allocated = false
+	return nil
+}
+
+// 返回被 pin 的页，使用完毕后需要调用 Unpin
 func (pager *Pager) GetPage(pageNum util.UUID, pageData pagedata.PageData) (*Page, error) {
-	if page, hit := pager.cache.Get(pageNum); hit {
-		return page.(*Page), nil
-	} else {
-		pager.file.Seek(0, io.SeekEnd)
-		page, err := LoadPage(pager.file, pageData)
+	return pager.pool.pin(pageNum, func() (*Page, error) {
+		// 校验失败时返回 *PageCorruptedError
+		image, err := ReadImage(pager.file, pageNum)
+		if err != nil && pager.recreateMissing && pager.unallocated(pageNum) {
+			return newPage(pageNum, pageData), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		page, err := LoadPage(bytes.NewReader(image), pageData)
 		if err != nil {
-			log.Fatalf("load page failed: %v", err)
+			err = fmt.Errorf("load page %d failed: %w", pageNum, err)
 			return nil, err
 		}
-		pager.cache.Set(pageNum, page)
 		return page, nil
-	}
+	})
+}
+
+// 重放从备份恢复的日志时设置为 true，不存在的页被当作新分配的空页
+func (pager *Pager) SetRecreateMissing(recreate bool) {
+	pager.recreateMissing = recreate
+}
+
+// 页在页文件末尾之后，或者从未被写入过
+func (pager *Pager) unallocated(pageNum util.UUID) bool {
+	header := make([]byte, PAGE_HEADER_SIZE)
+	n, _ := pager.file.ReadAt(header, int64(pageNum)*util.PAGE_SIZE)
+	return n == 0 || bytes.Equal(header[:n], make([]byte, n))
+}
+
+// 释放对页的 pin，dirty 表示在 pin 期间是否修改了页
+func (pager *Pager) Unpin(page *Page, dirty bool) {
+	pager.pool.unpin(page, dirty)
+}
+
+// 将被 pin 的页标记为脏页
+func (pager *Pager) MarkDirty(page *Page) {
+	pager.pool.markDirty(page)
 }
 
 func (pager *Pager) GetMetaData() *pagedata.MetaData {
-	page, err := pager.GetPage(0, pagedata.NewMetaData())
-	if err != nil {
-		log.Fatalf("get meta page failed: %v", err)
+	return pager.metaPage.data.(*pagedata.MetaData)
+}
+
+func (pager *Pager) MetaPage() *Page {
+	return pager.metaPage
+}
+
+// 直接将页写入页文件
+func (pager *Pager) Flush(page *Page) error {
+	raw := page.Raw()
+	if _, err := pager.file.WriteAt(raw, int64(page.pageNum)*util.PAGE_SIZE); err != nil {
+		return fmt.Errorf("write page %d failed: %w", page.pageNum, err)
+	}
+	return pager.file.Sync()
+}
+
+// 默认的写回方式，每个页单独落盘，新分配的页也随之落盘
+func (pager *Pager) flushPages(pages []*Page) error {
+	for _, page := range pages {
+		if err := pager.Flush(page); err != nil {
+			return err
+		}
 	}
-	return page.data.(*pagedata.MetaData)
+	return nil
+}
+
+// 写回所有脏页，返回第一个写回失败的错误，失败的页仍然是脏页
+func (pager *Pager) FlushAll() error {
+	return pager.pool.flushAll()
 }
 
-func (pager *Pager) Flush(page *Page) {
-	n, err := pager.file.WriteAt(page.Raw(), int64(uint32(page.pageNum)*util.PAGE_SIZE))
-	if err != nil || n != util.PAGE_SIZE {
-		log.Fatalf("write page %d failed: %v", page.pageNum, err)
+// 缓冲池的命中、未命中和淘汰次数
+func (pager *Pager) Stats() cache.Stats {
+	return pager.pool.getStats()
+}
+
+// 返回写回脏页时的错误，此时页文件中缺少部分修改
+func (pager *Pager) Close() error {
+	err := pager.pool.close()
+	pager.file.Close()
+	if err != nil {
+		return fmt.Errorf("flush dirty pages on close failed: %w", err)
 	}
-	pager.file.Sync()
+	return nil
 }
 
-func (pager *Pager) Close() {
-	pager.cache.Close()
+// 打开数据库失败时调用，脏页可能只应用了部分 redo log，直接丢弃不写回
+func (pager *Pager) Discard() {
+	pager.pool.stopBackgroundFlush()
 	pager.file.Close()
 }
@@ -0,0 +1,34 @@
+package pager
+
+import (
+	"errors"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
+	"os"
+)
+
+// 检查页文件中每一页的校验和，返回总页数和损坏的页号，需要在数据库关闭时调用
+func Verify(path string) (int, []util.UUID, error) {
+	path = path + "/" + PAGE_FILE_NAME
+	file, err := vfs.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	// 压缩的页不会写满整个页，向上取整
+	pageCount := int((stat.Size() + util.PAGE_SIZE - 1) / util.PAGE_SIZE)
+	corrupted := make([]util.UUID, 0)
+	for i := 0; i < pageCount; i++ {
+		_, err := ReadImage(file, util.UUID(i))
+		if errors.Is(err, ErrPageCorrupted) {
+			corrupted = append(corrupted, util.UUID(i))
+		} else if err != nil {
+			return 0, nil, err
+		}
+	}
+	return pageCount, corrupted, nil
+}
@@ -13,93 +13,138 @@ package doublewrite
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"minidb-go/storage/pager"
 	"minidb-go/util"
+	"minidb-go/util/vfs"
 	"os"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var EMPTY_BUFFER = make([]byte, util.PAGE_SIZE*util.DOUBLE_WRITE_POOL_PAGE_NUM)
-
 const (
 	DOUBLE_WRITE_BUFF_FILE_NAME = "double_write.buf"
 )
 
 type DoubleWrite struct {
-	// 内存中的脏页，key 为页号，value 为页的字节数组，大小为 PAGE_SIZE
+	// 内存中的脏页，key 为页号，value 为页的字节数组，
+	// 大小为 PAGE_SIZE，压缩的页为 SECTOR_SIZE 的整数倍
 	pages map[util.UUID][]byte
 
 	memoryLock sync.Mutex
 	diskLock   sync.Mutex
 
-	bufferFile *os.File
+	bufferFile vfs.File
 	// double write 不负责关闭 page file
-	pageFile *os.File
+	pageFile vfs.File
+	// 写入页文件之前调用，将新分配的页落盘
+	syncAllocated func() error
 
-	SetCheckPoint func(checkPoint int64) error
+	// 内存中缓存的页数达到 poolPages 的 75% 时写入磁盘
+	poolPages int
 }
 
-func Open(path string, pageFile *os.File) *DoubleWrite {
+// poolPages: 内存中缓存的页数上限，创建 buffer 文件时预先分配 poolPages 个页的空间
+func Open(path string, pageFile vfs.File, poolPages int) (*DoubleWrite, error) {
 	path = path + "/" + DOUBLE_WRITE_BUFF_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
-		log.Fatalf("open double write file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open double write file %s failed: %w", path, err)
 	}
 
 	return &DoubleWrite{
 		pages:      make(map[util.UUID][]byte),
 		bufferFile: file,
 		pageFile:   pageFile,
-	}
+		poolPages:  poolPages,
+	}, nil
 }
 
-func Create(path string, pageFile *os.File) *DoubleWrite {
+func Create(path string, pageFile vfs.File, poolPages int) (*DoubleWrite, error) {
 	path = path + "/" + DOUBLE_WRITE_BUFF_FILE_NAME
 
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		log.Fatalf("open double write file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open double write file %s failed: %w", path, err)
+	}
+	if _, err := file.WriteAt(make([]byte, util.PAGE_SIZE*poolPages), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write double write file %s failed: %w", path, err)
 	}
-	file.Write(EMPTY_BUFFER)
 	file.Sync()
 	return &DoubleWrite{
 		pages:      make(map[util.UUID][]byte),
 		bufferFile: file,
 		pageFile:   pageFile,
-	}
+		poolPages:  poolPages,
+	}, nil
 }
 
 // 将页文件恢复到所有页均未损坏的状态，使之可以被 redo log 恢复
-func (dw *DoubleWrite) Recover() {
-	dw.bufferFile.Seek(0, 0)
+func (dw *DoubleWrite) Recover() error {
+	stat, err := dw.bufferFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat double write file failed: %w", err)
+	}
+	for _, buffered := range ReadBuffer(dw.bufferFile, stat.Size()) {
+		image := buffered.Image
+		// 页头是大端序
+		pageNum := binary.BigEndian.Uint32(image[:4])
+		if _, err := dw.pageFile.WriteAt(image, int64(pageNum)*util.PAGE_SIZE); err != nil {
+			return fmt.Errorf("restore page %d failed: %w", pageNum, err)
+		}
+	}
+	// 恢复的页落盘之后才能覆盖 buffer
+	return dw.pageFile.Sync()
+}
 
-	page := make([]byte, util.PAGE_SIZE)
+// buffer 中的一个页，Offset 为页在 buffer 中的位置
+type BufferedImage struct {
+	Offset int64
+	Image  []byte
+}
+
+// 按顺序读取 buffer 中完整的页，size 为 buffer 文件的大小
+func ReadBuffer(bufferFile io.ReaderAt, size int64) []BufferedImage {
+	buffer := io.NewSectionReader(bufferFile, 0, size)
+
+	images := make([]BufferedImage, 0)
+	offset := int64(0)
+	header := make([]byte, pager.PAGE_HEADER_SIZE)
 	EMPTY_PAGE := make([]byte, util.PAGE_SIZE)
 	for {
-		n, err := dw.bufferFile.Read(page)
-		if n < util.PAGE_SIZE || err != nil {
+		// 页的大小不固定，先读入页头得到页的大小
+		_, err := io.ReadFull(buffer, header)
+		if err != nil {
 			break
 		}
 		// 如果读入的数据全为 0，则该页后面的数据都是 0
-		if bytes.Equal(page[:12], EMPTY_PAGE[:12]) {
+		if bytes.Equal(header[:12], EMPTY_PAGE[:12]) {
+			break
+		}
+		page := make([]byte, pager.ImageSize(header))
+		copy(page, header)
+		_, err = io.ReadFull(buffer, page[len(header):])
+		if err != nil {
 			break
 		}
 		// 如果 checkeSum 校验失败，说明在该页处写入 buffer 时发生了非正常退出，
 		// 则当前页所对应的数据文件中的 page 一定是完好的，
 		// 因为在写入时，是先将脏页写入磁盘中的 buffer，然后再将 buffer 写入磁盘中的 page
-		if !IsPartialWrite(page) {
+		if !pager.VerifyImage(page) {
 			break
 		}
-		pageNum := util.BytesToUUID(page[:4])
-		dw.pageFile.Seek(int64(pageNum*util.PAGE_SIZE), 0)
-		dw.pageFile.Write(page)
+		images = append(images, BufferedImage{Offset: offset, Image: page})
+		offset += int64(len(page))
 	}
+	return images
 }
 
-// 将内存中的数据写入磁盘，并且刷新 CheckPoint
-func (dw *DoubleWrite) FlushToDisk() {
+// 将内存中的数据写入磁盘，失败时没有写完的页放回内存，下次写入时重试
+func (dw *DoubleWrite) FlushToDisk() error {
 	// 分配一个 pages 的副本，并清空原 pages
 	dw.memoryLock.Lock()
 	pages := dw.pages
@@ -108,81 +153,87 @@ func (dw *DoubleWrite) FlushToDisk() {
 
 	// 先将内存中的脏页写入磁盘中的 buffer
 	dw.diskLock.Lock()
+	defer dw.diskLock.Unlock()
+
+	if err := dw.writeToDisk(pages); err != nil {
+		dw.memoryLock.Lock()
+		for pageNum, pageBytes := range pages {
+			// 之后写入的新版本优先
+			if _, ok := dw.pages[pageNum]; !ok {
+				dw.pages[pageNum] = pageBytes
+			}
+		}
+		dw.memoryLock.Unlock()
+		return fmt.Errorf("double write failed: %w", err)
+	}
+	return nil
+}
 
-	dw.bufferFile.Seek(0, 0)
+func (dw *DoubleWrite) writeToDisk(pages map[util.UUID][]byte) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	// 分配新页时没有落盘，先让这些页落盘，之后写入的页中引用的新页在磁盘上一定存在
+	if dw.syncAllocated != nil {
+		if err := dw.syncAllocated(); err != nil {
+			return err
+		}
+	}
+	offset := int64(0)
 	for _, pageBytes := range pages {
-		dw.bufferFile.Write(pageBytes)
+		if _, err := dw.bufferFile.WriteAt(pageBytes, offset); err != nil {
+			return err
+		}
+		offset += int64(len(pageBytes))
+	}
+	if err := dw.bufferFile.Sync(); err != nil {
+		return err
 	}
-	dw.bufferFile.Sync()
 
 	// 然后再将脏页写入磁盘中的 page
-	maxLSN := int64(0)
 	for pageNum, pageBytes := range pages {
-		dw.pageFile.WriteAt(pageBytes, int64(pageNum*util.PAGE_SIZE))
-		dw.pageFile.Sync()
-		if getLSN(pageBytes) > maxLSN {
-			maxLSN = getLSN(pageBytes)
+		if _, err := dw.pageFile.WriteAt(pageBytes, int64(pageNum)*util.PAGE_SIZE); err != nil {
+			return err
 		}
 	}
-
-	// 最后需要将 buffer 清空
-	dw.bufferFile.WriteAt(EMPTY_BUFFER, 0)
-
-	dw.diskLock.Unlock()
-
-	if dw.SetCheckPoint != nil {
-		dw.SetCheckPoint(maxLSN)
+	if err := dw.pageFile.Sync(); err != nil {
+		return err
 	}
-}
 
-func getLSN(page []byte) int64 {
-	return util.BytesToInt64(page[4:12])
+	// 最后需要将 buffer 中写入的部分清空
+	_, err := dw.bufferFile.WriteAt(make([]byte, offset), 0)
+	return err
 }
 
-func (dw *DoubleWrite) Write(page *pager.Page) {
-	raw := page.Raw()
-	pageNum := page.PageNum()
+func (dw *DoubleWrite) SetSyncAllocated(syncAllocated func() error) {
+	dw.diskLock.Lock()
+	defer dw.diskLock.Unlock()
+	dw.syncAllocated = syncAllocated
+}
 
+// 缓存页在磁盘上的二进制，页头中已经包含校验和
+func (dw *DoubleWrite) Write(pageNum util.UUID, raw []byte) {
 	dw.memoryLock.Lock()
 	defer dw.memoryLock.Unlock()
 
-	// 写入 checkSum 到 page 末尾
-	pageCheckSum := CheckSum(raw[:util.PAGE_SIZE-4])
-	copy(raw[util.PAGE_SIZE-4:], pageCheckSum)
-
 	dw.pages[pageNum] = raw
 
 	// 当写入的页数达到一定数量时，则将内存中的数据写入磁盘
 	// 默认为 75%
-	if len(dw.pages) >= util.DOUBLE_WRITE_POOL_PAGE_NUM*0.75 {
-		go dw.FlushToDisk()
+	if len(dw.pages) >= dw.poolPages*3/4 {
+		go func() {
+			// 失败的页留在内存中，由下一次写入重试
+			if err := dw.FlushToDisk(); err != nil {
+				log.Error(err)
+			}
+		}()
 	}
 }
 
 // 将内存中的数据写入磁盘，关闭 DoubleWrite 文件，并且更新 LSN
 func (dw *DoubleWrite) Close() {
-	dw.FlushToDisk()
-	dw.bufferFile.Close()
-}
-
-func CheckSum(page []byte) []byte {
-	sum := make([]byte, 4)
-	k := len(page) / 4
-	for _, b := range page[:k] {
-		sum[0] ^= b
-	}
-	for _, b := range page[k : k*2] {
-		sum[1] ^= b
-	}
-	for _, b := range page[k*2 : k*3] {
-		sum[2] ^= b
+	if err := dw.FlushToDisk(); err != nil {
+		log.Error(err)
 	}
-	for _, b := range page[k*3:] {
-		sum[3] ^= b
-	}
-	return sum
-}
-
-func IsPartialWrite(page []byte) bool {
-	return bytes.Equal(CheckSum(page[:util.PAGE_SIZE-4]), page[util.PAGE_SIZE-4:])
+	dw.bufferFile.Close()
 }
@@ -0,0 +1,255 @@
+/*
+按时间点恢复：在基础备份上重放归档的 redo log，停在指定的 LSN、事务提交或者时间点。
+备份时写入 backup_label 记录备份中日志的范围，恢复的目标不能早于备份结束的位置，
+否则复制的页中可能包含目标之后的修改。
+建表不记录日志，不能通过归档的日志恢复，建表之后需要重新备份。
+*/
+package recovery
+
+import (
+	"errors"
+	"fmt"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/recovery/recinfo"
+	"minidb-go/storage/recovery/redo"
+	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util/vfs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const BACKUP_LABEL_FILE_NAME = "backup_label"
+
+type TargetKind int
+
+const (
+	// 重放所有日志
+	TARGET_NONE TargetKind = iota
+	// 重放结束位置不超过 LSN 的日志
+	TARGET_LSN
+	// 重放到事务的提交日志为止
+	TARGET_XID
+	// 重放到第一条晚于该时间的提交日志之前
+	TARGET_TIME
+)
+
+type Target struct {
+	Kind TargetKind
+	LSN  int64
+	XID  tm.XID
+	Time time.Time
+}
+
+// 解析恢复的目标，格式为 LSN、lsn:<LSN>、xid:<XID> 或者 RFC3339 格式的时间，为空时重放所有日志
+func ParseTarget(s string) (Target, error) {
+	switch {
+	case s == "":
+		return Target{Kind: TARGET_NONE}, nil
+	case strings.HasPrefix(s, "xid:"):
+		xid, err := strconv.ParseUint(strings.TrimPrefix(s, "xid:"), 10, 32)
+		if err == nil {
+			return Target{Kind: TARGET_XID, XID: tm.XID(xid)}, nil
+		}
+	case strings.HasPrefix(s, "lsn:"):
+		LSN, err := strconv.ParseInt(strings.TrimPrefix(s, "lsn:"), 10, 64)
+		if err == nil {
+			return Target{Kind: TARGET_LSN, LSN: LSN}, nil
+		}
+	default:
+		if LSN, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return Target{Kind: TARGET_LSN, LSN: LSN}, nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return Target{Kind: TARGET_TIME, Time: t}, nil
+		}
+	}
+	return Target{}, fmt.Errorf("invalid recovery target %q, expected an LSN, xid:<xid> or an RFC3339 time", s)
+}
+
+func (target Target) String() string {
+	switch target.Kind {
+	case TARGET_LSN:
+		return fmt.Sprintf("lsn:%d", target.LSN)
+	case TARGET_XID:
+		return fmt.Sprintf("xid:%d", target.XID)
+	case TARGET_TIME:
+		return target.Time.Format(time.RFC3339Nano)
+	}
+	return "end of log"
+}
+
+func writeBackupLabel(dir string, startLSN int64, endLSN int64) error {
+	name := filepath.Join(dir, BACKUP_LABEL_FILE_NAME)
+	file, err := vfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	label := fmt.Sprintf("START LSN: %d\nEND LSN: %d\n", startLSN, endLSN)
+	if _, err := file.WriteAt([]byte(label), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// 返回备份中日志的起始和结束位置
+func ReadBackupLabel(dir string) (int64, int64, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, BACKUP_LABEL_FILE_NAME))
+	if err != nil {
+		return 0, 0, err
+	}
+	var startLSN, endLSN int64
+	if _, err := fmt.Sscanf(string(raw), "START LSN: %d\nEND LSN: %d\n", &startLSN, &endLSN); err != nil {
+		return 0, 0, fmt.Errorf("invalid backup label: %w", err)
+	}
+	return startLSN, endLSN, nil
+}
+
+var errTargetReached = errors.New("recovery target reached")
+
+/*
+准备从复制到 path 中的备份恢复：复制 archiveDir 中备份之后归档的段，丢弃恢复目标之后的日志，
+并将目标之前提交的事务在 XID 文件中标记为已提交，返回日志结束的位置。
+之后正常打开数据库即可重放日志，并回滚目标处未提交的事务，backup_label 在重放结束后删除。
+*/
+func PrepareRestore(path string, archiveDir string, target Target) (int64, error) {
+	_, endLSN, err := ReadBackupLabel(path)
+	if err != nil {
+		return 0, err
+	}
+	if archiveDir != "" {
+		if err := copyArchivedSegments(archiveDir, path); err != nil {
+			return 0, err
+		}
+	}
+
+	info, err := recinfo.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	redoStartLSN := info.Data().RedoStartLSN
+	info.Close()
+	r, err := redo.Open(path, nil, redo.DefaultOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// 目标之前提交的事务
+	committed := make([]tm.XID, 0)
+	stopLSN := redoStartLSN
+	reached := false
+	LSN, err := r.Scan(redoStartLSN, func(l redolog.Log) error {
+		if reached {
+			return errTargetReached
+		}
+		commitLog, isCommit := l.(*redolog.CommitLog)
+		switch target.Kind {
+		case TARGET_LSN:
+			if l.LSN() > target.LSN {
+				reached = true
+				return errTargetReached
+			}
+		case TARGET_TIME:
+			if isCommit && commitLog.Time().After(target.Time) {
+				reached = true
+				return errTargetReached
+			}
+		case TARGET_XID:
+			// 包含事务的提交日志，在下一条日志处停止
+			reached = isCommit && commitLog.Xid() == target.XID
+		}
+		if isCommit {
+			committed = append(committed, commitLog.Xid())
+		}
+		stopLSN = l.LSN()
+		return nil
+	})
+	if err != nil && err != errTargetReached {
+		return 0, err
+	}
+	// 日志在到达目标之前中断时，如果是因为缺少段，不能丢弃之后的段，否则之后提交的事务会丢失
+	gapStart, gapEnd, gap := r.Gap()
+	if gap && !reached && !(target.Kind == TARGET_LSN && stopLSN >= target.LSN) {
+		return 0, fmt.Errorf("redo log between %d and %d is missing, recovery target %v is not reachable",
+			gapStart, gapEnd, target)
+	}
+	if err == nil && LSN < r.CurrentLSN() {
+		log.Warnf("redo log is truncated at %d", LSN)
+	}
+
+	switch {
+	case target.Kind == TARGET_XID && !reached:
+		return 0, fmt.Errorf("transaction %d does not commit before the end of the redo log at %d", target.XID, stopLSN)
+	case target.Kind == TARGET_LSN && !reached && stopLSN < target.LSN:
+		return 0, fmt.Errorf("recovery target %v is beyond the end of the redo log at %d", target, stopLSN)
+	case stopLSN < endLSN || target.Kind == TARGET_LSN && target.LSN < endLSN:
+		return 0, fmt.Errorf("recovery target %v is before the end of the backup at %d", target, endLSN)
+	}
+	if err := r.DiscardAfter(stopLSN); err != nil {
+		return 0, err
+	}
+
+	// XID 文件复制于备份时，之后提交的事务需要根据提交日志标记
+	transactionManager, err := tm.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, xid := range committed {
+		transactionManager.Advance(xid)
+		transactionManager.Commit(xid)
+	}
+	transactionManager.Close()
+
+	log.Infof("recovery target %v: redo log ends at %d, %d transactions committed after the backup",
+		target, stopLSN, len(committed))
+	return stopLSN, nil
+}
+
+// 复制归档的段中不早于 path 中最后一个段的部分，path 中的最后一个段在备份时可能只复制了一部分
+func copyArchivedSegments(archiveDir string, path string) error {
+	names, err := filepath.Glob(filepath.Join(path, redo.REDO_LOG_FILE_PATTERN))
+	if err != nil {
+		return err
+	}
+	lastLSN := int64(-1)
+	for _, name := range names {
+		startLSN, err := redo.SegmentStartLSN(name)
+		if err != nil {
+			return err
+		}
+		if startLSN > lastLSN {
+			lastLSN = startLSN
+		}
+	}
+	archived, err := filepath.Glob(filepath.Join(archiveDir, redo.REDO_LOG_FILE_PATTERN))
+	if err != nil {
+		return err
+	}
+	for _, name := range archived {
+		startLSN, err := redo.SegmentStartLSN(name)
+		if err != nil {
+			return err
+		}
+		if startLSN < lastLSN {
+			continue
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(path, filepath.Base(name))
+		if stat, err := os.Stat(dst); err == nil && stat.Size() >= int64(len(raw)) {
+			continue
+		}
+		if err := os.WriteFile(dst, raw, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
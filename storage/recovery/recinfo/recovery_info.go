@@ -1,95 +1,175 @@
 /*
-recinfo 用于获取recovery的信息，包括 checkpoint 和 是否正常退出
-文件名为 REC_INFO_FILE_NAME
-文件格式为：
-	checkpoint int64
-	exit bool
-
+recinfo 保存恢复需要的控制信息，文件名为 REC_INFO_FILE_NAME
+文件中有两个格式相同的槽，每次更新写入序号较旧的槽，
+写到一半时异常退出不会破坏另一个槽，打开时选择校验和正确且序号最大的槽。
+每个槽的格式为：
+
+	magic         uint32
+	seq           uint64  写入的序号
+	checkpoint    int64   最近一次 checkpoint 开始时的 LSN
+	redoStart     int64   恢复时开始重放 redo log 的 LSN
+	clean         bool    上次是否正常关闭
+	nextXID       uint32  checkpoint 时下一个将要分配的 XID
+	catalogRoot   uint32  meta page 的页号
+	checksum      uint32  以上字段的 CRC32
 */
 package recinfo
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"minidb-go/serialization/tm"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
 	"os"
 	"sync"
 )
 
 const (
 	REC_INFO_FILE_NAME = "recovery_info"
+
+	REC_INFO_MAGIC uint32 = 0x4d444243
+
+	// 两个槽位于不同的扇区
+	SLOT_SIZE  = 512
+	SLOT_COUNT = 2
+	// 槽中有效数据的长度，包括校验和
+	SLOT_DATA_SIZE = 4 + 8 + 8 + 8 + 1 + 4 + 4 + 4
 )
 
+var ErrInfoCorrupted = errors.New("recovery info is corrupted")
+
+type ControlData struct {
+	CheckPointLSN int64
+	RedoStartLSN  int64
+	CleanShutdown bool
+	NextXID       tm.XID
+	CatalogRoot   util.UUID
+}
+
 type RecoveryInfo struct {
-	infoFile *os.File
+	infoFile vfs.File
+
+	// 最近一次写入的槽的序号和内容
+	seq  uint64
+	data ControlData
 
 	lock sync.RWMutex
 }
 
-func Create(path string) *RecoveryInfo {
+func Create(path string) (*RecoveryInfo, error) {
 	path = path + "/" + REC_INFO_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
 	}
-	file.WriteAt([]byte{0, 0}, 0)
-	return &RecoveryInfo{
+	info := &RecoveryInfo{
 		infoFile: file,
 	}
+	// 运行期间 clean 为 false
+	if err := info.Update(func(data *ControlData) {}); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write recovery info failed: %w", err)
+	}
+	return info, nil
 }
 
-func Open(path string) *RecoveryInfo {
+func Open(path string) (*RecoveryInfo, error) {
 	path = path + "/" + REC_INFO_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	file, err := vfs.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open file %s failed: %w", path, err)
 	}
-	return &RecoveryInfo{
+	info := &RecoveryInfo{
 		infoFile: file,
 	}
+	found := false
+	for i := 0; i < SLOT_COUNT; i++ {
+		seq, data, err := info.readSlot(i)
+		if err != nil {
+			continue
+		}
+		if !found || seq > info.seq {
+			info.seq = seq
+			info.data = data
+			found = true
+		}
+	}
+	if !found {
+		file.Close()
+		return nil, fmt.Errorf("open file %s failed: %w", path, ErrInfoCorrupted)
+	}
+	return info, nil
 }
 
-func (info *RecoveryInfo) GetCheckPoint() (int64, error) {
-	info.lock.RLock()
-	defer info.lock.RUnlock()
-
-	info.infoFile.Seek(0, 0)
-	var lsn int64
-	_, err := fmt.Fscanf(info.infoFile, "%d", &lsn)
-	return lsn, err
-}
-
-func (info *RecoveryInfo) SetCheckPoint(lsn int64) error {
-	info.lock.Lock()
-	defer info.lock.Unlock()
-
-	info.infoFile.Seek(0, 0)
-	_, err := fmt.Fprintf(info.infoFile, "%d", lsn)
-	info.infoFile.Sync()
-	return err
+func (info *RecoveryInfo) readSlot(slot int) (uint64, ControlData, error) {
+	var data ControlData
+	raw := make([]byte, SLOT_DATA_SIZE)
+	if _, err := info.infoFile.ReadAt(raw, int64(slot)*SLOT_SIZE); err != nil {
+		return 0, data, ErrInfoCorrupted
+	}
+	checksum := binary.BigEndian.Uint32(raw[SLOT_DATA_SIZE-4:])
+	if crc32.ChecksumIEEE(raw[:SLOT_DATA_SIZE-4]) != checksum {
+		return 0, data, ErrInfoCorrupted
+	}
+	r := bytes.NewReader(raw)
+	var magic uint32
+	var seq uint64
+	binary.Read(r, binary.BigEndian, &magic)
+	if magic != REC_INFO_MAGIC {
+		return 0, data, ErrInfoCorrupted
+	}
+	binary.Read(r, binary.BigEndian, &seq)
+	binary.Read(r, binary.BigEndian, &data.CheckPointLSN)
+	binary.Read(r, binary.BigEndian, &data.RedoStartLSN)
+	binary.Read(r, binary.BigEndian, &data.CleanShutdown)
+	binary.Read(r, binary.BigEndian, &data.NextXID)
+	binary.Read(r, binary.BigEndian, &data.CatalogRoot)
+	return seq, data, nil
 }
 
-func (info *RecoveryInfo) IsExit() (bool, error) {
+// 返回最近一次写入的控制信息
+func (info *RecoveryInfo) Data() ControlData {
 	info.lock.RLock()
 	defer info.lock.RUnlock()
-
-	info.infoFile.Seek(0, 0)
-	var exit bool
-	_, err := fmt.Fscanf(info.infoFile, "%t", &exit)
-	return exit, err
+	return info.data
 }
 
-func (info *RecoveryInfo) SetExit(exit bool) error {
+// 修改控制信息并写入较旧的槽，返回时已经落盘
+func (info *RecoveryInfo) Update(update func(data *ControlData)) error {
 	info.lock.Lock()
 	defer info.lock.Unlock()
 
-	info.infoFile.Seek(0, 0)
-	_, err := fmt.Fprintf(info.infoFile, "%t", exit)
-	info.infoFile.Sync()
-	return err
+	data := info.data
+	update(&data)
+	seq := info.seq + 1
+
+	buf := new(bytes.Buffer)
+	buf.Grow(SLOT_DATA_SIZE)
+	binary.Write(buf, binary.BigEndian, REC_INFO_MAGIC)
+	binary.Write(buf, binary.BigEndian, seq)
+	binary.Write(buf, binary.BigEndian, data.CheckPointLSN)
+	binary.Write(buf, binary.BigEndian, data.RedoStartLSN)
+	binary.Write(buf, binary.BigEndian, data.CleanShutdown)
+	binary.Write(buf, binary.BigEndian, data.NextXID)
+	binary.Write(buf, binary.BigEndian, data.CatalogRoot)
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	slot := int64(seq % SLOT_COUNT)
+	if _, err := info.infoFile.WriteAt(buf.Bytes(), slot*SLOT_SIZE); err != nil {
+		return err
+	}
+	if err := info.infoFile.Sync(); err != nil {
+		return err
+	}
+	info.seq = seq
+	info.data = data
+	return nil
 }
 
-// 关闭 recinfo，需要在最后关闭，并在关闭之前写入最新的 LSN
 func (info *RecoveryInfo) Close() {
-	info.SetExit(true)
 	info.infoFile.Close()
 }
@@ -4,11 +4,17 @@ Data Manager 的恢复机制实现，由 redo log 和 double write 实现
 package recovery
 
 import (
+	"fmt"
+	"minidb-go/serialization/tm"
 	"minidb-go/storage/pager"
 	"minidb-go/storage/recovery/doublewrite"
 	"minidb-go/storage/recovery/recinfo"
 	"minidb-go/storage/recovery/redo"
+	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util"
+	"minidb-go/util/vfs"
 	"os"
+	"path/filepath"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,64 +22,274 @@ import (
 type Recovery struct {
 	redo     *redo.Redo
 	dwrite   *doublewrite.DoubleWrite
-	pageFile *os.File
+	pageFile vfs.File
 	recinfo  *recinfo.RecoveryInfo
+
+	// 上次是否异常退出，需要重放 redo log
+	needRedo bool
+	// 是否从备份恢复，重放结束后删除 backup_label
+	fromBackup bool
+	path       string
+	// double write 缓存的页数，备份时创建相同大小的 buffer 文件
+	doubleWritePages int
 }
 
-func Create(path string, pageFile *os.File) *Recovery {
+// options: redo log 的配置，doubleWritePages: double write 在内存中缓存的页数
+func Create(path string, pageFile vfs.File, options redo.Options, doubleWritePages int) (*Recovery, error) {
 	r := &Recovery{
-		redo:     redo.Create(path, pageFile),
-		dwrite:   doublewrite.Create(path, pageFile),
-		pageFile: pageFile,
-		recinfo:  recinfo.Create(path),
+		pageFile:         pageFile,
+		path:             path,
+		doubleWritePages: doubleWritePages,
+	}
+	var err error
+	if r.redo, err = redo.Create(path, pageFile, options); err != nil {
+		return nil, err
+	}
+	if r.dwrite, err = doublewrite.Create(path, pageFile, doubleWritePages); err != nil {
+		r.Discard()
+		return nil, err
 	}
-	r.dwrite.SetCheckPoint = r.recinfo.SetCheckPoint
-	return r
+	if r.recinfo, err = recinfo.Create(path); err != nil {
+		r.Discard()
+		return nil, err
+	}
+	return r, nil
 }
 
-func Open(path string, pageFile *os.File) *Recovery {
+// 打开时如果上次异常退出，会先通过 double write 修复部分写的页，
+// 此时页文件中的页都是完整的，但可能缺少 redo log 中的修改，需要再调用 Redo 重放日志
+func Open(path string, pageFile vfs.File, options redo.Options, doubleWritePages int) (*Recovery, error) {
 	r := &Recovery{
-		redo:     redo.Open(path, pageFile),
-		dwrite:   doublewrite.Open(path, pageFile),
-		pageFile: pageFile,
-		recinfo:  recinfo.Open(path),
+		pageFile:         pageFile,
+		path:             path,
+		doubleWritePages: doubleWritePages,
+	}
+	var err error
+	if r.redo, err = redo.Open(path, pageFile, options); err != nil {
+		return nil, err
+	}
+	if r.dwrite, err = doublewrite.Open(path, pageFile, doubleWritePages); err != nil {
+		r.Discard()
+		return nil, err
+	}
+	if r.recinfo, err = recinfo.Open(path); err != nil {
+		r.Discard()
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(path, BACKUP_LABEL_FILE_NAME)); err == nil {
+		r.fromBackup = true
 	}
-	r.dwrite.SetCheckPoint = r.recinfo.SetCheckPoint
 
 	// 判断是否需要恢复
-	exit, err := r.recinfo.IsExit()
+	if !r.recinfo.Data().CleanShutdown {
+		log.Warnf("database exited abnormally, need recovery")
+		// 先恢复 Double Write，恢复部分写的页
+		if err := r.dwrite.Recover(); err != nil {
+			r.Discard()
+			return nil, fmt.Errorf("recover double write failed: %w", err)
+		}
+		r.needRedo = true
+	}
+	// 运行期间 clean 为 false，正常关闭时才设置为 true
+	err = r.recinfo.Update(func(data *recinfo.ControlData) {
+		data.CleanShutdown = false
+	})
 	if err != nil {
-		log.Fatalf("check recovery info failed: %v", err)
+		r.Discard()
+		return nil, fmt.Errorf("update recovery info failed: %w", err)
 	}
-	if !exit {
-		log.Warnf("database exited abnormally, need recovery")
-		r.recover()
+	return r, nil
+}
+
+// 打开失败时关闭已经打开的文件，不修改控制信息，下次打开时仍然按异常退出恢复
+func (r *Recovery) Discard() {
+	if r.redo != nil {
+		r.redo.Close()
+	}
+	if r.dwrite != nil {
+		r.dwrite.Close()
 	}
-	return r
+	if r.recinfo != nil {
+		r.recinfo.Close()
+	}
+}
+
+// meta page 的页号
+func (r *Recovery) CatalogRoot() util.UUID {
+	return r.recinfo.Data().CatalogRoot
+}
+
+// 返回控制文件中的信息
+func (r *Recovery) ControlData() recinfo.ControlData {
+	return r.recinfo.Data()
+}
+
+func (r *Recovery) NeedRedo() bool {
+	return r.needRedo
+}
+
+// 数据库目录中有 backup_label，页文件是在线复制的，备份之后分配的页不在其中
+func (r *Recovery) FromBackup() bool {
+	return r.fromBackup
 }
 
-func (r *Recovery) recover() {
+// 从 checkpoint 记录的位置开始重放 redo log，apply 将一条日志应用到对应的页上
+func (r *Recovery) Redo(apply func(log redolog.Log) error) error {
 	log.Info("recover begin")
-	// 先恢复 Double Write，恢复部分写的页
-	r.dwrite.Recover()
-	// 然后再恢复 Redo
-	LSN, err := r.recinfo.GetCheckPoint()
-	if err != nil {
-		log.Fatalf("get check point failed: %v", err)
+	LSN := r.recinfo.Data().RedoStartLSN
+	if err := r.redo.Recover(LSN, apply); err != nil {
+		return err
 	}
-	r.redo.Recover(LSN)
+	r.needRedo = false
 	log.Info("recover end")
+	return nil
+}
+
+// 从备份恢复时，重放的页全部写回之后调用，之后异常退出时作为普通的数据库恢复
+func (r *Recovery) FinishRestore() {
+	if !r.fromBackup {
+		return
+	}
+	if err := vfs.Remove(filepath.Join(r.path, BACKUP_LABEL_FILE_NAME)); err != nil {
+		log.Panicf("remove backup label failed: %v", err)
+	}
+	r.fromBackup = false
+}
+
+/*
+分配新页时只写入页文件而不落盘，引用新页的日志或者页写入文件之前调用 syncAllocated，
+保证磁盘上的日志和页引用的页都已经存在，重放日志时不会读到不存在的页
+*/
+func (rec *Recovery) SetSyncAllocated(syncAllocated func() error) {
+	rec.redo.SetSyncAllocated(syncAllocated)
+	rec.dwrite.SetSyncAllocated(syncAllocated)
+}
+
+// 为一条日志分配 LSN，返回的 LSN 需要设置到被修改的页上
+func (rec *Recovery) AppendLog(l redolog.Log) int64 {
+	LSN, err := rec.redo.Append([]redolog.Log{l})
+	if err != nil {
+		log.Panicf("append redo log failed: %v", err)
+	}
+	return LSN
 }
 
-func (rec *Recovery) Write(page *pager.Page) {
-	// LSN, _ := rec.redo.Append(page.Logs())
-	// // 需要先更新页的 LSN，再写入 double write
-	// page.LSN = LSN
-	rec.dwrite.Write(page)
+// 写入 double write 之前，页的二进制中的 LSN 之前的 redo log 必须已经落盘
+func (rec *Recovery) Write(pageNum util.UUID, image []byte) error {
+	if err := rec.redo.Flush(pager.ReadHeader(image).LSN); err != nil {
+		return fmt.Errorf("flush redo log failed: %w", err)
+	}
+	rec.dwrite.Write(pageNum, image)
+	return nil
+}
+
+// 将 double write 中缓存的页写入磁盘
+func (rec *Recovery) Flush() error {
+	return rec.dwrite.FlushToDisk()
+}
+
+// 将所有的 redo log 落盘，事务提交时调用
+func (rec *Recovery) FlushLog() error {
+	if err := rec.redo.Flush(rec.redo.CurrentLSN()); err != nil {
+		return fmt.Errorf("flush redo log failed: %w", err)
+	}
+	return nil
+}
+
+// 最后一条日志的 LSN
+func (rec *Recovery) CurrentLSN() int64 {
+	return rec.redo.CurrentLSN()
+}
+
+/*
+记录一次 checkpoint，调用者需要保证 LSN 之前的修改都已经写回磁盘，
+redoStartLSN 不大于 LSN，之后的日志包含了所有未结束的事务的日志。
+恢复时从 redoStartLSN 开始重放，之前的日志段可以删除。
+后台 checkpoint 中调用，出错时返回错误，控制文件没有更新时之前的 checkpoint 仍然有效。
+*/
+func (rec *Recovery) CheckPoint(LSN int64, redoStartLSN int64, nextXID tm.XID) error {
+	if err := rec.redo.Flush(rec.redo.CurrentLSN()); err != nil {
+		return fmt.Errorf("flush redo log failed: %w", err)
+	}
+	err := rec.recinfo.Update(func(data *recinfo.ControlData) {
+		data.CheckPointLSN = LSN
+		data.RedoStartLSN = redoStartLSN
+		data.NextXID = nextXID
+	})
+	if err != nil {
+		return fmt.Errorf("update recovery info failed: %w", err)
+	}
+	// checkpoint 已经生效，没有归档的段留在 redo log 中，下次 checkpoint 时重试
+	if err := rec.redo.Truncate(redoStartLSN); err != nil {
+		log.Errorf("truncate redo log failed: %v", err)
+	}
+	return nil
+}
+
+// 开始备份，在 checkpoint 之后调用，返回的控制信息中 RedoStartLSN 之后的日志在 EndBackup 之前不会被删除
+func (rec *Recovery) StartBackup() recinfo.ControlData {
+	data := rec.recinfo.Data()
+	rec.redo.Hold(data.RedoStartLSN)
+	return data
 }
 
-func (rec *Recovery) Close() {
+/*
+将 data.RedoStartLSN 到 endLSN 之间的 redo log 复制到 dir 中，并写入控制文件、空的 double write buffer
+和记录日志范围的 backup_label，控制文件标记为异常退出，恢复时从 RedoStartLSN 开始重放日志，使复制的页一致。
+*/
+func (rec *Recovery) BackupLog(dir string, data recinfo.ControlData, endLSN int64) error {
+	if err := rec.redo.Flush(endLSN); err != nil {
+		return err
+	}
+	if err := rec.redo.CopyTo(dir, data.RedoStartLSN, endLSN); err != nil {
+		return err
+	}
+	info, err := recinfo.Create(dir)
+	if err != nil {
+		return err
+	}
+	defer info.Close()
+	err = info.Update(func(backup *recinfo.ControlData) {
+		*backup = data
+		backup.CleanShutdown = false
+	})
+	if err != nil {
+		return err
+	}
+	dwrite, err := doublewrite.Create(dir, nil, rec.doubleWritePages)
+	if err != nil {
+		return err
+	}
+	dwrite.Close()
+	return writeBackupLabel(dir, data.RedoStartLSN, endLSN)
+}
+
+// 结束备份，之后的 checkpoint 可以删除备份需要的日志
+func (rec *Recovery) EndBackup() {
+	rec.redo.Release()
+}
+
+// 需要在页文件的所有脏页写回之后关闭，出错时不标记为正常关闭，下次打开时重放日志
+func (rec *Recovery) Close() error {
+	if err := rec.FlushLog(); err != nil {
+		rec.Discard()
+		return err
+	}
+	LSN := rec.redo.CurrentLSN()
+	err := rec.recinfo.Update(func(data *recinfo.ControlData) {
+		data.CheckPointLSN = LSN
+		data.RedoStartLSN = LSN
+		data.CleanShutdown = true
+	})
+	if err != nil {
+		rec.Discard()
+		return fmt.Errorf("update recovery info failed: %w", err)
+	}
+	if err := rec.redo.Truncate(LSN); err != nil {
+		log.Errorf("truncate redo log failed: %v", err)
+	}
 	rec.redo.Close()
 	rec.dwrite.Close()
 	rec.recinfo.Close()
+	return nil
 }
@@ -1,103 +1,594 @@
+/*
+Redo 以追加的方式保存 redo log，每条日志的格式如下：
+
+length(uint32) + checksum(uint32) + log
+
+日志先写入内存中的缓冲区，在页写入 double write 之前，
+或者事务提交时调用 Flush 将缓冲区写入文件并 fsync。
+fsync 期间不持有锁，其他事务可以继续追加日志，它们的提交日志由下一次 fsync 一起落盘（组提交）。
+异常退出时最后一条日志可能只写入了一部分，恢复时根据长度和校验和识别并丢弃。
+
+日志分段保存在多个文件中，文件名为段中第一条日志的起始位置，
+当前段超过 Options.SegmentSize 后新的日志写入下一个段，一条日志不会跨越两个段。
+checkpoint 之后恢复不再需要的段通过 Truncate 删除。
+*/
 package redo
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util/vfs"
+
+	log "github.com/sirupsen/logrus"
 )
 
+type segment struct {
+	// 段中第一条日志的起始位置
+	startLSN int64
+	file     vfs.File
+}
+
 type Redo struct {
-	redoFile *os.File
+	path string
+	// 按起始位置排序，最后一个为当前写入的段
+	segments []*segment
+	options  Options
 	// 数据页文件，redo 不负责关闭
-	pageFile *os.File
-	LSN      int64
+	pageFile vfs.File
+	// 日志写入文件之前调用，日志中引用的新分配的页需要先落盘
+	syncAllocated func() error
+	// 下一条日志的起始位置，也是最后一条日志的 LSN
+	LSN int64
+	// 已经写入文件并 fsync 的位置
+	flushedLSN int64
 
-	lock sync.RWMutex
+	// 尚未写入文件的日志，结束位置为 LSN
+	buf *bytes.Buffer
+
+	// 备份期间需要保留的第一条日志的位置，为 -1 时没有备份
+	heldLSN int64
+
+	// 正在 fsync 时为 true，其他需要落盘的调用者等待 synced 后重新检查 flushedLSN
+	syncing bool
+	synced  *sync.Cond
+	// 等待 fsync 结束的调用者个数
+	waiting int
+
+	lock sync.Mutex
 }
 
 const (
-	REDO_LOG_FILE_NAME = "redo.log"
+	REDO_LOG_FILE_PATTERN = "redo_*.log"
+
+	// 日志长度和校验和
+	LOG_HEADER_SIZE = 4 + 4
+	// 缓冲区超过该大小时写入文件，但不 fsync
+	REDO_BUFFER_SIZE = 1 << 16
 )
 
-func Create(path string, pageFile *os.File) *Redo {
-	path = path + "/" + REDO_LOG_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+// 每个数据库单独的配置，只读取日志时使用 DefaultOptions
+type Options struct {
+	// 每个段的大小上限
+	SegmentSize int64
+	// 被 checkpoint 删除的段归档到该目录，为空时不归档，用于按时间点恢复
+	ArchiveDir string
+	// 组提交时 fsync 之前等待其他事务追加提交日志的时间，只在有其他事务同时等待落盘时生效，为 0 时不等待
+	CommitDelay time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize: 16 << 20,
+	}
+}
+
+var ErrLogCorrupted = errors.New("redo log is corrupted")
+
+func segmentFileName(path string, startLSN int64) string {
+	return filepath.Join(path, fmt.Sprintf("redo_%016x.log", startLSN))
+}
+
+// 从段的文件名中得到段的起始位置
+func SegmentStartLSN(name string) (int64, error) {
+	var startLSN int64
+	if _, err := fmt.Sscanf(filepath.Base(name), "redo_%x.log", &startLSN); err != nil {
+		return 0, fmt.Errorf("invalid redo log segment %s", name)
+	}
+	return startLSN, nil
+}
+
+func createSegment(path string, startLSN int64) (*segment, error) {
+	name := segmentFileName(path, startLSN)
+	file, err := vfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+		return nil, fmt.Errorf("open file %s failed: %w", name, err)
+	}
+	return &segment{
+		startLSN: startLSN,
+		file:     file,
+	}, nil
+}
+
+func Create(path string, pageFile vfs.File, options Options) (*Redo, error) {
+	seg, err := createSegment(path, 0)
+	if err != nil {
+		return nil, err
 	}
 	redo := &Redo{
-		redoFile: file,
+		path:     path,
+		options:  options,
+		segments: []*segment{seg},
 		pageFile: pageFile,
 		LSN:      0,
+		buf:      new(bytes.Buffer),
+		heldLSN:  -1,
 	}
-	return redo
+	redo.synced = sync.NewCond(&redo.lock)
+	return redo, nil
 }
 
-func Open(path string, pageFile *os.File) *Redo {
-	path = path + "/" + REDO_LOG_FILE_NAME
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
-	if err != nil {
-		log.Fatalf("open file %s failed: %v", path, err)
+func Open(path string, pageFile vfs.File, options Options) (*Redo, error) {
+	names, err := filepath.Glob(filepath.Join(path, REDO_LOG_FILE_PATTERN))
+	if err != nil || len(names) == 0 {
+		return nil, fmt.Errorf("open redo log in %s failed: no segment found", path)
 	}
-	stat, _ := file.Stat()
 	redo := &Redo{
-		redoFile: file,
+		path:     path,
+		options:  options,
 		pageFile: pageFile,
-		LSN:      stat.Size(),
+		buf:      new(bytes.Buffer),
+		heldLSN:  -1,
+	}
+	redo.synced = sync.NewCond(&redo.lock)
+	for _, name := range names {
+		startLSN, err := SegmentStartLSN(name)
+		if err != nil {
+			redo.closeSegments()
+			return nil, err
+		}
+		file, err := vfs.OpenFile(name, os.O_RDWR, 0666)
+		if err != nil {
+			redo.closeSegments()
+			return nil, fmt.Errorf("open file %s failed: %w", name, err)
+		}
+		redo.segments = append(redo.segments, &segment{
+			startLSN: startLSN,
+			file:     file,
+		})
+	}
+	sort.Slice(redo.segments, func(i, j int) bool {
+		return redo.segments[i].startLSN < redo.segments[j].startLSN
+	})
+	current := redo.current()
+	stat, err := current.file.Stat()
+	if err != nil {
+		redo.closeSegments()
+		return nil, err
+	}
+	redo.LSN = current.startLSN + stat.Size()
+	redo.flushedLSN = redo.LSN
+	return redo, nil
+}
+
+func (redo *Redo) current() *segment {
+	return redo.segments[len(redo.segments)-1]
+}
+
+// 返回包含 LSN 处日志的段，LSN 在第一个段之前时返回 nil
+func (redo *Redo) segmentOf(LSN int64) *segment {
+	for i := len(redo.segments) - 1; i >= 0; i-- {
+		if redo.segments[i].startLSN <= LSN {
+			return redo.segments[i]
+		}
 	}
-	return redo
+	return nil
+}
+
+// 段中日志结束的位置，之后的段的起始位置或者最后一条日志的 LSN。
+// 段写满 options.SegmentSize 之后才会切换，所以段的长度不超过 SegmentSize 加上一条日志
+func (redo *Redo) segmentEnd(seg *segment) int64 {
+	for i, s := range redo.segments {
+		if s == seg && i+1 < len(redo.segments) {
+			return redo.segments[i+1].startLSN
+		}
+	}
+	return redo.LSN
+}
+
+// 第一个段的起始位置，之前的日志已经被删除
+func (redo *Redo) FirstLSN() int64 {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	return redo.segments[0].startLSN
+}
+
+func (redo *Redo) SetSyncAllocated(syncAllocated func() error) {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	redo.syncAllocated = syncAllocated
 }
 
-// 添加一系列 redo log，并返回最后一个 redo log 的 LSN
+// 添加一系列 redo log 到缓冲区，并返回最后一个 redo log 的 LSN
 func (redo *Redo) Append(logs []redolog.Log) (int64, error) {
 	redo.lock.Lock()
 	defer redo.lock.Unlock()
-	buf := new(bytes.Buffer)
-	buf.Grow(512)
 	for _, log := range logs {
-		err := redo.write(log, buf)
-		if err != nil {
+		if redo.LSN-redo.current().startLSN >= redo.options.SegmentSize {
+			if err := redo.switchSegment(); err != nil {
+				return 0, err
+			}
+		}
+		redo.write(log)
+	}
+	if redo.buf.Len() >= REDO_BUFFER_SIZE {
+		if err := redo.writeBuffer(); err != nil {
 			return 0, err
 		}
 	}
-	redo.redoFile.Write(buf.Bytes())
-	redo.redoFile.Sync()
 	return redo.LSN, nil
 }
 
-func (redo *Redo) write(log redolog.Log, w io.Writer) error {
-	log.SetLSN(redo.LSN)
+func (redo *Redo) write(log redolog.Log) {
 	raw := log.Bytes()
-	redo.LSN += int64(len(raw))
-	_, err := w.Write(raw)
+	var header [LOG_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(raw)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(raw))
+	redo.buf.Write(header[:])
+	redo.buf.Write(raw)
+	redo.LSN += int64(LOG_HEADER_SIZE + len(raw))
+	log.SetLSN(redo.LSN)
+}
+
+// 将缓冲区写入当前段，调用时已经持有 redo.lock
+func (redo *Redo) writeBuffer() error {
+	if redo.buf.Len() == 0 {
+		return nil
+	}
+	if redo.syncAllocated != nil {
+		if err := redo.syncAllocated(); err != nil {
+			return err
+		}
+	}
+	current := redo.current()
+	offset := redo.LSN - int64(redo.buf.Len()) - current.startLSN
+	if _, err := current.file.WriteAt(redo.buf.Bytes(), offset); err != nil {
+		return err
+	}
+	redo.buf.Reset()
+	return nil
+}
+
+// 当前段落盘后开始写入新的段，调用时已经持有 redo.lock
+func (redo *Redo) switchSegment() error {
+	if err := redo.writeBuffer(); err != nil {
+		return err
+	}
+	if err := redo.current().file.Sync(); err != nil {
+		return err
+	}
+	redo.flushedLSN = redo.LSN
+	seg, err := createSegment(redo.path, redo.LSN)
+	if err != nil {
+		return err
+	}
+	redo.segments = append(redo.segments, seg)
+	return nil
+}
+
+// 最后一条日志的 LSN
+func (redo *Redo) CurrentLSN() int64 {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	return redo.LSN
+}
+
+/*
+保证 LSN 之前的日志都已经落盘。
+同一时间只有一个调用者执行 fsync，它会把缓冲区中所有的日志一起落盘，
+其他调用者等待本次 fsync 结束，如果日志还没有落盘再由其中一个调用者执行下一次 fsync。
+*/
+func (redo *Redo) Flush(LSN int64) error {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	for redo.syncing && LSN > redo.flushedLSN {
+		redo.waiting++
+		redo.synced.Wait()
+		redo.waiting--
+	}
+	if LSN <= redo.flushedLSN {
+		return nil
+	}
+	redo.syncing = true
+	defer redo.synced.Broadcast()
+	// 只有一个事务提交时等待只会增加延迟
+	if redo.options.CommitDelay > 0 && redo.waiting > 0 {
+		redo.lock.Unlock()
+		time.Sleep(redo.options.CommitDelay)
+		redo.lock.Lock()
+	}
+	if err := redo.writeBuffer(); err != nil {
+		redo.syncing = false
+		return err
+	}
+	current, LSN := redo.current(), redo.LSN
+	redo.lock.Unlock()
+	err := current.file.Sync()
+	redo.lock.Lock()
+	redo.syncing = false
+	// fsync 期间切换了段时，旧的段在切换时已经落盘，可能已经被 Truncate 关闭
+	if err != nil && current != redo.current() {
+		err = nil
+	}
 	if err != nil {
 		return err
 	}
+	if LSN > redo.flushedLSN {
+		redo.flushedLSN = LSN
+	}
 	return nil
 }
 
-func (redo *Redo) Recover(beginLSN int64) {
+// 读取 LSN 处开始的一条日志，返回的日志的 LSN 为其结束的位置
+func (redo *Redo) readLog(LSN int64) (redolog.Log, error) {
+	seg := redo.segmentOf(LSN)
+	if seg == nil {
+		return nil, ErrLogCorrupted
+	}
+	var header [LOG_HEADER_SIZE]byte
+	if _, err := seg.file.ReadAt(header[:], LSN-seg.startLSN); err != nil {
+		if err == io.EOF && LSN == redo.LSN {
+			return nil, io.EOF
+		}
+		return nil, ErrLogCorrupted
+	}
+	// 长度来自磁盘，损坏时可能非常大，不能超过段中剩余的日志
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > redo.segmentEnd(seg)-LSN-LOG_HEADER_SIZE {
+		return nil, fmt.Errorf("%w: log at %d has invalid length %d", ErrLogCorrupted, LSN, length)
+	}
+	raw := make([]byte, length)
+	if _, err := seg.file.ReadAt(raw, LSN-seg.startLSN+LOG_HEADER_SIZE); err != nil {
+		return nil, ErrLogCorrupted
+	}
+	if crc32.ChecksumIEEE(raw) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, ErrLogCorrupted
+	}
+	l, err := redolog.ReadLog(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrLogCorrupted
+	}
+	l.SetLSN(LSN + LOG_HEADER_SIZE + int64(len(raw)))
+	return l, nil
+}
+
+// 从 beginLSN 开始按顺序读取日志，返回最后一条完整的日志结束的位置，
+// 返回的位置小于 CurrentLSN 时说明之后的日志已经损坏
+func (redo *Redo) Scan(beginLSN int64, visit func(log redolog.Log) error) (int64, error) {
+	if beginLSN < redo.segments[0].startLSN {
+		return beginLSN, fmt.Errorf("%w: log before %d has been removed", ErrLogCorrupted, redo.segments[0].startLSN)
+	}
+	LSN := beginLSN
+	for LSN < redo.LSN {
+		l, err := redo.readLog(LSN)
+		if err != nil {
+			break
+		}
+		if err := visit(l); err != nil {
+			return LSN, err
+		}
+		LSN = l.LSN()
+	}
+	return LSN, nil
+}
+
+// 从 beginLSN 开始按顺序重放日志，apply 负责根据页的 LSN 判断日志是否已经生效
+// 恢复时没有其他写入，apply 中淘汰脏页会调用 Flush，所以这里不持有锁
+func (redo *Redo) Recover(beginLSN int64, apply func(log redolog.Log) error) error {
+	LSN, err := redo.Scan(beginLSN, apply)
+	if err != nil {
+		return err
+	}
+	if LSN < redo.LSN {
+		// 最后一条日志没有完整写入，丢弃之后的内容
+		log.Warnf("redo log is truncated at %d", LSN)
+		return redo.DiscardAfter(LSN)
+	}
+	return nil
+}
+
+// 返回第一处缺失的日志的范围，段中日志的结束位置与下一个段的起始位置不符时说明中间的段缺失，
+// 例如从归档中复制段时缺少了部分段，没有缺失时返回 false
+func (redo *Redo) Gap() (int64, int64, bool) {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	for i := 0; i+1 < len(redo.segments); i++ {
+		seg, next := redo.segments[i], redo.segments[i+1]
+		end := seg.startLSN
+		if stat, err := seg.file.Stat(); err == nil {
+			end += stat.Size()
+		}
+		if end != next.startLSN {
+			return end, next.startLSN, true
+		}
+	}
+	return 0, 0, false
+}
+
+// 丢弃 LSN 之后的日志，LSN 需要是一条日志结束的位置，恢复时没有其他写入
+func (redo *Redo) DiscardAfter(LSN int64) error {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	if LSN < redo.segments[0].startLSN {
+		return fmt.Errorf("%w: log before %d has been removed", ErrLogCorrupted, redo.segments[0].startLSN)
+	}
+	// 删除 LSN 之后开始的段
+	for len(redo.segments) > 1 && redo.current().startLSN > LSN {
+		redo.removeSegment(len(redo.segments) - 1)
+	}
+	current := redo.current()
+	if err := current.file.Truncate(LSN - current.startLSN); err != nil {
+		return err
+	}
+	current.file.Sync()
+	redo.LSN = LSN
+	redo.flushedLSN = LSN
+	return nil
+}
+
+/*
+删除只包含 LSN 之前的日志的段，当前段和 Hold 保留的段不会被删除。
+设置了 options.ArchiveDir 时，段在删除之前先复制到归档目录中，归档失败时该段和之后的段都留在 redo log 中，
+下次 Truncate 时再次尝试，归档中不会出现缺失的段。
+*/
+func (redo *Redo) Truncate(LSN int64) error {
+	redo.lock.Lock()
+	if redo.heldLSN >= 0 && redo.heldLSN < LSN {
+		LSN = redo.heldLSN
+	}
+	n := 0
+	for n+1 < len(redo.segments) && redo.segments[n+1].startLSN <= LSN {
+		n++
+	}
+	candidates := append([]*segment(nil), redo.segments[:n]...)
+	// 段的大小为下一个段的起始位置与自己的起始位置之差
+	sizes := make([]int64, n)
+	for i := range candidates {
+		sizes[i] = redo.segments[i+1].startLSN - candidates[i].startLSN
+	}
+	redo.lock.Unlock()
+
+	// 复制段时不阻塞日志的写入，这些段已经写满，不会再被修改
+	var archiveErr error
+	if redo.options.ArchiveDir != "" {
+		for i, seg := range candidates {
+			if err := archiveSegment(redo.options.ArchiveDir, seg, sizes[i]); err != nil {
+				archiveErr = fmt.Errorf("archive redo log segment %s failed: %w", seg.file.Name(), err)
+				candidates = candidates[:i]
+				break
+			}
+		}
+	}
+
+	// 只删除已经归档的段，其他 Truncate 可能已经删除了其中一部分
+	redo.lock.Lock()
+	removed := candidates[:0]
+	for _, seg := range candidates {
+		if len(redo.segments) > 1 && redo.segments[0] == seg {
+			redo.segments = redo.segments[1:]
+			removed = append(removed, seg)
+		}
+	}
+	redo.lock.Unlock()
+
+	for _, seg := range removed {
+		seg.file.Close()
+		if err := vfs.Remove(seg.file.Name()); err != nil {
+			log.Errorf("remove redo log segment %s failed: %v", seg.file.Name(), err)
+		}
+	}
+	return archiveErr
+}
+
+// 将 size 字节的段复制到 dir 中，文件名不变
+func archiveSegment(dir string, seg *segment, size int64) error {
+	raw := make([]byte, size)
+	if _, err := seg.file.ReadAt(raw, 0); err != nil {
+		return err
+	}
+	name := segmentFileName(dir, seg.startLSN)
+	file, err := vfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(raw, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// 保留 LSN 之后的日志直到 Release，备份时调用
+func (redo *Redo) Hold(LSN int64) {
 	redo.lock.Lock()
 	defer redo.lock.Unlock()
-	redo.redoFile.Seek(beginLSN, 0)
-	for {
-		// log, err := redolog.Read(redo.redoFile)
-		// if err != nil {
-		// 	if err == io.EOF {
-		// 		break
-		// 	}
-		// 	log.Printf("read redo log failed: %v", err)
-		// 	break
-		// }
-		// redo.LSN = log.LSN()
-		// redo.apply(log)
+	redo.heldLSN = LSN
+}
+
+func (redo *Redo) Release() {
+	redo.lock.Lock()
+	defer redo.lock.Unlock()
+	redo.heldLSN = -1
+}
+
+// 将 beginLSN 到 endLSN 之间的日志所在的段复制到 dir 中，最后一个段只复制到 endLSN，
+// 调用者需要保证 endLSN 之前的日志已经落盘，并且这些段不会被 Truncate 删除
+func (redo *Redo) CopyTo(dir string, beginLSN int64, endLSN int64) error {
+	redo.lock.Lock()
+	segments := append([]*segment(nil), redo.segments...)
+	flushedLSN := redo.flushedLSN
+	redo.lock.Unlock()
+	if beginLSN < segments[0].startLSN || endLSN > flushedLSN {
+		return fmt.Errorf("%w: log from %d to %d is not available", ErrLogCorrupted, beginLSN, endLSN)
+	}
+	for i, seg := range segments {
+		if seg.startLSN > endLSN {
+			break
+		}
+		if i+1 < len(segments) && segments[i+1].startLSN <= beginLSN {
+			continue
+		}
+		size := endLSN - seg.startLSN
+		if i+1 < len(segments) && segments[i+1].startLSN-seg.startLSN < size {
+			size = segments[i+1].startLSN - seg.startLSN
+		}
+		raw := make([]byte, size)
+		if _, err := seg.file.ReadAt(raw, 0); err != nil {
+			return err
+		}
+		name := segmentFileName(dir, seg.startLSN)
+		file, err := vfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteAt(raw, 0)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func (redo *Redo) removeSegment(i int) {
+	seg := redo.segments[i]
+	seg.file.Close()
+	if err := vfs.Remove(seg.file.Name()); err != nil {
+		log.Errorf("remove redo log segment %s failed: %v", seg.file.Name(), err)
+	}
+	redo.segments = append(redo.segments[:i], redo.segments[i+1:]...)
 }
 
 func (redo *Redo) Close() {
-	redo.redoFile.Close()
+	redo.Flush(redo.CurrentLSN())
+	redo.closeSegments()
+}
+
+func (redo *Redo) closeSegments() {
+	for _, seg := range redo.segments {
+		seg.file.Close()
+	}
 }
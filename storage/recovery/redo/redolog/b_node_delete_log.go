@@ -0,0 +1,88 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/util"
+)
+
+type BNodeDeleteKVLog struct {
+	lsn      int64
+	tableId  uint16
+	columnId uint16
+	pageNum  util.UUID
+	key      []byte
+	value    []byte
+}
+
+func NewBNodeDeleteKVLog(tableId uint16, columnId uint16, pageNum util.UUID,
+	key []byte, value []byte) *BNodeDeleteKVLog {
+
+	return &BNodeDeleteKVLog{
+		lsn:      -1,
+		tableId:  tableId,
+		columnId: columnId,
+		pageNum:  pageNum,
+		key:      key,
+		value:    value,
+	}
+}
+
+func (log *BNodeDeleteKVLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *BNodeDeleteKVLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *BNodeDeleteKVLog) TableId() uint16 {
+	return log.tableId
+}
+
+func (log *BNodeDeleteKVLog) ColumnId() uint16 {
+	return log.columnId
+}
+
+func (log *BNodeDeleteKVLog) PageNum() util.UUID {
+	return log.pageNum
+}
+
+func (log *BNodeDeleteKVLog) Key() []byte {
+	return log.key
+}
+
+func (log *BNodeDeleteKVLog) Value() []byte {
+	return log.value
+}
+
+func (log *BNodeDeleteKVLog) Type() LogType {
+	return B_NODE_DELETE_KV
+}
+
+// 编码 B_NODE_DELETE_KV 日志
+func (log *BNodeDeleteKVLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.tableId)
+	binary.Write(buf, binary.BigEndian, log.columnId)
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	writeBytes(buf, log.key)
+	writeBytes(buf, log.value)
+	return buf.Bytes()
+}
+
+func (log *BNodeDeleteKVLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.tableId)
+	binary.Read(r, binary.BigEndian, &log.columnId)
+	err := binary.Read(r, binary.BigEndian, &log.pageNum)
+	if err != nil {
+		return err
+	}
+	if log.key, err = readBytes(r); err != nil {
+		return err
+	}
+	log.value, err = readBytes(r)
+	return err
+}
@@ -3,7 +3,6 @@ package redolog
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"io"
 	"minidb-go/util"
 )
@@ -66,10 +65,24 @@ func (log *BNodeInsertKVLog) Type() LogType {
 func (log *BNodeInsertKVLog) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, log.Type())
-	gob.NewEncoder(buf).Encode(log)
+	binary.Write(buf, binary.BigEndian, log.tableId)
+	binary.Write(buf, binary.BigEndian, log.columnId)
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	writeBytes(buf, log.key)
+	writeBytes(buf, log.value)
 	return buf.Bytes()
 }
 
-func (log *BNodeInsertKVLog) Decode(r io.Reader) {
-	gob.NewDecoder(r).Decode(log)
+func (log *BNodeInsertKVLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.tableId)
+	binary.Read(r, binary.BigEndian, &log.columnId)
+	err := binary.Read(r, binary.BigEndian, &log.pageNum)
+	if err != nil {
+		return err
+	}
+	if log.key, err = readBytes(r); err != nil {
+		return err
+	}
+	log.value, err = readBytes(r)
+	return err
 }
@@ -3,21 +3,33 @@ package redolog
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"io"
 	"minidb-go/util"
 )
 
+/*
+节点分裂的日志，保存分裂时移动到新节点的 key 和 value，
+新节点可以只根据日志恢复，不依赖原节点在磁盘上的状态。
+*/
 type BNodeSplitLog struct {
 	lsn         int64
 	tableId     uint16
 	columnId    uint16
 	pageNum     util.UUID
 	nextPageNum util.UUID
+	// 根节点分裂时新建的根节点，否则为 NIL_PAGE_NUM
+	rootPageNum util.UUID
+	// 分裂前节点的下一个叶子节点
+	nextLeaf util.UUID
+	isLeaf   bool
+
+	keys   [][]byte
+	values [][]byte
 }
 
 func NewBNodeSplitLog(tableId uint16, columnId uint16, pageNum util.UUID,
-	nextPageNum util.UUID) *BNodeSplitLog {
+	nextPageNum util.UUID, rootPageNum util.UUID, nextLeaf util.UUID,
+	isLeaf bool, keys [][]byte, values [][]byte) *BNodeSplitLog {
 
 	return &BNodeSplitLog{
 		lsn:         -1,
@@ -25,6 +37,11 @@ func NewBNodeSplitLog(tableId uint16, columnId uint16, pageNum util.UUID,
 		columnId:    columnId,
 		pageNum:     pageNum,
 		nextPageNum: nextPageNum,
+		rootPageNum: rootPageNum,
+		nextLeaf:    nextLeaf,
+		isLeaf:      isLeaf,
+		keys:        keys,
+		values:      values,
 	}
 }
 
@@ -52,6 +69,28 @@ func (log *BNodeSplitLog) NextPageNum() util.UUID {
 	return log.nextPageNum
 }
 
+func (log *BNodeSplitLog) RootPageNum() util.UUID {
+	return log.rootPageNum
+}
+
+func (log *BNodeSplitLog) NextLeaf() util.UUID {
+	return log.nextLeaf
+}
+
+func (log *BNodeSplitLog) IsLeaf() bool {
+	return log.isLeaf
+}
+
+// 移动到新节点的 key，非叶子节点中不包括上升到父节点的 key
+func (log *BNodeSplitLog) Keys() [][]byte {
+	return log.keys
+}
+
+// 移动到新节点的 value，非叶子节点比 keys 多一个
+func (log *BNodeSplitLog) Values() [][]byte {
+	return log.values
+}
+
 func (log *BNodeSplitLog) Type() LogType {
 	return B_NODE_SPLIT
 }
@@ -59,10 +98,52 @@ func (log *BNodeSplitLog) Type() LogType {
 func (log *BNodeSplitLog) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, log.Type())
-	gob.NewEncoder(buf).Encode(log)
+	binary.Write(buf, binary.BigEndian, log.tableId)
+	binary.Write(buf, binary.BigEndian, log.columnId)
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	binary.Write(buf, binary.BigEndian, log.nextPageNum)
+	binary.Write(buf, binary.BigEndian, log.rootPageNum)
+	binary.Write(buf, binary.BigEndian, log.nextLeaf)
+	binary.Write(buf, binary.BigEndian, log.isLeaf)
+	binary.Write(buf, binary.BigEndian, uint16(len(log.keys)))
+	for _, key := range log.keys {
+		writeBytes(buf, key)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(log.values)))
+	for _, value := range log.values {
+		writeBytes(buf, value)
+	}
 	return buf.Bytes()
 }
 
-func (log *BNodeSplitLog) Decode(r io.Reader) {
-	gob.NewDecoder(r).Decode(log)
+func (log *BNodeSplitLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.tableId)
+	binary.Read(r, binary.BigEndian, &log.columnId)
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	binary.Read(r, binary.BigEndian, &log.nextPageNum)
+	binary.Read(r, binary.BigEndian, &log.rootPageNum)
+	binary.Read(r, binary.BigEndian, &log.nextLeaf)
+	binary.Read(r, binary.BigEndian, &log.isLeaf)
+	var err error
+	if log.keys, err = readBytesList(r); err != nil {
+		return err
+	}
+	log.values, err = readBytesList(r)
+	return err
+}
+
+func readBytesList(r io.Reader) ([][]byte, error) {
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	list := make([][]byte, count)
+	for i := range list {
+		b, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = b
+	}
+	return list, nil
 }
@@ -0,0 +1,61 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/serialization/tm"
+	"time"
+)
+
+/*
+事务提交时写入的日志，不修改任何页。
+异常退出后事务的状态以 XID 文件为准，
+按时间点恢复时根据提交日志确定恢复目标之前提交的事务。
+*/
+type CommitLog struct {
+	lsn  int64
+	xid  tm.XID
+	time int64
+}
+
+func NewCommitLog(xid tm.XID, commitTime time.Time) *CommitLog {
+	return &CommitLog{
+		lsn:  -1,
+		xid:  xid,
+		time: commitTime.UnixNano(),
+	}
+}
+
+func (log *CommitLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *CommitLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *CommitLog) Xid() tm.XID {
+	return log.xid
+}
+
+func (log *CommitLog) Time() time.Time {
+	return time.Unix(0, log.time)
+}
+
+func (log *CommitLog) Type() LogType {
+	return COMMIT
+}
+
+func (log *CommitLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.xid)
+	binary.Write(buf, binary.BigEndian, log.time)
+	return buf.Bytes()
+}
+
+func (log *CommitLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.xid)
+	return binary.Read(r, binary.BigEndian, &log.time)
+}
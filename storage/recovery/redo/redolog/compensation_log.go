@@ -0,0 +1,90 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/serialization/tm"
+)
+
+/*
+补偿日志 (CLR)，回滚事务时每撤销一条日志写入一条补偿日志。
+补偿日志只重做不撤销，恢复时被补偿的日志不会再次被撤销，
+因此回滚到一半时异常退出，重启后可以从中断的位置继续回滚。
+action 为撤销时对数据页的修改，撤销索引插入时为 nil，
+索引的修改由 B+ 树自己的日志记录。
+*/
+type CompensationLog struct {
+	lsn int64
+	xid tm.XID
+	// 被撤销的日志的 LSN
+	undoneLSN int64
+	action    Log
+}
+
+func NewCompensationLog(xid tm.XID, undoneLSN int64, action Log) *CompensationLog {
+	return &CompensationLog{
+		lsn:       -1,
+		xid:       xid,
+		undoneLSN: undoneLSN,
+		action:    action,
+	}
+}
+
+func (log *CompensationLog) LSN() int64 {
+	return log.lsn
+}
+
+// action 和补偿日志共用一个 LSN
+func (log *CompensationLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+	if log.action != nil {
+		log.action.SetLSN(LSN)
+	}
+}
+
+func (log *CompensationLog) Xid() tm.XID {
+	return log.xid
+}
+
+func (log *CompensationLog) UndoneLSN() int64 {
+	return log.undoneLSN
+}
+
+func (log *CompensationLog) Action() Log {
+	return log.action
+}
+
+func (log *CompensationLog) Type() LogType {
+	return COMPENSATION
+}
+
+func (log *CompensationLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.xid)
+	binary.Write(buf, binary.BigEndian, log.undoneLSN)
+	binary.Write(buf, binary.BigEndian, log.action != nil)
+	if log.action != nil {
+		buf.Write(log.action.Bytes())
+	}
+	return buf.Bytes()
+}
+
+func (log *CompensationLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.xid)
+	binary.Read(r, binary.BigEndian, &log.undoneLSN)
+	var hasAction bool
+	if err := binary.Read(r, binary.BigEndian, &hasAction); err != nil {
+		return err
+	}
+	if !hasAction {
+		return nil
+	}
+	action, err := ReadLog(r)
+	if err != nil {
+		return err
+	}
+	log.action = action
+	return nil
+}
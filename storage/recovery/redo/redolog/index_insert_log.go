@@ -0,0 +1,99 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/serialization/tm"
+	"minidb-go/util"
+)
+
+/*
+事务向索引中插入 key-value 对，只用于撤销，不修改任何页。
+节点中的修改由 BNodeInsertKVLog 记录，分裂后 key 可能被移动到其他节点，
+所以撤销时在整棵树中删除该 key-value 对。
+*/
+type IndexInsertLog struct {
+	lsn      int64
+	xid      tm.XID
+	tableId  uint16
+	columnId uint16
+	// 被插入的数据行所在的数据页
+	pageNum util.UUID
+	key     []byte
+	value   []byte
+}
+
+func NewIndexInsertLog(xid tm.XID, tableId uint16, columnId uint16,
+	pageNum util.UUID, key []byte, value []byte) *IndexInsertLog {
+	return &IndexInsertLog{
+		lsn:      -1,
+		xid:      xid,
+		tableId:  tableId,
+		columnId: columnId,
+		pageNum:  pageNum,
+		key:      key,
+		value:    value,
+	}
+}
+
+func (log *IndexInsertLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *IndexInsertLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *IndexInsertLog) Xid() tm.XID {
+	return log.xid
+}
+
+func (log *IndexInsertLog) TableId() uint16 {
+	return log.tableId
+}
+
+func (log *IndexInsertLog) ColumnId() uint16 {
+	return log.columnId
+}
+
+func (log *IndexInsertLog) PageNum() util.UUID {
+	return log.pageNum
+}
+
+func (log *IndexInsertLog) Key() []byte {
+	return log.key
+}
+
+func (log *IndexInsertLog) Value() []byte {
+	return log.value
+}
+
+func (log *IndexInsertLog) Type() LogType {
+	return INDEX_INSERT
+}
+
+func (log *IndexInsertLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.xid)
+	binary.Write(buf, binary.BigEndian, log.tableId)
+	binary.Write(buf, binary.BigEndian, log.columnId)
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	writeBytes(buf, log.key)
+	writeBytes(buf, log.value)
+	return buf.Bytes()
+}
+
+func (log *IndexInsertLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.xid)
+	binary.Read(r, binary.BigEndian, &log.tableId)
+	binary.Read(r, binary.BigEndian, &log.columnId)
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	var err error
+	if log.key, err = readBytes(r); err != nil {
+		return err
+	}
+	log.value, err = readBytes(r)
+	return err
+}
@@ -3,7 +3,9 @@ package redolog
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"minidb-go/serialization/tm"
 )
 
 type LogType uint8
@@ -13,16 +15,52 @@ const (
 	B_NODE_SPLIT
 
 	RECORD_PAGE_APPEND
+
+	B_NODE_DELETE_KV
+
+	RECORD_PAGE_REMOVE
+	RECORD_SET_XMAX
+	INDEX_INSERT
+	COMPENSATION
+	RECORD_PAGE_COMPACT
+	COMMIT
 )
 
 var ErrUnknownLogType = errors.New("unknown log type")
 
+var logTypeNames = map[LogType]string{
+	B_NODE_INSERT_KV:    "B_NODE_INSERT_KV",
+	B_NODE_SPLIT:        "B_NODE_SPLIT",
+	RECORD_PAGE_APPEND:  "RECORD_PAGE_APPEND",
+	B_NODE_DELETE_KV:    "B_NODE_DELETE_KV",
+	RECORD_PAGE_REMOVE:  "RECORD_PAGE_REMOVE",
+	RECORD_SET_XMAX:     "RECORD_SET_XMAX",
+	INDEX_INSERT:        "INDEX_INSERT",
+	COMPENSATION:        "COMPENSATION",
+	RECORD_PAGE_COMPACT: "RECORD_PAGE_COMPACT",
+	COMMIT:              "COMMIT",
+}
+
+func (t LogType) String() string {
+	if name, ok := logTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogType(%d)", uint8(t))
+}
+
+// LSN 为日志在 redo log 文件中结束的位置，页的 LSN 为修改该页的最后一条日志的 LSN
 type Log interface {
 	LSN() int64
 	SetLSN(int64)
 	Type() LogType
 	Bytes() []byte
-	Decode(r io.Reader)
+	Decode(r io.Reader) error
+}
+
+// 事务对数据的修改，事务撤销时需要按相反的顺序回滚
+type UndoLog interface {
+	Log
+	Xid() tm.XID
 }
 
 func ReadLog(r io.Reader) (Log, error) {
@@ -39,9 +77,47 @@ func ReadLog(r io.Reader) (Log, error) {
 		log = &BNodeSplitLog{}
 	case RECORD_PAGE_APPEND:
 		log = &RecordPageAppendLog{}
+	case B_NODE_DELETE_KV:
+		log = &BNodeDeleteKVLog{}
+	case RECORD_PAGE_REMOVE:
+		log = &RecordPageRemoveLog{}
+	case RECORD_SET_XMAX:
+		log = &RecordSetXmaxLog{}
+	case INDEX_INSERT:
+		log = &IndexInsertLog{}
+	case COMPENSATION:
+		log = &CompensationLog{}
+	case RECORD_PAGE_COMPACT:
+		log = &RecordPageCompactLog{}
+	case COMMIT:
+		log = &CommitLog{}
 	default:
 		return nil, ErrUnknownLogType
 	}
-	log.Decode(r)
+	if err := log.Decode(r); err != nil {
+		// 日志写到一半时异常退出，读到的是不完整的日志
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
 	return log, nil
 }
+
+// 变长的字节数组以 uint16 的长度开头
+func writeBytes(w io.Writer, b []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(b)))
+	w.Write(b)
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
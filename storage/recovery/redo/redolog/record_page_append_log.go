@@ -3,22 +3,29 @@ package redolog
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"io"
 	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
 	"minidb-go/util"
 )
 
 type RecordPageAppendLog struct {
 	lsn     int64
+	tableId uint16
 	pageNum util.UUID
-	row     *ast.Row
+	// 数据页是新分配的页时为表的上一个数据页，否则为 NIL_PAGE_NUM
+	prevPageNum util.UUID
+	row         *ast.Row
 }
 
-func NewRecordPageAppendLog(pageNum util.UUID, row *ast.Row) *RecordPageAppendLog {
+func NewRecordPageAppendLog(tableId uint16, pageNum util.UUID, prevPageNum util.UUID,
+	row *ast.Row) *RecordPageAppendLog {
 	return &RecordPageAppendLog{
-		pageNum: pageNum,
-		row:     row,
+		lsn:         -1,
+		tableId:     tableId,
+		pageNum:     pageNum,
+		prevPageNum: prevPageNum,
+		row:         row,
 	}
 }
 
@@ -30,6 +37,14 @@ func (log *RecordPageAppendLog) SetLSN(LSN int64) {
 	log.lsn = LSN
 }
 
+func (log *RecordPageAppendLog) TableId() uint16 {
+	return log.tableId
+}
+
+func (log *RecordPageAppendLog) PrevPageNum() util.UUID {
+	return log.prevPageNum
+}
+
 func (log *RecordPageAppendLog) PageNum() util.UUID {
 	return log.pageNum
 }
@@ -38,6 +53,12 @@ func (log *RecordPageAppendLog) Row() *ast.Row {
 	return log.row
 }
 
+// 插入数据行的事务
+func (log *RecordPageAppendLog) Xid() tm.XID {
+	xmin, _ := log.row.Xmin()
+	return xmin
+}
+
 func (log *RecordPageAppendLog) Type() LogType {
 	return RECORD_PAGE_APPEND
 }
@@ -45,10 +66,20 @@ func (log *RecordPageAppendLog) Type() LogType {
 func (log *RecordPageAppendLog) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, log.Type())
-	gob.NewEncoder(buf).Encode(log)
+	binary.Write(buf, binary.BigEndian, log.tableId)
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	binary.Write(buf, binary.BigEndian, log.prevPageNum)
+	buf.Write(log.row.Encode())
 	return buf.Bytes()
 }
 
-func (log *RecordPageAppendLog) Decode(r io.Reader) {
-	gob.NewDecoder(r).Decode(log)
+func (log *RecordPageAppendLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.tableId)
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	err := binary.Read(r, binary.BigEndian, &log.prevPageNum)
+	if err != nil {
+		return err
+	}
+	log.row = new(ast.Row)
+	return log.row.Decode(r)
 }
@@ -0,0 +1,66 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/util"
+)
+
+/*
+vacuum 删除数据页中的行并整理数据页，整理不会改变剩余的行的 offset。
+被删除的行由 offset 确定，重放时页的内容与写入日志时相同。
+*/
+type RecordPageCompactLog struct {
+	lsn     int64
+	pageNum util.UUID
+	offsets []int64
+}
+
+func NewRecordPageCompactLog(pageNum util.UUID, offsets []int64) *RecordPageCompactLog {
+	return &RecordPageCompactLog{
+		lsn:     -1,
+		pageNum: pageNum,
+		offsets: offsets,
+	}
+}
+
+func (log *RecordPageCompactLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *RecordPageCompactLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *RecordPageCompactLog) PageNum() util.UUID {
+	return log.pageNum
+}
+
+// 被删除的行的 offset
+func (log *RecordPageCompactLog) Offsets() []int64 {
+	return log.offsets
+}
+
+func (log *RecordPageCompactLog) Type() LogType {
+	return RECORD_PAGE_COMPACT
+}
+
+func (log *RecordPageCompactLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	binary.Write(buf, binary.BigEndian, uint16(len(log.offsets)))
+	binary.Write(buf, binary.BigEndian, log.offsets)
+	return buf.Bytes()
+}
+
+func (log *RecordPageCompactLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	log.offsets = make([]int64, count)
+	return binary.Read(r, binary.BigEndian, log.offsets)
+}
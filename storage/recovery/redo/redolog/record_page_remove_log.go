@@ -0,0 +1,81 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/serialization/tm"
+	"minidb-go/util"
+)
+
+/*
+从数据页中删除一行，只在撤销插入时使用。
+数据行由主键和 xmin 确定，offset 只用于区分同一事务插入的主键相同的行，
+vacuum 整理数据页后行的 offset 会改变。
+*/
+type RecordPageRemoveLog struct {
+	lsn     int64
+	pageNum util.UUID
+	offset  int64
+	key     []byte
+	xmin    tm.XID
+}
+
+func NewRecordPageRemoveLog(pageNum util.UUID, offset int64, key []byte,
+	xmin tm.XID) *RecordPageRemoveLog {
+	return &RecordPageRemoveLog{
+		lsn:     -1,
+		pageNum: pageNum,
+		offset:  offset,
+		key:     key,
+		xmin:    xmin,
+	}
+}
+
+func (log *RecordPageRemoveLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *RecordPageRemoveLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *RecordPageRemoveLog) PageNum() util.UUID {
+	return log.pageNum
+}
+
+func (log *RecordPageRemoveLog) Offset() int64 {
+	return log.offset
+}
+
+func (log *RecordPageRemoveLog) Key() []byte {
+	return log.key
+}
+
+func (log *RecordPageRemoveLog) Xmin() tm.XID {
+	return log.xmin
+}
+
+func (log *RecordPageRemoveLog) Type() LogType {
+	return RECORD_PAGE_REMOVE
+}
+
+func (log *RecordPageRemoveLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	binary.Write(buf, binary.BigEndian, log.offset)
+	writeBytes(buf, log.key)
+	binary.Write(buf, binary.BigEndian, log.xmin)
+	return buf.Bytes()
+}
+
+func (log *RecordPageRemoveLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	binary.Read(r, binary.BigEndian, &log.offset)
+	var err error
+	if log.key, err = readBytes(r); err != nil {
+		return err
+	}
+	return binary.Read(r, binary.BigEndian, &log.xmin)
+}
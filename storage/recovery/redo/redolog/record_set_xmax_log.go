@@ -0,0 +1,98 @@
+package redolog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"minidb-go/serialization/tm"
+	"minidb-go/util"
+)
+
+// 修改数据行的 xmax，数据行的定位方式和 RecordPageRemoveLog 相同
+type RecordSetXmaxLog struct {
+	lsn     int64
+	pageNum util.UUID
+	offset  int64
+	key     []byte
+	xmin    tm.XID
+	oldXmax tm.XID
+	newXmax tm.XID
+}
+
+func NewRecordSetXmaxLog(pageNum util.UUID, offset int64, key []byte,
+	xmin tm.XID, oldXmax tm.XID, newXmax tm.XID) *RecordSetXmaxLog {
+	return &RecordSetXmaxLog{
+		lsn:     -1,
+		pageNum: pageNum,
+		offset:  offset,
+		key:     key,
+		xmin:    xmin,
+		oldXmax: oldXmax,
+		newXmax: newXmax,
+	}
+}
+
+func (log *RecordSetXmaxLog) LSN() int64 {
+	return log.lsn
+}
+
+func (log *RecordSetXmaxLog) SetLSN(LSN int64) {
+	log.lsn = LSN
+}
+
+func (log *RecordSetXmaxLog) PageNum() util.UUID {
+	return log.pageNum
+}
+
+func (log *RecordSetXmaxLog) Offset() int64 {
+	return log.offset
+}
+
+func (log *RecordSetXmaxLog) Key() []byte {
+	return log.key
+}
+
+func (log *RecordSetXmaxLog) Xmin() tm.XID {
+	return log.xmin
+}
+
+func (log *RecordSetXmaxLog) OldXmax() tm.XID {
+	return log.oldXmax
+}
+
+func (log *RecordSetXmaxLog) NewXmax() tm.XID {
+	return log.newXmax
+}
+
+// 删除数据行的事务
+func (log *RecordSetXmaxLog) Xid() tm.XID {
+	return log.newXmax
+}
+
+func (log *RecordSetXmaxLog) Type() LogType {
+	return RECORD_SET_XMAX
+}
+
+func (log *RecordSetXmaxLog) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, log.Type())
+	binary.Write(buf, binary.BigEndian, log.pageNum)
+	binary.Write(buf, binary.BigEndian, log.offset)
+	writeBytes(buf, log.key)
+	binary.Write(buf, binary.BigEndian, log.xmin)
+	binary.Write(buf, binary.BigEndian, log.oldXmax)
+	binary.Write(buf, binary.BigEndian, log.newXmax)
+	return buf.Bytes()
+}
+
+func (log *RecordSetXmaxLog) Decode(r io.Reader) error {
+	binary.Read(r, binary.BigEndian, &log.pageNum)
+	binary.Read(r, binary.BigEndian, &log.offset)
+	var err error
+	if log.key, err = readBytes(r); err != nil {
+		return err
+	}
+	binary.Read(r, binary.BigEndian, &log.xmin)
+	binary.Read(r, binary.BigEndian, &log.oldXmax)
+	return binary.Read(r, binary.BigEndian, &log.newXmax)
+}
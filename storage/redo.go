@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"fmt"
+	"minidb-go/storage/bplustree"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/redo/redolog"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 从 meta page 中解码出来的索引没有 pager，需要在使用之前设置
+func (dm *DataManager) attachIndexes() {
+	for _, tableInfo := range dm.pager.GetMetaData().Tables {
+		for _, columnDefine := range tableInfo.ColumnDefines {
+			if tree, ok := columnDefine.Index.(*bplustree.BPlusTree); ok {
+				tree.SetPager(dm.pager)
+			}
+		}
+	}
+}
+
+func (dm *DataManager) getTableInfoById(tableId uint16) *pagedata.TableInfo {
+	for _, tableInfo := range dm.pager.GetMetaData().Tables {
+		if tableInfo.TableId == tableId {
+			return tableInfo
+		}
+	}
+	return nil
+}
+
+func (dm *DataManager) getTree(tableId uint16, columnId uint16) *bplustree.BPlusTree {
+	tableInfo := dm.getTableInfoById(tableId)
+	if tableInfo == nil || int(columnId) >= len(tableInfo.ColumnDefines) {
+		return nil
+	}
+	tree, _ := tableInfo.ColumnDefines[columnId].Index.(*bplustree.BPlusTree)
+	return tree
+}
+
+// 重放一条 redo log，页的 LSN 不小于日志的 LSN 时说明修改已经写入磁盘，跳过该日志
+func (dm *DataManager) redo(l redolog.Log) error {
+	// 提交日志不修改页，XID 文件中的状态可能没有落盘，由调用者根据 CommittedTransactions 补全
+	if commitLog, ok := l.(*redolog.CommitLog); ok {
+		dm.DiscardUndo(commitLog.Xid())
+		dm.committed = append(dm.committed, commitLog.Xid())
+		return nil
+	}
+	// 收集未结束的事务的日志，恢复结束后回滚未提交的事务
+	if undoLog, ok := l.(redolog.UndoLog); ok {
+		dm.pushUndo(undoLog)
+	}
+	switch l := l.(type) {
+	case *redolog.RecordPageAppendLog:
+		return dm.redoRecordPageAppend(l)
+	case *redolog.RecordSetXmaxLog:
+		return dm.redoRecordPage(l.PageNum(), l.LSN(), func(recordData *pagedata.RecordData) {
+			applyRecordSetXmax(recordData, l)
+		})
+	case *redolog.RecordPageCompactLog:
+		return dm.redoRecordPage(l.PageNum(), l.LSN(), func(recordData *pagedata.RecordData) {
+			applyRecordPageCompact(recordData, l)
+		})
+	case *redolog.IndexInsertLog:
+		return nil
+	case *redolog.CompensationLog:
+		return dm.redoCompensation(l)
+	case *redolog.BNodeInsertKVLog:
+		if tree := dm.getTree(l.TableId(), l.ColumnId()); tree != nil {
+			return tree.RecoverInsertKV(l)
+		}
+	case *redolog.BNodeDeleteKVLog:
+		if tree := dm.getTree(l.TableId(), l.ColumnId()); tree != nil {
+			return tree.RecoverDeleteKV(l)
+		}
+	case *redolog.BNodeSplitLog:
+		if tree := dm.getTree(l.TableId(), l.ColumnId()); tree != nil {
+			return tree.RecoverSplitNode(l)
+		}
+	default:
+		return fmt.Errorf("unknown redo log type: %v", l.Type())
+	}
+	// 建表之前异常退出，表的元数据没有写入磁盘
+	log.Warnf("skip redo log %d of unknown table", l.LSN())
+	return nil
+}
+
+func (dm *DataManager) redoRecordPageAppend(l *redolog.RecordPageAppendLog) error {
+	tableInfo := dm.getTableInfoById(l.TableId())
+	if tableInfo == nil {
+		log.Warnf("skip redo log %d of unknown table", l.LSN())
+		return nil
+	}
+	page, err := dm.pager.GetPage(l.PageNum(), pagedata.NewRecordData())
+	if err != nil {
+		return err
+	}
+	applied := page.LSN() >= l.LSN()
+	if !applied {
+		// 从备份恢复时页可能是重新创建的
+		page.SetCompressible(tableInfo.Compressed)
+		page.Data().(*pagedata.RecordData).Append(l.Row())
+		page.SetLSN(l.LSN())
+		page.SetPrevPageNum(l.PrevPageNum())
+	}
+	dm.pager.Unpin(page, !applied)
+
+	// 新分配的数据页在写入日志之前已经写入磁盘，但是上一个数据页和 meta page 中的链接可能丢失
+	prevPageNum := l.PrevPageNum()
+	if prevPageNum == pager.NIL_PAGE_NUM {
+		return nil
+	}
+	prevPage, err := dm.pager.GetPage(prevPageNum, pagedata.NewRecordData())
+	if err != nil {
+		return err
+	}
+	linked := prevPage.NextPageNum() == l.PageNum()
+	if !linked {
+		prevPage.SetNextPageNum(l.PageNum())
+	}
+	dm.pager.Unpin(prevPage, !linked)
+	if tableInfo.LastPageNum == prevPageNum {
+		tableInfo.SetLastPageNum(l.PageNum())
+		dm.pager.MarkDirty(dm.pager.MetaPage())
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/index"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+每个未结束的事务按顺序保存自己写入的可撤销日志，事务撤销时按相反的顺序回滚，
+每回滚一条日志写入一条补偿日志。
+异常退出后重放 redo log 时重新收集这些日志，被补偿日志撤销过的日志不再收集，
+未提交的事务由 Serializer 打开时回滚。
+*/
+
+type undoChain struct {
+	// 事务的第一条日志之前的 LSN，恢复时需要从这里开始重放才能收集到事务的所有日志
+	beginLSN int64
+	logs     []redolog.UndoLog
+}
+
+// 在事务写入第一条日志之前调用，记录事务开始写日志的位置
+func (dm *DataManager) beginUndo(xid tm.XID) {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	if _, ok := dm.undoLogs[xid]; !ok {
+		dm.undoLogs[xid] = &undoChain{beginLSN: dm.recovery.CurrentLSN()}
+	}
+}
+
+// 重放日志时没有调用 beginUndo，恢复结束之前不会进行 checkpoint，beginLSN 为 0
+func (dm *DataManager) pushUndo(l redolog.UndoLog) {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	chain, ok := dm.undoLogs[l.Xid()]
+	if !ok {
+		chain = &undoChain{}
+		dm.undoLogs[l.Xid()] = chain
+	}
+	chain.logs = append(chain.logs, l)
+}
+
+// 未结束的事务中最早开始写日志的位置，没有未结束的事务时返回 LSN
+func (dm *DataManager) oldestUndoLSN(LSN int64) int64 {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	for _, chain := range dm.undoLogs {
+		if chain.beginLSN < LSN {
+			LSN = chain.beginLSN
+		}
+	}
+	return LSN
+}
+
+// 重放补偿日志时，删除已经被撤销的日志
+func (dm *DataManager) popUndo(xid tm.XID, undoneLSN int64) {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	chain, ok := dm.undoLogs[xid]
+	if !ok {
+		return
+	}
+	for i := len(chain.logs) - 1; i >= 0; i-- {
+		if chain.logs[i].LSN() == undoneLSN {
+			chain.logs = append(chain.logs[:i], chain.logs[i+1:]...)
+			return
+		}
+	}
+}
+
+// 事务提交后不再需要撤销
+func (dm *DataManager) DiscardUndo(xid tm.XID) {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	delete(dm.undoLogs, xid)
+}
+
+// 返回有未撤销日志的事务，异常退出后其中未提交的事务需要回滚
+func (dm *DataManager) PendingTransactions() []tm.XID {
+	dm.undoLock.Lock()
+	defer dm.undoLock.Unlock()
+	xids := make([]tm.XID, 0, len(dm.undoLogs))
+	for xid := range dm.undoLogs {
+		xids = append(xids, xid)
+	}
+	sort.Slice(xids, func(i, j int) bool { return xids[i] > xids[j] })
+	return xids
+}
+
+// 返回重放日志时遇到提交日志的事务，异常退出时它们在 XID 文件中的状态可能还没有落盘
+func (dm *DataManager) CommittedTransactions() []tm.XID {
+	return dm.committed
+}
+
+// 回滚事务对数据页和索引的修改
+func (dm *DataManager) Rollback(xid tm.XID) {
+	dm.undoLock.Lock()
+	chain, ok := dm.undoLogs[xid]
+	dm.undoLock.Unlock()
+	if !ok {
+		return
+	}
+	// 回滚结束之前的 checkpoint 仍然需要保留事务的日志
+	defer dm.DiscardUndo(xid)
+	logs := chain.logs
+
+	// 回滚时不允许插入和 vacuum，保证判断索引项是否仍被引用时数据页不会变化
+	dm.vacuumLock.Lock()
+	defer dm.vacuumLock.Unlock()
+	for i := len(logs) - 1; i >= 0; i-- {
+		switch l := logs[i].(type) {
+		case *redolog.RecordPageAppendLog:
+			dm.undoRecordPageAppend(xid, l)
+		case *redolog.RecordSetXmaxLog:
+			dm.undoRecordSetXmax(xid, l)
+		case *redolog.IndexInsertLog:
+			dm.undoIndexInsert(xid, l)
+		}
+	}
+}
+
+// 回滚不能跳过任何一条日志，数据页无法读取时只能退出
+func (dm *DataManager) mustGetRecordPage(pageNum util.UUID) *pager.Page {
+	page, err := dm.getRecordPage(pageNum)
+	if err != nil {
+		log.Panicf("rollback failed: %v", err)
+	}
+	return page
+}
+
+func (dm *DataManager) undoRecordPageAppend(xid tm.XID, l *redolog.RecordPageAppendLog) {
+	row := l.Row()
+	action := redolog.NewRecordPageRemoveLog(l.PageNum(), row.Offset, row.Data[0].Raw(), xid)
+	page := dm.mustGetRecordPage(l.PageNum())
+	page.Lock()
+	applyRecordPageRemove(page.Data().(*pagedata.RecordData), action)
+	dm.pager.AppendLog(redolog.NewCompensationLog(xid, l.LSN(), action), page)
+	page.Unlock()
+	dm.pager.Unpin(page, true)
+}
+
+func (dm *DataManager) undoRecordSetXmax(xid tm.XID, l *redolog.RecordSetXmaxLog) {
+	action := redolog.NewRecordSetXmaxLog(l.PageNum(), l.Offset(), l.Key(),
+		l.Xmin(), l.NewXmax(), l.OldXmax())
+	page := dm.mustGetRecordPage(l.PageNum())
+	page.Lock()
+	applyRecordSetXmax(page.Data().(*pagedata.RecordData), action)
+	dm.pager.AppendLog(redolog.NewCompensationLog(xid, l.LSN(), action), page)
+	page.Unlock()
+	dm.pager.Unpin(page, true)
+}
+
+func (dm *DataManager) undoIndexInsert(xid tm.XID, l *redolog.IndexInsertLog) {
+	tableInfo := dm.getTableInfoById(l.TableId())
+	if tableInfo != nil && int(l.ColumnId()) < len(tableInfo.ColumnDefines) {
+		columnIndex := tableInfo.ColumnDefines[l.ColumnId()].Index
+		// 其他事务插入的行可能指向同一个索引项
+		if columnIndex != nil && !dm.indexEntryReferenced(tableInfo, l, xid) {
+			err := columnIndex.Delete(l.Key(), l.Value())
+			if err != nil && err != index.ErrKeyNotFound {
+				log.Panicf("undo index insert failed: %v", err)
+			}
+		}
+	}
+	// 索引的修改已经由 B+ 树记录了日志，补偿日志只标记该日志已被撤销
+	dm.pager.AppendLog(redolog.NewCompensationLog(xid, l.LSN(), nil))
+}
+
+// 判断索引项是否被 xid 以外的事务插入的行引用
+func (dm *DataManager) indexEntryReferenced(tableInfo *pagedata.TableInfo,
+	l *redolog.IndexInsertLog, xid tm.XID) bool {
+	entry := indexEntry{key: string(l.Key()), value: string(l.Value())}
+	pageNums := []util.UUID{l.PageNum()}
+	if l.ColumnId() != 0 {
+		// 非主键索引指向主键，主键相同的行可能在其他数据页中
+		pageNums = pageNums[:0]
+		primaryIndex := tableInfo.ColumnDefines[0].Index
+		result := primaryIndex.Search(index.KeyType(l.Value()))
+		for pageNumBytes := range result.Values() {
+			pageNums = append(pageNums, util.BytesToUUID(pageNumBytes))
+		}
+		if err := result.Err(); err != nil {
+			log.Panicf("search primary index failed: %v", err)
+		}
+	}
+	for _, pageNum := range pageNums {
+		page := dm.mustGetRecordPage(pageNum)
+		page.RLock()
+		rows := page.Data().(*pagedata.RecordData).Rows()
+		page.RUnlock()
+		dm.pager.Unpin(page, false)
+		for _, row := range rows {
+			if xmin, _ := row.Xmin(); xmin == xid {
+				continue
+			}
+			if getIndexEntry(tableInfo, int(l.ColumnId()), row, pageNum) == entry {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 按主键和 xmin 查找数据行，优先返回 offset 相同的行
+func findRow(recordData *pagedata.RecordData, offset int64, key []byte,
+	xmin tm.XID, match func(*ast.Row) bool) *ast.Row {
+	var found *ast.Row
+	for _, row := range recordData.Rows() {
+		rowXmin, _ := row.Xmin()
+		if rowXmin != xmin || !bytes.Equal(row.Data[0].Raw(), key) || !match(row) {
+			continue
+		}
+		if row.Offset == offset {
+			return row
+		}
+		if found == nil {
+			found = row
+		}
+	}
+	return found
+}
+
+func applyRecordPageRemove(recordData *pagedata.RecordData, l *redolog.RecordPageRemoveLog) {
+	row := findRow(recordData, l.Offset(), l.Key(), l.Xmin(), func(*ast.Row) bool {
+		return true
+	})
+	if row != nil {
+		recordData.Remove(row)
+	}
+}
+
+func applyRecordSetXmax(recordData *pagedata.RecordData, l *redolog.RecordSetXmaxLog) {
+	row := findRow(recordData, l.Offset(), l.Key(), l.Xmin(), func(row *ast.Row) bool {
+		xmax, _ := row.Xmax()
+		return xmax == l.OldXmax()
+	})
+	if row != nil {
+		row.SetXmax(l.NewXmax())
+	}
+}
+
+// 重放修改数据页的日志，页的 LSN 不小于日志的 LSN 时跳过
+func (dm *DataManager) redoRecordPage(pageNum util.UUID, LSN int64,
+	apply func(*pagedata.RecordData)) error {
+	page, err := dm.pager.GetPage(pageNum, pagedata.NewRecordData())
+	if err != nil {
+		return err
+	}
+	applied := page.LSN() >= LSN
+	if !applied {
+		apply(page.Data().(*pagedata.RecordData))
+		page.SetLSN(LSN)
+	}
+	dm.pager.Unpin(page, !applied)
+	return nil
+}
+
+func (dm *DataManager) redoCompensation(l *redolog.CompensationLog) error {
+	var err error
+	switch action := l.Action().(type) {
+	case *redolog.RecordPageRemoveLog:
+		err = dm.redoRecordPage(action.PageNum(), l.LSN(), func(recordData *pagedata.RecordData) {
+			applyRecordPageRemove(recordData, action)
+		})
+	case *redolog.RecordSetXmaxLog:
+		err = dm.redoRecordPage(action.PageNum(), l.LSN(), func(recordData *pagedata.RecordData) {
+			applyRecordSetXmax(recordData, action)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	dm.popUndo(l.Xid(), l.UndoneLSN())
+	return nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/pager/pagedata"
+	"minidb-go/storage/recovery/redo/redolog"
+	"minidb-go/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 一次 vacuum 的统计信息
+type VacuumStat struct {
+	TableName string
+
+	// 扫描的数据页数
+	ScannedPages int
+	// 被整理过的数据页数
+	CompactedPages int
+	// 删除的行版本数
+	RemovedRows int
+	// 删除的索引项数
+	RemovedIndexEntries int
+	// 回收的字节数
+	ReclaimedBytes int
+}
+
+func (stat *VacuumStat) String() string {
+	return fmt.Sprintf("%s: removed %d row versions, %d index entries, reclaimed %d bytes in %d/%d pages",
+		stat.TableName, stat.RemovedRows, stat.RemovedIndexEntries, stat.ReclaimedBytes,
+		stat.CompactedPages, stat.ScannedPages)
+}
+
+type indexEntry struct {
+	key   string
+	value string
+}
+
+// 返回 row 在第 columnId 列索引中对应的索引项
+func getIndexEntry(tableInfo *pagedata.TableInfo, columnId int,
+	row *ast.Row, pageNum util.UUID) indexEntry {
+	index := tableInfo.ColumnDefines[columnId].Index
+	if columnId == 0 {
+		// 主键索引指向数据页
+		return indexEntry{
+			key:   string(row.Data[0].Raw()),
+			value: string(util.UUIDToBytes(index.ValueSize(), pageNum)),
+		}
+	}
+	// 非主键索引指向主键
+	return indexEntry{
+		key:   string(row.Data[columnId].Raw()),
+		value: string(row.Data[0].Raw()),
+	}
+}
+
+// 删除表中 dead 返回 true 的行版本，整理数据页，并删除不再指向任何行的索引项
+func (dm *DataManager) Vacuum(tableName string, dead func(*ast.Row) bool) (*VacuumStat, error) {
+	tableInfo := dm.pager.GetMetaData().GetTableInfo(tableName)
+	if tableInfo == nil {
+		return nil, ErrTableNotExist
+	}
+
+	dm.vacuumLock.Lock()
+	defer dm.vacuumLock.Unlock()
+
+	stat := &VacuumStat{TableName: tableName}
+	columnNum := len(tableInfo.ColumnDefines)
+	// 每个索引中被删除和仍被引用的索引项
+	removedEntries := make([]map[indexEntry]struct{}, columnNum)
+	keptEntries := make([]map[indexEntry]struct{}, columnNum)
+	for i := 0; i < columnNum; i++ {
+		removedEntries[i] = make(map[indexEntry]struct{})
+		keptEntries[i] = make(map[indexEntry]struct{})
+	}
+
+	pageNum := tableInfo.FirstPageNum
+	for pageNum != pager.NIL_PAGE_NUM {
+		page, err := dm.getRecordPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		recordData := page.Data().(*pagedata.RecordData)
+
+		page.Lock()
+		sizeBefore := recordData.Size()
+		removed := recordData.Compact(dead)
+		reclaimed := sizeBefore - recordData.Size()
+		// 撤销插入留下的空间也会被回收，此时虽然没有删除行，但页中数据的大小改变了
+		compacted := reclaimed > 0
+		if compacted {
+			offsets := make([]int64, len(removed))
+			for i, row := range removed {
+				offsets[i] = row.Offset
+			}
+			dm.pager.AppendLog(redolog.NewRecordPageCompactLog(pageNum, offsets), page)
+		}
+		for i, columnDefine := range tableInfo.ColumnDefines {
+			if columnDefine.Index == nil {
+				continue
+			}
+			for _, row := range removed {
+				removedEntries[i][getIndexEntry(tableInfo, i, row, pageNum)] = struct{}{}
+			}
+			for _, row := range recordData.Rows() {
+				keptEntries[i][getIndexEntry(tableInfo, i, row, pageNum)] = struct{}{}
+			}
+		}
+		nextPageNum := page.NextPageNum()
+		page.Unlock()
+
+		stat.ScannedPages++
+		if compacted {
+			stat.CompactedPages++
+			stat.RemovedRows += len(removed)
+			stat.ReclaimedBytes += reclaimed
+		}
+		dm.pager.Unpin(page, compacted)
+		pageNum = nextPageNum
+	}
+
+	// 只有当索引项不再指向任何存活的行时才删除
+	for i, columnDefine := range tableInfo.ColumnDefines {
+		if columnDefine.Index == nil {
+			continue
+		}
+		for entry := range removedEntries[i] {
+			if _, ok := keptEntries[i][entry]; ok {
+				continue
+			}
+			err := columnDefine.Index.Delete([]byte(entry.key), []byte(entry.value))
+			if err != nil {
+				log.Warnf("vacuum %s: delete index entry of column %s failed: %v",
+					tableName, columnDefine.Name, err)
+				continue
+			}
+			stat.RemovedIndexEntries++
+		}
+	}
+	return stat, nil
+}
+
+// 按 offset 删除行，并以与 vacuum 相同的方式整理数据页
+func applyRecordPageCompact(recordData *pagedata.RecordData, l *redolog.RecordPageCompactLog) {
+	offsets := make(map[int64]struct{}, len(l.Offsets()))
+	for _, offset := range l.Offsets() {
+		offsets[offset] = struct{}{}
+	}
+	recordData.Compact(func(row *ast.Row) bool {
+		_, ok := offsets[row.Offset]
+		return ok
+	})
+}
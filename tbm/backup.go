@@ -0,0 +1,102 @@
+package tbm
+
+import (
+	"fmt"
+	"io"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/recovery"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 在线备份数据库到 dir，dir 不存在或者为空，备份期间不能建表和重建索引
+func (tbm *TableManager) Backup(dir string) (*ResultList, error) {
+	tbm.backupLock.Lock()
+	defer tbm.backupLock.Unlock()
+
+	if err := makeEmptyDir(dir); err != nil {
+		return nil, err
+	}
+	stat, err := tbm.dataManager.Backup(dir, tbm.serializer.NextXID(), func() error {
+		return tbm.serializer.BackupXIDFile(dir)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backup to %s failed: %w", dir, err)
+	}
+	log.Infof("backup %v", stat)
+	return &ResultList{
+		Message: "BACKUP " + stat.String(),
+	}, nil
+}
+
+// 将 backupDir 中的备份复制到 path 并重放其中的 redo log，回滚备份时未提交的事务
+func Restore(backupDir string, path string, options pager.Options) error {
+	return RestoreUntil(backupDir, "", path, recovery.Target{Kind: recovery.TARGET_NONE}, options)
+}
+
+// 将 backupDir 中的备份复制到 path，重放备份和 archiveDir 中归档的 redo log 直到 target，回滚目标处未提交的事务
+// options: 重放日志时打开数据库使用的配置
+func RestoreUntil(backupDir string, archiveDir string, path string, target recovery.Target,
+	options pager.Options) error {
+	if err := makeEmptyDir(path); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		err := copyFile(filepath.Join(backupDir, entry.Name()), filepath.Join(path, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("restore %s failed: %w", entry.Name(), err)
+		}
+	}
+	if _, err := recovery.PrepareRestore(path, archiveDir, target); err != nil {
+		return fmt.Errorf("restore to %v failed: %w", target, err)
+	}
+	// 备份的控制文件标记为异常退出，打开时会重放日志
+	db, err := OpenWithOptions(path, options)
+	if err != nil {
+		return fmt.Errorf("open restored database failed: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("close restored database failed: %w", err)
+	}
+	return nil
+}
+
+func makeEmptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
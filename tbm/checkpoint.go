@@ -0,0 +1,87 @@
+package tbm
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 执行一次 checkpoint，之后恢复时不需要重放更早的日志，出错时之前的 checkpoint 仍然有效
+func (tbm *TableManager) CheckPoint() error {
+	return tbm.dataManager.CheckPoint(tbm.serializer.NextXID())
+}
+
+// 启动后台 checkpoint，每隔 interval 进行一次，redo log 中不再需要的段会被删除
+func (tbm *TableManager) StartCheckPoint(interval time.Duration) {
+	if interval <= 0 || tbm.stopCheckPoint != nil {
+		return
+	}
+	tbm.stopCheckPoint = make(chan struct{})
+	tbm.checkPointDone = make(chan struct{})
+	go func() {
+		defer close(tbm.checkPointDone)
+		defer tbm.recoverBackground("checkpoint")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tbm.stopCheckPoint:
+				return
+			case <-ticker.C:
+				// 失败时下一次 checkpoint 重试
+				if err := tbm.CheckPoint(); err != nil {
+					log.Errorf("checkpoint failed: %v", err)
+				} else {
+					log.Debugf("checkpoint at %d", tbm.rec.ControlData().CheckPointLSN)
+				}
+			}
+		}
+	}()
+}
+
+// 设置后台 autovacuum 和 checkpoint 中 panic 的处理函数，需要在启动后台任务之前调用。
+// 处理之后该后台任务停止，嵌入使用时用于将数据库标记为损坏而不是退出进程
+func (tbm *TableManager) SetPanicHandler(handler func(r interface{})) {
+	tbm.onPanic = handler
+}
+
+// 在后台任务的 goroutine 中 defer 调用
+func (tbm *TableManager) recoverBackground(task string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if tbm.onPanic == nil {
+		panic(r)
+	}
+	log.Errorf("background %s stopped: %v", task, r)
+	tbm.onPanic(r)
+}
+
+// 停止后台 checkpoint，并等待正在进行的 checkpoint 结束
+func (tbm *TableManager) StopCheckPoint() {
+	if tbm.stopCheckPoint == nil {
+		return
+	}
+	close(tbm.stopCheckPoint)
+	<-tbm.checkPointDone
+	tbm.stopCheckPoint = nil
+}
+
+// 根据数据页重建所有表的索引，只能在没有其他事务时调用
+func (tbm *TableManager) RebuildIndexes() error {
+	tbm.backupLock.Lock()
+	defer tbm.backupLock.Unlock()
+	// 重建索引不记录日志，之前的日志不能再被重放到旧的索引上
+	if err := tbm.CheckPoint(); err != nil {
+		return err
+	}
+	for _, tableName := range tbm.tableNames() {
+		entries, err := tbm.dataManager.RebuildIndexes(tableName)
+		if err != nil {
+			return err
+		}
+		log.Infof("rebuilt indexes of %s: %d entries", tableName, entries)
+	}
+	return nil
+}
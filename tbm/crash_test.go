@@ -0,0 +1,397 @@
+package tbm_test
+
+import (
+	"fmt"
+	"math/rand"
+	"minidb-go/parser"
+	"minidb-go/parser/ast"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage/pager"
+	"minidb-go/tbm"
+	"minidb-go/util/vfs"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+/*
+faultFS 替换 vfs 中打开和删除文件的函数，模拟进程在第 crashAfter 次写入时被杀死：
+触发退出的写入被丢弃，或者 torn 为 true 时只写入前一半；之后所有的写入、fsync、截断和删除都不再生效。
+revert 模拟断电，撤销每个文件上次 fsync 之后的写入。
+*/
+type faultFS struct {
+	lock sync.Mutex
+
+	crashAfter int
+	torn       bool
+	writes     int
+	crashed    bool
+
+	files []*faultFile
+}
+
+type faultFile struct {
+	*os.File
+	fs *faultFS
+
+	// 上次 fsync 时的文件大小，以及之后的写入覆盖的旧内容
+	syncedSize int64
+	pending    []pendingWrite
+	// 退出之后才创建的文件
+	ghost bool
+}
+
+type pendingWrite struct {
+	offset int64
+	old    []byte
+}
+
+// crashAfter 为 0 时不会退出，只统计写入次数
+func installFaultFS(crashAfter int, torn bool) *faultFS {
+	fs := &faultFS{
+		crashAfter: crashAfter,
+		torn:       torn,
+	}
+	vfs.OpenFile = fs.openFile
+	vfs.Remove = fs.remove
+	return fs
+}
+
+func restoreFS() {
+	vfs.OpenFile = func(name string, flag int, perm os.FileMode) (vfs.File, error) {
+		file, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	vfs.Remove = os.Remove
+}
+
+func (fs *faultFS) openFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, statErr := os.Stat(name)
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &faultFile{
+		File:       file,
+		fs:         fs,
+		syncedSize: stat.Size(),
+		ghost:      fs.crashed && os.IsNotExist(statErr),
+	}
+	fs.files = append(fs.files, f)
+	return f, nil
+}
+
+func (fs *faultFS) remove(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return nil
+	}
+	return os.Remove(name)
+}
+
+func (fs *faultFS) isCrashed() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.crashed
+}
+
+func (fs *faultFS) writeCount() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.writes
+}
+
+// 在尚未退出时立即退出
+func (fs *faultFS) crash() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.crashed = true
+}
+
+// 撤销所有没有 fsync 的写入，删除退出之后创建的文件
+func (fs *faultFS) revert(t *testing.T) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, f := range fs.files {
+		if f.ghost {
+			os.Remove(f.Name())
+			continue
+		}
+		file, err := os.OpenFile(f.Name(), os.O_RDWR, 0666)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := len(f.pending) - 1; i >= 0; i-- {
+			file.WriteAt(f.pending[i].old, f.pending[i].offset)
+		}
+		file.Truncate(f.syncedSize)
+		file.Close()
+	}
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	fs := f.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return len(p), nil
+	}
+	fs.writes++
+	if fs.writes == fs.crashAfter {
+		fs.crashed = true
+		if fs.torn {
+			// 写入一半的数据已经到达磁盘
+			f.File.WriteAt(p[:len(p)/2], off)
+		}
+		return len(p), nil
+	}
+	old := make([]byte, len(p))
+	n, _ := f.File.ReadAt(old, off)
+	f.pending = append(f.pending, pendingWrite{offset: off, old: old[:n]})
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Sync() error {
+	fs := f.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return nil
+	}
+	stat, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.syncedSize = stat.Size()
+	f.pending = nil
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	fs := f.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return nil
+	}
+	f.syncedSize = size
+	return f.File.Truncate(size)
+}
+
+// 表 t1 中每个 id 对应的 age
+type tableState map[int]int
+
+func (state tableState) clone() tableState {
+	cloned := make(tableState, len(state))
+	for id, age := range state {
+		cloned[id] = age
+	}
+	return cloned
+}
+
+func (state tableState) randomId(rng *rand.Rand) (int, bool) {
+	if len(state) == 0 {
+		return 0, false
+	}
+	ids := make([]int, 0, len(state))
+	for id := range state {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids[rng.Intn(len(ids))], true
+}
+
+func execStmt(t *testing.T, db *tbm.TableManager, xid tm.XID, sql string) {
+	stmt, err := parser.Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch stmt := stmt.(type) {
+	case ast.InsertIntoStmt:
+		_, err = db.Insert(xid, stmt)
+	case ast.UpdateStmt:
+		_, err = db.Update(xid, stmt)
+	case ast.DeleteStatement:
+		_, err = db.Delete(xid, stmt)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+/*
+随机执行插入、修改、删除、提交、撤销、checkpoint 和 vacuum，直到写入次数达到 crashAfter。
+返回已经提交的状态，以及退出时正在提交、无法确定是否已经提交的事务提交后的状态。
+*/
+func crashWorkload(t *testing.T, db *tbm.TableManager, fs *faultFS, seed int64) (tableState, tableState) {
+	rng := rand.New(rand.NewSource(seed))
+	committed := make(tableState)
+	nextId := 0
+	for i := 0; i < 60; i++ {
+		xid := db.Begin()
+		state := committed.clone()
+		for j := rng.Intn(8); j >= 0; j-- {
+			switch op := rng.Intn(10); {
+			case op < 5:
+				age := rng.Intn(1000)
+				execStmt(t, db, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", nextId, "test crash", age))
+				state[nextId] = age
+				nextId++
+			case op < 8:
+				if id, ok := state.randomId(rng); ok {
+					age := rng.Intn(1000)
+					execStmt(t, db, xid, fmt.Sprintf("update t1 set age = %d where id = %d;", age, id))
+					state[id] = age
+				}
+			default:
+				if id, ok := state.randomId(rng); ok {
+					execStmt(t, db, xid, fmt.Sprintf("delete from t1 where id = %d;", id))
+					delete(state, id)
+				}
+			}
+			if fs.isCrashed() {
+				return committed, nil
+			}
+		}
+		if rng.Intn(4) == 0 {
+			db.Abort(xid)
+		} else {
+			db.Commit(xid)
+			if fs.isCrashed() {
+				return committed, state
+			}
+			committed = state
+		}
+		switch rng.Intn(10) {
+		case 0:
+			db.CheckPoint()
+		case 1:
+			vacuumStmt, _ := parser.Parse("vacuum t1;")
+			db.Vacuum(vacuumStmt.(ast.VacuumStmt))
+		}
+		if fs.isCrashed() {
+			return committed, nil
+		}
+	}
+	return committed, nil
+}
+
+func readState(t *testing.T, db *tbm.TableManager) tableState {
+	xid := db.Begin()
+	defer db.Commit(xid)
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, err := db.Select(xid, selectStmt.(ast.SelectStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(tableState)
+	for _, row := range resultList.Rows {
+		id, _ := strconv.Atoi(row.Data[0].String())
+		age, _ := strconv.Atoi(row.Data[2].String())
+		if _, ok := state[id]; ok {
+			t.Fatalf("duplicate rows for id = %d: %v", id, resultList)
+		}
+		state[id] = age
+		// 通过主键索引也能找到同一行
+		selectStmt, _ := parser.Parse(fmt.Sprintf("select * from t1 where id = %d;", id))
+		indexResult, _ := db.Select(xid, selectStmt.(ast.SelectStmt))
+		if indexResult == nil || len(indexResult.Rows) != 1 || indexResult.Rows[0].Data[2].String() != fmt.Sprint(age) {
+			t.Fatalf("unexpected rows for id = %d: %v", id, indexResult)
+		}
+	}
+	return state
+}
+
+func sameState(a, b tableState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, age := range a {
+		if other, ok := b[id]; !ok || other != age {
+			return false
+		}
+	}
+	return true
+}
+
+func createCrashTable(t *testing.T, path string, options pager.Options) *tbm.TableManager {
+	db := createWithOptions(t, path, options)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	if _, err := db.CreateTable(xid, stmt.(ast.CreateTableStmt)); err != nil {
+		t.Fatal(err)
+	}
+	db.Commit(xid)
+	return db
+}
+
+// 在随机的写入处模拟异常退出，恢复后已提交的行都存在，未提交的行都不可见
+func TestCrashRecovery(t *testing.T) {
+	defer restoreFS()
+	options := pager.DefaultOptions()
+	options.Frames = 8
+	options.Shards = 2
+	options.FlushInterval = 0
+
+	rounds := 30
+	if testing.Short() {
+		rounds = 5
+	}
+	for seed := int64(1); seed <= int64(rounds); seed++ {
+		// 先完整运行一次，统计负载的写入次数
+		path := createtmpdir()
+		fs := installFaultFS(0, false)
+		db := createCrashTable(t, path, options)
+		setupWrites := fs.writeCount()
+		crashWorkload(t, db, fs, seed)
+		totalWrites := fs.writeCount() - setupWrites
+		db.Close()
+		destorytemp(path)
+
+		rng := rand.New(rand.NewSource(seed))
+		crashAfter := setupWrites + 1 + rng.Intn(totalWrites)
+		torn := rng.Intn(2) == 0
+
+		path = createtmpdir()
+		fs = installFaultFS(crashAfter, torn)
+		db = createCrashTable(t, path, options)
+		committed, committing := crashWorkload(t, db, fs, seed)
+		// 负载结束时还没有达到写入次数，直接退出
+		fs.crash()
+		// 退出的进程不会再关闭数据库，丢弃 db
+		fs.revert(t)
+		restoreFS()
+
+		db = openWithOptions(t, path, options)
+		state := readState(t, db)
+		if !sameState(state, committed) && (committing == nil || !sameState(state, committing)) {
+			t.Fatalf("seed %d, crash after %d writes (torn %v): expected %v, got %v",
+				seed, crashAfter, torn, committed, state)
+		}
+		// vacuum 不会清理已提交的行
+		vacuumStmt, _ := parser.Parse("vacuum t1;")
+		if _, err := db.Vacuum(vacuumStmt.(ast.VacuumStmt)); err != nil {
+			t.Fatal(err)
+		}
+		if !sameState(readState(t, db), state) {
+			t.Fatalf("seed %d: rows changed after vacuum", seed)
+		}
+		db.Close()
+		destorytemp(path)
+	}
+}
@@ -0,0 +1,63 @@
+package tbm
+
+import (
+	"minidb-go/parser/ast"
+	"minidb-go/serialization"
+	"minidb-go/serialization/tm"
+)
+
+// 查询结果的游标，按需从数据页中读取行，用于流式返回结果和 DECLARE CURSOR
+type Cursor struct {
+	Columns []Column
+
+	rows *serialization.RowIterator
+}
+
+// 在事务 xid 中执行查询，游标只能在事务结束之前读取，不再使用时需要调用 Close
+func (tbm *TableManager) OpenCursor(xid tm.XID, selectStmt ast.SelectStmt) (*Cursor, error) {
+	columns, err := tbm.Columns(selectStmt.TableName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tbm.serializer.Scan(xid, selectStmt)
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{
+		Columns: columns,
+		rows:    rows,
+	}, nil
+}
+
+// 读取最多 n 行，n 为 0 时读取剩余的全部行，读取完之后返回空的结果
+func (cursor *Cursor) Fetch(n int) ([]*ast.Row, error) {
+	rows := make([]*ast.Row, 0)
+	for n == 0 || len(rows) < n {
+		row, err := cursor.rows.Next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// 读取最多 n 行并返回 ResultList
+func (cursor *Cursor) FetchResult(n int) (*ResultList, error) {
+	rows, err := cursor.Fetch(n)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{
+		Columns: cursor.Columns,
+		Rows:    rows,
+	}, nil
+}
+
+// 结束读取，释放扫描数据页的 goroutine
+func (cursor *Cursor) Close() {
+	cursor.rows.Close()
+}
@@ -79,7 +79,7 @@ func (tbm *TableManager) getOffsetsFromPrimaryKeys(
 				continue
 			}
 			offsetValues := primaryIndex.Search(key)
-			for offsetValue := range offsetValues {
+			for offsetValue := range offsetValues.Values() {
 				if offsetValue == nil {
 					continue
 				}
@@ -98,7 +98,7 @@ func (tbm *TableManager) getPrimaryKeys(simpleIndex index.Index, value ast.SQLEx
 	primaryKeys := make(chan index.KeyType, 16)
 	// 查询主键
 	go func() {
-		for val := range simpleIndex.Search(value.Raw()) {
+		for val := range simpleIndex.Search(value.Raw()).Values() {
 			if val == nil {
 				continue
 			}
@@ -3,37 +3,103 @@ package tbm
 import (
 	"fmt"
 	"minidb-go/parser/ast"
+	"strings"
+	"unicode/utf8"
 )
 
+// 结果中一列的名字、类型和是否可能为 NULL
+type Column struct {
+	Name string
+	Type ast.ColumnType
+	// 表中的列目前都不能为 NULL
+	Nullable bool
+}
+
 type ResultList struct {
-	Columns []string
+	// 不返回数据行的语句为空
+	Columns []Column
 	Rows    []*ast.Row
+	// INSERT、UPDATE、DELETE 影响的行数
+	RowsAffected int
+	// 不返回数据行的语句的执行信息
+	Message string
 }
 
+// 以对齐的表格显示结果，行末尾隐藏的 xmin 和 xmax 不显示
 func (result *ResultList) String() string {
+	if result.Message != "" {
+		return result.Message + "\n"
+	}
 	if len(result.Columns) == 0 {
 		return "\n"
 	}
-	str := ""
-	for _, column := range result.Columns {
-		str += column + "\t"
+	cells := make([][]string, len(result.Rows))
+	widths := make([]int, len(result.Columns))
+	for i, column := range result.Columns {
+		widths[i] = utf8.RuneCountInString(column.Name)
+	}
+	for i, row := range result.Rows {
+		cells[i] = make([]string, len(result.Columns))
+		for j := range result.Columns {
+			cells[i][j] = row.Data[j].String()
+			if width := utf8.RuneCountInString(cells[i][j]); width > widths[j] {
+				widths[j] = width
+			}
+		}
+	}
+
+	var b strings.Builder
+	line := func(values []string) {
+		for i, value := range values {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value))
+			// 数值右对齐，文本左对齐
+			if result.Columns[i].Type == ast.CT_TEXT {
+				b.WriteString(value + padding)
+			} else {
+				b.WriteString(padding + value)
+			}
+		}
+		b.WriteString("\n")
+	}
+	names := make([]string, len(result.Columns))
+	separators := make([]string, len(result.Columns))
+	for i, column := range result.Columns {
+		names[i] = column.Name
+		separators[i] = strings.Repeat("-", widths[i])
 	}
-	str += "\n"
-	for _, row := range result.Rows {
-		str += fmt.Sprintf("%s\n", row)
+	line(names)
+	b.WriteString(strings.Join(separators, "-+-") + "\n")
+	for _, values := range cells {
+		line(values)
 	}
-	str += "\n"
-	return str
+	if len(result.Rows) == 1 {
+		b.WriteString("(1 row)\n")
+	} else {
+		fmt.Fprintf(&b, "(%d rows)\n", len(result.Rows))
+	}
+	return b.String()
 }
 
-func (tbm *TableManager) NewResultList(tableName string, rows []*ast.Row) (*ResultList, error) {
+// INSERT、UPDATE、DELETE 的结果，只返回影响的行数
+func newAffectedResult(command string, rows int) *ResultList {
+	return &ResultList{
+		RowsAffected: rows,
+		Message:      fmt.Sprintf("%s %d", command, rows),
+	}
+}
+
+// 表的列，不包含行末尾的 xmin 和 xmax
+func (tbm *TableManager) Columns(tableName string) ([]Column, error) {
 	tableInfo := tbm.metaData.GetTableInfo(tableName)
 	if tableInfo == nil {
 		return nil, ErrTableNotExists
 	}
-	columns := tableInfo.ColumnNames()
-	return &ResultList{
-		Columns: columns,
-		Rows:    rows,
-	}, nil
+	columns := make([]Column, len(tableInfo.ColumnDefines))
+	for i, columnDefine := range tableInfo.ColumnDefines {
+		columns[i] = Column{Name: columnDefine.Name, Type: columnDefine.Type}
+	}
+	return columns, nil
 }
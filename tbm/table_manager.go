@@ -2,6 +2,7 @@ package tbm
 
 import (
 	"errors"
+	"fmt"
 	"minidb-go/parser/ast"
 	"minidb-go/serialization"
 	"minidb-go/serialization/tm"
@@ -10,6 +11,10 @@ import (
 	"minidb-go/storage/pager"
 	"minidb-go/storage/pager/pagedata"
 	"minidb-go/storage/recovery"
+	"minidb-go/util/cache"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
 var ErrTableNotExists = errors.New("table not exists")
@@ -21,13 +26,58 @@ type TableManager struct {
 	rec         *recovery.Recovery
 	dataManager *storage.DataManager
 	serializer  *serialization.Serializer
+
+	// 用于停止后台 autovacuum
+	stopVacuum chan struct{}
+	vacuumDone chan struct{}
+
+	// 用于停止后台 checkpoint
+	stopCheckPoint chan struct{}
+	checkPointDone chan struct{}
+	// 后台任务中存储层 panic 时调用，为 nil 时继续 panic 退出进程
+	onPanic func(r interface{})
+
+	// 备份时持有，建表和重建索引不记录 redo log，不能与备份同时进行
+	backupLock sync.Mutex
+	// 保护 catalog 中的用户，修改时替换整个 map
+	userLock sync.RWMutex
 }
 
+// 打开或创建失败时退出进程，嵌入使用时应调用 CreateWithOptions 和 OpenWithOptions
 func Create(path string) *TableManager {
-	pager := pager.Create(path)
-	rec := recovery.Create(path, pager.PageFile())
-	dataManager := storage.Create(path, pager, rec)
-	serializer := serialization.Create(path, dataManager)
+	tbm, err := CreateWithOptions(path, pager.DefaultOptions())
+	if err != nil {
+		log.Fatalf("create database failed: %v", err)
+	}
+	return tbm
+}
+
+func Open(path string) *TableManager {
+	tbm, err := OpenWithOptions(path, pager.DefaultOptions())
+	if err != nil {
+		log.Fatalf("open database failed: %v", err)
+	}
+	return tbm
+}
+
+// options: 缓冲池、redo log 和 double write 等的配置
+func CreateWithOptions(path string, options pager.Options) (*TableManager, error) {
+	pager, err := pager.Create(path, options)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := recovery.Create(path, pager.PageFile(), options.Redo, options.DoubleWritePages)
+	if err != nil {
+		pager.Discard()
+		return nil, err
+	}
+	dataManager := storage.Create(path, pager, rec, options.SearchWorkers)
+	serializer, err := serialization.Create(path, dataManager)
+	if err != nil {
+		pager.Discard()
+		rec.Discard()
+		return nil, err
+	}
 	tbm := &TableManager{
 		metaData:    pager.GetMetaData(),
 		serializer:  serializer,
@@ -35,14 +85,37 @@ func Create(path string) *TableManager {
 		rec:         rec,
 		dataManager: dataManager,
 	}
-	return tbm
+	return tbm, nil
 }
 
-func Open(path string) *TableManager {
-	pager := pager.Open(path)
-	rec := recovery.Open(path, pager.PageFile())
-	dataManager := storage.Open(path, pager, rec)
-	serializer := serialization.Open(path, dataManager)
+// 打开失败时不修改数据库的文件，下次打开时仍然会进行恢复
+func OpenWithOptions(path string, options pager.Options) (*TableManager, error) {
+	pager, err := pager.Open(path, options)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := recovery.Open(path, pager.PageFile(), options.Redo, options.DoubleWritePages)
+	if err != nil {
+		pager.Discard()
+		return nil, err
+	}
+	if err := pager.LoadMetaPage(rec.CatalogRoot()); err != nil {
+		pager.Discard()
+		rec.Discard()
+		return nil, err
+	}
+	dataManager, err := storage.Open(path, pager, rec, options.SearchWorkers)
+	if err != nil {
+		pager.Discard()
+		rec.Discard()
+		return nil, err
+	}
+	serializer, err := serialization.Open(path, dataManager)
+	if err != nil {
+		pager.Discard()
+		rec.Discard()
+		return nil, err
+	}
 	tbm := &TableManager{
 		metaData:    pager.GetMetaData(),
 		serializer:  serializer,
@@ -50,7 +123,10 @@ func Open(path string) *TableManager {
 		rec:         rec,
 		dataManager: dataManager,
 	}
-	return tbm
+	if tbm.metaData.Users == nil {
+		tbm.metaData.Users = make(map[string]*pagedata.UserInfo)
+	}
+	return tbm, nil
 }
 
 func (tbm *TableManager) Begin() tm.XID {
@@ -66,21 +142,19 @@ func (tbm *TableManager) Abort(xid tm.XID) error {
 }
 
 func (tbm *TableManager) Select(xid tm.XID, selectStmt ast.SelectStmt) (*ResultList, error) {
-	rows, err := tbm.serializer.Read(xid, selectStmt)
+	cursor, err := tbm.OpenCursor(xid, selectStmt)
 	if err != nil {
 		return nil, err
 	}
-	return tbm.NewResultList(selectStmt.TableName, rows)
+	defer cursor.Close()
+	return cursor.FetchResult(0)
 }
 
 func (tbm *TableManager) Insert(xid tm.XID, insertStmt ast.InsertIntoStmt) (*ResultList, error) {
-	values, err := tbm.serializer.Insert(xid, insertStmt)
-	if err != nil {
+	if _, err := tbm.serializer.Insert(xid, insertStmt); err != nil {
 		return nil, err
 	}
-	rows := []*ast.Row{ast.NewRow(values)}
-	resultList, err := tbm.NewResultList(insertStmt.TableName, rows)
-	return resultList, nil
+	return newAffectedResult("INSERT", 1), nil
 }
 
 func (tbm *TableManager) Delete(xid tm.XID, deleteStmt ast.DeleteStatement) (*ResultList, error) {
@@ -88,7 +162,7 @@ func (tbm *TableManager) Delete(xid tm.XID, deleteStmt ast.DeleteStatement) (*Re
 	if err != nil {
 		return nil, err
 	}
-	return tbm.NewResultList(deleteStmt.TableName, rows)
+	return newAffectedResult("DELETE", len(rows)), nil
 }
 
 func (tbm *TableManager) Update(xid tm.XID, updateStmt ast.UpdateStmt) (*ResultList, error) {
@@ -102,7 +176,7 @@ func (tbm *TableManager) Update(xid tm.XID, updateStmt ast.UpdateStmt) (*ResultL
 		return nil, err
 	}
 	if len(old_rows) == 0 {
-		return nil, nil
+		return newAffectedResult("UPDATE", 0), nil
 	}
 
 	// 再插入修改后的行
@@ -112,7 +186,6 @@ func (tbm *TableManager) Update(xid tm.XID, updateStmt ast.UpdateStmt) (*ResultL
 		columnIds[i] = tableInfo.GetColumnDefine(columnAssign.ColumnName).ColumnId
 	}
 
-	rows := make([]*ast.Row, 0)
 	for _, row := range old_rows {
 		insertValues := row.DeepCopyData()
 		insertValues = insertValues[:len(insertValues)-2]
@@ -123,42 +196,70 @@ func (tbm *TableManager) Update(xid tm.XID, updateStmt ast.UpdateStmt) (*ResultL
 			TableName: updateStmt.TableName,
 			Row:       insertValues,
 		}
-		values, err := tbm.serializer.Insert(xid, insertStmt)
-		rows = append(rows, ast.NewRow(values))
-		if err != nil {
+		if _, err := tbm.serializer.Insert(xid, insertStmt); err != nil {
 			return nil, err
 		}
 	}
-	return tbm.NewResultList(updateStmt.TableName, rows)
+	return newAffectedResult("UPDATE", len(old_rows)), nil
 }
 
-func (tbm *TableManager) CreateTable(xid tm.XID, createTableStmt ast.CreateTableStmt) error {
+func (tbm *TableManager) CreateTable(xid tm.XID, createTableStmt ast.CreateTableStmt) (*ResultList, error) {
+	tbm.backupLock.Lock()
+	defer tbm.backupLock.Unlock()
 	if _, ok := tbm.metaData.Tables[createTableStmt.TableName]; ok {
-		return errors.New("table already exists")
+		return nil, errors.New("table already exists")
 	}
 
 	tableInfo := new(pagedata.TableInfo)
 	tableInfo.TableName = createTableStmt.TableName
 	tableInfo.TableId = uint16(len(tbm.metaData.Tables))
 	tableInfo.ColumnDefines = createTableStmt.ColumnDefines
+	tableInfo.Compressed = createTableStmt.Compressed
 
 	// 设置主键索引
-	tableInfo.ColumnDefines[0].Index = bplustree.NewTree(
-		tbm.pager, 8, 4, tableInfo.TableId, 0, tbm.rec,
+	primaryIndex := bplustree.NewTree(
+		tbm.pager, 8, 4, tableInfo.TableId, 0,
 	)
+	primaryIndex.SetCompressed(createTableStmt.Compressed)
+	tableInfo.ColumnDefines[0].Index = primaryIndex
 
 	// 初始化一个空数据页
 	page := tbm.pager.NewPage(pagedata.NewRecordData())
+	page.SetCompressible(tableInfo.Compressed)
 	tableInfo.FirstPageNum = page.PageNum()
 	tableInfo.LastPageNum = page.PageNum()
+	tbm.pager.Unpin(page, true)
 
+	// meta page 可能正在被 checkpoint 写回
+	tbm.pager.MetaPage().Lock()
 	err := tbm.metaData.AddTable(tableInfo)
-	return err
+	tbm.pager.MetaPage().Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tbm.pager.MarkDirty(tbm.pager.MetaPage())
+	// 建表不记录 redo log，直接将新表的页和 meta page 写回磁盘
+	if err := tbm.pager.FlushAll(); err != nil {
+		return nil, fmt.Errorf("write catalog failed: %w", err)
+	}
+	return &ResultList{Message: "CREATE TABLE " + createTableStmt.TableName}, nil
 }
 
-func (tbm *TableManager) Close() {
+// 缓冲池的命中、未命中和淘汰次数
+func (tbm *TableManager) BufferPoolStats() cache.Stats {
+	return tbm.pager.Stats()
+}
+
+// 脏页没有全部写回时返回错误，数据仍然可以在下次打开时恢复
+func (tbm *TableManager) Close() error {
+	tbm.StopAutoVacuum()
+	tbm.StopCheckPoint()
 	tbm.serializer.Close()
 	tbm.dataManager.Close()
-	tbm.pager.Close()
-	tbm.rec.Close()
+	if err := tbm.pager.Close(); err != nil {
+		// 不标记为正常关闭，下次打开时通过 redo log 恢复没有写回的修改
+		tbm.rec.Discard()
+		return err
+	}
+	return tbm.rec.Close()
 }
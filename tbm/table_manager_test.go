@@ -1,22 +1,36 @@
 package tbm_test
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"minidb-go/parser"
 	"minidb-go/parser/ast"
+	"minidb-go/serialization"
+	"minidb-go/serialization/tm"
+	"minidb-go/storage"
 	"minidb-go/storage/bplustree"
+	"minidb-go/storage/inspect"
+	"minidb-go/storage/pager"
+	"minidb-go/storage/recovery"
+	"minidb-go/storage/recovery/recinfo"
 	"minidb-go/tbm"
+	"minidb-go/util"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 func init() {
-	gob.Register(bplustree.BPlusTree{})
+	gob.Register(&bplustree.BPlusTree{})
 	gob.Register(ast.SQLInt(0))
 	gob.Register(ast.SQLFloat(0))
 	gob.Register(ast.SQLText(""))
@@ -56,21 +70,59 @@ func createtmpdir() string {
 	return dir
 }
 
+func createWithOptions(t *testing.T, path string, options pager.Options) *tbm.TableManager {
+	db, err := tbm.CreateWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func openWithOptions(t *testing.T, path string, options pager.Options) *tbm.TableManager {
+	db, err := tbm.OpenWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// 每条插入语句作为一个单独的事务提交，并发提交的事务共用一次 redo log 的 fsync
 func BenchmarkInsert(b *testing.B) {
+	for _, clients := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			benchmarkInsert(b, clients)
+		})
+	}
+}
+
+func benchmarkInsert(b *testing.B, clients int) {
 	path := createtmpdir()
-	logrus.Info(path)
 	tbm := tbm.Create(path)
 	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
 	createStmt := stmt.(ast.CreateTableStmt)
 	xid := tbm.Begin()
 	tbm.CreateTable(xid, createStmt)
+	tbm.Commit(xid)
+	var next int64
+	var wg sync.WaitGroup
 	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		stmtStr := fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test student insert", i)
-		stmt, _ := parser.Parse(stmtStr)
-		tbm.Insert(xid, stmt.(ast.InsertIntoStmt))
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := atomic.AddInt64(&next, 1) - 1; i < int64(b.N); i = atomic.AddInt64(&next, 1) - 1 {
+				stmtStr := fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test student insert", i)
+				stmt, _ := parser.Parse(stmtStr)
+				xid := tbm.Begin()
+				if _, err := tbm.Insert(xid, stmt.(ast.InsertIntoStmt)); err != nil {
+					b.Error(err)
+				}
+				tbm.Commit(xid)
+			}
+		}()
 	}
-	tbm.Commit(xid)
+	wg.Wait()
+	b.StopTimer()
 	tbm.Close()
 	destorytemp(path)
 }
@@ -100,3 +152,976 @@ func BenchmarkSelect(b *testing.B) {
 	}
 	destorytemp(path)
 }
+
+func TestVacuum(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	tbm := tbm.Create(path)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := tbm.Begin()
+	tbm.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 100; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test", i))
+		tbm.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	tbm.Commit(xid)
+
+	// 旧事务开始于 update 之前，update 产生的旧版本对它仍然可见
+	oldXid := tbm.Begin()
+	xid = tbm.Begin()
+	for i := 0; i < 10; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("update t1 set age = 0 where id = %d;", i))
+		tbm.Update(xid, stmt.(ast.UpdateStmt))
+	}
+	tbm.Commit(xid)
+
+	vacuumStmt, _ := parser.Parse("vacuum t1;")
+	result, err := tbm.Vacuum(vacuumStmt.(ast.VacuumStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Message, "removed 0 row versions") {
+		t.Fatalf("vacuum removed rows visible to active transaction: %v", result)
+	}
+	tbm.Commit(oldXid)
+
+	result, _ = tbm.Vacuum(vacuumStmt.(ast.VacuumStmt))
+	if !strings.Contains(result.Message, "removed 10 row versions") {
+		t.Fatalf("unexpected vacuum result: %v", result)
+	}
+
+	xid = tbm.Begin()
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 100 {
+		t.Fatalf("expected 100 rows after vacuum, got %d", len(resultList.Rows))
+	}
+	selectStmt, _ = parser.Parse("select * from t1 where id = 3;")
+	resultList, _ = tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 1 || resultList.Rows[0].Data[2].String() != "0" {
+		t.Fatalf("unexpected rows for id = 3: %v", resultList)
+	}
+	// vacuum 不改变行的 offset，之后插入的行不能使用已有的行的 offset
+	for i := 100; i < 110; i++ {
+		execStmt(t, tbm, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test", i))
+	}
+	execStmt(t, tbm, xid, "delete from t1 where id = 5;")
+	tbm.Commit(xid)
+	if err := tbm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := storage.Check(path)
+	if err != nil || !report.OK() {
+		t.Fatalf("check failed: %v\n%v", err, report)
+	}
+}
+
+func TestBufferPoolEviction(t *testing.T) {
+	for _, replacer := range []pager.ReplacerType{
+		pager.REPLACER_LRU, pager.REPLACER_W_TINY_LFU, pager.REPLACER_CLOCK,
+	} {
+		t.Run(replacer.String(), func(t *testing.T) {
+			testBufferPoolEviction(t, replacer)
+		})
+	}
+}
+
+func testBufferPoolEviction(t *testing.T, replacer pager.ReplacerType) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	// 只有很少的页框，插入和查询过程中会不断淘汰脏页
+	options := pager.DefaultOptions()
+	options.Frames = 8
+	options.Shards = 2
+	options.Replacer = replacer
+	tbm := createWithOptions(t, path, options)
+	defer tbm.Close()
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := tbm.Begin()
+	tbm.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 3000; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test buffer pool", i))
+		tbm.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	tbm.Commit(xid)
+
+	xid = tbm.Begin()
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 3000 {
+		t.Fatalf("expected 3000 rows, got %d", len(resultList.Rows))
+	}
+	for i := 0; i < 3000; i += 97 {
+		selectStmt, _ := parser.Parse(fmt.Sprintf("select * from t1 where id = %d;", i))
+		resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+		if len(resultList.Rows) != 1 || resultList.Rows[0].Data[2].String() != fmt.Sprint(i) {
+			t.Fatalf("unexpected rows for id = %d: %v", i, resultList)
+		}
+	}
+	tbm.Commit(xid)
+	t.Log(tbm.BufferPoolStats())
+	if tbm.BufferPoolStats().Evictions == 0 {
+		t.Fatalf("expected evictions with %d frames", options.Frames)
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	options := pager.DefaultOptions()
+	options.Frames = 8
+	options.Shards = 2
+	tbm := createWithOptions(t, path, options)
+	stmt, err := parser.Parse("create table t1(id int, name text, age int) compressed;")
+	if err != nil || !stmt.(ast.CreateTableStmt).Compressed {
+		t.Fatalf("parse compressed table failed: %v", err)
+	}
+	xid := tbm.Begin()
+	tbm.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 2000; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test student insert", i%10))
+		tbm.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	tbm.Commit(xid)
+
+	xid = tbm.Begin()
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 2000 {
+		t.Fatalf("expected 2000 rows, got %d", len(resultList.Rows))
+	}
+	selectStmt, _ = parser.Parse("select * from t1 where id = 1234;")
+	resultList, _ = tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 1 || resultList.Rows[0].Data[2].String() != "4" {
+		t.Fatalf("unexpected rows for id = 1234: %v", resultList)
+	}
+	tbm.Commit(xid)
+	tbm.Close()
+
+	// 数据页和索引页都应该以压缩的形式写入磁盘
+	data, err := os.ReadFile(filepath.Join(path, pager.PAGE_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := 0
+	for offset := 0; offset+pager.PAGE_HEADER_SIZE <= len(data); offset += util.PAGE_SIZE {
+		if pager.ImageSize(data[offset:offset+pager.PAGE_HEADER_SIZE]) < util.PAGE_SIZE {
+			compressed++
+		}
+	}
+	if compressed*2 < len(data)/util.PAGE_SIZE {
+		t.Fatalf("only %d of %d pages are compressed", compressed, len(data)/util.PAGE_SIZE)
+	}
+}
+
+// 复制数据库目录中的所有文件，相当于在此时异常退出后磁盘上的状态
+func copyDatabase(t *testing.T, src string) string {
+	dst := createtmpdir()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+func checkRows(t *testing.T, tbm *tbm.TableManager, count int) {
+	xid := tbm.Begin()
+	defer tbm.Commit(xid)
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+	if resultList == nil || len(resultList.Rows) != count {
+		t.Fatalf("expected %d rows, got %v", count, resultList)
+	}
+	for i := 0; i < count; i += 37 {
+		selectStmt, _ := parser.Parse(fmt.Sprintf("select * from t1 where id = %d;", i))
+		resultList, _ := tbm.Select(xid, selectStmt.(ast.SelectStmt))
+		if len(resultList.Rows) != 1 || resultList.Rows[0].Data[2].String() != fmt.Sprint(i) {
+			t.Fatalf("unexpected rows for id = %d: %v", i, resultList)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	// 页框很少，部分脏页在提交前已经写回，其余的修改只在 redo log 中
+	options := pager.DefaultOptions()
+	options.Frames = 8
+	options.Shards = 2
+	options.FlushInterval = 0
+	db := createWithOptions(t, path, options)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	db.Commit(xid)
+	xid = db.Begin()
+	for i := 0; i < 2000; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test recovery", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	db.Commit(xid)
+
+	crashed := copyDatabase(t, path)
+	defer destorytemp(crashed)
+	db.Close()
+
+	// 正常关闭后重新打开
+	db = openWithOptions(t, path, options)
+	checkRows(t, db, 2000)
+	db.Close()
+
+	// XID 文件中的计数器落后于控制文件时，不会重新分配已经使用过的 XID
+	xidFile, err := os.OpenFile(filepath.Join(path, tm.XID_FILE_NAME), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xidFile.WriteAt(make([]byte, tm.XID_FILE_HEADER_SIZE), 0)
+	xidFile.Close()
+	db = openWithOptions(t, path, options)
+	if next := db.Begin(); next <= xid {
+		t.Fatalf("xid %d allocated again", next)
+	}
+	db.Close()
+
+	// 异常退出后通过 redo log 恢复
+	db = openWithOptions(t, crashed, options)
+	checkRows(t, db, 2000)
+	db.Close()
+}
+
+// 修改 100 行中的 10 行并插入 50 行，不提交
+func modifyRows(db *tbm.TableManager) tm.XID {
+	xid := db.Begin()
+	for i := 0; i < 10; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("update t1 set age = 0 where id = %d;", i*7))
+		db.Update(xid, stmt.(ast.UpdateStmt))
+	}
+	for i := 100; i < 150; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test abort", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	return xid
+}
+
+// 回滚后数据页和索引中不再有被撤销的行，vacuum 没有可以清理的内容
+func checkRolledBack(t *testing.T, db *tbm.TableManager, count int) {
+	checkRows(t, db, count)
+	vacuumStmt, _ := parser.Parse("vacuum t1;")
+	result, err := db.Vacuum(vacuumStmt.(ast.VacuumStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result.Message, "removed 0 row versions, 0 index entries") {
+		t.Fatalf("aborted rows left in table: %v", result)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	options := pager.DefaultOptions()
+	options.Frames = 8
+	options.Shards = 2
+	options.FlushInterval = 0
+	db := createWithOptions(t, path, options)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 100; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test abort", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	db.Commit(xid)
+
+	xid = modifyRows(db)
+	db.Abort(xid)
+	checkRolledBack(t, db, 100)
+
+	// 未提交的事务在异常退出后的恢复过程中回滚，
+	// 其他事务提交时未提交事务的日志也会被写入磁盘
+	modifyRows(db)
+	db.Commit(db.Begin())
+	crashed := copyDatabase(t, path)
+	defer destorytemp(crashed)
+	db.Close()
+
+	db = openWithOptions(t, path, options)
+	checkRolledBack(t, db, 100)
+	db.Close()
+
+	db = openWithOptions(t, crashed, options)
+	checkRolledBack(t, db, 100)
+	db.Close()
+}
+
+// 并发的事务删除同一行时，后删除的事务不能覆盖已经提交的删除
+func TestConcurrentDelete(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	db := tbm.Create(path)
+	defer db.Close()
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 2; i++ {
+		execStmt(t, db, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test delete", i))
+	}
+	db.Commit(xid)
+
+	// 等待删除 id = 0 的事务提交后再删除
+	xid1, xid2 := db.Begin(), db.Begin()
+	execStmt(t, db, xid2, "update t1 set age = 10 where id = 0;")
+	deleted := make(chan error)
+	go func() {
+		stmt, _ := parser.Parse("update t1 set age = 20 where id = 0;")
+		_, err := db.Update(xid1, stmt.(ast.UpdateStmt))
+		deleted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	db.Commit(xid2)
+	if err := <-deleted; !errors.Is(err, serialization.ErrSerialization) {
+		t.Fatalf("expected serialization error after waiting, got %v", err)
+	}
+
+	// 删除 id = 1 的事务在当前事务开始之后提交
+	xid1, xid2 = db.Begin(), db.Begin()
+	execStmt(t, db, xid2, "delete from t1 where id = 1;")
+	db.Commit(xid2)
+	stmt, _ = parser.Parse("delete from t1 where id = 1;")
+	if _, err := db.Delete(xid1, stmt.(ast.DeleteStatement)); !errors.Is(err, serialization.ErrSerialization) {
+		t.Fatalf("expected serialization error, got %v", err)
+	}
+
+	xid = db.Begin()
+	selectStmt, _ := parser.Parse("select * from t1;")
+	resultList, _ := db.Select(xid, selectStmt.(ast.SelectStmt))
+	if len(resultList.Rows) != 1 || resultList.Rows[0].Data[2].String() != "10" {
+		t.Fatalf("unexpected rows: %v", resultList)
+	}
+	db.Commit(xid)
+}
+
+func TestCheckPoint(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	options := pager.DefaultOptions()
+	options.Redo.SegmentSize = 1 << 14
+	options.Frames = 8
+	options.Shards = 2
+	options.FlushInterval = 0
+	db := createWithOptions(t, path, options)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	db.Commit(xid)
+	for i := 0; i < 100; i++ {
+		xid := db.Begin()
+		for j := i * 10; j < i*10+10; j++ {
+			stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", j, "test checkpoint", j))
+			db.Insert(xid, stmt.(ast.InsertIntoStmt))
+		}
+		db.Commit(xid)
+		// 未提交的事务的日志不能随 checkpoint 删除
+		if i == 50 {
+			modifyRows(db)
+		}
+		if i%10 == 0 {
+			db.CheckPoint()
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(path, "redo_*.log"))
+	firstSegment := filepath.Base(segments[0])
+	if firstSegment == "redo_0000000000000000.log" {
+		t.Fatalf("redo log segments before checkpoint are not removed: %v", segments)
+	}
+
+	crashed := copyDatabase(t, path)
+	defer destorytemp(crashed)
+	db.Close()
+
+	db = openWithOptions(t, crashed, options)
+	checkRolledBack(t, db, 1000)
+	db.Close()
+
+	// 控制文件最后写入的槽损坏时使用另一个槽
+	for i := 0; i < 2; i++ {
+		file, err := os.OpenFile(filepath.Join(path, "recovery_info"), os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 槽的序号在 magic 之后
+		var seq [2]uint64
+		for slot := range seq {
+			raw := make([]byte, 8)
+			file.ReadAt(raw, int64(slot)*512+4)
+			seq[slot] = binary.BigEndian.Uint64(raw)
+		}
+		newest := int64(0)
+		if seq[1] > seq[0] {
+			newest = 1
+		}
+		file.WriteAt([]byte("torn"), newest*512+8)
+		file.Close()
+
+		db = openWithOptions(t, path, options)
+		checkRows(t, db, 1000)
+		db.Close()
+	}
+}
+
+// checkpoint 写回被 pin 的页时，页上的修改可能正在进行
+func TestConcurrentCheckPoint(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	options := pager.DefaultOptions()
+	options.FlushInterval = 0
+	db := createWithOptions(t, path, options)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	db.Commit(xid)
+
+	const clients, rows = 4, 200
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := c; i < clients*rows; i += clients {
+				xid := db.Begin()
+				execStmt(t, db, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test checkpoint", i))
+				db.Commit(xid)
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err := db.CheckPoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	crashed := copyDatabase(t, path)
+	defer destorytemp(crashed)
+	db.Close()
+	db = openWithOptions(t, crashed, options)
+	checkRows(t, db, clients*rows)
+	db.Close()
+}
+
+func TestPageChecksum(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	db := tbm.Create(path)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 100; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test checksum", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	db.Commit(xid)
+	db.Close()
+
+	pageCount, corrupted, err := pager.Verify(path)
+	if err != nil || len(corrupted) != 0 {
+		t.Fatalf("verify failed: %v %v", corrupted, err)
+	}
+
+	// 翻转 meta page 以外每一页中的一个比特
+	file, err := os.OpenFile(filepath.Join(path, pager.PAGE_FILE_NAME), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < pageCount; i++ {
+		b := make([]byte, 1)
+		offset := int64(i)*util.PAGE_SIZE + pager.PAGE_HEADER_SIZE + 1
+		file.ReadAt(b, offset)
+		b[0] ^= 0x10
+		file.WriteAt(b, offset)
+	}
+	file.Close()
+
+	_, corrupted, err = pager.Verify(path)
+	if err != nil || len(corrupted) != pageCount-1 {
+		t.Fatalf("expected %d corrupted pages, got %v %v", pageCount-1, corrupted, err)
+	}
+
+	// 读取损坏的页时返回错误而不是退出
+	db = tbm.Open(path)
+	defer db.Close()
+	xid = db.Begin()
+	defer db.Commit(xid)
+	selectStmt, _ := parser.Parse("select * from t1;")
+	_, err = db.Select(xid, selectStmt.(ast.SelectStmt))
+	var pageErr *pager.PageCorruptedError
+	if !errors.Is(err, pager.ErrPageCorrupted) || !errors.As(err, &pageErr) || pageErr.PageNum == 0 {
+		t.Fatalf("expected page corrupted error, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	db := tbm.Create(path)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	// 插入足够多的行使 B+ 树分裂
+	for i := 0; i < 1500; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test check", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	db.Commit(xid)
+	db.Abort(modifyRows(db))
+	xid = db.Begin()
+	for _, sql := range []string{"update t1 set age = 0 where id = 3;", "delete from t1 where id = 4;"} {
+		execStmt(t, db, xid, sql)
+	}
+	db.Commit(xid)
+	vacuumStmt, _ := parser.Parse("vacuum t1;")
+	db.Vacuum(vacuumStmt.(ast.VacuumStmt))
+	db.Close()
+
+	report, err := storage.Check(path)
+	if err != nil || !report.OK() {
+		t.Fatalf("check failed: %v\n%v", err, report)
+	}
+	if report.Rows == 0 || len(report.Indexes) != 1 || report.Indexes[0].Depth < 2 {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+
+	// 绕过数据库删除主键索引中 id = 10 的索引项
+	p, err := pager.Open(path, pager.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := recinfo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.LoadMetaPage(info.Data().CatalogRoot)
+	info.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryIndex := p.GetMetaData().GetTableInfo("t1").ColumnDefines[0].Index.(*bplustree.BPlusTree)
+	primaryIndex.SetPager(p)
+	id := ast.SQLInt(10)
+	key := id.Raw()
+	values := make([][]byte, 0)
+	for value := range primaryIndex.Search(key).Values() {
+		values = append(values, value)
+	}
+	for _, value := range values {
+		primaryIndex.Delete(key, value)
+	}
+	p.FlushAll()
+	p.Close()
+
+	report, err = storage.Check(path)
+	if err != nil || report.OK() || !strings.Contains(report.String(), "is not indexed") {
+		t.Fatalf("expected missing index entry: %v\n%v", err, report)
+	}
+
+	// 重建索引后旧索引的页不再被引用
+	db = tbm.Open(path)
+	if err := db.RebuildIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	report, err = storage.Check(path)
+	if err != nil || !report.OK() || len(report.Warnings) == 0 {
+		t.Fatalf("check after repair failed: %v\n%v", err, report)
+	}
+
+	db = tbm.Open(path)
+	defer db.Close()
+	xid = db.Begin()
+	defer db.Commit(xid)
+	selectStmt, _ := parser.Parse("select * from t1 where id = 10;")
+	resultList, err := db.Select(xid, selectStmt.(ast.SelectStmt))
+	if err != nil || len(resultList.Rows) != 1 {
+		t.Fatalf("expected 1 row for id = 10, got %v %v", resultList, err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	db := tbm.Create(path)
+	stmt, _ := parser.Parse("create table t1(id int, name text, age int);")
+	xid := db.Begin()
+	db.CreateTable(xid, stmt.(ast.CreateTableStmt))
+	for i := 0; i < 100; i++ {
+		stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test inspect", i))
+		db.Insert(xid, stmt.(ast.InsertIntoStmt))
+	}
+	db.Commit(xid)
+	db.Abort(modifyRows(db))
+	db.Close()
+
+	control, err := inspect.Catalog(path)
+	if err != nil || !control.CleanShutdown || len(control.Catalog.Tables) != 1 {
+		t.Fatalf("unexpected catalog: %v %v", control, err)
+	}
+	table := control.Catalog.Tables[0]
+	if table.Name != "t1" || len(table.Columns) != 3 || table.Columns[0].Index == nil {
+		t.Fatalf("unexpected table: %v", control)
+	}
+
+	pages := map[util.UUID]string{
+		control.CatalogRoot:         inspect.AS_META,
+		table.FirstPage:             inspect.AS_RECORD,
+		table.Columns[0].Index.Root: inspect.AS_INDEX,
+	}
+	for pageNum, pageType := range pages {
+		info, err := inspect.Page(path, pageNum, inspect.AS_AUTO)
+		if err != nil || !info.ChecksumOK || info.Type != pageType {
+			t.Fatalf("page %d: expected %s, got %v %v", pageNum, pageType, info, err)
+		}
+	}
+	info, _ := inspect.Page(path, table.FirstPage, inspect.AS_AUTO)
+	if len(info.Rows) != 100 || info.Rows[0].Values[1] != "test inspect" || info.Owner != "table t1" {
+		t.Fatalf("unexpected record page: %v", info)
+	}
+	if _, err := json.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+
+	// 撤销的事务写入了补偿日志
+	redoInfo, err := inspect.RedoLog(path)
+	if err != nil || redoInfo.EndLSN != redoInfo.FileLSN || !strings.Contains(redoInfo.String(), "COMPENSATION") {
+		t.Fatalf("unexpected redo log: %v %v", redoInfo, err)
+	}
+	doubleWrite, err := inspect.DoubleWrite(path)
+	if err != nil || len(doubleWrite.Pages) != 0 {
+		t.Fatalf("double write buffer is not empty after close: %v %v", doubleWrite, err)
+	}
+	xids, err := inspect.XIDs(path)
+	if err != nil || len(xids.Transactions) != 2 ||
+		xids.Transactions[0].Status != "committed" || xids.Transactions[1].Status != "aborted" {
+		t.Fatalf("unexpected xid statuses: %v %v", xids, err)
+	}
+}
+
+// 备份期间继续写入，恢复后包含备份时已提交的事务，不包含未提交的事务
+func TestBackup(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	options := pager.DefaultOptions()
+	options.Redo.SegmentSize = 1 << 14
+	db := createCrashTable(t, path, options)
+	xid := db.Begin()
+	for i := 0; i < 1000; i++ {
+		execStmt(t, db, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test backup", i))
+	}
+	db.Commit(xid)
+	pending := db.Begin()
+	for i := 2000; i < 2050; i++ {
+		execStmt(t, db, pending, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test pending", i))
+	}
+
+	// 备份期间不断提交新的事务并进行 checkpoint
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for i := 1000; ; i++ {
+			if i == 1100 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			xid := db.Begin()
+			stmt, _ := parser.Parse(fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test concurrent", i))
+			if _, err := db.Insert(xid, stmt.(ast.InsertIntoStmt)); err != nil {
+				done <- err
+				return
+			}
+			db.Commit(xid)
+			if i%10 == 0 {
+				db.CheckPoint()
+			}
+		}
+	}()
+
+	<-started
+	backupDir := filepath.Join(path, "Backup")
+	stmt, err := parser.Parse(fmt.Sprintf("BACKUP TO '%s';", backupDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Backup(stmt.(ast.BackupStmt).Dir)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.Message, "BACKUP "+backupDir) {
+		t.Fatalf("unexpected backup result: %v", result)
+	}
+	if _, err := db.Backup(backupDir); err == nil {
+		t.Fatal("backup into a non-empty directory succeeded")
+	}
+	db.Commit(pending)
+	db.Close()
+
+	restored := filepath.Join(path, "restored")
+	if err := tbm.Restore(backupDir, restored, pager.DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := storage.Check(restored)
+	if err != nil || !report.OK() {
+		t.Fatalf("restored database is inconsistent: %v %v", report, err)
+	}
+	db = tbm.Open(restored)
+	defer db.Close()
+	state := readState(t, db)
+	for i := 0; i < 1000; i++ {
+		if age, ok := state[i]; !ok || age != i {
+			t.Fatalf("row %d committed before backup is lost", i)
+		}
+	}
+	// 并发提交的事务按顺序提交，恢复的是其中的一个前缀
+	concurrent := len(state) - 1000
+	if concurrent < 100 {
+		t.Fatalf("only %d concurrent rows are restored", concurrent)
+	}
+	for i := 1000; i < 1000+concurrent; i++ {
+		if _, ok := state[i]; !ok {
+			t.Fatalf("row %d is lost while %d concurrent rows are restored", i, concurrent)
+		}
+	}
+}
+
+// 在归档的日志上按时间点恢复，撤销删除所有行的 delete
+func TestPointInTimeRecovery(t *testing.T) {
+	path := createtmpdir()
+	defer destorytemp(path)
+	archiveDir := filepath.Join(path, "archive")
+	os.Mkdir(archiveDir, 0755)
+	options := pager.DefaultOptions()
+	options.Redo.SegmentSize = 1 << 14
+	options.Redo.ArchiveDir = archiveDir
+
+	dbPath := filepath.Join(path, "db")
+	os.Mkdir(dbPath, 0755)
+	db := createCrashTable(t, dbPath, options)
+	xid := db.Begin()
+	for i := 0; i < 500; i++ {
+		execStmt(t, db, xid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test pitr", i))
+	}
+	db.Commit(xid)
+	backupDir := filepath.Join(path, "backup")
+	if _, err := db.Backup(backupDir); err != nil {
+		t.Fatal(err)
+	}
+
+	insertXid := db.Begin()
+	for i := 500; i < 1000; i++ {
+		execStmt(t, db, insertXid, fmt.Sprintf("insert into t1 values(%d, '%s', %d);", i, "test pitr", i))
+	}
+	db.Commit(insertXid)
+	// 归档目录不可用时日志段保留在 redo log 中，之后的 checkpoint 再归档，归档中没有缺失的段
+	os.Rename(archiveDir, archiveDir+".moved")
+	db.CheckPoint()
+	os.Rename(archiveDir+".moved", archiveDir)
+	db.CheckPoint()
+	time.Sleep(10 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	deleteXid := db.Begin()
+	for i := 0; i < 1000; i++ {
+		execStmt(t, db, deleteXid, fmt.Sprintf("delete from t1 where id = %d;", i))
+	}
+	db.Commit(deleteXid)
+	db.Close()
+
+	restoreUntil := func(until string) string {
+		target, err := recovery.ParseTarget(until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := filepath.Join(path, fmt.Sprintf("restored-%d", time.Now().UnixNano()))
+		if err := tbm.RestoreUntil(backupDir, archiveDir, restored, target, pager.DefaultOptions()); err != nil {
+			t.Fatalf("restore until %s: %v", until, err)
+		}
+		report, err := storage.Check(restored)
+		if err != nil || !report.OK() {
+			t.Fatalf("restored database is inconsistent: %v %v", report, err)
+		}
+		return restored
+	}
+
+	for _, until := range []string{fmt.Sprintf("xid:%d", insertXid), beforeDelete.Format(time.RFC3339Nano)} {
+		restored := restoreUntil(until)
+		db = tbm.Open(restored)
+		checkRows(t, db, 1000)
+		db.Close()
+	}
+	// 重放所有归档的日志，删除的事务没有提交
+	restored := restoreUntil("")
+	db = tbm.Open(restored)
+	checkRows(t, db, 1000)
+	db.Close()
+	// 只重放备份中的日志
+	restored = filepath.Join(path, "backup-only")
+	if err := tbm.Restore(backupDir, restored, pager.DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	db = tbm.Open(restored)
+	checkRows(t, db, 500)
+	db.Close()
+
+	// 目标早于备份结束的位置
+	target, _ := recovery.ParseTarget("lsn:1")
+	if err := tbm.RestoreUntil(backupDir, archiveDir, filepath.Join(path, "early"), target, pager.DefaultOptions()); err == nil {
+		t.Fatal("restore to a target before the end of the backup succeeded")
+	}
+
+	// 归档中缺少段时不能只重放缺失之前的日志
+	archived, _ := filepath.Glob(filepath.Join(archiveDir, "redo_*.log"))
+	if len(archived) < 2 {
+		t.Fatalf("expected more archived segments: %v", archived)
+	}
+	os.Remove(archived[len(archived)-2])
+	target, _ = recovery.ParseTarget("")
+	if err := tbm.RestoreUntil(backupDir, archiveDir, filepath.Join(path, "gap"), target, pager.DefaultOptions()); err == nil {
+		t.Fatal("restore with a missing archived segment succeeded")
+	}
+}
+
+// 结果带有列的类型，修改语句只返回影响的行数，浮点数不丢失精度
+func TestResultList(t *testing.T) {
+	db := tbm.Create(t.TempDir())
+	defer db.Close()
+	execute := func(xid tm.XID, sql string) *tbm.ResultList {
+		stmt, err := parser.Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resultList *tbm.ResultList
+		switch stmt := stmt.(type) {
+		case ast.CreateTableStmt:
+			resultList, err = db.CreateTable(xid, stmt)
+		case ast.InsertIntoStmt:
+			resultList, err = db.Insert(xid, stmt)
+		case ast.UpdateStmt:
+			resultList, err = db.Update(xid, stmt)
+		case ast.DeleteStatement:
+			resultList, err = db.Delete(xid, stmt)
+		case ast.SelectStmt:
+			resultList, err = db.Select(xid, stmt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultList
+	}
+
+	xid := db.Begin()
+	defer db.Commit(xid)
+	if resultList := execute(xid, "create table t1(id int, name text, score float);"); resultList.Message != "CREATE TABLE t1" {
+		t.Fatalf("unexpected create table result %q", resultList.Message)
+	}
+	for i := 1; i <= 3; i++ {
+		resultList := execute(xid, fmt.Sprintf("insert into t1 values(%d, 'name%d', 0.1);", i, i))
+		if resultList.RowsAffected != 1 || len(resultList.Rows) != 0 || resultList.Message != "INSERT 1" {
+			t.Fatalf("unexpected insert result %+v", resultList)
+		}
+	}
+	if resultList := execute(xid, "update t1 set score = 1234567.123456789 where id = 2;"); resultList.RowsAffected != 1 || len(resultList.Rows) != 0 {
+		t.Fatalf("unexpected update result %+v", resultList)
+	}
+	if resultList := execute(xid, "update t1 set score = 1 where id = 9;"); resultList.RowsAffected != 0 || resultList.Message != "UPDATE 0" {
+		t.Fatalf("unexpected update result %+v", resultList)
+	}
+	if resultList := execute(xid, "delete from t1 where id = 3;"); resultList.RowsAffected != 1 || resultList.Message != "DELETE 1" {
+		t.Fatalf("unexpected delete result %+v", resultList)
+	}
+
+	resultList := execute(xid, "select * from t1;")
+	expected := []tbm.Column{
+		{Name: "id", Type: ast.CT_INT},
+		{Name: "name", Type: ast.CT_TEXT},
+		{Name: "score", Type: ast.CT_FLOAT},
+	}
+	if fmt.Sprint(resultList.Columns) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected columns %v", resultList.Columns)
+	}
+	table := "id | name  |             score\n" +
+		"---+-------+------------------\n" +
+		" 1 | name1 |               0.1\n" +
+		" 2 | name2 | 1234567.123456789\n" +
+		"(2 rows)\n"
+	if resultList.String() != table {
+		t.Fatalf("unexpected table\n%s", resultList)
+	}
+}
+
+// 用户和权限保存在 catalog 中，重新打开后仍然有效
+func TestUsers(t *testing.T) {
+	tbm.PasswordIterations = 16
+	defer func() { tbm.PasswordIterations = 4096 }()
+	path := t.TempDir()
+	db := tbm.Create(path)
+	if db.HasUsers() {
+		t.Fatal("new database should have no users")
+	}
+	if _, err := db.CreateTable(0, ast.CreateTableStmt{TableName: "t1", ColumnDefines: []*ast.ColumnDefine{{Name: "id", Type: ast.CT_INT}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser(ast.CreateUserStmt{Name: "admin", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser(ast.CreateUserStmt{Name: "admin", Password: "other"}); !errors.Is(err, tbm.ErrUserExists) {
+		t.Fatalf("expected %v, got %v", tbm.ErrUserExists, err)
+	}
+	if _, err := db.CreateUser(ast.CreateUserStmt{Name: "bob", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Grant(ast.GrantStmt{Privileges: ast.PRIV_SELECT | ast.PRIV_UPDATE, Table: "t1", User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = tbm.Open(path)
+	defer db.Close()
+	if err := db.Authenticate("admin", "secret"); err != nil || !db.IsSuperuser("admin") {
+		t.Fatalf("admin should be a superuser after reopen, %v", err)
+	}
+	if err := db.Authenticate("bob", "secret"); !errors.Is(err, tbm.ErrAuthentication) {
+		t.Fatalf("expected %v, got %v", tbm.ErrAuthentication, err)
+	}
+	if !db.HasPrivilege("bob", "t1", ast.PRIV_SELECT|ast.PRIV_UPDATE) || db.HasPrivilege("bob", "t1", ast.PRIV_DELETE) ||
+		db.HasPrivilege("bob", "t2", ast.PRIV_SELECT) {
+		t.Fatal("unexpected privileges after reopen")
+	}
+}
@@ -0,0 +1,242 @@
+package tbm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"minidb-go/parser/ast"
+	"minidb-go/storage/pager/pagedata"
+)
+
+var (
+	ErrUserExists     = errors.New("user already exists")
+	ErrUserNotExist   = errors.New("user not exist")
+	ErrAuthentication = errors.New("password authentication failed")
+	ErrLastSuperuser  = errors.New("cannot drop the last superuser")
+)
+
+// 计算密码哈希的 PBKDF2 迭代次数，只影响之后设置的密码
+var PasswordIterations = 4096
+
+const saltSize = 16
+
+// 数据库中是否有用户，没有用户时连接不需要认证
+func (tbm *TableManager) HasUsers() bool {
+	tbm.userLock.RLock()
+	defer tbm.userLock.RUnlock()
+	return len(tbm.metaData.Users) > 0
+}
+
+// 检查用户名和密码，失败时只返回 ErrAuthentication，不区分用户不存在和密码错误
+func (tbm *TableManager) Authenticate(name string, password string) error {
+	tbm.userLock.RLock()
+	user, ok := tbm.metaData.Users[name]
+	tbm.userLock.RUnlock()
+	if !ok {
+		// 用户不存在时也计算一次哈希，使认证的耗时不暴露用户是否存在
+		user = &pagedata.UserInfo{Salt: make([]byte, saltSize), Iterations: PasswordIterations}
+	}
+	hash := pbkdf2([]byte(password), user.Salt, user.Iterations)
+	if !hmac.Equal(hash, user.Hash) || !ok {
+		return ErrAuthentication
+	}
+	return nil
+}
+
+func (tbm *TableManager) IsSuperuser(name string) bool {
+	tbm.userLock.RLock()
+	defer tbm.userLock.RUnlock()
+	user, ok := tbm.metaData.Users[name]
+	return ok && user.Superuser
+}
+
+// 用户是否拥有表的权限，超级用户拥有所有的权限
+func (tbm *TableManager) HasPrivilege(name string, table string, privilege ast.Privilege) bool {
+	tbm.userLock.RLock()
+	defer tbm.userLock.RUnlock()
+	user, ok := tbm.metaData.Users[name]
+	if !ok {
+		return false
+	}
+	if user.Superuser {
+		return true
+	}
+	granted := user.Privileges[""] | user.Privileges[table]
+	return granted&privilege == privilege
+}
+
+// 第一个创建的用户是超级用户
+func (tbm *TableManager) CreateUser(stmt ast.CreateUserStmt) (*ResultList, error) {
+	err := tbm.updateUsers(func(users map[string]*pagedata.UserInfo) error {
+		if _, ok := users[stmt.Name]; ok {
+			return fmt.Errorf("%w: %s", ErrUserExists, stmt.Name)
+		}
+		user := &pagedata.UserInfo{
+			Name:       stmt.Name,
+			Superuser:  len(users) == 0,
+			Privileges: make(map[string]ast.Privilege),
+		}
+		if err := setPassword(user, stmt.Password); err != nil {
+			return err
+		}
+		users[stmt.Name] = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{Message: "CREATE USER " + stmt.Name}, nil
+}
+
+func (tbm *TableManager) AlterUser(stmt ast.AlterUserStmt) (*ResultList, error) {
+	err := tbm.updateUsers(func(users map[string]*pagedata.UserInfo) error {
+		user, ok := users[stmt.Name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotExist, stmt.Name)
+		}
+		return setPassword(user, stmt.Password)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{Message: "ALTER USER " + stmt.Name}, nil
+}
+
+func (tbm *TableManager) DropUser(stmt ast.DropUserStmt) (*ResultList, error) {
+	err := tbm.updateUsers(func(users map[string]*pagedata.UserInfo) error {
+		user, ok := users[stmt.Name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotExist, stmt.Name)
+		}
+		if user.Superuser {
+			superusers := 0
+			for _, other := range users {
+				if other.Superuser {
+					superusers++
+				}
+			}
+			// 只剩普通用户时没有人能够管理用户
+			if superusers == 1 && len(users) > 1 {
+				return ErrLastSuperuser
+			}
+		}
+		delete(users, stmt.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{Message: "DROP USER " + stmt.Name}, nil
+}
+
+func (tbm *TableManager) Grant(stmt ast.GrantStmt) (*ResultList, error) {
+	err := tbm.updateUsers(func(users map[string]*pagedata.UserInfo) error {
+		// 建表同样持有 backupLock
+		if stmt.Table != "" && tbm.metaData.GetTableInfo(stmt.Table) == nil {
+			return ErrTableNotExists
+		}
+		user, ok := users[stmt.User]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotExist, stmt.User)
+		}
+		user.Privileges[stmt.Table] |= stmt.Privileges
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{Message: "GRANT"}, nil
+}
+
+func (tbm *TableManager) Revoke(stmt ast.RevokeStmt) (*ResultList, error) {
+	err := tbm.updateUsers(func(users map[string]*pagedata.UserInfo) error {
+		user, ok := users[stmt.User]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotExist, stmt.User)
+		}
+		privileges := user.Privileges[stmt.Table] &^ stmt.Privileges
+		if privileges == 0 {
+			delete(user.Privileges, stmt.Table)
+		} else {
+			user.Privileges[stmt.Table] = privileges
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ResultList{Message: "REVOKE"}, nil
+}
+
+// 在用户的副本上修改，成功后替换 catalog 中的用户并写回 meta page，写回失败时恢复原来的用户。
+// 与建表一样不记录 redo log，持有 backupLock，不能与建表和备份同时进行
+func (tbm *TableManager) updateUsers(update func(users map[string]*pagedata.UserInfo) error) error {
+	tbm.backupLock.Lock()
+	defer tbm.backupLock.Unlock()
+	tbm.userLock.Lock()
+	users := make(map[string]*pagedata.UserInfo, len(tbm.metaData.Users)+1)
+	for name, user := range tbm.metaData.Users {
+		copied := *user
+		copied.Privileges = make(map[string]ast.Privilege, len(user.Privileges))
+		for table, privileges := range user.Privileges {
+			copied.Privileges[table] = privileges
+		}
+		users[name] = &copied
+	}
+	if err := update(users); err != nil {
+		tbm.userLock.Unlock()
+		return err
+	}
+	old := tbm.metaData.Users
+	tbm.pager.MetaPage().Lock()
+	tbm.metaData.Users = users
+	tbm.pager.MetaPage().Unlock()
+	tbm.userLock.Unlock()
+
+	tbm.pager.MarkDirty(tbm.pager.MetaPage())
+	if err := tbm.pager.FlushAll(); err != nil {
+		tbm.userLock.Lock()
+		tbm.pager.MetaPage().Lock()
+		tbm.metaData.Users = old
+		tbm.pager.MetaPage().Unlock()
+		tbm.userLock.Unlock()
+		// meta page 可能已经写入了新的用户，之后以原来的用户再次写回
+		tbm.pager.MarkDirty(tbm.pager.MetaPage())
+		return fmt.Errorf("write catalog failed: %w", err)
+	}
+	return nil
+}
+
+func setPassword(user *pagedata.UserInfo, password string) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	user.Salt = salt
+	user.Iterations = PasswordIterations
+	user.Hash = pbkdf2([]byte(password), salt, user.Iterations)
+	return nil
+}
+
+// PBKDF2-HMAC-SHA256，只生成一个块，密钥长度为 32 字节
+func pbkdf2(password []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	prf.Write(block[:])
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,87 @@
+package tbm
+
+import (
+	"minidb-go/parser/ast"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 清理指定的表，TableName 为空时清理所有表
+func (tbm *TableManager) Vacuum(vacuumStmt ast.VacuumStmt) (*ResultList, error) {
+	tableNames := []string{vacuumStmt.TableName}
+	if vacuumStmt.TableName == "" {
+		tableNames = tbm.tableNames()
+	} else if tbm.metaData.GetTableInfo(vacuumStmt.TableName) == nil {
+		return nil, ErrTableNotExists
+	}
+
+	messages := make([]string, 0, len(tableNames))
+	for _, tableName := range tableNames {
+		stat, err := tbm.serializer.Vacuum(tableName)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, "VACUUM "+stat.String())
+	}
+	return &ResultList{
+		Message: strings.Join(messages, "\n"),
+	}, nil
+}
+
+func (tbm *TableManager) tableNames() []string {
+	tableNames := make([]string, 0, len(tbm.metaData.Tables))
+	for tableName := range tbm.metaData.Tables {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	return tableNames
+}
+
+// 启动后台 autovacuum，每隔 interval 清理一次所有表
+func (tbm *TableManager) StartAutoVacuum(interval time.Duration) {
+	if interval <= 0 || tbm.stopVacuum != nil {
+		return
+	}
+	tbm.stopVacuum = make(chan struct{})
+	tbm.vacuumDone = make(chan struct{})
+	go func() {
+		defer close(tbm.vacuumDone)
+		defer tbm.recoverBackground("autovacuum")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tbm.stopVacuum:
+				return
+			case <-ticker.C:
+				tbm.autoVacuum()
+			}
+		}
+	}()
+}
+
+func (tbm *TableManager) autoVacuum() {
+	for _, tableName := range tbm.tableNames() {
+		stat, err := tbm.serializer.Vacuum(tableName)
+		if err != nil {
+			log.Errorf("autovacuum %s failed: %v", tableName, err)
+			continue
+		}
+		if stat.RemovedRows > 0 {
+			log.Infof("autovacuum %v", stat)
+		}
+	}
+}
+
+// 停止后台 autovacuum，并等待正在进行的清理结束
+func (tbm *TableManager) StopAutoVacuum() {
+	if tbm.stopVacuum == nil {
+		return
+	}
+	close(tbm.stopVacuum)
+	<-tbm.vacuumDone
+	tbm.stopVacuum = nil
+}
@@ -0,0 +1,151 @@
+package transporter
+
+import (
+	"fmt"
+	"io"
+)
+
+// 一条语句的全部结果
+type Result struct {
+	Columns []Column
+	Rows    [][]Value
+	// 返回或者影响的行数
+	RowCount uint64
+	Message  string
+	// 语句执行后连接的事务状态
+	Status byte
+}
+
+// 客户端发送 Hello 并等待 Welcome，服务端拒绝时返回 *Error
+func (conn *Conn) Handshake(params map[string]string) (*Welcome, error) {
+	if err := conn.Send(&Hello{Magic: Magic, Version: Version, Params: params}); err != nil {
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	msg, err := conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *Welcome:
+		conn.SetVersion(msg.Version)
+		return msg, nil
+	case *Error:
+		return nil, msg
+	}
+	return nil, fmt.Errorf("unexpected message %q during handshake", msg.messageType())
+}
+
+// 逐批读取一条语句的结果，结果结束之前连接不能发送其他请求
+type Stream struct {
+	conn *Conn
+	// 不返回数据行的语句为空
+	Columns  []Column
+	complete *Complete
+	err      error
+}
+
+// 发送一条语句，收到 Columns 或者结果已经结束时返回，语句执行出错时返回 *Error
+func (conn *Conn) Query(sql string) (*Stream, error) {
+	if err := conn.Send(&Query{SQL: sql}); err != nil {
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	msg, err := conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	stream := &Stream{conn: conn}
+	switch msg := msg.(type) {
+	case *Columns:
+		stream.Columns = msg.Columns
+	case *Complete:
+		stream.complete = msg
+	case *Error:
+		return nil, msg
+	default:
+		return nil, fmt.Errorf("unexpected message %q in the result", msg.messageType())
+	}
+	return stream, nil
+}
+
+// 读取下一批行，结果结束时返回 io.EOF，之后通过 Complete 得到执行信息。
+// 服务端在发送部分结果之后出错时返回 *Error，已经读取的行应该被丢弃
+func (stream *Stream) Next() ([][]Value, error) {
+	if stream.complete != nil {
+		return nil, io.EOF
+	}
+	if stream.err != nil {
+		return nil, stream.err
+	}
+	msg, err := stream.conn.Receive()
+	if err != nil {
+		stream.err = err
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *Rows:
+		return msg.Rows, nil
+	case *Complete:
+		stream.complete = msg
+		return nil, io.EOF
+	case *Error:
+		stream.err = msg
+		return nil, msg
+	}
+	stream.err = fmt.Errorf("unexpected message %q in the result", msg.messageType())
+	return nil, stream.err
+}
+
+// 结果结束时的 Complete，结果还没有读完时为 nil
+func (stream *Stream) Complete() *Complete {
+	return stream.complete
+}
+
+// 读取并丢弃剩余的行，返回结果中的错误
+func (stream *Stream) Close() error {
+	for {
+		if _, err := stream.Next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// 执行一条语句并读取全部结果，语句执行出错时返回 *Error，连接仍然可以使用
+func (conn *Conn) Exec(sql string) (*Result, error) {
+	stream, err := conn.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Columns: stream.Columns}
+	for {
+		rows, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, rows...)
+	}
+	complete := stream.Complete()
+	result.RowCount = complete.Rows
+	result.Message = complete.Message
+	result.Status = complete.Status
+	return result, nil
+}
+
+// 通知服务端关闭连接
+func (conn *Conn) Terminate() error {
+	if err := conn.Send(&Terminate{}); err != nil {
+		return err
+	}
+	return conn.Flush()
+}
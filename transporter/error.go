@@ -0,0 +1,40 @@
+package transporter
+
+// 错误码，新的版本只增加错误码，不改变已有错误码的含义
+const (
+	// 消息格式错误或者版本不支持，之后服务端断开连接
+	CodeProtocol uint16 = 1
+	// 语句无法解析
+	CodeSyntax uint16 = 2
+	// 表不存在
+	CodeUndefinedTable uint16 = 3
+	// 事务状态不允许执行该语句，例如在事务中 BEGIN
+	CodeTransactionState uint16 = 4
+	// 检测到死锁，事务已经被回滚
+	CodeDeadlock uint16 = 5
+	// 其他执行错误
+	CodeInternal uint16 = 6
+	// 游标不存在或者已经存在
+	CodeCursor uint16 = 7
+	// 用户没有执行该语句的权限
+	CodePermissionDenied uint16 = 8
+	// 用户名或者密码错误，之后服务端断开连接
+	CodeAuthentication uint16 = 9
+	// 要修改的行已经被并发的事务修改，事务已经被回滚
+	CodeSerialization uint16 = 10
+)
+
+// 服务端返回的错误，也是 Error 消息
+type Error struct {
+	Code    uint16
+	Message string
+	Status  byte
+}
+
+func NewError(code uint16, err error) *Error {
+	return &Error{Code: code, Message: err.Error()}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
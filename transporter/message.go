@@ -0,0 +1,211 @@
+package transporter
+
+import (
+	"fmt"
+)
+
+type Message interface {
+	messageType() byte
+	encode(w *writer)
+	decode(r *reader)
+}
+
+// 值为 nil、int64、float64 或者 string
+type Value interface{}
+
+type Hello struct {
+	Magic   uint32
+	Version uint16
+	Params  map[string]string
+}
+
+type Welcome struct {
+	Version uint16
+	Server  string
+}
+
+type Query struct {
+	SQL string
+}
+
+type Terminate struct{}
+
+type Column struct {
+	Name     string
+	Type     uint8
+	Nullable bool
+}
+
+type Columns struct {
+	Columns []Column
+}
+
+// 一批数据行，每行的值的个数相同
+type Rows struct {
+	Rows [][]Value
+}
+
+type Complete struct {
+	Rows    uint64
+	Message string
+	Status  byte
+}
+
+func (*Hello) messageType() byte     { return MsgHello }
+func (*Welcome) messageType() byte   { return MsgWelcome }
+func (*Query) messageType() byte     { return MsgQuery }
+func (*Terminate) messageType() byte { return MsgTerminate }
+func (*Columns) messageType() byte   { return MsgColumns }
+func (*Rows) messageType() byte      { return MsgRows }
+func (*Complete) messageType() byte  { return MsgComplete }
+func (*Error) messageType() byte     { return MsgError }
+
+func (msg *Hello) encode(w *writer) {
+	w.uint32(msg.Magic)
+	w.uint16(msg.Version)
+	w.params(msg.Params)
+}
+
+func (msg *Hello) decode(r *reader) {
+	msg.Magic = r.uint32()
+	msg.Version = r.uint16()
+	msg.Params = r.params()
+}
+
+func (msg *Welcome) encode(w *writer) {
+	w.uint16(msg.Version)
+	w.string(msg.Server)
+}
+
+func (msg *Welcome) decode(r *reader) {
+	msg.Version = r.uint16()
+	msg.Server = r.string()
+}
+
+func (msg *Query) encode(w *writer) {
+	w.string(msg.SQL)
+}
+
+func (msg *Query) decode(r *reader) {
+	msg.SQL = r.string()
+}
+
+func (msg *Terminate) encode(w *writer) {}
+
+func (msg *Terminate) decode(r *reader) {}
+
+func (msg *Columns) encode(w *writer) {
+	w.uint16(uint16(len(msg.Columns)))
+	for _, column := range msg.Columns {
+		w.string(column.Name)
+		w.uint8(column.Type)
+		if w.version >= 2 {
+			var flags uint8
+			if column.Nullable {
+				flags |= flagNullable
+			}
+			w.uint8(flags)
+		}
+	}
+}
+
+func (msg *Columns) decode(r *reader) {
+	count := r.uint16()
+	for i := 0; i < int(count) && r.err == nil; i++ {
+		name := r.string()
+		column := Column{Name: name, Type: r.uint8()}
+		if r.version >= 2 {
+			column.Nullable = r.uint8()&flagNullable != 0
+		}
+		msg.Columns = append(msg.Columns, column)
+	}
+}
+
+func (msg *Rows) encode(w *writer) {
+	columns := 0
+	if len(msg.Rows) > 0 {
+		columns = len(msg.Rows[0])
+	}
+	w.uint32(uint32(len(msg.Rows)))
+	w.uint16(uint16(columns))
+	for _, row := range msg.Rows {
+		for _, value := range row {
+			w.value(value)
+		}
+	}
+}
+
+func (msg *Rows) decode(r *reader) {
+	count := r.uint32()
+	columns := int(r.uint16())
+	// 每个值至少 1 字节，行数超过剩余的数据时消息不完整
+	if count > 0 && (columns == 0 || int(count) > len(r.data)/columns) {
+		r.err = fmt.Errorf("%d rows of %d columns in %d bytes", count, columns, len(r.data))
+		return
+	}
+	msg.Rows = make([][]Value, 0, count)
+	for i := 0; i < int(count) && r.err == nil; i++ {
+		row := make([]Value, columns)
+		for j := range row {
+			row[j] = r.value()
+		}
+		msg.Rows = append(msg.Rows, row)
+	}
+}
+
+func (msg *Complete) encode(w *writer) {
+	w.uint64(msg.Rows)
+	w.string(msg.Message)
+	w.uint8(msg.Status)
+}
+
+func (msg *Complete) decode(r *reader) {
+	msg.Rows = r.uint64()
+	msg.Message = r.string()
+	msg.Status = r.uint8()
+}
+
+func (msg *Error) encode(w *writer) {
+	w.uint16(msg.Code)
+	w.string(msg.Message)
+	w.uint8(msg.Status)
+}
+
+func (msg *Error) decode(r *reader) {
+	msg.Code = r.uint16()
+	msg.Message = r.string()
+	msg.Status = r.uint8()
+}
+
+func decodeMessage(typ byte, body []byte, version uint16) (Message, error) {
+	var msg Message
+	switch typ {
+	case MsgHello:
+		msg = &Hello{}
+	case MsgWelcome:
+		msg = &Welcome{}
+	case MsgQuery:
+		msg = &Query{}
+	case MsgTerminate:
+		msg = &Terminate{}
+	case MsgColumns:
+		msg = &Columns{}
+	case MsgRows:
+		msg = &Rows{}
+	case MsgComplete:
+		msg = &Complete{}
+	case MsgError:
+		msg = &Error{}
+	default:
+		return nil, fmt.Errorf("unknown message type %q", typ)
+	}
+	r := &reader{data: body, version: version}
+	msg.decode(r)
+	if r.err != nil {
+		return nil, fmt.Errorf("decode message %q failed: %w", typ, r.err)
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("decode message %q failed: %w", typ, ErrUnexpectedData)
+	}
+	return msg, nil
+}
@@ -0,0 +1,340 @@
+/*
+transporter 实现客户端与服务端之间的二进制协议，协议只依赖下面的格式，其他语言的客户端可以直接实现。
+
+每个消息的格式为：
+
+	type    uint8   消息类型
+	length  uint32  payload 的长度，不包含 type 和 length，不超过 MaxMessageSize
+	payload
+
+整数都是大端序，string 为 uint32 的字节数加上 UTF-8 编码的内容。
+
+连接建立后客户端先发送 Hello，服务端回复 Welcome 后开始处理请求，
+客户端的版本低于服务端支持的最低版本时回复 Error 并断开连接：
+
+	Hello     'H'  magic uint32 (0x4d444257) | version uint16 | count uint16 | count 个 (name string, value string)
+	Welcome   'W'  version uint16 | server string
+
+version 为客户端支持的最高版本，服务端使用两者中较低的版本，当前版本为 2。
+Hello 中的参数为客户端的设置，服务端忽略不认识的参数。
+数据库中有用户时服务端以参数 user 和 password 认证，失败时回复 CodeAuthentication 的 Error 并断开连接。
+创建第一个用户之前建立的连接没有认证，之后只能结束进行中的事务，其他语句返回 CodePermissionDenied。
+密码以明文发送，不可信的网络中应该只通过 unix socket 或者加密的隧道连接。
+
+之后客户端发送请求，每个请求的响应以 Complete 或者 Error 结束：
+
+	Query     'Q'  sql string     执行一条以分号结尾的语句
+	Terminate 'X'                 关闭连接
+
+	Columns   'C'  count uint16 | count 个 (name string, type uint8, flags uint8)
+	Rows      'D'  count uint32 | columns uint16 | count 行，每行依次为 columns 个值
+	Complete  'Z'  rows uint64 | message string | status uint8
+	Error     'E'  code uint16 | message string | status uint8
+
+返回数据行的语句先发送一个 Columns，之后是任意个 Rows，每个 Rows 最多包含一批行，
+Complete 表示结果结束，rows 为返回或者影响的行数，message 为语句的执行信息，可以为空。
+status 为请求结束后连接的事务状态，'I' 表示没有进行中的事务，'T' 表示在事务中。
+服务端边读取边发送结果，发送部分 Rows 之后出错时以 Error 结束，客户端需要丢弃已经收到的行。
+
+结果很大时可以在事务中使用游标分批读取，每次 FETCH 的结果与 SELECT 的格式相同：
+
+	DECLARE name CURSOR FOR SELECT ...;
+	FETCH [count | NEXT | ALL] [FROM] name;
+	CLOSE name;
+
+列的类型为 1 INT、2 FLOAT、3 TEXT。flags 的最低位表示列的值可能为 NULL，版本 1 的 Columns 没有 flags。
+INSERT、UPDATE、DELETE 不返回数据行，Complete 中的 rows 为影响的行数。每个值以 1 字节的 tag 开头：
+
+	0  NULL   没有数据
+	1  INT    int64
+	2  FLOAT  float64，IEEE 754 的位表示
+	3  TEXT   string
+
+错误码见 Code 开头的常量，客户端可以根据错误码判断错误的类型，message 为给用户看的描述。
+*/
+package transporter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	Magic uint32 = 0x4d444257
+
+	// 当前版本和服务端支持的最低版本
+	Version    uint16 = 2
+	MinVersion uint16 = 1
+
+	// 单个消息 payload 的最大长度
+	MaxMessageSize = 1 << 26
+	// 输出缓冲超过该大小时写入连接
+	flushSize = 1 << 16
+)
+
+// 消息类型
+const (
+	MsgHello     byte = 'H'
+	MsgWelcome   byte = 'W'
+	MsgQuery     byte = 'Q'
+	MsgTerminate byte = 'X'
+	MsgColumns   byte = 'C'
+	MsgRows      byte = 'D'
+	MsgComplete  byte = 'Z'
+	MsgError     byte = 'E'
+)
+
+// 列的类型
+const (
+	TypeInt   uint8 = 1
+	TypeFloat uint8 = 2
+	TypeText  uint8 = 3
+)
+
+// 值的 tag
+const (
+	tagNull  uint8 = 0
+	tagInt   uint8 = 1
+	tagFloat uint8 = 2
+	tagText  uint8 = 3
+)
+
+// Column 的 flags
+const (
+	flagNullable uint8 = 1
+)
+
+// 连接的事务状态
+const (
+	StatusIdle          byte = 'I'
+	StatusInTransaction byte = 'T'
+)
+
+var (
+	ErrMessageSize    = errors.New("message too large")
+	ErrBadMagic       = errors.New("not a minidb client")
+	ErrUnexpectedData = errors.New("unexpected data at the end of the message")
+)
+
+// 收发消息的连接，发送的消息先写入缓冲区，调用 Flush 后写入连接
+type Conn struct {
+	rw     io.ReadWriter
+	reader *bufio.Reader
+	// 握手之后双方使用的协议版本
+	version uint16
+
+	buf []byte
+	err error
+}
+
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		rw:      rw,
+		reader:  bufio.NewReader(rw),
+		version: Version,
+	}
+}
+
+// 设置握手协商的版本，之后的消息按该版本编码
+func (conn *Conn) SetVersion(version uint16) {
+	conn.version = version
+}
+
+func (conn *Conn) Version() uint16 {
+	return conn.version
+}
+
+// 读取一个消息，不认识的消息类型返回错误
+func (conn *Conn) Receive() (Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxMessageSize {
+		return nil, ErrMessageSize
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn.reader, body); err != nil {
+		return nil, err
+	}
+	return decodeMessage(header[0], body, conn.version)
+}
+
+// 将消息写入缓冲区，缓冲区较大时写入连接
+func (conn *Conn) Send(msg Message) error {
+	start := len(conn.buf)
+	conn.buf = append(conn.buf, msg.messageType(), 0, 0, 0, 0)
+	w := &writer{buf: conn.buf, version: conn.version}
+	msg.encode(w)
+	conn.buf = w.buf
+	size := len(conn.buf) - start - 5
+	if size > MaxMessageSize {
+		conn.buf = conn.buf[:start]
+		return ErrMessageSize
+	}
+	binary.BigEndian.PutUint32(conn.buf[start+1:], uint32(size))
+	if len(conn.buf) > flushSize {
+		return conn.Flush()
+	}
+	return conn.err
+}
+
+// 将缓冲的消息写入连接，写入失败后连接不能再使用
+func (conn *Conn) Flush() error {
+	if conn.err == nil && len(conn.buf) > 0 {
+		_, conn.err = conn.rw.Write(conn.buf)
+	}
+	conn.buf = conn.buf[:0]
+	return conn.err
+}
+
+type writer struct {
+	buf     []byte
+	version uint16
+}
+
+func (w *writer) uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *writer) uint16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *writer) uint32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *writer) uint64(v uint64) {
+	w.uint32(uint32(v >> 32))
+	w.uint32(uint32(v))
+}
+
+func (w *writer) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// 按名字排序写入，同样的参数编码相同
+func (w *writer) params(params map[string]string) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.uint16(uint16(len(names)))
+	for _, name := range names {
+		w.string(name)
+		w.string(params[name])
+	}
+}
+
+// 值只能是 nil、int64、float64 和 string
+func (w *writer) value(v Value) {
+	switch v := v.(type) {
+	case nil:
+		w.uint8(tagNull)
+	case int64:
+		w.uint8(tagInt)
+		w.uint64(uint64(v))
+	case float64:
+		w.uint8(tagFloat)
+		w.uint64(math.Float64bits(v))
+	case string:
+		w.uint8(tagText)
+		w.string(v)
+	default:
+		panic(fmt.Sprintf("unsupported value %T", v))
+	}
+}
+
+// 消息体的读取，数据不足时记录错误
+type reader struct {
+	data    []byte
+	version uint16
+	err     error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	n := r.uint32()
+	if n > uint32(len(r.data)) {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *reader) params() map[string]string {
+	count := r.uint16()
+	params := make(map[string]string, count)
+	for i := 0; i < int(count) && r.err == nil; i++ {
+		name := r.string()
+		params[name] = r.string()
+	}
+	return params
+}
+
+func (r *reader) value() Value {
+	switch tag := r.uint8(); tag {
+	case tagNull:
+		return nil
+	case tagInt:
+		return int64(r.uint64())
+	case tagFloat:
+		return math.Float64frombits(r.uint64())
+	case tagText:
+		return r.string()
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown value tag %d", tag)
+		}
+		return nil
+	}
+}
@@ -1,14 +1,20 @@
 package cache
 
-type Cache interface {
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+type Cache[K comparable, V any] interface {
 	// Get returns the value for the given key.
-	Get(key interface{}) (value interface{}, ok bool)
+	Get(key K) (value V, ok bool)
 
 	// Set sets the value for the given key.
-	Set(key interface{}, value interface{})
+	Set(key K, value V)
 
 	// Remove deletes the value for the given key.
-	Remove(key interface{})
+	// Remove does not call the eviction function.
+	Remove(key K)
 
 	// Clear clears the cache.
 	// Clear()
@@ -32,21 +38,72 @@ type Cache interface {
 	// SetCapacity(capacity int)
 
 	// SetEviction sets the eviction function for the cache.
-	SetEviction(eviction Eviction)
+	SetEviction(eviction Eviction[K, V])
 
 	// SetExpiration sets the expiration function for the cache.
 	// SetExpiration(expiration Expiration)
 
+	// Stats returns the hit, miss and eviction counters of the cache.
+	Stats() Stats
+
 	Close()
 }
 
-type Eviction func(key, value interface{})
+// 只有因为容量不足而被淘汰的元素才会调用 Eviction
+type Eviction[K comparable, V any] func(key K, value V)
 
 // type Expiration func(key string, value []byte) bool
 
-type CacheItems []*CacheItem
+type CacheItems[K comparable, V any] []*CacheItem[K, V]
+
+type CacheItem[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// 命中率，没有访问时返回 0
+func (stats Stats) HitRatio() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+func (stats Stats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d hit_ratio=%.4f",
+		stats.Hits, stats.Misses, stats.Evictions, stats.HitRatio())
+}
+
+// 可以并发更新的统计计数器，嵌入到各个 cache 的实现中
+type Counter struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func (c *Counter) Hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *Counter) Miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *Counter) Evict() {
+	atomic.AddUint64(&c.evictions, 1)
+}
 
-type CacheItem struct {
-	Key   interface{}
-	Value interface{}
+func (c *Counter) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
 }
@@ -0,0 +1,117 @@
+package cache_test
+
+import (
+	"fmt"
+	"math/rand"
+	"minidb-go/util"
+	"minidb-go/util/cache"
+	"minidb-go/util/cache/clock"
+	"minidb-go/util/cache/lru"
+	"minidb-go/util/cache/sharded"
+	"minidb-go/util/cache/wtinylfu"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	BENCH_CAPACITY = 1 << 12
+	BENCH_KEYS     = 1 << 16
+	BENCH_SHARDS   = 16
+)
+
+func hashUUID(key util.UUID) uint64 {
+	return key.Hash()
+}
+
+var benchCaches = []struct {
+	name     string
+	newCache func() cache.Cache[util.UUID, int]
+}{
+	{"lru", func() cache.Cache[util.UUID, int] {
+		return lru.NewLRU[util.UUID, int](BENCH_CAPACITY)
+	}},
+	{"wtinylfu", func() cache.Cache[util.UUID, int] {
+		return wtinylfu.NewWTinyLFU[util.UUID, int](BENCH_CAPACITY, nil)
+	}},
+	{"clock", func() cache.Cache[util.UUID, int] {
+		return clock.NewClock[util.UUID, int](BENCH_CAPACITY)
+	}},
+	{"sharded-lru", func() cache.Cache[util.UUID, int] {
+		return sharded.NewSharded(BENCH_SHARDS, BENCH_CAPACITY, hashUUID,
+			func(maxEntries int) cache.Cache[util.UUID, int] {
+				return lru.NewLRU[util.UUID, int](maxEntries)
+			})
+	}},
+	{"sharded-wtinylfu", func() cache.Cache[util.UUID, int] {
+		return sharded.NewSharded(BENCH_SHARDS, BENCH_CAPACITY, hashUUID,
+			func(maxEntries int) cache.Cache[util.UUID, int] {
+				return wtinylfu.NewWTinyLFU[util.UUID, int](maxEntries, nil)
+			})
+	}},
+	{"sharded-clock", func() cache.Cache[util.UUID, int] {
+		return sharded.NewSharded(BENCH_SHARDS, BENCH_CAPACITY, hashUUID,
+			func(maxEntries int) cache.Cache[util.UUID, int] {
+				return clock.NewClock[util.UUID, int](maxEntries)
+			})
+	}},
+}
+
+// 模拟按主键的点查：key 服从 zipf 分布，未命中时从“磁盘”读入并放入 cache
+// 运行 go test -bench Cache -run ^$ ./util/cache 比较不同 GOMAXPROCS 下的吞吐量
+func BenchmarkCache(b *testing.B) {
+	for _, bc := range benchCaches {
+		for _, p := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/procs=%d", bc.name, p), func(b *testing.B) {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(p))
+				c := bc.newCache()
+				var seed int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+					zipf := rand.NewZipf(r, 1.1, 1, BENCH_KEYS-1)
+					for pb.Next() {
+						key := util.UUID(zipf.Uint64())
+						if _, ok := c.Get(key); !ok {
+							c.Set(key, int(key))
+						}
+					}
+				})
+				b.StopTimer()
+				b.ReportMetric(c.Stats().HitRatio(), "hit-ratio")
+			})
+		}
+	}
+}
+
+func TestSharded(t *testing.T) {
+	evicted := 0
+	c := sharded.NewSharded(3, 64, hashUUID,
+		func(maxEntries int) cache.Cache[util.UUID, int] {
+			return lru.NewLRU[util.UUID, int](maxEntries)
+		})
+	c.SetEviction(func(key util.UUID, value int) {
+		evicted++
+	})
+	if c.ShardNum() != 4 {
+		t.Fatalf("expected 4 shards, got %d", c.ShardNum())
+	}
+	for i := util.UUID(0); i < 1000; i++ {
+		c.Set(i, int(i))
+	}
+	if c.Len() > 64 || c.Len()+evicted != 1000 {
+		t.Fatalf("unexpected size %d with %d evictions", c.Len(), evicted)
+	}
+	for i := util.UUID(999); i > 990; i-- {
+		if v, ok := c.Get(i); !ok || v != int(i) {
+			t.Fatalf("recent key %d not found", i)
+		}
+	}
+	c.Remove(999)
+	if _, ok := c.Get(999); ok {
+		t.Fatalf("removed key found")
+	}
+	if stats := c.Stats(); stats.Hits != 9 || stats.Misses != 1 || int(stats.Evictions) != evicted {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+CLOCK 是 LRU 的近似实现，所有元素放在一个环形数组中，每个元素有一个访问位。
+访问元素时只设置访问位，不需要移动元素，所以 Get 的开销比 LRU 小。
+需要淘汰时指针沿着环移动，清除遇到的访问位，淘汰第一个访问位为 0 的元素。
+*/
+package clock
+
+import (
+	"minidb-go/util/cache"
+	"sync"
+)
+
+type entry[K comparable, V any] struct {
+	key        K
+	value      V
+	referenced bool
+}
+
+type Clock[K comparable, V any] struct {
+	maxEntries int
+	onEvicted  cache.Eviction[K, V]
+
+	// 环形数组，nil 表示空槽位
+	entries []*entry[K, V]
+	// key 所在的槽位
+	index map[K]int
+	// 空槽位
+	free []int
+	// 时钟指针
+	hand int
+
+	cache.Counter
+
+	lock sync.Mutex
+}
+
+func NewClock[K comparable, V any](maxEntries int) *Clock[K, V] {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	free := make([]int, maxEntries)
+	for i := range free {
+		free[i] = maxEntries - 1 - i
+	}
+	return &Clock[K, V]{
+		maxEntries: maxEntries,
+		entries:    make([]*entry[K, V], maxEntries),
+		index:      make(map[K]int),
+		free:       free,
+	}
+}
+
+func (cache *Clock[K, V]) Get(key K) (value V, ok bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if i, hit := cache.index[key]; hit {
+		cache.Hit()
+		cache.entries[i].referenced = true
+		return cache.entries[i].value, true
+	}
+	cache.Miss()
+	return
+}
+
+func (cache *Clock[K, V]) Set(key K, value V) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if i, ok := cache.index[key]; ok {
+		cache.entries[i].value = value
+		cache.entries[i].referenced = true
+		return
+	}
+	if len(cache.free) == 0 {
+		cache.evict()
+	}
+	i := cache.free[len(cache.free)-1]
+	cache.free = cache.free[:len(cache.free)-1]
+	// 放入元素也算作一次访问
+	cache.entries[i] = &entry[K, V]{key: key, value: value, referenced: true}
+	cache.index[key] = i
+}
+
+// 移动时钟指针直到找到访问位为 0 的元素，然后淘汰它
+func (cache *Clock[K, V]) evict() {
+	for {
+		e := cache.entries[cache.hand]
+		if e != nil {
+			if !e.referenced {
+				break
+			}
+			e.referenced = false
+		}
+		cache.hand = (cache.hand + 1) % cache.maxEntries
+	}
+	victim := cache.removeAt(cache.hand)
+	cache.hand = (cache.hand + 1) % cache.maxEntries
+	cache.Evict()
+	if cache.onEvicted != nil {
+		cache.onEvicted(victim.key, victim.value)
+	}
+}
+
+func (cache *Clock[K, V]) removeAt(i int) *entry[K, V] {
+	e := cache.entries[i]
+	cache.entries[i] = nil
+	delete(cache.index, e.key)
+	cache.free = append(cache.free, i)
+	return e
+}
+
+// 删除元素，不会调用 onEvicted
+func (cache *Clock[K, V]) Remove(key K) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if i, ok := cache.index[key]; ok {
+		cache.removeAt(i)
+	}
+}
+
+func (cache *Clock[K, V]) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return len(cache.index)
+}
+
+func (cache *Clock[K, V]) SetEviction(eviction cache.Eviction[K, V]) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.onEvicted = eviction
+}
+
+// 对所有剩余的元素调用 onEvicted
+func (cache *Clock[K, V]) Close() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for i, e := range cache.entries {
+		if e == nil {
+			continue
+		}
+		cache.removeAt(i)
+		if cache.onEvicted != nil {
+			cache.onEvicted(e.key, e.value)
+		}
+	}
+}
@@ -8,46 +8,48 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type LRU struct {
+type LRU[K comparable, V any] struct {
 	MaxEntries int
-	OnEvicted  func(key interface{}, value interface{})
+	OnEvicted  cache.Eviction[K, V]
 
 	// list 存放 entry 的指针
 	cacheList *list.List
 	// map 存放 list node 的指针
-	cacheMap map[interface{}]*list.Element
+	cacheMap map[K]*list.Element
 
-	lock sync.RWMutex
+	cache.Counter
+
+	lock sync.Mutex
 }
 
-type entry struct {
-	key   interface{}
-	value interface{}
+type entry[K comparable, V any] struct {
+	key   K
+	value V
 }
 
-func NewLRU(maxEntries int) (cache *LRU) {
-	return &LRU{
+func NewLRU[K comparable, V any](maxEntries int) *LRU[K, V] {
+	return &LRU[K, V]{
 		MaxEntries: maxEntries,
 		cacheList:  list.New(),
-		cacheMap:   make(map[interface{}]*list.Element),
+		cacheMap:   make(map[K]*list.Element),
 	}
 }
 
-func (cache *LRU) Set(key interface{}, value interface{}) {
+func (cache *LRU[K, V]) Set(key K, value V) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 	if cache.cacheList == nil {
 		cache.cacheList = list.New()
-		cache.cacheMap = make(map[interface{}]*list.Element)
+		cache.cacheMap = make(map[K]*list.Element)
 	}
 
 	if elementValue, ok := cache.cacheMap[key]; ok {
 		cache.cacheList.MoveToFront(elementValue)
-		elementValue.Value = &entry{key, value}
+		elementValue.Value = &entry[K, V]{key, value}
 		return
 	}
 
-	element := cache.cacheList.PushFront(&entry{key, value})
+	element := cache.cacheList.PushFront(&entry[K, V]{key, value})
 	cache.cacheMap[key] = element
 
 	if cache.MaxEntries != 0 && cache.cacheList.Len() > cache.MaxEntries {
@@ -55,9 +57,10 @@ func (cache *LRU) Set(key interface{}, value interface{}) {
 	}
 }
 
-func (cache *LRU) Get(key interface{}) (value interface{}, ok bool) {
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
+func (cache *LRU[K, V]) Get(key K) (value V, ok bool) {
+	// MoveToFront 会修改链表，所以需要写锁
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 
 	if cache.cacheMap == nil {
 		return
@@ -65,23 +68,29 @@ func (cache *LRU) Get(key interface{}) (value interface{}, ok bool) {
 
 	// 返回 value 的指针，使之可以修改
 	if ele, hit := cache.cacheMap[key]; hit {
+		cache.Hit()
 		cache.cacheList.MoveToFront(ele)
-		return ele.Value.(*entry).value, true
+		return ele.Value.(*entry[K, V]).value, true
 	}
+	cache.Miss()
 	return
 }
 
-func (cache *LRU) removeOldest() {
+func (cache *LRU[K, V]) removeOldest() {
 	if cache.cacheMap == nil {
 		return
 	}
 	element := cache.cacheList.Back()
 	if element != nil {
-		cache.removeElement(element)
+		node := cache.removeElement(element)
+		cache.Evict()
+		if cache.OnEvicted != nil {
+			cache.OnEvicted(node.key, node.value)
+		}
 	}
 }
 
-func (cache *LRU) Remove(key interface{}) {
+func (cache *LRU[K, V]) Remove(key K) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 	if cache.cacheMap == nil {
@@ -92,32 +101,29 @@ func (cache *LRU) Remove(key interface{}) {
 	}
 }
 
-func (cache *LRU) removeElement(element *list.Element) {
-	node := element.Value.(*entry)
-	key, value := node.key, node.value
-	delete(cache.cacheMap, key)
-	if cache.OnEvicted != nil {
-		cache.OnEvicted(key, value)
-	}
+func (cache *LRU[K, V]) removeElement(element *list.Element) *entry[K, V] {
+	node := element.Value.(*entry[K, V])
+	delete(cache.cacheMap, node.key)
 	cache.cacheList.Remove(element)
+	return node
 }
 
-func (cache *LRU) Len() int {
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
+func (cache *LRU[K, V]) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 
 	return cache.cacheList.Len()
 }
 
-func (cache *LRU) SetEviction(eviction cache.Eviction) {
+func (cache *LRU[K, V]) SetEviction(eviction cache.Eviction[K, V]) {
 	cache.OnEvicted = eviction
 }
 
-func (cache *LRU) Close() {
+func (cache *LRU[K, V]) Close() {
 	log.Info("clearing pages in cache...")
 	if cache.OnEvicted != nil {
 		for cache.cacheList.Len() > 0 {
-			entry := cache.cacheList.Back().Value.(*entry)
+			entry := cache.cacheList.Back().Value.(*entry[K, V])
 			cache.OnEvicted(entry.key, entry.value)
 			cache.cacheList.Remove(cache.cacheList.Back())
 			delete(cache.cacheMap, entry.key)
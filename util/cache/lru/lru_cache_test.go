@@ -6,17 +6,16 @@ import (
 )
 
 func TestCache(t *testing.T) {
-	cache := lru.NewLRU(2)
-	cache.OnEvicted = func(key interface{}, value interface{}) {
-		t.Log("remove: ", key, value)
-	}
 	type P struct {
 		X, Y int
 	}
+	cache := lru.NewLRU[int, *P](2)
+	cache.OnEvicted = func(key int, value *P) {
+		t.Log("remove: ", key, value)
+	}
 	cache.Set(1, &P{1, 2})
 
-	ele, _ := cache.Get(1)
-	v := ele.(*P)
+	v, _ := cache.Get(1)
 	*v = P{2, 3}
 
 	cache.Set(2, &P{2, 3})
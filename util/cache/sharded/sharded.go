@@ -0,0 +1,104 @@
+/*
+Sharded 将 key 按哈希值分到多个相互独立的 cache 中，每个分片有自己的锁和淘汰策略。
+不同分片上的访问不会互相阻塞，适合多个 goroutine 并发读取的场景。
+淘汰只在分片内部进行，所以整体的淘汰顺序只是近似的 LRU 或 W-TinyLFU。
+*/
+package sharded
+
+import (
+	"minidb-go/util/cache"
+)
+
+type Sharded[K comparable, V any] struct {
+	shards []cache.Cache[K, V]
+	// 分片数为 2 的幂，mask = 分片数 - 1
+	mask uint64
+	hash func(key K) uint64
+}
+
+// shardNum: 分片数量，会向上取整为 2 的幂
+// maxEntries: 所有分片的总容量，平均分给每个分片
+// hash: key 的哈希函数
+// newShard: 根据容量创建一个分片
+func NewSharded[K comparable, V any](shardNum int, maxEntries int, hash func(key K) uint64,
+	newShard func(maxEntries int) cache.Cache[K, V]) *Sharded[K, V] {
+	n := 1
+	for n < shardNum {
+		n <<= 1
+	}
+	shardCap := (maxEntries + n - 1) / n
+	if shardCap < 1 {
+		shardCap = 1
+	}
+	shards := make([]cache.Cache[K, V], n)
+	for i := range shards {
+		shards[i] = newShard(shardCap)
+	}
+	return &Sharded[K, V]{
+		shards: shards,
+		mask:   uint64(n - 1),
+		hash:   hash,
+	}
+}
+
+// 打散哈希值，避免连续的 key 落在相邻的分片上造成不均匀
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (s *Sharded[K, V]) shard(key K) cache.Cache[K, V] {
+	return s.shards[mix(s.hash(key))&s.mask]
+}
+
+func (s *Sharded[K, V]) Get(key K) (value V, ok bool) {
+	return s.shard(key).Get(key)
+}
+
+func (s *Sharded[K, V]) Set(key K, value V) {
+	s.shard(key).Set(key, value)
+}
+
+func (s *Sharded[K, V]) Remove(key K) {
+	s.shard(key).Remove(key)
+}
+
+func (s *Sharded[K, V]) Len() int {
+	n := 0
+	for _, shard := range s.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (s *Sharded[K, V]) SetEviction(eviction cache.Eviction[K, V]) {
+	for _, shard := range s.shards {
+		shard.SetEviction(eviction)
+	}
+}
+
+// 所有分片的统计之和
+func (s *Sharded[K, V]) Stats() cache.Stats {
+	stats := cache.Stats{}
+	for _, shard := range s.shards {
+		shardStats := shard.Stats()
+		stats.Hits += shardStats.Hits
+		stats.Misses += shardStats.Misses
+		stats.Evictions += shardStats.Evictions
+	}
+	return stats
+}
+
+func (s *Sharded[K, V]) ShardNum() int {
+	return len(s.shards)
+}
+
+func (s *Sharded[K, V]) Close() {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+}
@@ -2,8 +2,6 @@ package wtinylfu
 
 import (
 	"math"
-
-	"github.com/sirupsen/logrus"
 )
 
 type Hashable interface {
@@ -77,8 +75,10 @@ func NewCountMinSketch(maxEntries int) *CountMinSketch {
 		hashNum = 1
 	}
 	// hashNum := 4
-	logrus.Error(hashNum)
 	tableSize := int(-float64(maxEntries) * math.Log(errorRate) / (ln2 * ln2) * 0.5)
+	if tableSize == 0 {
+		tableSize = 1
+	}
 	return &CountMinSketch{
 		maxEntries:   maxEntries,
 		tableSize:    tableSize,
@@ -132,6 +132,13 @@ func min[T Ordered](a, b T) T {
 	return b
 }
 
+func max[T Ordered](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // 获得次数数组中的最小值
 func (c *CountMinSketch) Count(e Hashable) int {
 	hashs := c.getHashs(e)
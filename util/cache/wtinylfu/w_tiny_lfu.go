@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"math/rand"
+	"minidb-go/util/cache"
 	"sync"
 )
 
@@ -17,10 +18,8 @@ type entry[K KeyType, V any] struct {
 	value V
 }
 
-type Eviction[K KeyType, V any] func(key K, value V)
-
 type WTinyLFU[K KeyType, V any] struct {
-	onEvicted Eviction[K, V]
+	onEvicted cache.Eviction[K, V]
 
 	maxSize int
 
@@ -42,6 +41,8 @@ type WTinyLFU[K KeyType, V any] struct {
 	// 频率列表
 	frequencyTable *CountMinSketch
 
+	cache.Counter
+
 	lock sync.Mutex
 }
 
@@ -50,13 +51,16 @@ var (
 )
 
 // NewWTinyLFU[K KeyType, V any] 初始化一个新的 WTinyLFU[K KeyType, V any]
-// maxEntries: 最大容量，需要大于 100
-// onEvicted: 当被淘汰的时候调用的函数
-func NewWTinyLFU[K KeyType, V any](maxEntries int, onEvicted Eviction[K, V]) *WTinyLFU[K, V] {
-	// window 占最大元素数量的百分之 2
-	windowSize := maxEntries * 2 / 100
-	// probation 队列的最大元素数量占 20%
-	probationSize := (maxEntries - windowSize) * 2 / 10
+// maxEntries: 最大容量，不能小于 3
+// onEvicted: 当被淘汰的时候调用的函数，可以为 nil
+func NewWTinyLFU[K KeyType, V any](maxEntries int, onEvicted cache.Eviction[K, V]) *WTinyLFU[K, V] {
+	if maxEntries < 3 {
+		maxEntries = 3
+	}
+	// window 占最大元素数量的百分之 2，容量较小时至少为 1
+	windowSize := max(maxEntries*2/100, 1)
+	// probation 队列的最大元素数量占 20%，容量较小时至少为 1
+	probationSize := max((maxEntries-windowSize)*2/10, 1)
 	// protection 队列的最大元素数量占 80%
 	protectionSize := maxEntries - windowSize - probationSize
 	return &WTinyLFU[K, V]{
@@ -83,10 +87,14 @@ func NewWTinyLFU[K KeyType, V any](maxEntries int, onEvicted Eviction[K, V]) *WT
 func (cache *WTinyLFU[K, V]) Get(key K) (value V, ok bool) {
 	cache.lock.Lock()
 	defer func() {
+		// 未命中的访问也计入频率，使再次访问的元素更容易被接纳
+		cache.frequencyTable.Add(key)
 		if ok {
-			cache.frequencyTable.Add(key)
-			cache.lock.Unlock()
+			cache.Hit()
+		} else {
+			cache.Miss()
 		}
+		cache.lock.Unlock()
 	}()
 	// 先看是否在 protection 中
 	if elementValue, ok := cache.protectionMap[key]; ok {
@@ -195,13 +203,59 @@ func (cache *WTinyLFU[K, V]) adjust() {
 			entry := victim.Value.(*entry[K, V])
 			cache.probationList.Remove(victim)
 			delete(cache.probationMap, entry.key)
-			cache.onEvicted(entry.key, entry.value)
+			cache.evict(entry)
 		} else {
 			// 删除 candidate
 			entry := candidate.Value.(*entry[K, V])
 			cache.probationList.Remove(candidate)
 			delete(cache.probationMap, entry.key)
-			cache.onEvicted(entry.key, entry.value)
+			cache.evict(entry)
+		}
+	}
+}
+
+func (cache *WTinyLFU[K, V]) evict(entry *entry[K, V]) {
+	cache.Evict()
+	if cache.onEvicted != nil {
+		cache.onEvicted(entry.key, entry.value)
+	}
+}
+
+// 删除元素，不会调用 onEvicted
+func (cache *WTinyLFU[K, V]) Remove(key K) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, lru := range []LruType{LRU_WINDOW, LRU_PROBATION, LRU_PROTECTION} {
+		if cache.removeFrom(lru, key) != nil {
+			return
+		}
+	}
+}
+
+func (cache *WTinyLFU[K, V]) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.windowList.Len() + cache.probationList.Len() + cache.protectionList.Len()
+}
+
+func (cache *WTinyLFU[K, V]) SetEviction(eviction cache.Eviction[K, V]) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.onEvicted = eviction
+}
+
+// 对所有剩余的元素调用 onEvicted
+func (cache *WTinyLFU[K, V]) Close() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, lru := range []LruType{LRU_WINDOW, LRU_PROBATION, LRU_PROTECTION} {
+		list, elemMap, _ := cache.getLRU(lru)
+		for list.Len() > 0 {
+			entry := list.Remove(list.Back()).(*entry[K, V])
+			delete(elemMap, entry.key)
+			if cache.onEvicted != nil {
+				cache.onEvicted(entry.key, entry.value)
+			}
 		}
 	}
 }
@@ -21,7 +21,7 @@ type LRU[K comparable, V any] struct {
 	lock sync.RWMutex
 }
 
-func NewLRU[K comparable, V any](maxEntries int, onEvicted cache.Eviction) *LRU[K, V] {
+func NewLRU[K comparable, V any](maxEntries int, onEvicted cache.Eviction[K, V]) *LRU[K, V] {
 	return &LRU[K, V]{
 		MaxEntries: maxEntries,
 		cacheList:  list.New(),
@@ -32,10 +32,10 @@ func NewLRU[K comparable, V any](maxEntries int, onEvicted cache.Eviction) *LRU[
 
 func TestSLRU(t *testing.T) {
 	// slru := slru.SLRU[int, int]{1, 2}
-	t.Errorf("%T\n", NewLRU[int, int])
+	t.Logf("%T\n", NewLRU[int, int])
 	ln2 := float64(math.Log(2))
 	tableSize := int(-float64(1000000)*math.Log(0.01)/(ln2*ln2)) / 2
-	t.Errorf("%v\n", tableSize)
+	t.Logf("%v\n", tableSize)
 }
 
 type H int
@@ -46,8 +46,7 @@ func (i H) Hash() uint64 {
 
 func TestCountMinSketch(t *testing.T) {
 	const (
-		COUNT     = 1000000
-		ErrorRate = 0.01
+		COUNT = 1000000
 	)
 	c := wtinylfu.NewCountMinSketch(COUNT)
 	for i := H(0); i < COUNT; i++ {
@@ -59,5 +58,43 @@ func TestCountMinSketch(t *testing.T) {
 			cnt++
 		}
 	}
-	t.Error(cnt)
+	if float64(cnt) > COUNT*wtinylfu.ErrorRate {
+		t.Errorf("too many wrong counts: %v", cnt)
+	}
+}
+
+func TestWTinyLFU(t *testing.T) {
+	evicted := 0
+	c := wtinylfu.NewWTinyLFU[H, int](100, func(key H, value int) {
+		evicted++
+	})
+	// 热点数据访问多次
+	for round := 0; round < 10; round++ {
+		for i := H(0); i < 50; i++ {
+			if _, ok := c.Get(i); !ok {
+				c.Set(i, int(i))
+			}
+		}
+	}
+	// 只访问一次的扫描不应该把热点数据挤出去
+	for i := H(1000); i < 2000; i++ {
+		c.Set(i, int(i))
+	}
+	hits := 0
+	for i := H(0); i < 50; i++ {
+		if _, ok := c.Get(i); ok {
+			hits++
+		}
+	}
+	// LRU 在扫描之后不会留下任何热点数据
+	t.Logf("%v hot keys survived the scan", hits)
+	if hits < 40 {
+		t.Fatalf("only %v hot keys survived the scan", hits)
+	}
+	if c.Len() > 100 {
+		t.Fatalf("cache size %v exceeds capacity", c.Len())
+	}
+	if stats := c.Stats(); int(stats.Evictions) != evicted {
+		t.Fatalf("evictions %v, callback called %v times", stats.Evictions, evicted)
+	}
 }
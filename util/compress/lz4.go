@@ -0,0 +1,166 @@
+/*
+LZ4 块格式的压缩和解压，只依赖标准库。
+压缩后的数据由若干个 sequence 组成，每个 sequence 的格式如下：
+
+token(1 byte) + [literal length] + literals + offset(2 bytes, little endian) + [match length]
+
+token 的高 4 位为字面量长度，低 4 位为匹配长度减 4，等于 15 时后面跟着额外的长度字节。
+最后一个 sequence 只有字面量，没有 offset 和 match length。
+*/
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrCorrupted = errors.New("compressed data is corrupted")
+	ErrTooLarge  = errors.New("decompressed data exceeds the size limit")
+)
+
+const (
+	MIN_MATCH = 4
+	// 最后 5 个字节必须是字面量
+	LAST_LITERALS = 5
+	// 最后一个匹配必须在结尾 12 个字节之前开始
+	MF_LIMIT   = 12
+	MAX_OFFSET = 1<<16 - 1
+
+	HASH_LOG = 12
+)
+
+func hash(sequence uint32) uint32 {
+	return (sequence * 2654435761) >> (32 - HASH_LOG)
+}
+
+// 压缩 src，返回的数据可能比 src 更长，调用者需要自行判断是否值得压缩
+func Compress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	// 保存 4 字节序列上一次出现的位置加一，0 表示没有出现过
+	var table [1 << HASH_LOG]int
+	anchor := 0
+	for i := 0; i+MF_LIMIT < len(src); {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		h := hash(sequence)
+		ref := table[h] - 1
+		table[h] = i + 1
+		if ref < 0 || i-ref > MAX_OFFSET || binary.LittleEndian.Uint32(src[ref:]) != sequence {
+			i++
+			continue
+		}
+		matchLen := MIN_MATCH
+		for i+matchLen < len(src)-LAST_LITERALS && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		dst = appendSequence(dst, src[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+	return appendLastLiterals(dst, src[anchor:])
+}
+
+// 长度大于等于 15 的部分使用额外的字节表示
+func appendLength(dst []byte, length int) []byte {
+	for length >= 255 {
+		dst = append(dst, 255)
+		length -= 255
+	}
+	return append(dst, byte(length))
+}
+
+func tokenNibble(length int) byte {
+	if length >= 15 {
+		return 15
+	}
+	return byte(length)
+}
+
+func appendSequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	dst = append(dst, tokenNibble(len(literals))<<4|tokenNibble(matchLen-MIN_MATCH))
+	if len(literals) >= 15 {
+		dst = appendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-MIN_MATCH >= 15 {
+		dst = appendLength(dst, matchLen-MIN_MATCH-15)
+	}
+	return dst
+}
+
+func appendLastLiterals(dst []byte, literals []byte) []byte {
+	dst = append(dst, tokenNibble(len(literals))<<4)
+	if len(literals) >= 15 {
+		dst = appendLength(dst, len(literals)-15)
+	}
+	return append(dst, literals...)
+}
+
+// 解压 src，maxSize 为解压后数据的最大长度
+func Decompress(src []byte, maxSize int) ([]byte, error) {
+	dst := make([]byte, 0, maxSize)
+	i := 0
+	readLength := func(length int) (int, error) {
+		if length != 15 {
+			return length, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, ErrCorrupted
+			}
+			b := src[i]
+			i++
+			length += int(b)
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+	for {
+		if i >= len(src) {
+			return nil, ErrCorrupted
+		}
+		token := src[i]
+		i++
+
+		literalLen, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if i+literalLen > len(src) {
+			return nil, ErrCorrupted
+		}
+		if len(dst)+literalLen > maxSize {
+			return nil, ErrTooLarge
+		}
+		dst = append(dst, src[i:i+literalLen]...)
+		i += literalLen
+		if i == len(src) {
+			// 最后一个 sequence 没有匹配部分
+			return dst, nil
+		}
+
+		if i+2 > len(src) {
+			return nil, ErrCorrupted
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLen, err := readLength(int(token & 0x0F))
+		if err != nil {
+			return nil, err
+		}
+		matchLen += MIN_MATCH
+		if offset == 0 || offset > len(dst) {
+			return nil, ErrCorrupted
+		}
+		if len(dst)+matchLen > maxSize {
+			return nil, ErrTooLarge
+		}
+		// 匹配部分可能和正在写入的部分重叠，需要逐字节复制
+		start := len(dst) - offset
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+}
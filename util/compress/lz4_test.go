@@ -0,0 +1,40 @@
+package compress_test
+
+import (
+	"bytes"
+	"math/rand"
+	"minidb-go/util/compress"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcdefghijklmnop"),
+		[]byte(strings.Repeat("test student insert ", 300)),
+		append(make([]byte, 8000), 1, 2, 3),
+		random,
+	}
+	for _, input := range inputs {
+		compressed := compress.Compress(input)
+		output, err := compress.Decompress(compressed, len(input))
+		if err != nil {
+			t.Fatalf("decompress %d bytes failed: %v", len(input), err)
+		}
+		if !bytes.Equal(input, output) {
+			t.Fatalf("round trip of %d bytes mismatch", len(input))
+		}
+	}
+
+	repetitive := []byte(strings.Repeat("test student insert ", 300))
+	if compressed := compress.Compress(repetitive); len(compressed) > len(repetitive)/10 {
+		t.Fatalf("repetitive data compressed to %d bytes", len(compressed))
+	}
+	if _, err := compress.Decompress(compress.Compress(repetitive), 100); err != compress.ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
@@ -7,6 +7,9 @@ const (
 	// PAGE_SIZE is the size of a page.
 	PAGE_SIZE = 8192 // 8KB
 
+	// SECTOR_SIZE is the write unit of compressed pages.
+	SECTOR_SIZE = 512
+
 	// MAX_PAGE_SIZE is the maximum value of PageSize.'
 	MAX_PAGE_SIZE = PAGE_SIZE - 1
 
@@ -33,10 +36,4 @@ const (
 	BPLUSTREE_KEY_LEN = 8
 
 	VERSION = "0.0.1"
-
-	MAX_SEARCH_THRESHOLD = 2
-
-	DOUBLE_WRITE_POOL_PAGE_NUM = 128
-
-	PAGE_CACHE_CAP = 16
 )
@@ -11,9 +11,9 @@ func DeepCopy(dst, src interface{}) {
 	enc := gob.NewEncoder(buf)
 	dec := gob.NewDecoder(buf)
 	if err := enc.Encode(src); err != nil {
-		log.Fatalf("encode failed: %v", err)
+		log.Panicf("encode failed: %v", err)
 	}
 	if err := dec.Decode(dst); err != nil {
-		log.Fatalf("decode failed: %v", err)
+		log.Panicf("decode failed: %v", err)
 	}
 }
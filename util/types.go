@@ -1,3 +1,8 @@
 package util
 
 type UUID uint32
+
+// 用于 W-TinyLFU 的频率统计
+func (id UUID) Hash() uint64 {
+	return uint64(id)
+}
@@ -0,0 +1,33 @@
+/*
+vfs 是存储层访问文件的入口，页文件、double write、redo log、控制文件和 XID 文件都通过这里打开。
+测试时可以替换 OpenFile 和 Remove，在写入时注入故障，模拟异常退出、部分写和未 fsync 的数据丢失。
+*/
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// 存储层用到的文件操作，*os.File 实现了该接口
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Name() string
+	Close() error
+}
+
+// 打开文件，参数与 os.OpenFile 相同
+var OpenFile = func(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// 删除文件
+var Remove = os.Remove